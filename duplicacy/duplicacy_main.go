@@ -16,6 +16,7 @@ import (
 	"runtime"
 	"strconv"
 	"strings"
+	"time"
 	"net/http"
 
 	_ "net/http/pprof"
@@ -94,8 +95,11 @@ func getRepositoryPreference(context *cli.Context, storageName string) (reposito
 }
 
 func getRevisions(context *cli.Context) (revisions []int) {
+	return parseRevisions(context, context.StringSlice("r"))
+}
 
-	flags := context.StringSlice("r")
+// parseRevisions converts revision specifications such as '5' or '3-8' into a list of revision numbers.
+func parseRevisions(context *cli.Context, flags []string) (revisions []int) {
 
 	rangeRegex := regexp.MustCompile(`^([0-9]+)-([0-9]+)$`)
 	numberRegex := regexp.MustCompile(`^([0-9]+)$`)
@@ -129,6 +133,35 @@ func getRevisions(context *cli.Context) (revisions []int) {
 
 }
 
+// getRevisionAtTime returns the latest revision of 'snapshotID' created at or before the time specified by the -at
+// option.
+func getRevisionAtTime(context *cli.Context, manager *duplicacy.SnapshotManager, snapshotID string, at string) int {
+
+	atTime, err := duplicacy.ParseRevisionTime(at, time.Now())
+	if err != nil {
+		fmt.Fprintf(context.App.Writer, "%v.\n\n", err)
+		cli.ShowCommandHelp(context, context.Command.Name)
+		os.Exit(ArgumentExitCode)
+	}
+
+	revision, err := manager.FindRevisionAtTime(snapshotID, atTime)
+	if err != nil {
+		duplicacy.LOG_ERROR("SNAPSHOT_LIST", "Failed to list the revisions of the snapshot %s: %v", snapshotID, err)
+		return 0
+	}
+
+	atTimeString := time.Unix(atTime, 0).Format("2006-01-02 15:04:05")
+	if revision == 0 {
+		duplicacy.LOG_ERROR("SNAPSHOT_AT", "No revision of snapshot %s was created at or before %s",
+			snapshotID, atTimeString)
+		return 0
+	}
+
+	duplicacy.LOG_INFO("SNAPSHOT_AT", "Revision %d is the latest revision of snapshot %s at %s",
+		revision, snapshotID, atTimeString)
+	return revision
+}
+
 func setGlobalOptions(context *cli.Context) {
 	if context.GlobalBool("log") {
 		duplicacy.EnableLogHeader()
@@ -159,8 +192,84 @@ func setGlobalOptions(context *cli.Context) {
 	}
 
 
+	err := duplicacy.SetStorageParameters(context.GlobalStringSlice("param"))
+	if err != nil {
+		fmt.Fprintf(context.App.Writer, "%v.\n", err)
+		os.Exit(ArgumentExitCode)
+	}
 
 	duplicacy.RunInBackground = context.GlobalBool("background")
+
+	if budget := context.GlobalString("memory-budget"); budget != "" {
+		size := duplicacy.AtoSize64(budget)
+		if size <= 0 {
+			fmt.Fprintf(context.App.Writer, "Invalid memory budget: %s.\n", budget)
+			os.Exit(ArgumentExitCode)
+		}
+		duplicacy.SetMemoryBudget(size)
+	}
+}
+
+// getThreads returns the number of threads from the -threads option, or from the 'threads' parameter of the storage
+// if the option is not given.
+func getThreads(context *cli.Context, preference *duplicacy.Preference) int {
+	threads := context.Int("threads")
+	if !context.IsSet("threads") {
+		threads = preference.GetStorageIntParameter("threads", threads)
+	}
+	if threads < 1 {
+		threads = 1
+	}
+	return threads
+}
+
+// getMaximumThreads returns the upper bound for adaptive threads from the -max-threads option, or from the
+// 'max_threads' parameter of the storage.  The number of threads is fixed if it is not above 'threads'.
+func getMaximumThreads(context *cli.Context, preference *duplicacy.Preference, threads int) int {
+	maximumThreads := context.Int("max-threads")
+	if !context.IsSet("max-threads") {
+		maximumThreads = preference.GetStorageIntParameter("max_threads", maximumThreads)
+	}
+	if maximumThreads < threads {
+		maximumThreads = threads
+	}
+	return maximumThreads
+}
+
+// setBackupPriority lowers the CPU and I/O priority of the process as configured for the backup, and returns the limits
+// on reading files.  Options given on the command line take precedence over those saved in the preference.
+func setBackupPriority(context *cli.Context, preference *duplicacy.Preference) (readRateLimit int, maximumLoad float64) {
+	nice := preference.Nice
+	if context.IsSet("nice") {
+		nice = context.Int("nice")
+	}
+	ioPriority := preference.IOPriority
+	if context.IsSet("io-priority") {
+		ioPriority = context.String("io-priority")
+	}
+
+	if err := duplicacy.SetProcessPriority(nice, ioPriority); err != nil {
+		duplicacy.LOG_WARN("PROCESS_PRIORITY", "%v", err)
+	} else if nice > 0 || ioPriority != "" {
+		duplicacy.LOG_INFO("PROCESS_PRIORITY", "Running with nice value %d and I/O priority '%s'", nice, ioPriority)
+	}
+
+	readRateLimit = preference.ReadRateLimit
+	if context.IsSet("read-limit-rate") {
+		readRateLimit = context.Int("read-limit-rate")
+	}
+
+	maximumLoad = preference.MaximumLoad
+	if context.IsSet("max-load") {
+		var err error
+		maximumLoad, err = strconv.ParseFloat(context.String("max-load"), 64)
+		if err != nil || maximumLoad < 0 {
+			fmt.Fprintf(context.App.Writer, "Invalid system load '%s'.\n\n", context.String("max-load"))
+			cli.ShowCommandHelp(context, context.Command.Name)
+			os.Exit(ArgumentExitCode)
+		}
+	}
+	return readRateLimit, maximumLoad
 }
 
 func runScript(context *cli.Context, storageName string, phase string) bool {
@@ -315,6 +424,7 @@ func configRepository(context *cli.Context, init bool) {
 		Encrypted:  context.Bool("encrypt"),
 	}
 
+	duplicacy.SetPrimaryStorage(preference.Name)
 	storage := duplicacy.CreateStorage(preference, true, 1)
 	storagePassword := ""
 	if preference.Encrypted {
@@ -535,6 +645,13 @@ func setPreference(context *cli.Context) {
 	
 	newPreference.NobackupFile = context.String("nobackup-file")
 
+	credentialHelper := context.String("credential-helper")
+	if credentialHelper == "none" {
+		newPreference.CredentialHelper = ""
+	} else if credentialHelper != "" {
+		newPreference.CredentialHelper = credentialHelper
+	}
+
 	key := context.String("key")
 	value := context.String("value")
 
@@ -557,6 +674,86 @@ func setPreference(context *cli.Context) {
 		}
 	}
 
+	parameters := context.StringSlice("parameter")
+	if len(parameters) > 0 {
+
+		// Same as the keys, the map must be copied
+		newParameters := make(map[string]string)
+		for k, v := range newPreference.Parameters {
+			newParameters[k] = v
+		}
+		newPreference.Parameters = newParameters
+
+		for _, parameter := range parameters {
+			index := strings.Index(parameter, "=")
+			if index <= 0 {
+				fmt.Fprintf(context.App.Writer, "Invalid storage parameter '%s'.\n\n", parameter)
+				cli.ShowCommandHelp(context, context.Command.Name)
+				os.Exit(ArgumentExitCode)
+			}
+			if index == len(parameter)-1 {
+				delete(newPreference.Parameters, parameter[:index])
+			} else {
+				newPreference.Parameters[parameter[:index]] = parameter[index+1:]
+			}
+		}
+
+		if len(newPreference.Parameters) == 0 {
+			newPreference.Parameters = nil
+		}
+	}
+
+	schedule := context.StringSlice("bandwidth-schedule")
+	if len(schedule) == 1 && schedule[0] == "none" {
+		newPreference.BandwidthSchedule = nil
+	} else if len(schedule) > 0 {
+		if _, err := duplicacy.ParseBandwidthSchedule(schedule); err != nil {
+			duplicacy.LOG_ERROR("STORAGE_SET", "%v", err)
+			return
+		}
+		newPreference.BandwidthSchedule = schedule
+	}
+
+	if context.IsSet("nice") {
+		nice := context.Int("nice")
+		if nice < 0 || nice > 19 {
+			duplicacy.LOG_ERROR("STORAGE_SET", "Invalid nice value %d; must be between 0 and 19", nice)
+			return
+		}
+		newPreference.Nice = nice
+	}
+
+	if context.IsSet("io-priority") {
+		ioPriority := context.String("io-priority")
+		if ioPriority == "none" {
+			newPreference.IOPriority = ""
+		} else {
+			if _, _, err := duplicacy.ParseIOPriority(ioPriority); err != nil {
+				duplicacy.LOG_ERROR("STORAGE_SET", "%v", err)
+				return
+			}
+			newPreference.IOPriority = ioPriority
+		}
+	}
+
+	if context.IsSet("read-limit-rate") {
+		newPreference.ReadRateLimit = context.Int("read-limit-rate")
+	}
+
+	if context.IsSet("max-load") {
+		maximumLoad := context.String("max-load")
+		if maximumLoad == "none" {
+			newPreference.MaximumLoad = 0
+		} else {
+			load, err := strconv.ParseFloat(maximumLoad, 64)
+			if err != nil || load < 0 {
+				duplicacy.LOG_ERROR("STORAGE_SET", "Invalid system load '%s'", maximumLoad)
+				return
+			}
+			newPreference.MaximumLoad = load
+		}
+	}
+
 	if duplicacy.IsTracing() {
 		description, _ := json.MarshalIndent(newPreference, "", "    ")
 		fmt.Printf("%s\n", description)
@@ -686,13 +883,11 @@ func backupRepository(context *cli.Context) {
 
 	runScript(context, preference.Name, "pre")
 
-	threads := context.Int("threads")
-	if threads < 1 {
-		threads = 1
-	}
+	threads := getThreads(context, preference)
+	maximumThreads := getMaximumThreads(context, preference, threads)
 
 	duplicacy.LOG_INFO("STORAGE_SET", "Storage set to %s", preference.StorageURL)
-	storage := duplicacy.CreateStorage(*preference, false, threads)
+	storage := duplicacy.CreateStorage(*preference, false, maximumThreads)
 	if storage == nil {
 		return
 	}
@@ -713,14 +908,28 @@ func backupRepository(context *cli.Context) {
 	vssTimeout := context.Int("vss-timeout")
 
 	dryRun := context.Bool("dry-run")
-	uploadRateLimit := context.Int("limit-rate")
 	enumOnly := context.Bool("enum-only")
-	storage.SetRateLimits(0, uploadRateLimit)
+	readRateLimit, maximumLoad := setBackupPriority(context, preference)
+	stopSchedule := setRateLimit(preference, storage, context.Int("limit-rate"), context.Int("limit-burst"), true)
+	defer stopSchedule()
 	backupManager := duplicacy.CreateBackupManager(preference.SnapshotID, storage, repository, password, preference.NobackupFile)
 	duplicacy.SavePassword(*preference, "password", password)
 
 	backupManager.SetupSnapshotCache(preference.Name)
+	backupManager.SetReadThrottling(readRateLimit, maximumLoad)
+
+	snapshotVersion := context.Int("snapshot-version")
+	if !context.IsSet("snapshot-version") {
+		snapshotVersion = preference.GetStorageIntParameter("snapshot_version", snapshotVersion)
+	}
+	if snapshotVersion != duplicacy.SNAPSHOT_VERSION_FILE_LIST && snapshotVersion != duplicacy.SNAPSHOT_VERSION_TREE {
+		duplicacy.LOG_ERROR("BACKUP_VERSION", "Invalid snapshot version %d; must be %d or %d", snapshotVersion,
+			duplicacy.SNAPSHOT_VERSION_FILE_LIST, duplicacy.SNAPSHOT_VERSION_TREE)
+		return
+	}
+	backupManager.SetSnapshotVersion(snapshotVersion)
 	backupManager.SetDryRun(dryRun)
+	backupManager.SetMaximumThreads(maximumThreads)
 	backupManager.Backup(repository, quickMode, threads, context.String("t"), showStatistics, enableVSS, vssTimeout, enumOnly)
 
 	runScript(context, preference.Name, "post")
@@ -731,11 +940,40 @@ func restoreRepository(context *cli.Context) {
 	defer duplicacy.CatchLogException()
 
 	revision := context.Int("r")
-	if revision <= 0 {
+	at := context.String("at")
+	mergedRevisions := parseRevisions(context, context.StringSlice("merge"))
+	if revision <= 0 && at == "" && len(mergedRevisions) == 0 {
 		fmt.Fprintf(context.App.Writer, "The revision flag is not specified or invalid\n\n")
 		cli.ShowCommandHelp(context, context.Command.Name)
 		os.Exit(ArgumentExitCode)
 	}
+	if revision > 0 && at != "" {
+		fmt.Fprintf(context.App.Writer, "The -r and -at options can't be used together\n\n")
+		cli.ShowCommandHelp(context, context.Command.Name)
+		os.Exit(ArgumentExitCode)
+	}
+	if len(mergedRevisions) > 0 && (revision > 0 || at != "") {
+		fmt.Fprintf(context.App.Writer, "The -merge option can't be used with -r or -at\n\n")
+		cli.ShowCommandHelp(context, context.Command.Name)
+		os.Exit(ArgumentExitCode)
+	}
+
+	dryRun := context.Bool("dry-run")
+	jsonOutput := context.Bool("json")
+	if dryRun && len(mergedRevisions) > 0 {
+		fmt.Fprintf(context.App.Writer, "The -dry-run option can't be used with -merge\n\n")
+		cli.ShowCommandHelp(context, context.Command.Name)
+		os.Exit(ArgumentExitCode)
+	}
+	if jsonOutput && !dryRun {
+		fmt.Fprintf(context.App.Writer, "The -json option can only be used with -dry-run\n\n")
+		cli.ShowCommandHelp(context, context.Command.Name)
+		os.Exit(ArgumentExitCode)
+	}
+	if jsonOutput {
+		// Keep informational messages out of the json output
+		duplicacy.SetLoggingLevel(duplicacy.WARN)
+	}
 
 	repository, preference := getRepositoryPreference(context, "")
 
@@ -747,13 +985,11 @@ func restoreRepository(context *cli.Context) {
 
 	runScript(context, preference.Name, "pre")
 
-	threads := context.Int("threads")
-	if threads < 1 {
-		threads = 1
-	}
+	threads := getThreads(context, preference)
+	maximumThreads := getMaximumThreads(context, preference, threads)
 
 	duplicacy.LOG_INFO("STORAGE_SET", "Storage set to %s", preference.StorageURL)
-	storage := duplicacy.CreateStorage(*preference, false, threads)
+	storage := duplicacy.CreateStorage(*preference, false, maximumThreads)
 	if storage == nil {
 		return
 	}
@@ -768,6 +1004,18 @@ func restoreRepository(context *cli.Context) {
 	deleteMode := context.Bool("delete")
 	setOwner := !context.Bool("ignore-owner")
 
+	var ownerMapping *duplicacy.OwnerMapping
+	if context.Bool("map-owner-by-name") || len(context.StringSlice("map-owner")) > 0 || context.Bool("squash-owner") {
+		var err error
+		ownerMapping, err = duplicacy.CreateOwnerMapping(context.Bool("map-owner-by-name"),
+			context.StringSlice("map-owner"), context.Bool("squash-owner"))
+		if err != nil {
+			fmt.Fprintf(context.App.Writer, "%v\n\n", err)
+			cli.ShowCommandHelp(context, context.Command.Name)
+			os.Exit(ArgumentExitCode)
+		}
+	}
+
 	showStatistics := context.Bool("stats")
 
 	var patterns []string
@@ -804,12 +1052,43 @@ func restoreRepository(context *cli.Context) {
 
 	duplicacy.LOG_DEBUG("REGEX_DEBUG", "There are %d compiled regular expressions stored", len(duplicacy.RegexMap))
 
-	storage.SetRateLimits(context.Int("limit-rate"), 0)
+	stopSchedule := setRateLimit(preference, storage, context.Int("limit-rate"), context.Int("limit-burst"), false)
+	defer stopSchedule()
 	backupManager := duplicacy.CreateBackupManager(preference.SnapshotID, storage, repository, password, preference.NobackupFile)
 	duplicacy.SavePassword(*preference, "password", password)
 
 	backupManager.SetupSnapshotCache(preference.Name)
-	backupManager.Restore(repository, revision, true, quickMode, threads, overwrite, deleteMode, setOwner, showStatistics, patterns)
+	backupManager.SetOwnerMapping(ownerMapping)
+	backupManager.SetResumeRestore(context.Bool("resume"))
+	backupManager.SetMaximumThreads(maximumThreads)
+
+	if at != "" {
+		revision = getRevisionAtTime(context, backupManager.SnapshotManager, preference.SnapshotID, at)
+	}
+
+	if dryRun {
+		plan := backupManager.PlanRestore(repository, revision, quickMode, overwrite, deleteMode, patterns)
+		if plan == nil {
+			return
+		}
+		if jsonOutput {
+			description, err := json.MarshalIndent(plan, "", "    ")
+			if err != nil {
+				duplicacy.LOG_ERROR("RESTORE_PLAN", "Failed to marshal the restore plan: %v", err)
+				return
+			}
+			fmt.Printf("%s\n", description)
+		} else {
+			plan.Print()
+		}
+	} else if len(mergedRevisions) > 0 {
+		if deleteMode {
+			duplicacy.LOG_WARN("RESTORE_MERGE", "The -delete option is ignored when merging revisions")
+		}
+		backupManager.MergeRestore(repository, mergedRevisions, quickMode, threads, overwrite, setOwner, showStatistics, patterns)
+	} else {
+		backupManager.Restore(repository, revision, true, quickMode, threads, overwrite, deleteMode, setOwner, showStatistics, patterns)
+	}
 
 	runScript(context, preference.Name, "post")
 }
@@ -859,6 +1138,16 @@ func listSnapshots(context *cli.Context) {
 	showChunks := context.Bool("chunks")
 
 	backupManager.SetupSnapshotCache(preference.Name)
+
+	if at := context.String("at"); at != "" {
+		if id == "" {
+			fmt.Fprintf(context.App.Writer, "The -at option can't be used with -all.\n\n")
+			cli.ShowCommandHelp(context, context.Command.Name)
+			os.Exit(ArgumentExitCode)
+		}
+		revisions = append(revisions, getRevisionAtTime(context, backupManager.SnapshotManager, id, at))
+	}
+
 	backupManager.SnapshotManager.ListSnapshots(id, revisions, tag, showFiles, showChunks)
 
 	runScript(context, preference.Name, "post")
@@ -925,6 +1214,13 @@ func printFile(context *cli.Context) {
 		os.Exit(ArgumentExitCode)
 	}
 
+	at := context.String("at")
+	if context.Int("r") > 0 && at != "" {
+		fmt.Fprintf(context.App.Writer, "The -r and -at options can't be used together\n\n")
+		cli.ShowCommandHelp(context, context.Command.Name)
+		os.Exit(ArgumentExitCode)
+	}
+
 	repository, preference := getRepositoryPreference(context, "")
 
 	runScript(context, preference.Name, "pre")
@@ -953,6 +1249,10 @@ func printFile(context *cli.Context) {
 
 	backupManager.SetupSnapshotCache(preference.Name)
 
+	if at != "" {
+		revision = getRevisionAtTime(context, backupManager.SnapshotManager, snapshotID, at)
+	}
+
 	file := ""
 	if len(context.Args()) > 0 {
 		file = context.Args()[0]
@@ -988,7 +1288,7 @@ func diff(context *cli.Context) {
 	}
 
 	revisions := context.IntSlice("r")
-	if len(revisions) > 2 {
+	if len(revisions)+len(context.StringSlice("at")) > 2 {
 		fmt.Fprintf(context.App.Writer, "The %s command requires at most 2 revisions.\n", context.Command.Name)
 		os.Exit(ArgumentExitCode)
 	}
@@ -1008,6 +1308,11 @@ func diff(context *cli.Context) {
 	duplicacy.SavePassword(*preference, "password", password)
 
 	backupManager.SetupSnapshotCache(preference.Name)
+
+	for _, at := range context.StringSlice("at") {
+		revisions = append(revisions, getRevisionAtTime(context, backupManager.SnapshotManager, snapshotID, at))
+	}
+
 	backupManager.SnapshotManager.Diff(repository, snapshotID, revisions, path, compareByHash, preference.NobackupFile)
 
 	runScript(context, preference.Name, "post")
@@ -1066,12 +1371,21 @@ func pruneSnapshots(context *cli.Context) {
 		os.Exit(ArgumentExitCode)
 	}
 
-	threads := context.Int("threads")
-	if threads < 1 {
-		threads = 1
+	useRetention := context.Bool("use-retention")
+	if useRetention && len(context.StringSlice("keep")) > 0 {
+		fmt.Fprintf(context.App.Writer, "The -use-retention option can't be used with -keep.\n\n")
+		cli.ShowCommandHelp(context, context.Command.Name)
+		os.Exit(ArgumentExitCode)
 	}
 
 	repository, preference := getRepositoryPreference(context, "")
+	threads := getThreads(context, preference)
+
+	if useRetention && len(preference.Retention) == 0 {
+		duplicacy.LOG_ERROR("PRUNE_RETENTION", "No retention policy is saved in the preferences of storage %s",
+			preference.Name)
+		return
+	}
 
 	runScript(context, preference.Name, "pre")
 
@@ -1104,6 +1418,12 @@ func pruneSnapshots(context *cli.Context) {
 	deleteOnly := context.Bool("delete-only")
 	collectOnly := context.Bool("collect-only")
 
+	if useRetention {
+		retentions = preference.Retention
+		duplicacy.LOG_INFO("PRUNE_RETENTION", "Using the retention policy %s from the preferences",
+			strings.Join(retentions, " "))
+	}
+
 	if !storage.IsMoveFileImplemented() && !exclusive {
 		fmt.Fprintf(context.App.Writer, "The --exclusive option must be enabled for storage %s\n",
 			preference.StorageURL)
@@ -1130,17 +1450,27 @@ func copySnapshots(context *cli.Context) {
 		os.Exit(ArgumentExitCode)
 	}
 
-	threads := context.Int("threads")
-	if threads < 1 {
-		threads = 1
+	allTargets := context.Bool("all-targets")
+	if allTargets && context.String("to") != "" {
+		fmt.Fprintf(context.App.Writer, "The -all-targets option can't be used with -to.\n\n")
+		cli.ShowCommandHelp(context, context.Command.Name)
+		os.Exit(ArgumentExitCode)
 	}
 
 	repository, source := getRepositoryPreference(context, context.String("from"))
+	duplicacy.SetPrimaryStorage(source.Name)
+	threads := getThreads(context, source)
+	maximumThreads := getMaximumThreads(context, source, threads)
+
+	if allTargets && len(source.CopyTo) == 0 {
+		duplicacy.LOG_ERROR("COPY_TARGETS", "No copy targets are saved in the preferences of storage %s", source.Name)
+		return
+	}
 
 	runScript(context, source.Name, "pre")
 
 	duplicacy.LOG_INFO("STORAGE_SET", "Source storage set to %s", source.StorageURL)
-	sourceStorage := duplicacy.CreateStorage(*source, false, threads)
+	sourceStorage := duplicacy.CreateStorage(*source, false, maximumThreads)
 	if sourceStorage == nil {
 		return
 	}
@@ -1152,49 +1482,102 @@ func copySnapshots(context *cli.Context) {
 
 	sourceManager := duplicacy.CreateBackupManager(source.SnapshotID, sourceStorage, repository, sourcePassword, source.NobackupFile)
 	sourceManager.SetupSnapshotCache(source.Name)
+	sourceManager.SetMaximumThreads(maximumThreads)
 	duplicacy.SavePassword(*source, "password", sourcePassword)
 
-	_, destination := getRepositoryPreference(context, context.String("to"))
-
-	if destination.Name == source.Name {
-		duplicacy.LOG_ERROR("COPY_IDENTICAL", "The source storage and the destination storage are the same")
-		return
+	revisions := getRevisions(context)
+	snapshotID := ""
+	if context.String("id") != "" {
+		snapshotID = context.String("id")
 	}
 
-	if destination.BackupProhibited {
-		duplicacy.LOG_ERROR("COPY_DISABLED", "Copying snapshots to %s was disabled by the preference",
-			destination.StorageURL)
-		return
+	destinationNames := []string{context.String("to")}
+	if allTargets {
+		destinationNames = source.CopyTo
 	}
 
-	duplicacy.LOG_INFO("STORAGE_SET", "Destination storage set to %s", destination.StorageURL)
-	destinationStorage := duplicacy.CreateStorage(*destination, false, threads)
-	if destinationStorage == nil {
-		return
+	for _, destinationName := range destinationNames {
+		_, destination := getRepositoryPreference(context, destinationName)
+
+		if destination.Name == source.Name {
+			duplicacy.LOG_ERROR("COPY_IDENTICAL", "The source storage and the destination storage are the same")
+			return
+		}
+
+		if destination.BackupProhibited {
+			duplicacy.LOG_ERROR("COPY_DISABLED", "Copying snapshots to %s was disabled by the preference",
+				destination.StorageURL)
+			return
+		}
+
+		duplicacy.LOG_INFO("STORAGE_SET", "Destination storage set to %s", destination.StorageURL)
+		destinationStorage := duplicacy.CreateStorage(*destination, false, maximumThreads)
+		if destinationStorage == nil {
+			return
+		}
+
+		destinationPassword := ""
+		if destination.Encrypted {
+			destinationPassword = duplicacy.GetPassword(*destination, "password",
+				"Enter destination storage password:", false, false)
+		}
+
+		stopSourceSchedule := setRateLimit(source, sourceStorage, context.Int("download-limit-rate"),
+			context.Int("limit-burst"), false)
+		stopDestinationSchedule := setRateLimit(destination, destinationStorage, context.Int("upload-limit-rate"),
+			context.Int("limit-burst"), true)
+
+		destinationManager := duplicacy.CreateBackupManager(destination.SnapshotID, destinationStorage, repository,
+			destinationPassword, destination.NobackupFile)
+		duplicacy.SavePassword(*destination, "password", destinationPassword)
+		destinationManager.SetupSnapshotCache(destination.Name)
+
+		sourceManager.CopySnapshots(destinationManager, snapshotID, revisions, threads)
+		stopSourceSchedule()
+		stopDestinationSchedule()
 	}
 
-	destinationPassword := ""
-	if destination.Encrypted {
-		destinationPassword = duplicacy.GetPassword(*destination, "password",
-			"Enter destination storage password:", false, false)
+	runScript(context, source.Name, "post")
+}
+
+// setRateLimit applies the rate limit given on the command line, or if there isn't one, the bandwidth schedule saved
+// in the preference, to all threads transferring in one direction.  The returned function stops following the
+// schedule and reports the actual transfer rate.
+func setRateLimit(preference *duplicacy.Preference, storage duplicacy.Storage, rateLimit int, burst int,
+	isUpload bool) func() {
+
+	var schedule *duplicacy.BandwidthSchedule
+	if rateLimit == 0 && len(preference.BandwidthSchedule) > 0 {
+		var err error
+		schedule, err = duplicacy.ParseBandwidthSchedule(preference.BandwidthSchedule)
+		if err != nil {
+			duplicacy.LOG_ERROR("BANDWIDTH_SCHEDULE", "%v", err)
+			return func() {}
+		}
 	}
 
-	sourceStorage.SetRateLimits(context.Int("download-limit-rate"), 0)
-	destinationStorage.SetRateLimits(0, context.Int("upload-limit-rate"))
+	if rateLimit <= 0 && schedule == nil {
+		return func() {}
+	}
 
-	destinationManager := duplicacy.CreateBackupManager(destination.SnapshotID, destinationStorage, repository,
-		destinationPassword, destination.NobackupFile)
-	duplicacy.SavePassword(*destination, "password", destinationPassword)
-	destinationManager.SetupSnapshotCache(destination.Name)
+	limiter := duplicacy.CreateRateLimiter(rateLimit, burst)
+	direction := "Downloaded"
+	if isUpload {
+		storage.SetRateLimiters(nil, limiter)
+		direction = "Uploaded"
+	} else {
+		storage.SetRateLimiters(limiter, nil)
+	}
 
-	revisions := getRevisions(context)
-	snapshotID := ""
-	if context.String("id") != "" {
-		snapshotID = context.String("id")
+	stopSchedule := func() {}
+	if schedule != nil {
+		stopSchedule = duplicacy.ScheduleRateLimit(limiter, schedule)
 	}
 
-	sourceManager.CopySnapshots(destinationManager, snapshotID, revisions, threads)
-	runScript(context, source.Name, "post")
+	return func() {
+		stopSchedule()
+		limiter.ReportStatistics(direction)
+	}
 }
 
 func infoStorage(context *cli.Context) {
@@ -1267,6 +1650,296 @@ func infoStorage(context *cli.Context) {
 
 }
 
+func manageSecrets(context *cli.Context) {
+	setGlobalOptions(context)
+	defer duplicacy.CatchLogException()
+
+	args := context.Args()
+	if len(args) == 0 {
+		fmt.Fprintf(context.App.Writer, "The %s command requires an action.\n\n", context.Command.Name)
+		cli.ShowCommandHelp(context, context.Command.Name)
+		os.Exit(ArgumentExitCode)
+	}
+
+	action := args[0]
+	if (action == "init" || action == "list") && len(args) != 1 ||
+		action == "set" && len(args) != 2 && len(args) != 3 ||
+		action == "remove" && len(args) != 2 {
+		fmt.Fprintf(context.App.Writer, "Wrong number of arguments for '%s'.\n\n", action)
+		cli.ShowCommandHelp(context, context.Command.Name)
+		os.Exit(ArgumentExitCode)
+	}
+
+	getRepositoryPreference(context, "")
+
+	if action == "init" {
+		method := context.String("method")
+		if method != duplicacy.SECRET_STORE_PASSPHRASE && method != duplicacy.SECRET_STORE_KEY_FILE &&
+			method != duplicacy.SECRET_STORE_MACHINE {
+			fmt.Fprintf(context.App.Writer, "Invalid method '%s'.\n\n", method)
+			cli.ShowCommandHelp(context, context.Command.Name)
+			os.Exit(ArgumentExitCode)
+		}
+
+		if duplicacy.SecretStoreExists() {
+			duplicacy.LOG_ERROR("SECRET_STORE", "The secret store already exists; delete the 'secrets' file under the "+
+				"preference directory to create a new one")
+			return
+		}
+
+		keyFile := context.String("key-file")
+		if keyFile != "" {
+			keyFile, _ = filepath.Abs(keyFile)
+		}
+
+		_, err := duplicacy.CreateSecretStore(method, keyFile)
+		if err != nil {
+			duplicacy.LOG_ERROR("SECRET_STORE", "Failed to create the secret store: %v", err)
+			return
+		}
+		duplicacy.LOG_INFO("SECRET_STORE", "The secret store has been created; passwords and keys will be saved there "+
+			"instead of the keychain/keyring")
+		if method == duplicacy.SECRET_STORE_MACHINE {
+			duplicacy.LOG_WARN("SECRET_STORE", "The machine method only protects the secrets from copies of the store "+
+				"taken to other machines; on this machine anyone who can read the store can decrypt it")
+		}
+		return
+	}
+
+	if !duplicacy.SecretStoreExists() {
+		duplicacy.LOG_ERROR("SECRET_STORE", "The secret store has not been created; run 'duplicacy secret init' first")
+		return
+	}
+
+	store, err := duplicacy.OpenSecretStore()
+	if err != nil {
+		duplicacy.LOG_ERROR("SECRET_STORE", "Failed to open the secret store: %v", err)
+		return
+	}
+
+	switch action {
+	case "list":
+		for _, name := range store.List() {
+			fmt.Printf("%s\n", name)
+		}
+	case "set":
+		value := ""
+		if len(args) == 3 {
+			value = args[2]
+		} else {
+			value, err = duplicacy.ReadPassword(fmt.Sprintf("Enter the value for %s:", args[1]))
+			if err != nil {
+				duplicacy.LOG_ERROR("SECRET_STORE", "Failed to read the value: %v", err)
+				return
+			}
+		}
+		if value == "" {
+			duplicacy.LOG_ERROR("SECRET_STORE", "The value can't be empty")
+			return
+		}
+		err = store.Set(args[1], value)
+		if err != nil {
+			duplicacy.LOG_ERROR("SECRET_STORE", "Failed to save %s: %v", args[1], err)
+			return
+		}
+		duplicacy.LOG_INFO("SECRET_STORE", "%s has been saved", args[1])
+	case "remove":
+		found, err := store.Remove(args[1])
+		if err != nil {
+			duplicacy.LOG_ERROR("SECRET_STORE", "Failed to remove %s: %v", args[1], err)
+			return
+		}
+		if !found {
+			duplicacy.LOG_ERROR("SECRET_STORE", "%s is not in the secret store", args[1])
+			return
+		}
+		duplicacy.LOG_INFO("SECRET_STORE", "%s has been removed", args[1])
+	default:
+		fmt.Fprintf(context.App.Writer, "Unknown action '%s'.\n\n", action)
+		cli.ShowCommandHelp(context, context.Command.Name)
+		os.Exit(ArgumentExitCode)
+	}
+}
+
+func loadFleetConfig(context *cli.Context) *duplicacy.FleetConfig {
+	if len(context.Args()) != 1 {
+		fmt.Fprintf(context.App.Writer, "The %s command requires a configuration file.\n\n", context.Command.Name)
+		cli.ShowCommandHelp(context, context.Command.Name)
+		os.Exit(ArgumentExitCode)
+	}
+
+	config, err := duplicacy.LoadFleetConfig(context.Args()[0])
+	if err != nil {
+		duplicacy.LOG_ERROR("CONFIG_LOAD", "Failed to load the configuration: %v", err)
+		return nil
+	}
+
+	problems := config.Validate()
+	for _, problem := range problems {
+		duplicacy.LOG_WARN("CONFIG_INVALID", "%s", problem)
+	}
+	if len(problems) > 0 {
+		duplicacy.LOG_ERROR("CONFIG_INVALID", "The configuration has %d problem(s)", len(problems))
+		return nil
+	}
+
+	return config
+}
+
+func validateConfig(context *cli.Context) {
+	setGlobalOptions(context)
+	defer duplicacy.CatchLogException()
+
+	config := loadFleetConfig(context)
+	if config == nil {
+		return
+	}
+
+	duplicacy.LOG_INFO("CONFIG_VALID", "The configuration of %d repositories is valid", len(config.Repositories))
+}
+
+func applyConfig(context *cli.Context) {
+	setGlobalOptions(context)
+	defer duplicacy.CatchLogException()
+
+	config := loadFleetConfig(context)
+	if config == nil {
+		return
+	}
+
+	dryRun := context.Bool("dry-run")
+	changes, err := config.Apply(dryRun)
+	if err != nil {
+		duplicacy.LOG_ERROR("CONFIG_APPLY", "%v", err)
+		return
+	}
+
+	if dryRun {
+		duplicacy.LOG_INFO("CONFIG_APPLY", "%d files would be created or updated", changes)
+	} else {
+		duplicacy.LOG_INFO("CONFIG_APPLY", "%d files were created or updated", changes)
+	}
+}
+
+// getBundlePassphrase returns the passphrase that encrypts the secrets in a preference bundle, from the environment
+// variable DUPLICACY_PREFS_PASSPHRASE or the keyboard.
+func getBundlePassphrase(confirm bool) string {
+	if passphrase, found := os.LookupEnv("DUPLICACY_PREFS_PASSPHRASE"); found && passphrase != "" {
+		return passphrase
+	}
+
+	passphrase, err := duplicacy.ReadPassword("Enter the passphrase for the secrets:")
+	if err != nil {
+		duplicacy.LOG_ERROR("PREFERENCE_PASSPHRASE", "Failed to read the passphrase: %v", err)
+		return ""
+	}
+	if passphrase == "" {
+		duplicacy.LOG_ERROR("PREFERENCE_PASSPHRASE", "The passphrase can't be empty")
+		return ""
+	}
+	if confirm {
+		again, err := duplicacy.ReadPassword("Re-enter the passphrase:")
+		if err != nil {
+			duplicacy.LOG_ERROR("PREFERENCE_PASSPHRASE", "Failed to read the passphrase: %v", err)
+			return ""
+		}
+		if again != passphrase {
+			duplicacy.LOG_ERROR("PREFERENCE_PASSPHRASE", "The passphrases entered do not match")
+			return ""
+		}
+	}
+	return passphrase
+}
+
+func manageBundle(context *cli.Context) {
+	setGlobalOptions(context)
+	defer duplicacy.CatchLogException()
+
+	args := context.Args()
+	if len(args) != 2 || (args[0] != "export" && args[0] != "import") {
+		fmt.Fprintf(context.App.Writer, "The %s command requires an action and a file.\n\n", context.Command.Name)
+		cli.ShowCommandHelp(context, context.Command.Name)
+		os.Exit(ArgumentExitCode)
+	}
+
+	bundleFile := args[1]
+
+	if args[0] == "export" {
+		getRepositoryPreference(context, "")
+
+		passphrase := ""
+		if context.Bool("secrets") {
+			passphrase = getBundlePassphrase(true)
+		}
+
+		bundle, err := duplicacy.ExportPreferences(passphrase)
+		if err != nil {
+			duplicacy.LOG_ERROR("PREFERENCE_EXPORT", "Failed to export the preferences: %v", err)
+			return
+		}
+
+		err = bundle.Save(bundleFile)
+		if err != nil {
+			duplicacy.LOG_ERROR("PREFERENCE_EXPORT", "Failed to write %s: %v", bundleFile, err)
+			return
+		}
+		duplicacy.LOG_INFO("PREFERENCE_EXPORT", "The preferences of %d storages have been exported to %s",
+			len(bundle.Preferences), bundleFile)
+		return
+	}
+
+	bundle, err := duplicacy.LoadPreferenceBundle(bundleFile)
+	if err != nil {
+		duplicacy.LOG_ERROR("PREFERENCE_IMPORT", "Failed to load the bundle: %v", err)
+		return
+	}
+
+	err = bundle.RewriteStorageURLs(context.StringSlice("rewrite-url"))
+	if err != nil {
+		fmt.Fprintf(context.App.Writer, "%v.\n\n", err)
+		cli.ShowCommandHelp(context, context.Command.Name)
+		os.Exit(ArgumentExitCode)
+	}
+
+	repository, err := os.Getwd()
+	if err != nil {
+		duplicacy.LOG_ERROR("REPOSITORY_PATH", "Failed to retrieve the current working directory: %v", err)
+		return
+	}
+
+	preferencePath := path.Join(repository, duplicacy.DUPLICACY_DIRECTORY)
+	if stat, _ := os.Stat(path.Join(preferencePath, "preferences")); stat != nil && !context.Bool("overwrite") {
+		duplicacy.LOG_ERROR("REPOSITORY_INIT", "The repository %s has already been initialized; use -overwrite "+
+			"to replace its preferences", repository)
+		return
+	}
+
+	err = os.Mkdir(preferencePath, 0744)
+	if err != nil && !os.IsExist(err) {
+		duplicacy.LOG_ERROR("REPOSITORY_INIT", "Failed to create the directory %s: %v", preferencePath, err)
+		return
+	}
+	duplicacy.SetDuplicacyPreferencePath(preferencePath)
+	duplicacy.SetKeyringFile(path.Join(preferencePath, "keyring"))
+
+	passphrase := ""
+	if bundle.HasSecrets() {
+		if context.Bool("no-secrets") {
+			duplicacy.LOG_INFO("PREFERENCE_IMPORT", "Secrets in the bundle are not imported")
+		} else {
+			passphrase = getBundlePassphrase(false)
+		}
+	}
+
+	err = bundle.Import(passphrase)
+	if err != nil {
+		duplicacy.LOG_ERROR("PREFERENCE_IMPORT", "Failed to import the preferences: %v", err)
+		return
+	}
+	duplicacy.LOG_INFO("PREFERENCE_IMPORT", "The preferences of %d storages have been imported to %s",
+		len(bundle.Preferences), repository)
+}
+
 func benchmark(context *cli.Context) {
 	setGlobalOptions(context)
 	defer duplicacy.CatchLogException()
@@ -1388,12 +2061,24 @@ func main() {
 					Usage:    "number of uploading threads",
 					Argument: "<n>",
 				},
+				cli.IntFlag{
+					Name:     "max-threads",
+					Value:    0,
+					Usage:    "adjust the number of uploading threads between -threads and this number as the storage allows",
+					Argument: "<n>",
+				},
 				cli.IntFlag{
 					Name:     "limit-rate",
 					Value:    0,
 					Usage:    "the maximum upload rate (in kilobytes/sec)",
 					Argument: "<kB/s>",
 				},
+				cli.IntFlag{
+					Name:     "limit-burst",
+					Value:    0,
+					Usage:    "the amount of data that can be sent at full speed before the rate limit applies (in kilobytes, defaults to one second worth)",
+					Argument: "<kB>",
+				},
 				cli.BoolFlag{
 					Name:  "dry-run",
 					Usage: "dry run for testing, don't backup anything. Use with -stats and -d",
@@ -1417,6 +2102,32 @@ func main() {
 					Name:  "enum-only",
 					Usage: "enumerate the repository recursively and then exit",
 				},
+				cli.IntFlag{
+					Name:     "nice",
+					Usage:    "lower the CPU priority of the backup to this nice value (0-19)",
+					Argument: "<n>",
+				},
+				cli.StringFlag{
+					Name:     "io-priority",
+					Usage:    "set the I/O priority of the backup ('idle' or 'best-effort[:<level>]')",
+					Argument: "<class>",
+				},
+				cli.IntFlag{
+					Name:     "read-limit-rate",
+					Usage:    "the maximum rate of reading files in kilobytes/sec",
+					Argument: "<kB/s>",
+				},
+				cli.StringFlag{
+					Name:     "max-load",
+					Usage:    "pause reading files while the system load average is above this value",
+					Argument: "<load>",
+				},
+				cli.IntFlag{
+					Name:     "snapshot-version",
+					Value:    1,
+					Usage:    "the format of the file list: 1 for a flat list, or 2 for a directory tree that can be partially loaded (not readable by older versions)",
+					Argument: "<version>",
+				},
 			},
 			Usage:     "Save a snapshot of the repository to the storage",
 			ArgsUsage: " ",
@@ -1428,9 +2139,19 @@ func main() {
 			Flags: []cli.Flag{
 				cli.IntFlag{
 					Name:     "r",
-					Usage:    "the revision number of the snapshot (required)",
+					Usage:    "the revision number of the snapshot (required unless -at is specified)",
 					Argument: "<revision>",
 				},
+				cli.StringFlag{
+					Name:     "at",
+					Usage:    "restore the latest revision created at or before the specified time (e.g., '2006-01-02 15:04' or '3d')",
+					Argument: "<time>",
+				},
+				cli.StringSliceFlag{
+					Name:     "merge",
+					Usage:    "restore the newest available version of each file from the specified revisions (e.g., 3-8)",
+					Argument: "<revisions>",
+				},
 				cli.BoolFlag{
 					Name:  "hash",
 					Usage: "detect file differences by hash (rather than size and timestamp)",
@@ -1447,6 +2168,31 @@ func main() {
 					Name:  "ignore-owner",
 					Usage: "do not set the original uid/gid on restored files",
 				},
+				cli.BoolFlag{
+					Name:  "map-owner-by-name",
+					Usage: "set the uid/gid of local users and groups with the same names as the original ones",
+				},
+				cli.StringSliceFlag{
+					Name:     "map-owner",
+					Usage:    "map an original uid or gid to a local one; can be specified multiple times",
+					Argument: "<uid:old=new|gid:old=new>",
+				},
+				cli.BoolFlag{
+					Name:  "squash-owner",
+					Usage: "give all restored files to the current user",
+				},
+				cli.BoolFlag{
+					Name:  "resume",
+					Usage: "continue the previous restore of the same revision that was interrupted",
+				},
+				cli.BoolFlag{
+					Name:  "dry-run",
+					Usage: "show which files would be created, overwritten, deleted or skipped without restoring anything",
+				},
+				cli.BoolFlag{
+					Name:  "json",
+					Usage: "print the dry-run plan in json",
+				},
 				cli.BoolFlag{
 					Name:  "stats",
 					Usage: "show statistics during and after restore",
@@ -1457,12 +2203,24 @@ func main() {
 					Usage:    "number of downloading threads",
 					Argument: "<n>",
 				},
+				cli.IntFlag{
+					Name:     "max-threads",
+					Value:    0,
+					Usage:    "adjust the number of downloading threads between -threads and this number as the storage allows",
+					Argument: "<n>",
+				},
 				cli.IntFlag{
 					Name:     "limit-rate",
 					Value:    0,
 					Usage:    "the maximum download rate (in kilobytes/sec)",
 					Argument: "<kB/s>",
 				},
+				cli.IntFlag{
+					Name:     "limit-burst",
+					Value:    0,
+					Usage:    "the amount of data that can be sent at full speed before the rate limit applies (in kilobytes, defaults to one second worth)",
+					Argument: "<kB>",
+				},
 				cli.StringFlag{
 					Name:     "storage",
 					Usage:    "restore from the specified storage instead of the default one",
@@ -1491,6 +2249,11 @@ func main() {
 					Usage:    "the revision number of the snapshot",
 					Argument: "<revision>",
 				},
+				cli.StringFlag{
+					Name:     "at",
+					Usage:    "list the latest revision created at or before the specified time",
+					Argument: "<time>",
+				},
 				cli.StringFlag{
 					Name:     "t",
 					Usage:    "list snapshots with the specified tag",
@@ -1583,6 +2346,11 @@ func main() {
 					Usage:    "the revision number of the snapshot",
 					Argument: "<revision>",
 				},
+				cli.StringFlag{
+					Name:     "at",
+					Usage:    "use the latest revision created at or before the specified time",
+					Argument: "<time>",
+				},
 				cli.StringFlag{
 					Name:     "storage",
 					Usage:    "retrieve the file from the specified storage",
@@ -1607,6 +2375,11 @@ func main() {
 					Usage:    "the revision number of the snapshot",
 					Argument: "<revision>",
 				},
+				cli.StringSliceFlag{
+					Name:     "at",
+					Usage:    "use the latest revision created at or before the specified time",
+					Argument: "<time>",
+				},
 				cli.BoolFlag{
 					Name:  "hash",
 					Usage: "compute the hashes of on-disk files",
@@ -1677,6 +2450,10 @@ func main() {
 					Usage:    "keep 1 snapshot every n days for snapshots older than m days",
 					Argument: "<n:m>",
 				},
+				cli.BoolFlag{
+					Name:  "use-retention",
+					Usage: "apply the retention policy saved in the preferences",
+				},
 				cli.BoolFlag{
 					Name:  "exhaustive",
 					Usage: "remove all unreferenced chunks (not just those referenced by deleted snapshots)",
@@ -1819,6 +2596,41 @@ func main() {
 					Argument: "<file name>",
 					Value:   "",
 				},
+				cli.StringFlag{
+					Name:     "credential-helper",
+					Usage:    "run this command to look up passwords and keys ('none' to stop using one)",
+					Argument: "<command>",
+				},
+				cli.StringSliceFlag{
+					Name:     "parameter",
+					Usage:    "set a storage parameter, or remove it if the value is empty (can be specified multiple times)",
+					Argument: "<name>=<value>",
+				},
+				cli.StringSliceFlag{
+					Name:     "bandwidth-schedule",
+					Usage:    "limit the transfer rate by time of day, e.g. 'mon-fri 08:00-18:00 2M' (can be specified multiple times; 'none' to remove the schedule)",
+					Argument: "<schedule>",
+				},
+				cli.IntFlag{
+					Name:     "nice",
+					Usage:    "lower the CPU priority of backups to this nice value (0-19; 0 to reset)",
+					Argument: "<n>",
+				},
+				cli.StringFlag{
+					Name:     "io-priority",
+					Usage:    "set the I/O priority of backups ('idle' or 'best-effort[:<level>]'; 'none' to reset)",
+					Argument: "<class>",
+				},
+				cli.IntFlag{
+					Name:     "read-limit-rate",
+					Usage:    "the maximum rate of reading files during backups in kilobytes/sec (0 for unlimited)",
+					Argument: "<kB/s>",
+				},
+				cli.StringFlag{
+					Name:     "max-load",
+					Usage:    "pause reading files during backups while the system load average is above this value ('none' to disable)",
+					Argument: "<load>",
+				},
 				cli.StringFlag{
 					Name:  "key",
 					Usage: "add a key/password whose value is supplied by the -value option",
@@ -1837,6 +2649,72 @@ func main() {
 			ArgsUsage: " ",
 			Action:    setPreference,
 		},
+
+		{
+			Name: "secret",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:     "method",
+					Value:    "passphrase",
+					Usage:    "how the store is unlocked with init: passphrase, keyfile, or machine (not protected on this host)",
+					Argument: "<method>",
+				},
+				cli.StringFlag{
+					Name:     "key-file",
+					Usage:    "the key file that unlocks the store when the method is keyfile",
+					Argument: "<file>",
+				},
+			},
+			Usage:     "Manage the encrypted secret store used in place of the keychain/keyring",
+			ArgsUsage: "init | list | set <name> [<value>] | remove <name>",
+			Action:    manageSecrets,
+		},
+		{
+			Name: "prefs",
+			Flags: []cli.Flag{
+				cli.BoolFlag{
+					Name:  "secrets",
+					Usage: "export saved passwords and keys too, encrypted with a passphrase",
+				},
+				cli.BoolFlag{
+					Name:  "no-secrets",
+					Usage: "don't import the passwords and keys in the bundle",
+				},
+				cli.StringSliceFlag{
+					Name:     "rewrite-url",
+					Usage:    "replace the prefix of storage urls when importing (can be specified multiple times)",
+					Argument: "<old>=<new>",
+				},
+				cli.BoolFlag{
+					Name:  "overwrite",
+					Usage: "replace the preferences of an initialized repository when importing",
+				},
+			},
+			Usage:     "Export the preferences, filters, scripts and secrets of the repository to a file, or import them",
+			ArgsUsage: "export <file> | import <file>",
+			Action:    manageBundle,
+		},
+
+		{
+			Name: "apply",
+			Flags: []cli.Flag{
+				cli.BoolFlag{
+					Name:  "dry-run",
+					Usage: "show the files to be created or updated without writing them",
+				},
+			},
+			Usage:     "Create or update the preferences of the repositories described by a configuration file",
+			ArgsUsage: "<config file>",
+			Action:    applyConfig,
+		},
+
+		{
+			Name:      "validate",
+			Usage:     "Check a configuration file for the apply command",
+			ArgsUsage: "<config file>",
+			Action:    validateConfig,
+		},
+
 		{
 			Name: "copy",
 			Flags: []cli.Flag{
@@ -1860,6 +2738,10 @@ func main() {
 					Usage:    "copy snapshots to the specified storage",
 					Argument: "<storage name>",
 				},
+				cli.BoolFlag{
+					Name:  "all-targets",
+					Usage: "copy snapshots to all storages listed as copy targets in the preferences",
+				},
 				cli.IntFlag{
 					Name:     "download-limit-rate",
 					Value:    0,
@@ -1872,12 +2754,24 @@ func main() {
 					Usage:    "the maximum upload rate (in kilobytes/sec)",
 					Argument: "<kB/s>",
 				},
+				cli.IntFlag{
+					Name:     "limit-burst",
+					Value:    0,
+					Usage:    "the amount of data that can be sent at full speed before the rate limit applies (in kilobytes, defaults to one second worth)",
+					Argument: "<kB>",
+				},
 				cli.IntFlag{
 					Name:     "threads",
 					Value:    1,
 					Usage:    "number of uploading threads",
 					Argument: "<n>",
 				},
+				cli.IntFlag{
+					Name:     "max-threads",
+					Value:    0,
+					Usage:    "adjust the number of uploading threads between -threads and this number as the storage allows",
+					Argument: "<n>",
+				},
 			},
 			Usage:     "Copy snapshots between compatible storages",
 			ArgsUsage: " ",
@@ -1981,6 +2875,16 @@ func main() {
 			Name:	"comment",
 			Usage:	"add a comment to identify the process",
 		},
+		cli.StringSliceFlag{
+			Name:     "param",
+			Usage:    "override a parameter of the named storage, or of the storage the command works on if no storage is given, for this run (can be specified multiple times)",
+			Argument: "[<storage>:]<name>=<value>",
+		},
+		cli.StringFlag{
+			Name:     "memory-budget",
+			Usage:    "limit the memory used by chunks being uploaded or downloaded, for example 512M or 1G",
+			Argument: "<size>",
+		},
 	}
 
 	app.HideVersion = true
@@ -6,8 +6,12 @@ package duplicacy
 
 import (
 	"fmt"
+	"net/http"
+	"net/url"
 	"strings"
+	"time"
 
+	"github.com/Azure/go-autorest/autorest/adal"
 	"github.com/gilbertchen/azure-sdk-for-go/storage"
 )
 
@@ -15,10 +19,62 @@ type AzureStorage struct {
 	StorageBase
 
 	containers []*storage.Container
+	transport  *azureTransport
+}
+
+// AzureCredentials specifies how requests are authorized: with the account key, with a SAS token, or as a service
+// principal (an Azure AD application) that obtains OAuth tokens with its client secret.  'Endpoint' replaces the
+// default blob endpoint of the account, e.g. 'http://127.0.0.1:10000/devstoreaccount1' for a local emulator, and
+// 'AuthorityHost' replaces the default Azure AD endpoint for service principals.
+type AzureCredentials struct {
+	AccountKey    string
+	SASToken      string
+	TenantID      string
+	ClientID      string
+	ClientSecret  string
+	AuthorityHost string
+	Endpoint      string
+}
+
+const (
+	azureStorageResource     = "https://storage.azure.com/"
+	azureDefaultAuthority    = "https://login.microsoftonline.com/"
+	azureSASExpiryWarningAge = 14 * 24 * time.Hour
+
+	// The SDK always signs requests with a key, which is ignored when a SAS token or an OAuth token is used instead
+	azurePlaceholderKey = "ZHVwbGljYWN5"
+
+	// OAuth tokens require at least this version of the REST API
+	azureOAuthAPIVersion = "2017-11-09"
+)
+
+// azureTransport authorizes the requests made by the SDK with a SAS token or an OAuth token instead of the account
+// key, and sends them to a different endpoint if one is specified.
+type azureTransport struct {
+	sasToken         url.Values
+	servicePrincipal *adal.ServicePrincipalToken
+	endpoint         *url.URL
 }
 
 func CreateAzureStorage(accountName string, accountKey string,
 	containerName string, threads int) (azureStorage *AzureStorage, err error) {
+	return CreateAzureStorageWithCredentials(accountName, AzureCredentials{AccountKey: accountKey}, containerName,
+		threads)
+}
+
+// CreateAzureStorageWithCredentials creates an Azure storage that authorizes requests as specified by 'credentials'.
+func CreateAzureStorageWithCredentials(accountName string, credentials AzureCredentials,
+	containerName string, threads int) (azureStorage *AzureStorage, err error) {
+
+	transport, err := createAzureTransport(credentials)
+	if err != nil {
+		return nil, err
+	}
+
+	accountKey := credentials.AccountKey
+	if credentials.SASToken != "" || credentials.ClientID != "" {
+		accountKey = azurePlaceholderKey
+	}
 
 	var containers []*storage.Container
 	for i := 0; i < threads; i++ {
@@ -29,6 +85,10 @@ func CreateAzureStorage(accountName string, accountKey string,
 			return nil, err
 		}
 
+		if transport != nil {
+			client.HTTPClient = &http.Client{Transport: transport}
+		}
+
 		blobService := client.GetBlobService()
 		container := blobService.GetContainerReference(containerName)
 		containers = append(containers, container)
@@ -45,6 +105,7 @@ func CreateAzureStorage(accountName string, accountKey string,
 
 	azureStorage = &AzureStorage{
 		containers: containers,
+		transport:  transport,
 	}
 
 	azureStorage.DerivedStorage = azureStorage
@@ -52,6 +113,162 @@ func CreateAzureStorage(accountName string, accountKey string,
 	return
 }
 
+// createAzureTransport returns the transport needed by the credentials, or nil if requests can be sent as they are.
+func createAzureTransport(credentials AzureCredentials) (transport *azureTransport, err error) {
+
+	transport = &azureTransport{}
+
+	if credentials.Endpoint != "" {
+		transport.endpoint, err = url.Parse(strings.TrimSuffix(credentials.Endpoint, "/"))
+		if err != nil || transport.endpoint.Host == "" {
+			return nil, fmt.Errorf("invalid endpoint '%s'", credentials.Endpoint)
+		}
+	}
+
+	if credentials.SASToken != "" {
+		var expiry time.Time
+		transport.sasToken, expiry, err = parseAzureSASToken(credentials.SASToken)
+		if err != nil {
+			return nil, err
+		}
+
+		if !expiry.IsZero() {
+			if expiry.Before(time.Now()) {
+				return nil, fmt.Errorf("the SAS token expired at %s", expiry.Local().Format("2006-01-02 15:04:05"))
+			} else if expiry.Before(time.Now().Add(azureSASExpiryWarningAge)) {
+				LOG_WARN("AZURE_SAS_EXPIRY", "The SAS token will expire at %s",
+					expiry.Local().Format("2006-01-02 15:04:05"))
+			} else {
+				LOG_DEBUG("AZURE_SAS_EXPIRY", "The SAS token will expire at %s",
+					expiry.Local().Format("2006-01-02 15:04:05"))
+			}
+		}
+	} else if credentials.ClientID != "" {
+		if credentials.TenantID == "" {
+			return nil, fmt.Errorf("the tenant id of the service principal is not specified")
+		}
+
+		authorityHost := credentials.AuthorityHost
+		if authorityHost == "" {
+			authorityHost = azureDefaultAuthority
+		}
+
+		oauthConfig, err := adal.NewOAuthConfig(authorityHost, credentials.TenantID)
+		if err != nil {
+			return nil, err
+		}
+
+		transport.servicePrincipal, err = adal.NewServicePrincipalToken(*oauthConfig, credentials.ClientID,
+			credentials.ClientSecret, azureStorageResource)
+		if err != nil {
+			return nil, err
+		}
+
+		// Fail early if the client secret is wrong
+		err = transport.servicePrincipal.EnsureFresh()
+		if err != nil {
+			return nil, fmt.Errorf("failed to obtain a token for the service principal %s: %v", credentials.ClientID,
+				err)
+		}
+	} else if transport.endpoint == nil {
+		return nil, nil
+	}
+
+	return transport, nil
+}
+
+// parseAzureSASToken parses a SAS token, which may also be given as a full SAS url, and returns its parameters and
+// expiry time.
+func parseAzureSASToken(token string) (parameters url.Values, expiry time.Time, err error) {
+
+	if index := strings.Index(token, "?"); index >= 0 {
+		token = token[index+1:]
+	}
+
+	parameters, err = url.ParseQuery(token)
+	if err != nil || parameters.Get("sig") == "" {
+		return nil, expiry, fmt.Errorf("invalid SAS token")
+	}
+
+	if value := parameters.Get("se"); value != "" {
+		for _, layout := range []string{time.RFC3339, "2006-01-02T15:04Z07:00", "2006-01-02"} {
+			expiry, err = time.Parse(layout, value)
+			if err == nil {
+				break
+			}
+		}
+		if err != nil {
+			return nil, expiry, fmt.Errorf("invalid expiry time '%s' in the SAS token", value)
+		}
+	}
+
+	return parameters, expiry, nil
+}
+
+// rewriteURL redirects the url to the custom endpoint and adds the SAS token to it.
+func (transport *azureTransport) rewriteURL(requestURL *url.URL) {
+	if transport.endpoint != nil {
+		requestURL.Scheme = transport.endpoint.Scheme
+		requestURL.Host = transport.endpoint.Host
+		requestURL.Path = transport.endpoint.Path + requestURL.Path
+		requestURL.RawPath = ""
+	}
+
+	if transport.sasToken != nil {
+		query := requestURL.Query()
+		for name, values := range transport.sasToken {
+			query[name] = values
+		}
+		requestURL.RawQuery = query.Encode()
+	}
+}
+
+// RoundTrip replaces the authorization of the request before sending it.
+func (transport *azureTransport) RoundTrip(request *http.Request) (*http.Response, error) {
+
+	// A RoundTripper must not modify the original request
+	clone := *request
+	requestURL := *request.URL
+	clone.URL = &requestURL
+	clone.Host = ""
+	clone.Header = make(http.Header)
+	for name, values := range request.Header {
+		clone.Header[name] = values
+	}
+
+	transport.rewriteURL(clone.URL)
+
+	if transport.sasToken != nil {
+		clone.Header.Del("Authorization")
+	} else if transport.servicePrincipal != nil {
+		err := transport.servicePrincipal.EnsureFresh()
+		if err != nil {
+			return nil, fmt.Errorf("failed to refresh the OAuth token: %v", err)
+		}
+		clone.Header.Set("Authorization", "Bearer "+transport.servicePrincipal.OAuthToken())
+		if clone.Header.Get("x-ms-version") < azureOAuthAPIVersion {
+			clone.Header.Set("x-ms-version", azureOAuthAPIVersion)
+		}
+	}
+
+	return http.DefaultTransport.RoundTrip(&clone)
+}
+
+// getCopySource returns the url of the blob to be used as the source of a copy.
+func (azureStorage *AzureStorage) getCopySource(blob *storage.Blob) string {
+	sourceURL := blob.GetURL()
+	if azureStorage.transport == nil {
+		return sourceURL
+	}
+
+	parsedURL, err := url.Parse(sourceURL)
+	if err != nil {
+		return sourceURL
+	}
+	azureStorage.transport.rewriteURL(parsedURL)
+	return parsedURL.String()
+}
+
 // ListFiles return the list of files and subdirectories under 'dir' (non-recursively)
 func (azureStorage *AzureStorage) ListFiles(threadIndex int, dir string) (files []string, sizes []int64, err error) {
 
@@ -124,7 +341,7 @@ func (storage *AzureStorage) DeleteFile(threadIndex int, filePath string) (err e
 func (storage *AzureStorage) MoveFile(threadIndex int, from string, to string) (err error) {
 	source := storage.containers[threadIndex].GetBlobReference(from)
 	destination := storage.containers[threadIndex].GetBlobReference(to)
-	err = destination.Copy(source.GetURL(), nil)
+	err = destination.Copy(storage.getCopySource(source), nil)
 	if err != nil {
 		return err
 	}
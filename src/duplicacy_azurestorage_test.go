@@ -0,0 +1,78 @@
+// Copyright (c) Acrosync LLC. All rights reserved.
+// Free for personal use and commercial trial
+// Commercial use requires per-user licenses available from https://duplicacy.com
+
+package duplicacy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestAzureSASToken(t *testing.T) {
+
+	setTestingT(t)
+
+	token := "sv=2019-02-02&sr=c&sp=racwdl&se=2030-01-01T00:00:00Z&sig=abcd%2Bef%3D"
+	parameters, expiry, err := parseAzureSASToken("https://account.blob.core.windows.net/container?" + token)
+	if err != nil || parameters.Get("sig") != "abcd+ef=" || parameters.Get("sr") != "c" {
+		t.Errorf("Failed to parse the SAS token: %v %v", parameters, err)
+	}
+	if !expiry.Equal(time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC)) {
+		t.Errorf("The expiry time was parsed as %s", expiry)
+	}
+
+	_, expiry, err = parseAzureSASToken("?se=2030-06-01&sig=abcd")
+	if err != nil || expiry.Month() != time.June {
+		t.Errorf("Failed to parse a SAS token with a date only expiry: %s %v", expiry, err)
+	}
+
+	for _, invalid := range []string{"sv=2019-02-02&sr=c", "se=tomorrow&sig=abcd"} {
+		if _, _, err = parseAzureSASToken(invalid); err == nil {
+			t.Errorf("The SAS token '%s' should be rejected", invalid)
+		}
+	}
+
+	if _, err = createAzureTransport(AzureCredentials{SASToken: "se=2001-01-01&sig=abcd"}); err == nil {
+		t.Errorf("An expired SAS token was accepted")
+	}
+
+	var received *http.Request
+	server := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		received = request
+	}))
+	defer server.Close()
+
+	transport, err := createAzureTransport(AzureCredentials{
+		SASToken: token,
+		Endpoint: server.URL + "/devstoreaccount1",
+	})
+	if err != nil {
+		t.Errorf("Failed to create the transport: %v", err)
+		return
+	}
+
+	request, _ := http.NewRequest("GET", "https://account.blob.core.windows.net/container/chunks/1234?comp=list", nil)
+	request.Header.Set("Authorization", "SharedKey account:signature")
+	response, err := transport.RoundTrip(request)
+	if err != nil {
+		t.Errorf("Failed to send the request: %v", err)
+		return
+	}
+	response.Body.Close()
+
+	if received.URL.Path != "/devstoreaccount1/container/chunks/1234" {
+		t.Errorf("The request was sent to %s", received.URL.Path)
+	}
+	if query := received.URL.Query(); query.Get("comp") != "list" || query.Get("sig") != "abcd+ef=" {
+		t.Errorf("Incorrect query: %s", received.URL.RawQuery)
+	}
+	if received.Header.Get("Authorization") != "" {
+		t.Errorf("The shared key authorization was not removed")
+	}
+	if request.Header.Get("Authorization") == "" || request.URL.Host != "account.blob.core.windows.net" {
+		t.Errorf("The original request was modified")
+	}
+}
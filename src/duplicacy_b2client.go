@@ -47,9 +47,23 @@ type B2Client struct {
 	BucketName         string
 	BucketID           string
 
+	// The account id returned by b2_authorize_account, which is different from AccountID if the latter is the id
+	// of an application key
+	AuthorizedAccountID string
+
+	// Restrictions of the application key; empty if the key can access all buckets and files
+	AllowedBucketID   string
+	AllowedBucketName string
+	AllowedPrefix     string
+
+	MinimumPartSize int
+
 	UploadURL   string
 	UploadToken string
 
+	// Called when a request is rejected with 429 or 503
+	ThrottlingFunc func()
+
 	TestMode bool
 }
 
@@ -178,9 +192,15 @@ func (client *B2Client) call(url string, method string, requestHeaders map[strin
 				return nil, nil, 0, fmt.Errorf("URL request '%s' returned status code %d", url, response.StatusCode)
 			}
 		} else if response.StatusCode == 429 || response.StatusCode == 408 {
+			if response.StatusCode == 429 && client.ThrottlingFunc != nil {
+				client.ThrottlingFunc()
+			}
 			backoff = client.retry(backoff, response)
 			continue
 		} else if response.StatusCode >= 500 && response.StatusCode <= 599 {
+			if response.StatusCode == 503 && client.ThrottlingFunc != nil {
+				client.ThrottlingFunc()
+			}
 			backoff = client.retry(backoff, response)
 			continue
 		} else {
@@ -203,11 +223,19 @@ func (client *B2Client) call(url string, method string, requestHeaders map[strin
 	return nil, nil, 0, fmt.Errorf("Maximum backoff reached")
 }
 
+type B2AllowedOutput struct {
+	BucketID   string
+	BucketName string
+	NamePrefix string
+}
+
 type B2AuthorizeAccountOutput struct {
-	AccountID          string
-	AuthorizationToken string
-	APIURL             string
-	DownloadURL        string
+	AccountID               string
+	AuthorizationToken      string
+	APIURL                  string
+	DownloadURL             string
+	AbsoluteMinimumPartSize int
+	Allowed                 *B2AllowedOutput
 }
 
 func (client *B2Client) AuthorizeAccount() (err error) {
@@ -228,6 +256,14 @@ func (client *B2Client) AuthorizeAccount() (err error) {
 	client.AuthorizationToken = output.AuthorizationToken
 	client.APIURL = output.APIURL
 	client.DownloadURL = output.DownloadURL
+	client.AuthorizedAccountID = output.AccountID
+	client.MinimumPartSize = output.AbsoluteMinimumPartSize
+
+	if output.Allowed != nil {
+		client.AllowedBucketID = output.Allowed.BucketID
+		client.AllowedBucketName = output.Allowed.BucketName
+		client.AllowedPrefix = output.Allowed.NamePrefix
+	}
 
 	return nil
 }
@@ -241,8 +277,21 @@ type ListBucketOutput struct {
 
 func (client *B2Client) FindBucket(bucketName string) (err error) {
 
+	// A key restricted to a bucket may not be allowed to list buckets, but the bucket id is already known
+	if client.AllowedBucketID != "" {
+		if client.AllowedBucketName != bucketName {
+			return fmt.Errorf("The application key is restricted to the bucket %s", client.AllowedBucketName)
+		}
+		client.BucketName = client.AllowedBucketName
+		client.BucketID = client.AllowedBucketID
+		return nil
+	}
+
 	input := make(map[string]string)
-	input["accountId"] = client.AccountID
+	input["accountId"] = client.AuthorizedAccountID
+	if input["accountId"] == "" {
+		input["accountId"] = client.AccountID
+	}
 
 	url := client.APIURL + "/b2api/v1/b2_list_buckets"
 
@@ -308,6 +357,10 @@ func (client *B2Client) ListFileNames(startFileName string, singleFile bool, inc
 	input["bucketId"] = client.BucketID
 	input["startFileName"] = startFileName
 	input["maxFileCount"] = maxFileCount
+	if startFileName != "" {
+		// Keys restricted to a name prefix can only list files under a prefix within it
+		input["prefix"] = startFileName
+	}
 
 	for {
 		url := client.APIURL + "/b2api/v1/b2_list_file_names"
@@ -513,36 +566,41 @@ func (client *B2Client) getUploadURL() error {
 
 func (client *B2Client) UploadFile(filePath string, content []byte, rateLimit int) (err error) {
 
+	headers := make(map[string]string)
+	headers["X-Bz-File-Name"] = strings.Replace(filePath, " ", "%20", -1)
+	headers["Content-Type"] = "application/octet-stream"
+
+	return client.upload(&client.UploadURL, &client.UploadToken, client.getUploadURL, headers, content, rateLimit)
+}
+
+// upload sends 'content' to the upload url, which is obtained by calling 'getUploadURL' first and again after each
+// failed attempt.
+func (client *B2Client) upload(uploadURL *string, uploadToken *string, getUploadURL func() error,
+	headers map[string]string, content []byte, rateLimit int) (err error) {
+
 	hasher := sha1.New()
 	hasher.Write(content)
 	hash := hex.EncodeToString(hasher.Sum(nil))
 
-	headers := make(map[string]string)
-	headers["X-Bz-File-Name"] = filePath
-	headers["Content-Type"] = "application/octet-stream"
-	headers["X-Bz-Content-Sha1"] = hash
-
 	var response *http.Response
 
 	backoff := 0
 	for i := 0; i < 8; i++ {
 
-		if client.UploadURL == "" || client.UploadToken == "" {
-			err = client.getUploadURL()
+		if *uploadURL == "" || *uploadToken == "" {
+			err = getUploadURL()
 			if err != nil {
 				return err
 			}
 		}
 
-		request, err := http.NewRequest("POST", client.UploadURL, CreateRateLimitedReader(content, rateLimit))
+		request, err := http.NewRequest("POST", *uploadURL, CreateRateLimitedReader(content, rateLimit))
 		if err != nil {
 			return err
 		}
 		request.ContentLength = int64(len(content))
 
-		request.Header.Set("Authorization", client.UploadToken)
-		request.Header.Set("X-Bz-File-Name", filePath)
-		request.Header.Set("Content-Type", "application/octet-stream")
+		request.Header.Set("Authorization", *uploadToken)
 		request.Header.Set("X-Bz-Content-Sha1", hash)
 
 		for key, value := range headers {
@@ -562,10 +620,10 @@ func (client *B2Client) UploadFile(filePath string, content []byte, rateLimit in
 
 		response, err = client.HTTPClient.Do(request)
 		if err != nil {
-			LOG_DEBUG("BACKBLAZE_UPLOAD", "URL request '%s' returned an error: %v", client.UploadURL, err)
+			LOG_DEBUG("BACKBLAZE_UPLOAD", "URL request '%s' returned an error: %v", *uploadURL, err)
 			backoff = client.retry(backoff, response)
-			client.UploadURL = ""
-			client.UploadToken = ""
+			*uploadURL = ""
+			*uploadToken = ""
 			continue
 		}
 
@@ -576,12 +634,12 @@ func (client *B2Client) UploadFile(filePath string, content []byte, rateLimit in
 			return nil
 		}
 
-		LOG_DEBUG("BACKBLAZE_UPLOAD", "URL request '%s' returned status code %d", client.UploadURL, response.StatusCode)
+		LOG_DEBUG("BACKBLAZE_UPLOAD", "URL request '%s' returned status code %d", *uploadURL, response.StatusCode)
 
 		if response.StatusCode == 401 {
 			LOG_INFO("BACKBLAZE_UPLOAD", "Re-authorization required")
-			client.UploadURL = ""
-			client.UploadToken = ""
+			*uploadURL = ""
+			*uploadToken = ""
 			continue
 		} else if response.StatusCode == 403 {
 			if !client.TestMode {
@@ -589,12 +647,127 @@ func (client *B2Client) UploadFile(filePath string, content []byte, rateLimit in
 			}
 			continue
 		} else {
-			LOG_INFO("BACKBLAZE_UPLOAD", "URL request '%s' returned status code %d", client.UploadURL, response.StatusCode)
+			LOG_INFO("BACKBLAZE_UPLOAD", "URL request '%s' returned status code %d", *uploadURL, response.StatusCode)
 			backoff = client.retry(backoff, response)
-			client.UploadURL = ""
-			client.UploadToken = ""
+			*uploadURL = ""
+			*uploadToken = ""
 		}
 	}
 
 	return fmt.Errorf("Maximum backoff reached")
 }
+
+type B2StartLargeFileOutput struct {
+	FileID string
+}
+
+// UploadLargeFile uploads the file with the large file API, sending up to 'options.Threads' parts at the same
+// time.  The large file is canceled if any part fails, so no unfinished parts are left behind.
+func (client *B2Client) UploadLargeFile(filePath string, content []byte, rateLimit int,
+	options MultipartOptions) (err error) {
+
+	if options.PartSize < client.MinimumPartSize {
+		options.PartSize = client.MinimumPartSize
+	}
+
+	parts := options.getParts(int64(len(content)))
+	if len(parts) < 2 {
+		return client.UploadFile(filePath, content, rateLimit)
+	}
+
+	input := make(map[string]string)
+	input["bucketId"] = client.BucketID
+	input["fileName"] = filePath
+	input["contentType"] = "application/octet-stream"
+
+	url := client.APIURL + "/b2api/v1/b2_start_large_file"
+	readCloser, _, _, err := client.call(url, http.MethodPost, make(map[string]string), input)
+	if err != nil {
+		return err
+	}
+
+	output := &B2StartLargeFileOutput{}
+	err = json.NewDecoder(readCloser).Decode(&output)
+	readCloser.Close()
+	if err != nil {
+		return err
+	}
+
+	LOG_DEBUG("BACKBLAZE_UPLOAD", "Uploading %s in %d parts as large file %s", filePath, len(parts), output.FileID)
+
+	hashes := make([]string, len(parts))
+	err = options.transferParts(len(parts), func(index int) error {
+		// Each part gets its own copy of the client so that parts being uploaded at the same time don't share
+		// authorization tokens
+		partClient := *client
+		part := content[parts[index].start:parts[index].end]
+
+		hasher := sha1.New()
+		hasher.Write(part)
+		hashes[index] = hex.EncodeToString(hasher.Sum(nil))
+
+		var uploadURL, uploadToken string
+		getUploadPartURL := func() (err error) {
+			uploadURL, uploadToken, err = partClient.getUploadPartURL(output.FileID)
+			return err
+		}
+
+		headers := make(map[string]string)
+		headers["X-Bz-Part-Number"] = strconv.Itoa(index + 1)
+		return partClient.upload(&uploadURL, &uploadToken, getUploadPartURL, headers, part,
+			options.getPartRateLimit(rateLimit))
+	})
+
+	if err != nil {
+		client.cancelLargeFile(output.FileID)
+		return err
+	}
+
+	finishInput := make(map[string]interface{})
+	finishInput["fileId"] = output.FileID
+	finishInput["partSha1Array"] = hashes
+
+	url = client.APIURL + "/b2api/v1/b2_finish_large_file"
+	readCloser, _, _, err = client.call(url, http.MethodPost, make(map[string]string), finishInput)
+	if err != nil {
+		client.cancelLargeFile(output.FileID)
+		return err
+	}
+
+	readCloser.Close()
+	return nil
+}
+
+func (client *B2Client) getUploadPartURL(fileID string) (uploadURL string, uploadToken string, err error) {
+	input := make(map[string]string)
+	input["fileId"] = fileID
+
+	url := client.APIURL + "/b2api/v1/b2_get_upload_part_url"
+	readCloser, _, _, err := client.call(url, http.MethodPost, make(map[string]string), input)
+	if err != nil {
+		return "", "", err
+	}
+
+	defer readCloser.Close()
+
+	output := &B2GetUploadArgumentOutput{}
+
+	if err = json.NewDecoder(readCloser).Decode(&output); err != nil {
+		return "", "", err
+	}
+
+	return output.UploadURL, output.AuthorizationToken, nil
+}
+
+func (client *B2Client) cancelLargeFile(fileID string) {
+	input := make(map[string]string)
+	input["fileId"] = fileID
+
+	url := client.APIURL + "/b2api/v1/b2_cancel_large_file"
+	readCloser, _, _, err := client.call(url, http.MethodPost, make(map[string]string), input)
+	if err != nil {
+		LOG_WARN("BACKBLAZE_UPLOAD", "Failed to cancel the large file %s: %v", fileID, err)
+		return
+	}
+	readCloser.Close()
+}
@@ -5,17 +5,23 @@
 package duplicacy
 
 import (
+	"fmt"
 	"strings"
 )
 
 type B2Storage struct {
 	StorageBase
 
-	clients []*B2Client
+	clients    []*B2Client
+	storageDir string // The prefix of all file names, either empty or ending with '/'
+	multipart  MultipartOptions
 }
 
-// CreateB2Storage creates a B2 storage object.
-func CreateB2Storage(accountID string, applicationKey string, bucket string, threads int) (storage *B2Storage, err error) {
+// CreateB2Storage creates a B2 storage object.  Files are stored at the root of the bucket, unless the application
+// key is restricted to a name prefix, in which case they are stored under 'storageDir'.  'storageDir' must then be
+// under that prefix, and defaults to it.
+func CreateB2Storage(accountID string, applicationKey string, bucket string, storageDir string,
+	threads int) (storage *B2Storage, err error) {
 
 	var clients []*B2Client
 
@@ -35,8 +41,40 @@ func CreateB2Storage(accountID string, applicationKey string, bucket string, thr
 		clients = append(clients, client)
 	}
 
+	for len(storageDir) > 0 && storageDir[len(storageDir)-1] == '/' {
+		storageDir = storageDir[:len(storageDir)-1]
+	}
+	if storageDir != "" {
+		storageDir += "/"
+	}
+
+	allowedPrefix := clients[0].AllowedPrefix
+	if allowedPrefix == "" {
+		// The directory in the storage url has always been ignored; using it now would hide existing storages
+		if storageDir != "" {
+			LOG_DEBUG("BACKBLAZE_PREFIX", "Ignoring the directory %s as the application key is not restricted to it",
+				storageDir)
+		}
+		storageDir = ""
+	} else {
+		if storageDir == "" {
+			storageDir = allowedPrefix
+			if !strings.HasSuffix(storageDir, "/") {
+				storageDir += "/"
+			}
+			LOG_INFO("BACKBLAZE_PREFIX", "Using the directory %s which the application key is restricted to", storageDir)
+		} else if !strings.HasPrefix(storageDir, allowedPrefix) {
+			return nil, fmt.Errorf("The application key is restricted to files starting with %s", allowedPrefix)
+		}
+	}
+
 	storage = &B2Storage{
-		clients: clients,
+		clients:    clients,
+		storageDir: storageDir,
+	}
+
+	for _, client := range clients {
+		client.ThrottlingFunc = storage.RecordThrottling
 	}
 
 	storage.DerivedStorage = storage
@@ -49,14 +87,14 @@ func (storage *B2Storage) ListFiles(threadIndex int, dir string) (files []string
 	for len(dir) > 0 && dir[len(dir)-1] == '/' {
 		dir = dir[:len(dir)-1]
 	}
-	length := len(dir) + 1
+	length := len(storage.storageDir) + len(dir) + 1
 
 	includeVersions := false
 	if dir == "chunks" {
 		includeVersions = true
 	}
 
-	entries, err := storage.clients[threadIndex].ListFileNames(dir, false, includeVersions)
+	entries, err := storage.clients[threadIndex].ListFileNames(storage.storageDir+dir, false, includeVersions)
 	if err != nil {
 		return nil, nil, err
 	}
@@ -100,6 +138,8 @@ func (storage *B2Storage) ListFiles(threadIndex int, dir string) (files []string
 // DeleteFile deletes the file or directory at 'filePath'.
 func (storage *B2Storage) DeleteFile(threadIndex int, filePath string) (err error) {
 
+	filePath = storage.storageDir + filePath
+
 	if strings.HasSuffix(filePath, ".fsl") {
 		filePath = filePath[:len(filePath)-len(".fsl")]
 		entries, err := storage.clients[threadIndex].ListFileNames(filePath, true, true)
@@ -140,6 +180,9 @@ func (storage *B2Storage) DeleteFile(threadIndex int, filePath string) (err erro
 // MoveFile renames the file.
 func (storage *B2Storage) MoveFile(threadIndex int, from string, to string) (err error) {
 
+	from = storage.storageDir + from
+	to = storage.storageDir + to
+
 	filePath := ""
 
 	if strings.HasSuffix(from, ".fsl") {
@@ -182,6 +225,7 @@ func (storage *B2Storage) CreateDirectory(threadIndex int, dir string) (err erro
 
 // GetFileInfo returns the information about the file or directory at 'filePath'.
 func (storage *B2Storage) GetFileInfo(threadIndex int, filePath string) (exist bool, isDir bool, size int64, err error) {
+	filePath = storage.storageDir + filePath
 	isFossil := false
 	if strings.HasSuffix(filePath, ".fsl") {
 		isFossil = true
@@ -210,7 +254,7 @@ func (storage *B2Storage) GetFileInfo(threadIndex int, filePath string) (exist b
 // DownloadFile reads the file at 'filePath' into the chunk.
 func (storage *B2Storage) DownloadFile(threadIndex int, filePath string, chunk *Chunk) (err error) {
 
-	filePath = strings.Replace(filePath, " ", "%20", -1)
+	filePath = strings.Replace(storage.storageDir+filePath, " ", "%20", -1)
 	readCloser, _, err := storage.clients[threadIndex].DownloadFile(filePath)
 	if err != nil {
 		return err
@@ -224,8 +268,18 @@ func (storage *B2Storage) DownloadFile(threadIndex int, filePath string, chunk *
 
 // UploadFile writes 'content' to the file at 'filePath'.
 func (storage *B2Storage) UploadFile(threadIndex int, filePath string, content []byte) (err error) {
-	filePath = strings.Replace(filePath, " ", "%20", -1)
-	return storage.clients[threadIndex].UploadFile(filePath, content, storage.UploadRateLimit/len(storage.clients))
+	filePath = storage.storageDir + filePath
+	rateLimit := storage.UploadRateLimit / len(storage.clients)
+	if storage.multipart.isMultipart(int64(len(content))) {
+		return storage.clients[threadIndex].UploadLargeFile(filePath, content, rateLimit, storage.multipart)
+	}
+	return storage.clients[threadIndex].UploadFile(filePath, content, rateLimit)
+}
+
+// SetMultipartOptions sets the part size and the number of parallel part uploads for files uploaded with the large
+// file API.
+func (storage *B2Storage) SetMultipartOptions(options MultipartOptions) {
+	storage.multipart = options
 }
 
 // If a local snapshot cache is needed for the storage to avoid downloading/uploading chunks too often when
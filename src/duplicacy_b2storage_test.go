@@ -0,0 +1,369 @@
+// Copyright (c) Acrosync LLC. All rights reserved.
+// Free for personal use and commercial trial
+// Commercial use requires per-user licenses available from https://duplicacy.com
+
+package duplicacy
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// b2TestFile is a version of a file, or a hide marker, kept by the B2 stand-in.
+type b2TestFile struct {
+	FileID          string `json:"fileId"`
+	FileName        string `json:"fileName"`
+	Action          string `json:"action"`
+	Size            int64  `json:"size"`
+	UploadTimestamp int64  `json:"uploadTimestamp"`
+	content         []byte
+}
+
+// b2TestServer is a minimal in-memory implementation of the B2 API, with an application key restricted to a bucket
+// and a name prefix.  Requests for files outside the prefix are recorded as violations.
+type b2TestServer struct {
+	server     *httptest.Server
+	lock       sync.Mutex
+	bucket     string
+	prefix     string
+	files      []*b2TestFile
+	largeFiles map[string]map[int][]byte
+	largeNames map[string]string
+	nextID     int
+	violations []string
+}
+
+func newB2TestServer(bucket string, prefix string) *b2TestServer {
+	b2 := &b2TestServer{
+		bucket:     bucket,
+		prefix:     prefix,
+		largeFiles: make(map[string]map[int][]byte),
+		largeNames: make(map[string]string),
+	}
+	b2.server = httptest.NewServer(http.HandlerFunc(b2.handle))
+	return b2
+}
+
+func (b2 *b2TestServer) checkName(name string) {
+	if !strings.HasPrefix(name, b2.prefix) {
+		b2.violations = append(b2.violations, name)
+	}
+}
+
+func (b2 *b2TestServer) addFile(name string, action string, content []byte) *b2TestFile {
+	b2.nextID++
+	file := &b2TestFile{
+		FileID:          fmt.Sprintf("id%d", b2.nextID),
+		FileName:        name,
+		Action:          action,
+		Size:            int64(len(content)),
+		UploadTimestamp: int64(b2.nextID),
+		content:         content,
+	}
+	b2.files = append(b2.files, file)
+	return file
+}
+
+// versions returns all versions sorted by name, with the newest version of each file first.
+func (b2 *b2TestServer) versions() []*b2TestFile {
+	versions := append([]*b2TestFile{}, b2.files...)
+	sort.Slice(versions, func(i, j int) bool {
+		if versions[i].FileName != versions[j].FileName {
+			return versions[i].FileName < versions[j].FileName
+		}
+		return versions[i].UploadTimestamp > versions[j].UploadTimestamp
+	})
+	return versions
+}
+
+// latest returns the newest version of the file, or nil if the file doesn't exist or is hidden.
+func (b2 *b2TestServer) latest(name string) *b2TestFile {
+	var latest *b2TestFile
+	for _, file := range b2.files {
+		if file.FileName == name {
+			latest = file
+		}
+	}
+	if latest == nil || latest.Action != "upload" {
+		return nil
+	}
+	return latest
+}
+
+func (b2 *b2TestServer) handle(writer http.ResponseWriter, request *http.Request) {
+	b2.lock.Lock()
+	defer b2.lock.Unlock()
+
+	body, _ := ioutil.ReadAll(request.Body)
+	input := make(map[string]interface{})
+	json.Unmarshal(body, &input)
+	getString := func(key string) string {
+		value, _ := input[key].(string)
+		return value
+	}
+
+	output := make(map[string]interface{})
+	api := strings.TrimPrefix(request.URL.Path, "/b2api/v1/")
+
+	switch {
+	case api == "b2_authorize_account":
+		output["accountId"] = "account"
+		output["authorizationToken"] = "token"
+		output["apiUrl"] = b2.server.URL
+		output["downloadUrl"] = b2.server.URL
+		output["absoluteMinimumPartSize"] = MinimumPartSize
+		output["allowed"] = map[string]string{"bucketId": "bucketid", "bucketName": b2.bucket, "namePrefix": b2.prefix}
+
+	case api == "b2_list_file_names" || api == "b2_list_file_versions":
+		prefix := getString("prefix")
+		b2.checkName(prefix)
+		startFileName := getString("startFileName")
+		startFileID := getString("startFileId")
+		maxFileCount := int(input["maxFileCount"].(float64))
+
+		var files []*b2TestFile
+		for _, file := range b2.versions() {
+			if !strings.HasPrefix(file.FileName, prefix) || file.FileName < startFileName {
+				continue
+			}
+			if api == "b2_list_file_names" && b2.latest(file.FileName) != file {
+				continue
+			}
+			if startFileID != "" && file.FileName == startFileName {
+				if file.FileID != startFileID {
+					continue
+				}
+				startFileID = ""
+			}
+			files = append(files, file)
+		}
+
+		output["nextFileName"] = ""
+		if len(files) > maxFileCount {
+			output["nextFileName"] = files[maxFileCount].FileName
+			output["nextFileId"] = files[maxFileCount].FileID
+			files = files[:maxFileCount]
+		}
+		output["files"] = files
+
+	case api == "b2_get_upload_url":
+		output["uploadUrl"] = b2.server.URL + "/upload"
+		output["authorizationToken"] = "uploadtoken"
+
+	case request.URL.Path == "/upload":
+		name, _ := url.PathUnescape(request.Header.Get("X-Bz-File-Name"))
+		b2.checkName(name)
+		hash := sha1.Sum(body)
+		if hex.EncodeToString(hash[:]) != request.Header.Get("X-Bz-Content-Sha1") {
+			http.Error(writer, "{\"status\": 400, \"message\": \"sha1 mismatch\"}", http.StatusBadRequest)
+			return
+		}
+		b2.addFile(name, "upload", body)
+
+	case api == "b2_hide_file":
+		b2.checkName(getString("fileName"))
+		output["fileId"] = b2.addFile(getString("fileName"), "hide", nil).FileID
+
+	case api == "b2_delete_file_version":
+		b2.checkName(getString("fileName"))
+		for i, file := range b2.files {
+			if file.FileID == getString("fileId") {
+				b2.files = append(b2.files[:i], b2.files[i+1:]...)
+				break
+			}
+		}
+
+	case api == "b2_start_large_file":
+		b2.checkName(getString("fileName"))
+		b2.nextID++
+		fileID := fmt.Sprintf("large%d", b2.nextID)
+		b2.largeFiles[fileID] = make(map[int][]byte)
+		b2.largeNames[fileID] = getString("fileName")
+		output["fileId"] = fileID
+
+	case api == "b2_get_upload_part_url":
+		output["uploadUrl"] = b2.server.URL + "/upload_part/" + getString("fileId")
+		output["authorizationToken"] = "parttoken"
+
+	case strings.HasPrefix(request.URL.Path, "/upload_part/"):
+		parts := b2.largeFiles[strings.TrimPrefix(request.URL.Path, "/upload_part/")]
+		partNumber, _ := strconv.Atoi(request.Header.Get("X-Bz-Part-Number"))
+		hash := sha1.Sum(body)
+		if parts == nil || hex.EncodeToString(hash[:]) != request.Header.Get("X-Bz-Content-Sha1") {
+			http.Error(writer, "{\"status\": 400, \"message\": \"invalid part\"}", http.StatusBadRequest)
+			return
+		}
+		parts[partNumber] = body
+
+	case api == "b2_finish_large_file":
+		fileID := getString("fileId")
+		parts := b2.largeFiles[fileID]
+		hashes, _ := input["partSha1Array"].([]interface{})
+		var content []byte
+		for i := range hashes {
+			hash := sha1.Sum(parts[i+1])
+			if hex.EncodeToString(hash[:]) != hashes[i] {
+				http.Error(writer, "{\"status\": 400, \"message\": \"part sha1 mismatch\"}", http.StatusBadRequest)
+				return
+			}
+			content = append(content, parts[i+1]...)
+		}
+		b2.addFile(b2.largeNames[fileID], "upload", content)
+		delete(b2.largeFiles, fileID)
+
+	case api == "b2_cancel_large_file":
+		delete(b2.largeFiles, getString("fileId"))
+
+	case strings.HasPrefix(request.URL.Path, "/file/"+b2.bucket+"/"):
+		name := strings.TrimPrefix(request.URL.Path, "/file/"+b2.bucket+"/")
+		b2.checkName(name)
+		file := b2.latest(name)
+		if file == nil {
+			http.Error(writer, "{\"status\": 404, \"message\": \"not found\"}", http.StatusNotFound)
+			return
+		}
+		writer.Header().Set("X-Bz-File-Id", file.FileID)
+		writer.Header().Set("X-Bz-File-Name", file.FileName)
+		writer.Header().Set("X-Bz-Upload-Timestamp", strconv.FormatInt(file.UploadTimestamp, 10))
+		if request.Method == http.MethodHead {
+			if file.Size > 0 {
+				writer.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", file.Size-1, file.Size-1, file.Size))
+				writer.Header().Set("Content-Length", "1")
+				writer.WriteHeader(http.StatusPartialContent)
+			}
+			return
+		}
+		writer.Write(file.content)
+		return
+
+	default:
+		http.Error(writer, "{\"status\": 400, \"message\": \"unknown request\"}", http.StatusBadRequest)
+		return
+	}
+
+	json.NewEncoder(writer).Encode(output)
+}
+
+func TestB2StorageWithRestrictedKey(t *testing.T) {
+
+	setTestingT(t)
+
+	b2 := newB2TestServer("bucket", "repository1/")
+	defer b2.server.Close()
+
+	defaultAuthorizationURL := B2AuthorizationURL
+	B2AuthorizationURL = b2.server.URL + "/b2api/v1/b2_authorize_account"
+	defer func() { B2AuthorizationURL = defaultAuthorizationURL }()
+
+	if _, err := CreateB2Storage("keyid", "key", "otherbucket", "", 1); err == nil {
+		t.Errorf("A bucket not allowed by the application key was accepted")
+	}
+	if _, err := CreateB2Storage("keyid", "key", "bucket", "repository2", 1); err == nil {
+		t.Errorf("A directory not allowed by the application key was accepted")
+	}
+
+	unrestricted := newB2TestServer("bucket", "")
+	defer unrestricted.server.Close()
+	B2AuthorizationURL = unrestricted.server.URL + "/b2api/v1/b2_authorize_account"
+	if storage, err := CreateB2Storage("keyid", "key", "bucket", "repository1", 1); err != nil || storage.storageDir != "" {
+		t.Errorf("The directory should be ignored for an unrestricted key: %v", err)
+	}
+	B2AuthorizationURL = b2.server.URL + "/b2api/v1/b2_authorize_account"
+
+	storage, err := CreateB2Storage("keyid", "key", "bucket", "", 2)
+	if err != nil {
+		t.Errorf("Failed to create the storage: %v", err)
+		return
+	}
+	if storage.storageDir != "repository1/" {
+		t.Errorf("The storage directory is '%s'", storage.storageDir)
+	}
+
+	options, _ := CreateMultipartOptions(MinimumPartSize/1024/1024, 2)
+	storage.SetMultipartOptions(options)
+
+	small := []byte("small chunk")
+	large := make([]byte, MinimumPartSize*2+1000)
+	rand.Read(large)
+
+	if err = storage.UploadFile(0, "chunks/small", small); err != nil {
+		t.Errorf("Failed to upload the small chunk: %v", err)
+	}
+	if err = storage.UploadFile(1, "chunks/large", large); err != nil {
+		t.Errorf("Failed to upload the large chunk: %v", err)
+	}
+	if err = storage.UploadFile(0, "snapshots/id/1", small); err != nil {
+		t.Errorf("Failed to upload the snapshot file: %v", err)
+	}
+
+	if len(b2.largeNames) != 1 || len(b2.largeFiles) != 0 {
+		t.Errorf("The large chunk was not uploaded with the large file API")
+	}
+
+	chunk := CreateChunk(CreateConfig(), true)
+	chunk.Reset(false)
+	if err = storage.DownloadFile(0, "chunks/large", chunk); err != nil || !bytes.Equal(chunk.GetBytes(), large) {
+		t.Errorf("The large chunk was not downloaded correctly: %v", err)
+	}
+
+	files, sizes, err := storage.ListFiles(0, "chunks/")
+	if err != nil || strings.Join(files, ",") != "large,small" || sizes[0] != int64(len(large)) {
+		t.Errorf("Incorrect chunk listing: %v %v %v", files, sizes, err)
+	}
+
+	files, _, err = storage.ListFiles(0, "snapshots/")
+	if err != nil || len(files) != 1 || files[0] != "id/" {
+		t.Errorf("Incorrect snapshot listing: %v %v", files, err)
+	}
+
+	if err = storage.MoveFile(0, "chunks/small", "chunks/small.fsl"); err != nil {
+		t.Errorf("Failed to turn the chunk into a fossil: %v", err)
+	}
+
+	if exist, _, _, _ := storage.GetFileInfo(0, "chunks/small"); exist {
+		t.Errorf("The fossilized chunk still exists")
+	}
+	if exist, _, _, _ := storage.GetFileInfo(0, "chunks/small.fsl"); !exist {
+		t.Errorf("The fossil doesn't exist")
+	}
+
+	files, _, _ = storage.ListFiles(0, "chunks/")
+	if strings.Join(files, ",") != "large,small.fsl" {
+		t.Errorf("Incorrect chunk listing after fossilization: %v", files)
+	}
+
+	if err = storage.DeleteFile(0, "chunks/small.fsl"); err != nil {
+		t.Errorf("Failed to delete the fossil: %v", err)
+	}
+	if err = storage.DeleteFile(0, "chunks/large"); err != nil {
+		t.Errorf("Failed to delete the large chunk: %v", err)
+	}
+
+	files, _, _ = storage.ListFiles(0, "chunks/")
+	if len(files) != 0 {
+		t.Errorf("Files left after deletion: %v", files)
+	}
+
+	for _, file := range b2.files {
+		if !strings.HasPrefix(file.FileName, "repository1/snapshots/") {
+			t.Errorf("Unexpected file %s left in the bucket", file.FileName)
+		}
+	}
+
+	if len(b2.violations) > 0 {
+		t.Errorf("Files outside the allowed prefix were accessed: %v", b2.violations)
+	}
+}
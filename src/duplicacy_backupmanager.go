@@ -35,12 +35,65 @@ type BackupManager struct {
 	config *Config // contains a number of options
 	
 	nobackupFile string // don't backup directory when this file name is found
+
+	ownerMapping *OwnerMapping // how uids/gids saved in snapshots are mapped on restore
+
+	resumeRestore  bool            // continue the previous restore recorded in the journal
+	restoreJournal *RestoreJournal // records the progress of the current restore
+
+	maximumThreads int // the number of transfer threads can grow up to this if larger than the number requested
+
+	readRateLimit int     // maximum rate of reading files during backup in kilobytes/sec; 0 means unlimited
+	maximumLoad   float64 // reading files pauses while the system load is above this if positive
+
+	snapshotVersion int // the format of new snapshots; SNAPSHOT_VERSION_TREE or SNAPSHOT_VERSION_FILE_LIST
 }
 
 func (manager *BackupManager) SetDryRun(dryRun bool) {
 	manager.config.dryRun = dryRun
 }
 
+// SetResumeRestore makes the next restore continue from where the previous one of the same revision stopped.
+func (manager *BackupManager) SetResumeRestore(resume bool) {
+	manager.resumeRestore = resume
+}
+
+// SetOwnerMapping sets how the ownership of restored files is decided.  If not set, the uid and gid saved in the
+// snapshot are used as is.
+func (manager *BackupManager) SetOwnerMapping(mapping *OwnerMapping) {
+	manager.ownerMapping = mapping
+}
+
+// SetMaximumThreads enables adaptive threads: uploads and downloads start with the number of threads requested and
+// may use up to 'maximumThreads' as long as the storage keeps up.  The storage must have been created with at least
+// 'maximumThreads' threads.
+func (manager *BackupManager) SetMaximumThreads(maximumThreads int) {
+	manager.maximumThreads = maximumThreads
+}
+
+// SetReadThrottling limits how fast files are read during backup, separately from the upload rate, and makes reading
+// pause while the system load is above 'maximumLoad'.  A value of 0 disables either one.
+func (manager *BackupManager) SetReadThrottling(readRateLimit int, maximumLoad float64) {
+	manager.readRateLimit = readRateLimit
+	manager.maximumLoad = maximumLoad
+}
+
+// SetSnapshotVersion sets the format of the file list in new snapshots.  Version 2 snapshots store the file list as a
+// directory tree which can be partially loaded, but can't be read by older versions.
+func (manager *BackupManager) SetSnapshotVersion(version int) {
+	manager.snapshotVersion = version
+}
+
+// createThreadController returns the number of transfer goroutines to start and the controller deciding how many of
+// them are active, which is nil if adaptive threads are not enabled.
+func (manager *BackupManager) createThreadController(storage Storage, operation string,
+	threads int) (int, *ThreadController) {
+	if manager.maximumThreads <= threads {
+		return threads, nil
+	}
+	return manager.maximumThreads, CreateThreadController(storage, operation, threads, manager.maximumThreads)
+}
+
 // CreateBackupManager creates a backup manager using the specified 'storage'.  'snapshotID' is a unique id to
 // identify snapshots created for this repository.  'top' is the top directory of the repository.  'password' is the
 // master key which can be nil if encryption is not enabled.
@@ -408,7 +461,10 @@ func (manager *BackupManager) Backup(top string, quickMode bool, threads int, ta
 	}
 
 	chunkMaker := CreateChunkMaker(manager.config, false)
-	chunkUploader := CreateChunkUploader(manager.config, manager.storage, nil, threads, nil)
+	chunkMaker.SetReadThrottling(manager.readRateLimit, manager.maximumLoad)
+	uploadThreads, threadController := manager.createThreadController(manager.storage, "upload", threads)
+	chunkUploader := CreateChunkUploader(manager.config, manager.storage, nil, uploadThreads, nil)
+	chunkUploader.SetThreadController(threadController)
 
 	localSnapshotReady := false
 	var once sync.Once
@@ -621,6 +677,9 @@ func (manager *BackupManager) Backup(top string, quickMode bool, threads int, ta
 	}
 
 	localSnapshot.FileSize = preservedFileSize + uploadedFileSize
+	if manager.snapshotVersion >= SNAPSHOT_VERSION_TREE {
+		localSnapshot.Version = SNAPSHOT_VERSION_TREE
+	}
 	localSnapshot.NumberOfFiles = int64(len(preservedEntries) + len(uploadedEntries))
 
 	totalSnapshotChunkLength, numberOfNewSnapshotChunks,
@@ -651,7 +710,7 @@ func (manager *BackupManager) Backup(top string, quickMode bool, threads int, ta
 	RemoveIncompleteSnapshot()
 
 	totalSnapshotChunks := len(localSnapshot.FileSequence) + len(localSnapshot.ChunkSequence) +
-		len(localSnapshot.LengthSequence)
+		len(localSnapshot.LengthSequence) + len(localSnapshot.IndexSequence) + len(localSnapshot.TreeSequence)
 	if showStatistics {
 
 		LOG_INFO("BACKUP_STATS", "Files: %d total, %s bytes; %d new, %s bytes",
@@ -681,6 +740,7 @@ func (manager *BackupManager) Backup(top string, quickMode bool, threads int, ta
 			now = startTime + 1
 		}
 		LOG_INFO("BACKUP_STATS", "Total running time: %s", PrettyTime(now-startTime))
+		logChunkMemoryStatistics("BACKUP_STATS")
 	}
 
 	skipped := ""
@@ -759,6 +819,9 @@ func (manager *BackupManager) Restore(top string, revision int, inPlace bool, qu
 
 	remoteSnapshot := manager.SnapshotManager.DownloadSnapshot(manager.snapshotID, revision)
 	manager.SnapshotManager.DownloadSnapshotContents(remoteSnapshot, patterns, true)
+	if setOwner {
+		manager.ownerMapping.Apply(remoteSnapshot.Files)
+	}
 
 	localSnapshot, _, _, err := CreateSnapshotFromDirectory(manager.snapshotID, top, manager.nobackupFile)
 	if err != nil {
@@ -768,6 +831,11 @@ func (manager *BackupManager) Restore(top string, revision int, inPlace bool, qu
 
 	LOG_INFO("RESTORE_START", "Restoring %s to revision %d", top, revision)
 
+	manager.restoreJournal = CreateRestoreJournal(manager.snapshotID, revision, top, manager.resumeRestore)
+	defer func() {
+		manager.restoreJournal = nil
+	}()
+
 	var includedFiles []*Entry
 
 	// Include/exclude some files if needed
@@ -789,7 +857,6 @@ func (manager *BackupManager) Restore(top string, revision int, inPlace bool, qu
 	fileEntries := make([]*Entry, 0, len(remoteSnapshot.Files)/2)
 
 	var totalFileSize int64
-	var downloadedFileSize int64
 
 	i := 0
 	for _, entry := range remoteSnapshot.Files {
@@ -818,43 +885,10 @@ func (manager *BackupManager) Restore(top string, revision int, inPlace bool, qu
 			continue
 		}
 
-		fullPath := joinPath(top, entry.Path)
-		if entry.IsLink() {
-			stat, err := os.Lstat(fullPath)
-			if stat != nil {
-				if stat.Mode()&os.ModeSymlink != 0 {
-					isRegular, link, err := Readlink(fullPath)
-					if err == nil && link == entry.Link && !isRegular {
-						continue
-					}
-				}
-
-				os.Remove(fullPath)
-			}
-
-			err = os.Symlink(entry.Link, fullPath)
-			if err != nil {
-				LOG_ERROR("RESTORE_SYMLINK", "Can't create symlink %s: %v", entry.Path, err)
-				return false
-			}
-			LOG_TRACE("DOWNLOAD_DONE", "Symlink %s updated", entry.Path)
-		} else if entry.IsDir() {
-			stat, err := os.Stat(fullPath)
-
-			if err == nil && !stat.IsDir() {
-				LOG_ERROR("RESTORE_NOTDIR", "The path %s is not a directory", fullPath)
+		if entry.IsLink() || entry.IsDir() {
+			if !manager.restoreLinkOrDirectory(top, entry) {
 				return false
 			}
-
-			if os.IsNotExist(err) {
-				// In the first pass of directories, set the directory to be user readable so we can create new files
-				// under it.
-				err = os.MkdirAll(fullPath, 0700)
-				if err != nil && !os.IsExist(err) {
-					LOG_ERROR("RESTORE_MKDIR", "%v", err)
-					return false
-				}
-			}
 		} else {
 			// We can't download files here since fileEntries needs to be sorted
 			fileEntries = append(fileEntries, entry)
@@ -870,19 +904,313 @@ func (manager *BackupManager) Restore(top string, revision int, inPlace bool, qu
 	// Sort entries by their starting chunks in order to linearize the access to the chunk chain.
 	sort.Sort(ByChunk(fileEntries))
 
-	chunkDownloader := CreateChunkDownloader(manager.config, manager.storage, nil, showStatistics, threads)
+	downloadThreads, threadController := manager.createThreadController(manager.storage, "download", threads)
+	chunkDownloader := CreateChunkDownloaderWithController(manager.config, manager.storage, nil, showStatistics,
+		downloadThreads, threadController)
 	chunkDownloader.AddFiles(remoteSnapshot, fileEntries)
 
 	chunkMaker := CreateChunkMaker(manager.config, true)
 
 	startDownloadingTime := time.Now().Unix()
 
+	downloadedFiles, downloadedFileSize, ok := manager.restoreFiles(chunkDownloader, chunkMaker, fileEntries, top,
+		inPlace, quickMode, overwrite, setOwner, showStatistics, totalFileSize, 0, startDownloadingTime)
+	if !ok {
+		return false
+	}
+
+	if deleteMode && len(patterns) == 0 {
+		// Reverse the order to make sure directories are empty before being deleted
+		for i := range extraFiles {
+			file := extraFiles[len(extraFiles)-1-i]
+			fullPath := joinPath(top, file)
+			os.Remove(fullPath)
+			LOG_INFO("RESTORE_DELETE", "Deleted %s", file)
+		}
+	}
+
+	manager.restoreDirectoryMetadata(top, remoteSnapshot.Files, setOwner)
+
+	if showStatistics {
+		for _, file := range downloadedFiles {
+			LOG_INFO("DOWNLOAD_DONE", "Downloaded %s (%d)", file.Path, file.Size)
+		}
+	}
+
+	manager.restoreJournal.Remove()
+
+	LOG_INFO("RESTORE_END", "Restored %s to revision %d", top, revision)
+	if showStatistics {
+		LOG_INFO("RESTORE_STATS", "Files: %d total, %s bytes", len(fileEntries), PrettySize(totalFileSize))
+		LOG_INFO("RESTORE_STATS", "Downloaded %d file, %s bytes, %d chunks",
+			len(downloadedFiles), PrettySize(downloadedFileSize), chunkDownloader.numberOfDownloadedChunks)
+		logChunkMemoryStatistics("RESTORE_STATS")
+	}
+
+	runningTime := time.Now().Unix() - startTime
+	if runningTime == 0 {
+		runningTime = 1
+	}
+
+	LOG_INFO("RESTORE_STATS", "Total running time: %s", PrettyTime(runningTime))
+
+	chunkDownloader.Stop()
+
+	return true
+}
+
+// MergeRestore restores files from several revisions at once.  For each path the version from the latest revision
+// whose chunks all exist in the storage is picked, so files lost or damaged in newer revisions can be recovered from
+// older ones.  Local files not found in any of these revisions are left untouched.
+func (manager *BackupManager) MergeRestore(top string, revisions []int, quickMode bool, threads int, overwrite bool,
+	setOwner bool, showStatistics bool, patterns []string) bool {
+
+	startTime := time.Now().Unix()
+
+	LOG_DEBUG("RESTORE_PARAMETERS", "top: %s, revisions: %v, quick: %t", top, revisions, quickMode)
+
+	if len(revisions) == 0 {
+		LOG_ERROR("RESTORE_MERGE", "No revisions are specified for merging")
+		return false
+	}
+
+	_, err := os.Stat(top)
+	if os.IsNotExist(err) {
+		err = os.Mkdir(top, 0744)
+		if err != nil {
+			LOG_ERROR("RESTORE_MKDIR", "Can't create the directory to be restored: %v", err)
+			return false
+		}
+	}
+
+	err = os.Mkdir(path.Join(top, DUPLICACY_DIRECTORY), 0744)
+	if err != nil && !os.IsExist(err) {
+		LOG_ERROR("RESTORE_MKDIR", "Failed to create the preference directory: %v", err)
+		return false
+	}
+
+	LOG_INFO("RESTORE_MERGE", "Listing all chunks")
+	existingChunks := make(map[string]bool)
+	allChunks, _ := manager.SnapshotManager.ListAllFiles(manager.storage, chunkDir)
+	for _, chunk := range allChunks {
+		if len(chunk) == 0 || chunk[len(chunk)-1] == '/' {
+			continue
+		}
+		// Fossils are resurrected by the chunk downloader when needed so they count as available chunks
+		chunk = strings.Replace(chunk, "/", "", -1)
+		chunk = strings.Replace(chunk, ".fsl", "", -1)
+		existingChunks[chunk] = true
+	}
+
+	sortedRevisions := make([]int, len(revisions))
+	copy(sortedRevisions, revisions)
+	sort.Sort(sort.Reverse(sort.IntSlice(sortedRevisions)))
+
+	// The version chosen for each path and the snapshot it belongs to
+	selectedEntries := make(map[string]*Entry)
+	selectedSnapshots := make(map[string]*Snapshot)
+	// Paths with at least one version that can't be restored
+	damagedPaths := make(map[string]bool)
+
+	var snapshots []*Snapshot
+	for _, revision := range sortedRevisions {
+		snapshot := manager.SnapshotManager.DownloadSnapshot(manager.snapshotID, revision)
+		if snapshot == nil {
+			continue
+		}
+		manager.SnapshotManager.DownloadSnapshotContents(snapshot, patterns, true)
+		if setOwner {
+			manager.ownerMapping.Apply(snapshot.Files)
+		}
+		snapshots = append(snapshots, snapshot)
+
+		damagedFiles := 0
+		for _, entry := range snapshot.Files {
+			if len(patterns) > 0 && !MatchPath(entry.Path, patterns) {
+				continue
+			}
+			if _, found := selectedEntries[entry.Path]; found {
+				continue
+			}
+			if entry.IsFile() && entry.Size > 0 && !manager.isEntryAvailable(snapshot, entry, existingChunks) {
+				LOG_DEBUG("RESTORE_MISSING", "File %s at revision %d has missing chunks", entry.Path, revision)
+				damagedPaths[entry.Path] = true
+				damagedFiles++
+				continue
+			}
+			selectedEntries[entry.Path] = entry
+			selectedSnapshots[entry.Path] = snapshot
+		}
+
+		if damagedFiles > 0 {
+			LOG_INFO("RESTORE_MISSING", "%d files at revision %d have missing chunks", damagedFiles, revision)
+		}
+	}
+
+	for damagedPath := range damagedPaths {
+		if _, found := selectedEntries[damagedPath]; !found {
+			LOG_WARN("RESTORE_UNAVAILABLE", "No revision has a complete copy of %s", damagedPath)
+		} else if IsTracing() {
+			LOG_TRACE("RESTORE_FALLBACK", "%s will be restored from revision %d", damagedPath,
+				selectedSnapshots[damagedPath].Revision)
+		}
+	}
+
+	entries := make([]*Entry, 0, len(selectedEntries))
+	for _, entry := range selectedEntries {
+		entries = append(entries, entry)
+	}
+	sort.Sort(ByName(entries))
+
+	LOG_INFO("RESTORE_START", "Restoring %s from revisions %v", top, sortedRevisions)
+
+	var totalFileSize int64
+	numberOfFiles := 0
+	for _, entry := range entries {
+		if entry.IsLink() || entry.IsDir() {
+			if !manager.restoreLinkOrDirectory(top, entry) {
+				return false
+			}
+		} else if entry.IsFile() {
+			// The progress is reported against all files to be restored, regardless of the revisions they come from
+			numberOfFiles++
+			totalFileSize += entry.Size
+		}
+	}
+
+	var downloadedFileSize int64
 	var downloadedFiles []*Entry
-	// Now download files one by one
+	numberOfDownloadedChunks := 0
+
+	startDownloadingTime := time.Now().Unix()
+	chunkMaker := CreateChunkMaker(manager.config, true)
+
+	// Files are restored one revision at a time since chunk indices are only meaningful within the same snapshot
+	for _, snapshot := range snapshots {
+
+		var fileEntries []*Entry
+		for _, entry := range entries {
+			if selectedSnapshots[entry.Path] == snapshot && entry.IsFile() {
+				fileEntries = append(fileEntries, entry)
+			}
+		}
+
+		if len(fileEntries) == 0 {
+			continue
+		}
+
+		LOG_INFO("RESTORE_MERGE", "Restoring %d files from revision %d", len(fileEntries), snapshot.Revision)
+
+		sort.Sort(ByChunk(fileEntries))
+
+		downloadThreads, threadController := manager.createThreadController(manager.storage, "download", threads)
+		chunkDownloader := CreateChunkDownloaderWithController(manager.config, manager.storage, nil, showStatistics,
+			downloadThreads, threadController)
+		chunkDownloader.AddFiles(snapshot, fileEntries)
+
+		var restoredFiles []*Entry
+		var ok bool
+		restoredFiles, downloadedFileSize, ok = manager.restoreFiles(chunkDownloader, chunkMaker, fileEntries, top,
+			true, quickMode, overwrite, setOwner, showStatistics, totalFileSize, downloadedFileSize, startDownloadingTime)
+		downloadedFiles = append(downloadedFiles, restoredFiles...)
+		if !ok {
+			chunkDownloader.Stop()
+			return false
+		}
+
+		chunkDownloader.Stop()
+		numberOfDownloadedChunks += chunkDownloader.numberOfDownloadedChunks
+	}
+
+	manager.restoreDirectoryMetadata(top, entries, setOwner)
+
+	if showStatistics {
+		for _, file := range downloadedFiles {
+			LOG_INFO("DOWNLOAD_DONE", "Downloaded %s (%d)", file.Path, file.Size)
+		}
+	}
+
+	LOG_INFO("RESTORE_END", "Restored %s from revisions %v", top, sortedRevisions)
+	if showStatistics {
+		LOG_INFO("RESTORE_STATS", "Files: %d total, %s bytes", numberOfFiles, PrettySize(totalFileSize))
+		LOG_INFO("RESTORE_STATS", "Downloaded %d file, %s bytes, %d chunks",
+			len(downloadedFiles), PrettySize(downloadedFileSize), numberOfDownloadedChunks)
+		logChunkMemoryStatistics("RESTORE_STATS")
+	}
+
+	runningTime := time.Now().Unix() - startTime
+	if runningTime == 0 {
+		runningTime = 1
+	}
+
+	LOG_INFO("RESTORE_STATS", "Total running time: %s", PrettyTime(runningTime))
+
+	return true
+}
+
+// restoreLinkOrDirectory creates the symlink or the directory 'entry' under 'top'.  New directories are only made
+// user accessible so files can be created under them; their permissions are set by restoreDirectoryMetadata once all
+// files have been restored.
+func (manager *BackupManager) restoreLinkOrDirectory(top string, entry *Entry) bool {
+
+	fullPath := joinPath(top, entry.Path)
+	if entry.IsLink() {
+		stat, _ := os.Lstat(fullPath)
+		if stat != nil {
+			if stat.Mode()&os.ModeSymlink != 0 {
+				isRegular, link, err := Readlink(fullPath)
+				if err == nil && link == entry.Link && !isRegular {
+					return true
+				}
+			}
+
+			os.Remove(fullPath)
+		}
+
+		err := os.Symlink(entry.Link, fullPath)
+		if err != nil {
+			LOG_ERROR("RESTORE_SYMLINK", "Can't create symlink %s: %v", entry.Path, err)
+			return false
+		}
+		LOG_TRACE("DOWNLOAD_DONE", "Symlink %s updated", entry.Path)
+		return true
+	}
+
+	stat, err := os.Stat(fullPath)
+
+	if err == nil && !stat.IsDir() {
+		LOG_ERROR("RESTORE_NOTDIR", "The path %s is not a directory", fullPath)
+		return false
+	}
+
+	if os.IsNotExist(err) {
+		err = os.MkdirAll(fullPath, 0700)
+		if err != nil && !os.IsExist(err) {
+			LOG_ERROR("RESTORE_MKDIR", "%v", err)
+			return false
+		}
+	}
+	return true
+}
+
+// restoreFiles downloads the files in 'fileEntries', which must have been sorted by their starting chunks and added
+// to 'chunkDownloader', and then restores their metadata.  Files restored by a previous run, and unchanged files in
+// quick mode, are skipped.  'downloadedFileSize' is the number of bytes already downloaded out of 'totalFileSize',
+// and the updated number is returned along with the files actually downloaded.
+func (manager *BackupManager) restoreFiles(chunkDownloader *ChunkDownloader, chunkMaker *ChunkMaker,
+	fileEntries []*Entry, top string, inPlace bool, quickMode bool, overwrite bool, setOwner bool, showStatistics bool,
+	totalFileSize int64, downloadedFileSize int64, startDownloadingTime int64) (downloadedFiles []*Entry,
+	newDownloadedFileSize int64, ok bool) {
+
 	for _, file := range fileEntries {
 
 		fullPath := joinPath(top, file.Path)
 		stat, _ := os.Stat(fullPath)
+		if manager.restoreJournal.IsFileRestored(file.Path, stat) {
+			LOG_TRACE("RESTORE_SKIP", "File %s restored by the previous run", file.Path)
+			continue
+		}
+
 		if stat != nil {
 			if quickMode {
 				if file.IsSameAsFileInfo(stat) {
@@ -896,7 +1224,7 @@ func (manager *BackupManager) Restore(top string, revision int, inPlace bool, qu
 				continue
 			}
 		} else {
-			err = os.MkdirAll(path.Dir(fullPath), 0744)
+			err := os.MkdirAll(path.Dir(fullPath), 0744)
 			if err != nil {
 				LOG_ERROR("DOWNLOAD_MKDIR", "Failed to create directory: %v", err)
 			}
@@ -907,11 +1235,13 @@ func (manager *BackupManager) Restore(top string, revision int, inPlace bool, qu
 			newFile, err := os.OpenFile(fullPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, file.GetPermissions())
 			if err != nil {
 				LOG_ERROR("DOWNLOAD_OPEN", "Failed to create empty file: %v", err)
-				return false
+				return downloadedFiles, downloadedFileSize, false
 			}
 			newFile.Close()
 
 			file.RestoreMetadata(fullPath, nil, setOwner)
+			stat, _ = os.Stat(fullPath)
+			manager.restoreJournal.RecordFile(file.Path, stat)
 			if !showStatistics {
 				LOG_INFO("DOWNLOAD_DONE", "Downloaded %s (0)", file.Path)
 			}
@@ -925,47 +1255,31 @@ func (manager *BackupManager) Restore(top string, revision int, inPlace bool, qu
 			downloadedFiles = append(downloadedFiles, file)
 		}
 		file.RestoreMetadata(fullPath, nil, setOwner)
+		stat, _ = os.Stat(fullPath)
+		manager.restoreJournal.RecordFile(file.Path, stat)
 	}
 
-	if deleteMode && len(patterns) == 0 {
-		// Reverse the order to make sure directories are empty before being deleted
-		for i := range extraFiles {
-			file := extraFiles[len(extraFiles)-1-i]
-			fullPath := joinPath(top, file)
-			os.Remove(fullPath)
-			LOG_INFO("RESTORE_DELETE", "Deleted %s", file)
-		}
-	}
+	return downloadedFiles, downloadedFileSize, true
+}
 
-	for _, entry := range remoteSnapshot.Files {
+// restoreDirectoryMetadata sets the permissions, timestamps and attributes of the directories in 'entries'.  This is
+// done after all files have been restored, as creating files would change the timestamps of their directories.
+func (manager *BackupManager) restoreDirectoryMetadata(top string, entries []*Entry, setOwner bool) {
+	for _, entry := range entries {
 		if entry.IsDir() && !entry.IsLink() {
 			dir := joinPath(top, entry.Path)
 			entry.RestoreMetadata(dir, nil, setOwner)
 		}
 	}
+}
 
-	if showStatistics {
-		for _, file := range downloadedFiles {
-			LOG_INFO("DOWNLOAD_DONE", "Downloaded %s (%d)", file.Path, file.Size)
+// isEntryAvailable returns true if every chunk referenced by the file can be found in 'existingChunks'.
+func (manager *BackupManager) isEntryAvailable(snapshot *Snapshot, entry *Entry, existingChunks map[string]bool) bool {
+	for i := entry.StartChunk; i <= entry.EndChunk; i++ {
+		if !existingChunks[manager.config.GetChunkIDFromHash(snapshot.ChunkHashes[i])] {
+			return false
 		}
 	}
-
-	LOG_INFO("RESTORE_END", "Restored %s to revision %d", top, revision)
-	if showStatistics {
-		LOG_INFO("RESTORE_STATS", "Files: %d total, %s bytes", len(fileEntries), PrettySize(totalFileSize))
-		LOG_INFO("RESTORE_STATS", "Downloaded %d file, %s bytes, %d chunks",
-			len(downloadedFiles), PrettySize(downloadedFileSize), chunkDownloader.numberOfDownloadedChunks)
-	}
-
-	runningTime := time.Now().Unix() - startTime
-	if runningTime == 0 {
-		runningTime = 1
-	}
-
-	LOG_INFO("RESTORE_STATS", "Total running time: %s", PrettyTime(runningTime))
-
-	chunkDownloader.Stop()
-
 	return true
 }
 
@@ -1066,10 +1380,26 @@ func (manager *BackupManager) UploadSnapshot(chunkMaker *ChunkMaker, uploader *C
 		return sequence
 	}
 
-	sequences := []string{"chunks", "lengths"}
-	// The file list is assumed not to be too large when fixed-size chunking is used
-	if chunkMaker.minimumChunkSize == chunkMaker.maximumChunkSize {
-		sequences = append(sequences, "files")
+	// Directories and the path index are uploaded instead of the three sequences in a version 2 snapshot
+	if snapshot.Version >= SNAPSHOT_VERSION_TREE {
+		err := manager.uploadSnapshotTree(snapshot, top, func(reader io.Reader) []string {
+			return uploadSequenceFunc(reader, func(fileSize int64, hash string) (io.Reader, bool) {
+				return nil, false
+			})
+		})
+		if err != nil {
+			LOG_ERROR("SNAPSHOT_MARSHAL", "Failed to encode the files in the snapshot %s: %v", manager.snapshotID, err)
+			return int64(0), 0, int64(0), int64(0)
+		}
+	}
+
+	var sequences []string
+	if snapshot.Version < SNAPSHOT_VERSION_TREE {
+		sequences = []string{"chunks", "lengths"}
+		// The file list is assumed not to be too large when fixed-size chunking is used
+		if chunkMaker.minimumChunkSize == chunkMaker.maximumChunkSize {
+			sequences = append(sequences, "files")
+		}
 	}
 
 	// Chunk and length sequences can be encoded and loaded into memory directly
@@ -1091,7 +1421,7 @@ func (manager *BackupManager) UploadSnapshot(chunkMaker *ChunkMaker, uploader *C
 
 	// File sequence may be too big to fit into the memory.  So we encode files one by one and take advantages of
 	// the multi-reader capability of the chunk maker.
-	if chunkMaker.minimumChunkSize != chunkMaker.maximumChunkSize {
+	if chunkMaker.minimumChunkSize != chunkMaker.maximumChunkSize && snapshot.Version < SNAPSHOT_VERSION_TREE {
 		encoder := fileEncoder{
 			top:            top,
 			readAttributes: snapshot.discardAttributes,
@@ -1215,6 +1545,16 @@ func (manager *BackupManager) RestoreFile(chunkDownloader *ChunkDownloader, chun
 			fileHasher := manager.config.NewFileHasher()
 			buffer := make([]byte, 64*1024)
 			err = nil
+
+			// Whole chunks written by an interrupted restore don't need to be hashed again if the file hasn't been
+			// changed since the journal recorded them.  The file hash is then unknown, but the file can't be
+			// unchanged anyway, and the chunks are still verified by the hash of the restored file.
+			existingStat, _ := existingFile.Stat()
+			resumedChunks, resumedOffset := manager.restoreJournal.GetProgress(entry.Path, existingStat)
+			if resumedChunks > 0 {
+				LOG_INFO("DOWNLOAD_RESUME", "Resuming %s from offset %d", entry.Path, resumedOffset)
+			}
+
 			// We set to read one more byte so the file hash will be different if the file to be restored is a
 			// truncated portion of the existing file
 			for i := entry.StartChunk; i <= entry.EndChunk+1; i++ {
@@ -1229,6 +1569,22 @@ func (manager *BackupManager) RestoreFile(chunkDownloader *ChunkDownloader, chun
 				} else {
 					chunkSize = 1 // the size of extra chunk beyond EndChunk
 				}
+
+				if i < entry.StartChunk+resumedChunks && chunkSize == chunkDownloader.taskList[i].chunkLength {
+					_, err = existingFile.Seek(int64(chunkSize), io.SeekCurrent)
+					if err != nil {
+						LOG_ERROR("DOWNLOAD_SEEK", "Failed to skip the restored chunk in %s: %v", fullPath, err)
+						return false
+					}
+					hash := chunkDownloader.taskList[i].chunkHash
+					existingChunks = append(existingChunks, hash)
+					existingLengths = append(existingLengths, chunkSize)
+					offsetMap[hash] = offset
+					lengthMap[hash] = chunkSize
+					offset += int64(chunkSize)
+					continue
+				}
+
 				count := 0
 				for count < chunkSize {
 					n := chunkSize - count
@@ -1262,7 +1618,9 @@ func (manager *BackupManager) RestoreFile(chunkDownloader *ChunkDownloader, chun
 					break
 				}
 			}
-			fileHash = hex.EncodeToString(fileHasher.Sum(nil))
+			if resumedChunks == 0 {
+				fileHash = hex.EncodeToString(fileHasher.Sum(nil))
+			}
 		} else {
 			// If it is not inplace, we want to reuse any chunks in the existing file regardless their offets, so
 			// we run the chunk maker to split the original file.
@@ -1325,6 +1683,7 @@ func (manager *BackupManager) RestoreFile(chunkDownloader *ChunkDownloader, chun
 
 		for i := entry.StartChunk; i <= entry.EndChunk; i++ {
 
+			written := false
 			for existingOffset < offset && j < len(existingChunks) {
 				existingOffset += int64(existingLengths[j])
 				j++
@@ -1367,9 +1726,14 @@ func (manager *BackupManager) RestoreFile(chunkDownloader *ChunkDownloader, chun
 					return false
 				}
 				hasher.Write(chunk.GetBytes()[start:end])
+				written = true
 			}
 
 			offset += int64(end - start)
+			if written {
+				stat, _ := existingFile.Stat()
+				manager.restoreJournal.RecordProgress(entry.Path, i-entry.StartChunk+1, offset, stat)
+			}
 		}
 
 		// Must truncate the file if the new size is smaller
@@ -1585,6 +1949,18 @@ func (manager *BackupManager) CopySnapshots(otherManager *BackupManager, snapsho
 
 		LOG_TRACE("SNAPSHOT_COPY", "Copying snapshot %s at revision %d", snapshot.ID, snapshot.Revision)
 
+		// Chunks of a version 2 snapshot can only be found by loading all its directories
+		if snapshot.Version >= SNAPSHOT_VERSION_TREE {
+			chunkHashes := manager.SnapshotManager.getSnapshotTreeChunkHashes(snapshot, false)
+			if chunkHashes == nil {
+				return false
+			}
+			for _, chunkHash := range chunkHashes {
+				chunks[chunkHash] = true
+			}
+			continue
+		}
+
 		for _, chunkHash := range snapshot.FileSequence {
 			if _, found := chunks[chunkHash]; !found {
 				chunks[chunkHash] = true
@@ -1649,9 +2025,12 @@ func (manager *BackupManager) CopySnapshots(otherManager *BackupManager, snapsho
 	LOG_DEBUG("SNAPSHOT_COPY", "Chunks to copy = %d, to skip = %d, total = %d", chunksToCopy, chunksToSkip, chunksToCopy+chunksToSkip)
 	LOG_DEBUG("SNAPSHOT_COPY", "Total chunks in source snapshot revisions = %d\n", len(chunks))
 
-	chunkDownloader := CreateChunkDownloader(manager.config, manager.storage, nil, false, threads)
+	downloadThreads, downloadController := manager.createThreadController(manager.storage, "download", threads)
+	chunkDownloader := CreateChunkDownloaderWithController(manager.config, manager.storage, nil, false,
+		downloadThreads, downloadController)
 
-	chunkUploader := CreateChunkUploader(otherManager.config, otherManager.storage, nil, threads,
+	uploadThreads, uploadController := manager.createThreadController(otherManager.storage, "upload", threads)
+	chunkUploader := CreateChunkUploader(otherManager.config, otherManager.storage, nil, uploadThreads,
 		func(chunk *Chunk, chunkIndex int, skipped bool, chunkSize int, uploadSize int) {
 			if skipped {
 				LOG_INFO("SNAPSHOT_COPY", "Chunk %s (%d/%d) exists at the destination", chunk.GetID(), chunkIndex, len(chunks))
@@ -1660,6 +2039,7 @@ func (manager *BackupManager) CopySnapshots(otherManager *BackupManager, snapsho
 			}
 			otherManager.config.PutChunk(chunk)
 		})
+	chunkUploader.SetThreadController(uploadController)
 
 	chunkUploader.Start()
 
@@ -298,6 +298,16 @@ func TestBackupManager(t *testing.T) {
 	createRandomFile(testDir+"/repository2/dir5/file5", 100)
 
 	SetDuplicacyPreferencePath(testDir + "/repository2/.duplicacy")
+
+	// A dry run should report the extra files without deleting them
+	plan := backupManager.PlanRestore(testDir+"/repository2", 3, /*quickMode=*/false, /*overwrite=*/true,
+		/*deleteMode=*/true, /*patterns=*/nil)
+	if plan.DeletedFiles != 5 {
+		t.Errorf("Expected 5 paths to be deleted but got %d", plan.DeletedFiles)
+	}
+	checkExistence(t, testDir+"/repository2/file4", true, false)
+	checkExistence(t, testDir+"/repository2/dir5/file5", true, false)
+
 	backupManager.Restore(testDir+"/repository2", 3, /*inPlace=*/true, /*quickMode=*/false, threads, /*overwrite=*/true,
 		/*deleteMode=*/true, /*setowner=*/false, /*showStatistics=*/false, /*patterns=*/nil)
 
@@ -309,6 +319,14 @@ func TestBackupManager(t *testing.T) {
 		}
 	}
 
+	// Nothing is left to download after the restore
+	plan = backupManager.PlanRestore(testDir+"/repository2", 3, /*quickMode=*/false, /*overwrite=*/true,
+		/*deleteMode=*/true, /*patterns=*/nil)
+	if plan.ChunksToDownload != 0 || plan.OverwrittenFiles != 0 || plan.CreatedFiles != 0 {
+		t.Errorf("Expected an empty plan but got %d chunks to download, %d files to overwrite, %d files to create",
+			plan.ChunksToDownload, plan.OverwrittenFiles, plan.CreatedFiles)
+	}
+
 	// These files/dirs should not exist because deleteMode == true
 	checkExistence(t, testDir+"/repository2/dir5", false, false)
 	checkExistence(t, testDir+"/repository2/dir5/dir6", false, false)
@@ -321,6 +339,61 @@ func TestBackupManager(t *testing.T) {
 	checkExistence(t, testDir+"/repository2/dir2/dir3", true, true)
 	checkExistence(t, testDir+"/repository2/dir4", true, true)
 
+	// Pretend that a restore of file1 was interrupted after writing all but its last chunk, and that the file was
+	// changed afterwards; resuming should detect the changed chunks and still restore the file correctly
+	snapshot := backupManager.SnapshotManager.DownloadSnapshot("host1", 3)
+	backupManager.SnapshotManager.DownloadSnapshotContents(snapshot, nil, false)
+	for _, entry := range snapshot.Files {
+		if entry.Path != "file1" {
+			continue
+		}
+		offset := int64(0)
+		for i := entry.StartChunk; i < entry.EndChunk; i++ {
+			offset += int64(snapshot.ChunkLengths[i])
+			if i == entry.StartChunk {
+				offset -= int64(entry.StartOffset)
+			}
+		}
+		stat, _ := os.Stat(testDir + "/repository2/file1")
+		journal := CreateRestoreJournal("host1", 3, testDir+"/repository2", false)
+		journal.RecordProgress(entry.Path, entry.EndChunk-entry.StartChunk, offset, stat)
+		journal.file.Close()
+	}
+	modifyFile(testDir+"/repository2/file1", 0.2)
+
+	backupManager.SetResumeRestore(true)
+	backupManager.Restore(testDir+"/repository2", 3, /*inPlace=*/true, /*quickMode=*/false, threads, /*overwrite=*/true,
+		/*deleteMode=*/false, /*setowner=*/false, /*showStatistics=*/false, /*patterns=*/nil)
+	backupManager.SetResumeRestore(false)
+
+	if hash1, hash2 := getFileHash(testDir+"/repository1/file1"), getFileHash(testDir+"/repository2/file1"); hash1 != hash2 {
+		t.Errorf("File file1 has different hashes after resuming: %s vs %s", hash1, hash2)
+	}
+	if _, err := os.Stat(getRestoreJournalPath()); !os.IsNotExist(err) {
+		t.Errorf("The restore journal was not removed after resuming: %v", err)
+	}
+
+	// If the file is still as the interrupted restore left it, the chunks it recorded are skipped without hashing
+	// them again, and the restored file is still verified
+	for _, entry := range snapshot.Files {
+		if entry.Path != "file1" {
+			continue
+		}
+		stat, _ := os.Stat(testDir + "/repository2/file1")
+		journal := CreateRestoreJournal("host1", 3, testDir+"/repository2", false)
+		journal.RecordProgress(entry.Path, entry.EndChunk-entry.StartChunk, stat.Size(), stat)
+		journal.file.Close()
+	}
+
+	backupManager.SetResumeRestore(true)
+	backupManager.Restore(testDir+"/repository2", 3, /*inPlace=*/true, /*quickMode=*/false, threads, /*overwrite=*/true,
+		/*deleteMode=*/false, /*setowner=*/false, /*showStatistics=*/false, /*patterns=*/nil)
+	backupManager.SetResumeRestore(false)
+
+	if hash1, hash2 := getFileHash(testDir+"/repository1/file1"), getFileHash(testDir+"/repository2/file1"); hash1 != hash2 {
+		t.Errorf("File file1 has different hashes after resuming an unchanged file: %s vs %s", hash1, hash2)
+	}
+
 	// Remove file2 and dir1/file3 and restore them from revision 3
 	os.Remove(testDir + "/repository1/file2")
 	os.Remove(testDir + "/repository1/dir1/file3")
@@ -360,6 +433,76 @@ func TestBackupManager(t *testing.T) {
 	backupManager.SnapshotManager.CheckSnapshots( /*snapshotID*/ "host1" /*revisions*/, []int{2, 3, 4} /*tag*/, "",
 		/*showStatistics*/ false /*showTabular*/, false /*checkFiles*/, false /*searchFossils*/, false /*resurrect*/, false)
 
+	// Merge revisions 2 to 4 into a new repository; every file should come from the latest revision
+	os.Mkdir(testDir+"/repository3", 0700)
+	os.Mkdir(testDir+"/repository3/.duplicacy", 0700)
+	SetDuplicacyPreferencePath(testDir + "/repository3/.duplicacy")
+	backupManager.MergeRestore(testDir+"/repository3", []int{2, 3, 4}, /*quickMode=*/false, threads, /*overwrite=*/true,
+		/*setowner=*/false, /*showStatistics=*/false, /*patterns=*/nil)
+
+	for _, f := range []string{"file1", "file2", "dir1/file3"} {
+		hash1 := getFileHash(testDir + "/repository1/" + f)
+		hash3 := getFileHash(testDir + "/repository3/" + f)
+		if hash1 != hash3 {
+			t.Errorf("File %s has different hashes: %s vs %s", f, hash1, hash3)
+		}
+	}
+
+	// Modify file1 in revision 5 and then delete a chunk only found in the new version; merging revisions 4 and 5
+	// should fall back to the copy of file1 in revision 4
+	oldHash := getFileHash(testDir + "/repository1/file1")
+	modifyFile(testDir+"/repository1/file1", 0.1)
+	SetDuplicacyPreferencePath(testDir + "/repository1/.duplicacy")
+	backupManager.Backup(testDir+"/repository1" /*quickMode=*/, false, threads, "fifth", false, false, 0, false)
+
+	previousChunks := make(map[string]bool)
+	for _, chunkID := range backupManager.SnapshotManager.GetSnapshotChunks(
+		backupManager.SnapshotManager.DownloadSnapshot("host1", 4), false) {
+		previousChunks[chunkID] = true
+	}
+
+	snapshot = backupManager.SnapshotManager.DownloadSnapshot("host1", 5)
+	backupManager.SnapshotManager.DownloadSnapshotContents(snapshot, nil, false)
+	deletedChunks := 0
+	for _, entry := range snapshot.Files {
+		if entry.Path != "file1" {
+			continue
+		}
+		for i := entry.StartChunk; i <= entry.EndChunk && deletedChunks == 0; i++ {
+			chunkID := backupManager.config.GetChunkIDFromHash(snapshot.ChunkHashes[i])
+			if previousChunks[chunkID] {
+				continue
+			}
+			chunkPath, exist, _, err := storage.FindChunk(0, chunkID, false)
+			if err != nil || !exist {
+				t.Errorf("Chunk %s of file1 can't be found: %v", chunkID, err)
+				continue
+			}
+			storage.DeleteFile(0, chunkPath)
+			deletedChunks++
+		}
+	}
+	if deletedChunks == 0 {
+		t.Errorf("No chunk is unique to revision 5")
+	}
+
+	os.Mkdir(testDir+"/repository4", 0700)
+	os.Mkdir(testDir+"/repository4/.duplicacy", 0700)
+	SetDuplicacyPreferencePath(testDir + "/repository4/.duplicacy")
+	backupManager.MergeRestore(testDir+"/repository4", []int{4, 5}, /*quickMode=*/false, threads, /*overwrite=*/true,
+		/*setowner=*/false, /*showStatistics=*/false, /*patterns=*/nil)
+
+	if hash := getFileHash(testDir + "/repository4/file1"); hash != oldHash {
+		t.Errorf("File file1 was not restored from revision 4: %s vs %s", hash, oldHash)
+	}
+	for _, f := range []string{"file2", "dir1/file3"} {
+		hash1 := getFileHash(testDir + "/repository1/" + f)
+		hash4 := getFileHash(testDir + "/repository4/" + f)
+		if hash1 != hash4 {
+			t.Errorf("File %s has different hashes: %s vs %s", f, hash1, hash4)
+		}
+	}
+
 	/*buf := make([]byte, 1<<16)
 	  runtime.Stack(buf, true)
 	  fmt.Printf("%s", buf)*/
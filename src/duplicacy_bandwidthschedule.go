@@ -0,0 +1,190 @@
+// Copyright (c) Acrosync LLC. All rights reserved.
+// Free for personal use and commercial trial
+// Commercial use requires per-user licenses available from https://duplicacy.com
+
+package duplicacy
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// BandwidthSchedule holds time-of-day rate limits, each in the form of '[<days>] <start>-<end> <rate>', for example
+// 'mon-fri 08:00-18:00 2M'.  Days are given as a comma separated list of names or ranges of names and default to
+// every day; a time range can wrap around midnight.  The rate is in kilobytes/sec unless followed by 'K' or 'M', and
+// a rate of 0 means unlimited.  When more than one entry applies the first one wins, and outside all entries the
+// transfer rate is unlimited.
+type BandwidthSchedule struct {
+	entries []bandwidthScheduleEntry
+}
+
+type bandwidthScheduleEntry struct {
+	days  [7]bool // Indexed by time.Weekday
+	start int     // Minutes since midnight
+	end   int
+	rate  int // kilobytes/sec
+}
+
+// How often the schedule is checked during a transfer
+var bandwidthScheduleInterval = time.Minute
+
+var weekdayNames = []string{"sun", "mon", "tue", "wed", "thu", "fri", "sat"}
+
+// ParseBandwidthSchedule parses the entries of a schedule.
+func ParseBandwidthSchedule(specs []string) (*BandwidthSchedule, error) {
+	schedule := &BandwidthSchedule{}
+	for _, spec := range specs {
+		entry, err := parseBandwidthScheduleEntry(spec)
+		if err != nil {
+			return nil, fmt.Errorf("invalid bandwidth schedule '%s': %v", spec, err)
+		}
+		schedule.entries = append(schedule.entries, entry)
+	}
+	return schedule, nil
+}
+
+func parseBandwidthScheduleEntry(spec string) (entry bandwidthScheduleEntry, err error) {
+	fields := strings.Fields(spec)
+	if len(fields) == 2 {
+		fields = append([]string{""}, fields...)
+	} else if len(fields) != 3 {
+		return entry, fmt.Errorf("the format is '[<days>] <start>-<end> <rate>'")
+	}
+
+	if fields[0] == "" {
+		for i := range entry.days {
+			entry.days[i] = true
+		}
+	} else {
+		for _, days := range strings.Split(strings.ToLower(fields[0]), ",") {
+			first, last := days, days
+			if index := strings.Index(days, "-"); index > 0 {
+				first, last = days[:index], days[index+1:]
+			}
+			firstDay, lastDay := parseWeekday(first), parseWeekday(last)
+			if firstDay < 0 || lastDay < 0 {
+				return entry, fmt.Errorf("invalid days '%s'", days)
+			}
+			// Ranges like 'sat-sun' or 'fri-mon' wrap around the end of the week
+			for day := firstDay; ; day = (day + 1) % 7 {
+				entry.days[day] = true
+				if day == lastDay {
+					break
+				}
+			}
+		}
+	}
+
+	times := strings.Split(fields[1], "-")
+	if len(times) != 2 {
+		return entry, fmt.Errorf("invalid time range '%s'", fields[1])
+	}
+	if entry.start, err = parseTimeOfDay(times[0]); err != nil {
+		return entry, err
+	}
+	if entry.end, err = parseTimeOfDay(times[1]); err != nil {
+		return entry, err
+	}
+
+	rate := strings.ToUpper(fields[2])
+	multiplier := 1
+	if strings.HasSuffix(rate, "M") {
+		multiplier = 1024
+		rate = rate[:len(rate)-1]
+	} else if strings.HasSuffix(rate, "K") {
+		rate = rate[:len(rate)-1]
+	}
+	entry.rate, err = strconv.Atoi(rate)
+	if err != nil || entry.rate < 0 {
+		return entry, fmt.Errorf("invalid rate '%s'", fields[2])
+	}
+	entry.rate *= multiplier
+
+	return entry, nil
+}
+
+func parseWeekday(name string) int {
+	for i, weekday := range weekdayNames {
+		if strings.HasPrefix(name, weekday) {
+			return i
+		}
+	}
+	return -1
+}
+
+// parseTimeOfDay returns the number of minutes since midnight; '24:00' is allowed as the end of the day.
+func parseTimeOfDay(value string) (int, error) {
+	parts := strings.Split(value, ":")
+	hour, err := strconv.Atoi(parts[0])
+	minute := 0
+	if err == nil && len(parts) == 2 {
+		minute, err = strconv.Atoi(parts[1])
+	} else if len(parts) > 2 {
+		err = fmt.Errorf("too many fields")
+	}
+	if err != nil || hour < 0 || minute < 0 || minute > 59 || hour*60+minute > 24*60 {
+		return 0, fmt.Errorf("invalid time '%s'", value)
+	}
+	return hour*60 + minute, nil
+}
+
+// GetRate returns the rate limit in kilobytes/sec at the given time, 0 meaning unlimited.
+func (schedule *BandwidthSchedule) GetRate(now time.Time) int {
+	minute := now.Hour()*60 + now.Minute()
+	weekday := now.Weekday()
+	yesterday := (weekday + 6) % 7
+
+	for _, entry := range schedule.entries {
+		if entry.start <= entry.end {
+			if entry.days[weekday] && minute >= entry.start && minute < entry.end {
+				return entry.rate
+			}
+		} else {
+			// The part after midnight belongs to the day the entry started
+			if (entry.days[weekday] && minute >= entry.start) || (entry.days[yesterday] && minute < entry.end) {
+				return entry.rate
+			}
+		}
+	}
+	return 0
+}
+
+// ScheduleRateLimit sets the rate of the limiter according to the schedule, and keeps updating it as the schedule
+// changes until the returned function is called.  Since the limiter is shared by all transfer threads, the schedule
+// applies to all threads combined.
+func ScheduleRateLimit(limiter *RateLimiter, schedule *BandwidthSchedule) (stop func()) {
+
+	rate := schedule.GetRate(time.Now())
+	limiter.SetRate(rate)
+	LOG_INFO("BANDWIDTH_SCHEDULE", "Rate limit set to %s by the bandwidth schedule", formatRateLimit(rate))
+
+	stopChannel := make(chan bool)
+	go func() {
+		ticker := time.NewTicker(bandwidthScheduleInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stopChannel:
+				return
+			case now := <-ticker.C:
+				if newRate := schedule.GetRate(now); newRate != rate {
+					rate = newRate
+					limiter.SetRate(rate)
+					LOG_INFO("BANDWIDTH_SCHEDULE", "Rate limit changed to %s by the bandwidth schedule",
+						formatRateLimit(rate))
+				}
+			}
+		}
+	}()
+
+	return func() { close(stopChannel) }
+}
+
+func formatRateLimit(rate int) string {
+	if rate == 0 {
+		return "unlimited"
+	}
+	return fmt.Sprintf("%d kB/s", rate)
+}
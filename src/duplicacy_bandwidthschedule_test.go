@@ -0,0 +1,60 @@
+// Copyright (c) Acrosync LLC. All rights reserved.
+// Free for personal use and commercial trial
+// Commercial use requires per-user licenses available from https://duplicacy.com
+
+package duplicacy
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBandwidthSchedule(t *testing.T) {
+
+	setTestingT(t)
+
+	schedule, err := ParseBandwidthSchedule([]string{
+		"mon-fri 08:00-18:00 2M",
+		"sat,sun 10:00-16:00 512K",
+		"fri-mon 22:00-06:00 100",
+	})
+	if err != nil {
+		t.Errorf("Failed to parse the schedule: %v", err)
+		return
+	}
+
+	// 2026-10-12 is a Monday
+	monday := time.Date(2026, 10, 12, 0, 0, 0, 0, time.Local)
+	at := func(day int, hour int, minute int) time.Time {
+		return monday.AddDate(0, 0, day).Add(time.Duration(hour)*time.Hour + time.Duration(minute)*time.Minute)
+	}
+
+	for _, test := range []struct {
+		time time.Time
+		rate int
+	}{
+		{at(0, 8, 0), 2048},
+		{at(0, 17, 59), 2048},
+		{at(0, 18, 0), 0},
+		{at(2, 12, 0), 2048},
+		{at(5, 12, 0), 512},
+		{at(5, 7, 0), 0},
+		{at(0, 23, 0), 100},
+		{at(1, 3, 0), 100}, // Monday night continues into Tuesday
+		{at(1, 23, 0), 0},
+		{at(2, 3, 0), 0},
+		{at(4, 23, 30), 100},
+		{at(6, 5, 59), 100},
+	} {
+		if rate := schedule.GetRate(test.time); rate != test.rate {
+			t.Errorf("The rate at %s is %d instead of %d", test.time.Format("Mon 15:04"), rate, test.rate)
+		}
+	}
+
+	for _, invalid := range []string{"08:00-18:00", "mon-fri 8-18 fast", "someday 08:00-18:00 10",
+		"08:00-25:00 10", "mon 08:00 10", "08:00-18:00 -5"} {
+		if _, err := ParseBandwidthSchedule([]string{invalid}); err == nil {
+			t.Errorf("The schedule '%s' should be rejected", invalid)
+		}
+	}
+}
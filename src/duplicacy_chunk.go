@@ -60,6 +60,8 @@ type Chunk struct {
 
 	config *Config // Every chunk is associated with a Config object.  Which hashing algorithm to use is determined
 	// by the config
+
+	reserved bool // Whether the chunk counts against the memory budget, i.e., it was obtained from Config.GetChunk
 }
 
 // Magic word to identify a duplicacy format encrypted file, plus a version number.
@@ -37,12 +37,15 @@ type ChunkDownloader struct {
 	showStatistics bool         // Show a stats log for each chunk if true
 	threads        int          // Number of threads
 
+	maximumActiveChunks int // Chunks downloaded or being downloaded are limited to this number
+
 	taskList       []ChunkDownloadTask // The list of chunks to be downloaded
 	completedTasks map[int]bool        // Store downloaded chunks
 	lastChunkIndex int                 // a monotonically increasing number indicating the last chunk to be downloaded
 
 	taskQueue         chan ChunkDownloadTask       // Downloading goroutines are waiting on this channel for input
 	stopChannel       chan bool                    // Used to stop the dowloading goroutines
+	controller        *ThreadController            // Adjusts the number of active downloading goroutines if not nil
 	completionChannel chan ChunkDownloadCompletion // A downloading goroutine sends back the chunk via this channel after downloading
 
 	startTime                 int64 // The time it starts downloading
@@ -54,6 +57,13 @@ type ChunkDownloader struct {
 }
 
 func CreateChunkDownloader(config *Config, storage Storage, snapshotCache *FileStorage, showStatistics bool, threads int) *ChunkDownloader {
+	return CreateChunkDownloaderWithController(config, storage, snapshotCache, showStatistics, threads, nil)
+}
+
+// CreateChunkDownloaderWithController creates a chunk downloader that starts 'threads' downloading goroutines but lets
+// 'controller', if not nil, decide how many of them can be active.
+func CreateChunkDownloaderWithController(config *Config, storage Storage, snapshotCache *FileStorage,
+	showStatistics bool, threads int, controller *ThreadController) *ChunkDownloader {
 	downloader := &ChunkDownloader{
 		config:         config,
 		storage:        storage,
@@ -68,15 +78,24 @@ func CreateChunkDownloader(config *Config, storage Storage, snapshotCache *FileS
 		taskQueue:         make(chan ChunkDownloadTask, threads),
 		stopChannel:       make(chan bool),
 		completionChannel: make(chan ChunkDownloadCompletion),
+		controller:        controller,
 
 		startTime: time.Now().Unix(),
 	}
 
+	downloader.maximumActiveChunks = threads
+	if maximumChunks := getMaximumChunksInMemory(config); maximumChunks > 0 && maximumChunks < threads {
+		downloader.maximumActiveChunks = maximumChunks
+	}
+
 	// Start the downloading goroutines
 	for i := 0; i < downloader.threads; i++ {
 		go func(threadIndex int) {
 			defer CatchLogException()
 			for {
+				if !downloader.controller.WaitForTurn(threadIndex, downloader.stopChannel) {
+					return
+				}
 				select {
 				case task := <-downloader.taskQueue:
 					downloader.Download(threadIndex, task)
@@ -134,7 +153,7 @@ func (downloader *ChunkDownloader) AddChunk(chunkHash string) int {
 		isDownloading: false,
 	}
 	downloader.taskList = append(downloader.taskList, task)
-	if downloader.numberOfActiveChunks < downloader.threads {
+	if downloader.numberOfActiveChunks < downloader.maximumActiveChunks {
 		downloader.taskQueue <- task
 		downloader.numberOfDownloadingChunks++
 		downloader.numberOfActiveChunks++
@@ -143,7 +162,7 @@ func (downloader *ChunkDownloader) AddChunk(chunkHash string) int {
 	return len(downloader.taskList) - 1
 }
 
-// Prefetch adds up to 'threads' chunks needed by a file to the download list
+// Prefetch adds up to 'threads' chunks needed by a file to the download list, or fewer under a memory budget
 func (downloader *ChunkDownloader) Prefetch(file *Entry) {
 
 	// Any chunks before the first chunk of this filea are not needed any more, so they can be reclaimed.
@@ -153,7 +172,7 @@ func (downloader *ChunkDownloader) Prefetch(file *Entry) {
 		task := &downloader.taskList[i]
 		if task.needed {
 			if !task.isDownloading {
-				if downloader.numberOfActiveChunks >= downloader.threads {
+				if downloader.numberOfActiveChunks >= downloader.maximumActiveChunks {
 					return
 				}
 
@@ -215,7 +234,7 @@ func (downloader *ChunkDownloader) WaitForChunk(chunkIndex int) (chunk *Chunk) {
 
 	// We also need to look ahead and prefetch other chunks as many as permitted by the number of threads
 	for i := chunkIndex + 1; i < len(downloader.taskList); i++ {
-		if downloader.numberOfActiveChunks >= downloader.threads {
+		if downloader.numberOfActiveChunks >= downloader.maximumActiveChunks {
 			break
 		}
 		task := &downloader.taskList[i]
@@ -362,6 +381,7 @@ func (downloader *ChunkDownloader) Download(threadIndex int, task ChunkDownloadT
 			continue
 		}
 
+		startTime := time.Now()
 		err = downloader.storage.DownloadFile(threadIndex, chunkPath, chunk)
 		if err != nil {
 			_, isHubic := downloader.storage.(*HubicStorage)
@@ -376,6 +396,12 @@ func (downloader *ChunkDownloader) Download(threadIndex int, task ChunkDownloadT
 			}
 		}
 
+		downloader.controller.Record(len(chunk.GetBytes()), time.Since(startTime))
+
+		// The size of a chunk isn't known until it is downloaded, so the rate limiter is charged afterwards
+		downloadLimiter, _ := downloader.storage.GetRateLimiters()
+		downloadLimiter.Wait(len(chunk.GetBytes()))
+
 		err = chunk.Decrypt(downloader.config.ChunkKey, task.chunkHash)
 		if err != nil {
 			if downloadAttempt < MaxDownloadAttempts {
@@ -9,6 +9,7 @@ import (
 	"encoding/binary"
 	"encoding/hex"
 	"io"
+	"time"
 )
 
 // ChunkMaker breaks data into chunks using buzhash.  To save memory, the chunk maker only use a circular buffer
@@ -29,8 +30,15 @@ type ChunkMaker struct {
 
 	hashOnly      bool
 	hashOnlyChunk *Chunk
+
+	readLimiter   *RateLimiter // Caps the rate of reading files if not nil
+	maximumLoad   float64      // Reading pauses while the system load is above this value if positive
+	lastLoadCheck time.Time
 }
 
+// How often the system load is checked, and rechecked while reading is paused
+var chunkMakerLoadInterval = 10 * time.Second
+
 // CreateChunkMaker creates a chunk maker.  'randomSeed' is used to generate the character-to-integer table needed by
 // buzhash.
 func CreateChunkMaker(config *Config, hashOnly bool) *ChunkMaker {
@@ -90,6 +98,47 @@ func (maker *ChunkMaker) buzhashUpdate(sum uint64, out byte, in byte, length int
 	return rotateLeftByOne(sum) ^ rotateLeft(maker.randomTable[out], uint(length)) ^ maker.randomTable[in]
 }
 
+// SetReadThrottling caps the rate of reading files at 'readRateLimit' kilobytes/sec and pauses reading while the
+// system load is above 'maximumLoad'.  A value of 0 disables either one.
+func (maker *ChunkMaker) SetReadThrottling(readRateLimit int, maximumLoad float64) {
+	maker.readLimiter = nil
+	if readRateLimit > 0 {
+		maker.readLimiter = CreateRateLimiter(readRateLimit, 0)
+	}
+	maker.maximumLoad = maximumLoad
+}
+
+// throttleRead is called after 'count' bytes have been read.
+func (maker *ChunkMaker) throttleRead(count int) {
+	maker.readLimiter.Wait(count)
+
+	if maker.maximumLoad <= 0 || time.Since(maker.lastLoadCheck) < chunkMakerLoadInterval {
+		return
+	}
+
+	paused := false
+	for {
+		maker.lastLoadCheck = time.Now()
+		load, err := GetSystemLoad()
+		if err != nil {
+			LOG_WARN("CHUNK_LOAD", "Reading will not pause on a high system load: %v", err)
+			maker.maximumLoad = 0
+			return
+		}
+		if load <= maker.maximumLoad {
+			if paused {
+				LOG_INFO("CHUNK_LOAD", "Resuming as the system load has dropped to %.2f", load)
+			}
+			return
+		}
+		if !paused {
+			LOG_INFO("CHUNK_LOAD", "Pausing as the system load %.2f is above %.2f", load, maker.maximumLoad)
+			paused = true
+		}
+		time.Sleep(chunkMakerLoadInterval)
+	}
+}
+
 // ForEachChunk reads data from 'reader'.  If EOF is encountered, it will call 'nextReader' to ask for next file.  If
 // 'nextReader' returns false, it will process remaining data in the buffer and then quit.  When a chunk is identified,
 // it will call 'endOfChunk' to return the chunk size and a boolean flag indicating if it is the last chunk.
@@ -149,6 +198,7 @@ func (maker *ChunkMaker) ForEachChunk(reader io.Reader, endOfChunk func(chunk *C
 			maker.bufferStart = 0
 			for maker.bufferStart < maker.minimumChunkSize && !isEOF {
 				count, err := reader.Read(maker.buffer[maker.bufferStart:maker.minimumChunkSize])
+				maker.throttleRead(count)
 
 				if err != nil {
 					if err != io.EOF {
@@ -198,6 +248,7 @@ func (maker *ChunkMaker) ForEachChunk(reader io.Reader, endOfChunk func(chunk *C
 			}
 
 			count, err = reader.Read(maker.buffer[start : start+count])
+			maker.throttleRead(count)
 
 			if err != nil && err != io.EOF {
 				LOG_ERROR("CHUNK_MAKER", "Failed to read %d bytes: %s", count, err.Error())
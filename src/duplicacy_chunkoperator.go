@@ -33,8 +33,9 @@ type ChunkOperator struct {
 	stopChannel         chan bool              // Used to stop all the goroutines
 	numberOfActiveTasks int64                  // The number of chunks that are being operated on
 
-	fossils     []string    // For fossilize operation, the paths of the fossils are stored in this slice
-	fossilsLock *sync.Mutex // The lock for 'fossils'
+	fossils     []string         // For fossilize operation, the paths of the fossils are stored in this slice
+	locked      map[string]int64 // Files that couldn't be deleted or fossilized because they are locked by the storage
+	fossilsLock *sync.Mutex      // The lock for 'fossils' and 'locked'
 }
 
 // CreateChunkOperator creates a new ChunkOperator.
@@ -47,6 +48,7 @@ func CreateChunkOperator(storage Storage, threads int) *ChunkOperator {
 		stopChannel: make(chan bool),
 
 		fossils:     make([]string, 0),
+		locked:      make(map[string]int64),
 		fossilsLock: &sync.Mutex{},
 	}
 
@@ -111,6 +113,22 @@ func (operator *ChunkOperator) Resurrect(chunkID string, filePath string) {
 	operator.AddTask(ChunkOperationResurrect, chunkID, filePath)
 }
 
+// deferLocked records the file if the error indicates that it is locked by the storage, so that its deletion can be
+// retried by a later prune once the lock expires.
+func (operator *ChunkOperator) deferLocked(filePath string, err error) bool {
+	lockedError, ok := err.(FileLockedError)
+	if !ok {
+		return false
+	}
+
+	LOG_DEBUG("CHUNK_LOCKED", "The file %s is locked until %s; its deletion is deferred", filePath,
+		lockedError.LockedUntil.Local().Format("2006-01-02 15:04:05"))
+	operator.fossilsLock.Lock()
+	operator.locked[filePath] = lockedError.LockedUntil.Unix()
+	operator.fossilsLock.Unlock()
+	return true
+}
+
 func (operator *ChunkOperator) Run(threadIndex int, task ChunkOperatorTask) {
 	defer func() {
 		atomic.AddInt64(&operator.numberOfActiveTasks, int64(-1))
@@ -142,7 +160,9 @@ func (operator *ChunkOperator) Run(threadIndex int, task ChunkOperatorTask) {
 		}
 	} else if task.operation == ChunkOperationDelete {
 		err := operator.storage.DeleteFile(threadIndex, task.filePath)
-		if err != nil {
+		if operator.deferLocked(task.filePath, err) {
+			return
+		} else if err != nil {
 			LOG_WARN("CHUNK_DELETE", "Failed to remove the file %s: %v", task.filePath, err)
 		} else {
 			if task.chunkID != "" {
@@ -156,7 +176,9 @@ func (operator *ChunkOperator) Run(threadIndex int, task ChunkOperatorTask) {
 		fossilPath := task.filePath + ".fsl"
 
 		err := operator.storage.MoveFile(threadIndex, task.filePath, fossilPath)
-		if err != nil {
+		if operator.deferLocked(task.filePath, err) {
+			return
+		} else if err != nil {
 			if _, exist, _, _ := operator.storage.FindChunk(threadIndex, task.chunkID, true); exist {
 				err := operator.storage.DeleteFile(threadIndex, task.filePath)
 				if err == nil {
@@ -26,6 +26,8 @@ type ChunkUploader struct {
 	threads       int                  // Number of uploading goroutines
 	taskQueue     chan ChunkUploadTask // Uploading goroutines are listening on this channel for upload jobs
 	stopChannel   chan bool            // Used to terminate uploading goroutines
+	controller    *ThreadController    // Adjusts the number of active uploading goroutines if not nil
+	memorySlots   chan bool            // Limits the number of chunks being uploaded under the memory budget if not nil
 
 	numberOfUploadingTasks int32 // The number of uploading tasks
 
@@ -46,18 +48,35 @@ func CreateChunkUploader(config *Config, storage Storage, snapshotCache *FileSto
 		completionFunc: completionFunc,
 	}
 
+	// One chunk is reserved for the chunk maker
+	if maximumChunks := getMaximumChunksInMemory(config); maximumChunks > 0 {
+		uploader.memorySlots = make(chan bool, maximumChunks-1)
+	}
+
 	return uploader
 }
 
+// SetThreadController makes the uploader adapt the number of active goroutines, up to 'threads', to the storage.  It
+// must be called before Start().
+func (uploader *ChunkUploader) SetThreadController(controller *ThreadController) {
+	uploader.controller = controller
+}
+
 // Starts starts uploading goroutines.
 func (uploader *ChunkUploader) Start() {
 	for i := 0; i < uploader.threads; i++ {
 		go func(threadIndex int) {
 			defer CatchLogException()
 			for {
+				if !uploader.controller.WaitForTurn(threadIndex, uploader.stopChannel) {
+					return
+				}
 				select {
 				case task := <-uploader.taskQueue:
 					uploader.Upload(threadIndex, task)
+					if uploader.memorySlots != nil {
+						<-uploader.memorySlots
+					}
 				case <-uploader.stopChannel:
 					return
 				}
@@ -66,8 +85,12 @@ func (uploader *ChunkUploader) Start() {
 	}
 }
 
-// StartChunk sends a chunk to be uploaded to  a waiting uploading goroutine.  It may block if all uploading goroutines are busy.
+// StartChunk sends a chunk to be uploaded to  a waiting uploading goroutine.  It may block if all uploading goroutines are busy,
+// or if the chunks being uploaded have used up the memory budget.
 func (uploader *ChunkUploader) StartChunk(chunk *Chunk, chunkIndex int) {
+	if uploader.memorySlots != nil {
+		uploader.memorySlots <- true
+	}
 	atomic.AddInt32(&uploader.numberOfUploadingTasks, 1)
 	uploader.taskQueue <- ChunkUploadTask{
 		chunk:      chunk,
@@ -135,11 +158,15 @@ func (uploader *ChunkUploader) Upload(threadIndex int, task ChunkUploadTask) boo
 	}
 
 	if !uploader.config.dryRun {
+		_, uploadLimiter := uploader.storage.GetRateLimiters()
+		uploadLimiter.Wait(len(chunk.GetBytes()))
+		startTime := time.Now()
 		err = uploader.storage.UploadFile(threadIndex, chunkPath, chunk.GetBytes())
 		if err != nil {
 			LOG_ERROR("UPLOAD_CHUNK", "Failed to upload the chunk %s: %v", chunkID, err)
 			return false
 		}
+		uploader.controller.Record(len(chunk.GetBytes()), time.Since(startTime))
 		LOG_DEBUG("CHUNK_UPLOAD", "Chunk %s has been uploaded", chunkID)
 	} else {
 		LOG_DEBUG("CHUNK_UPLOAD", "Uploading was skipped for chunk %s", chunkID)
@@ -217,6 +217,8 @@ func (config *Config) GetChunk() (chunk *Chunk) {
 		}
 		chunk = CreateChunk(config, true)
 	}
+	chunk.reserved = true
+	reserveChunkMemory(config)
 	return chunk
 }
 
@@ -226,6 +228,11 @@ func (config *Config) PutChunk(chunk *Chunk) {
 		return
 	}
 
+	if chunk.reserved {
+		chunk.reserved = false
+		releaseChunkMemory(config)
+	}
+
 	select {
 	case config.chunkPool <- chunk:
 	default:
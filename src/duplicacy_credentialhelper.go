@@ -0,0 +1,152 @@
+// Copyright (c) Acrosync LLC. All rights reserved.
+// Free for personal use and commercial trial
+// Commercial use requires per-user licenses available from https://duplicacy.com
+
+package duplicacy
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+	"sync"
+)
+
+// A credential helper is an external command, configured per storage, that duplicacy runs to look up secrets, in
+// the same spirit as git credential helpers.  The action ('get', 'store' or 'erase') is appended to the command, which
+// is run by the shell.  The request is written to the standard input as 'key=value' lines followed by an empty line:
+//
+//     storage=<storage name>
+//     url=<storage url>
+//     id=<snapshot id>
+//     key=<secret type, e.g. password, s3_secret, ssh_key_file>
+//     name=<the name used for the keyring, e.g. offsite_password>
+//     secret=<the secret; only for 'store'>
+//
+// For 'get', the helper prints 'secret=<value>' on the standard output; printing nothing or exiting with a non-zero
+// status means the secret is not available.  Standard error is passed through so the helper can prompt the user.
+
+// Secrets obtained from or given to helpers in this process
+var credentialHelperCache = make(map[string]string)
+var credentialHelperLock sync.Mutex
+
+func getCredentialHelperCacheKey(preference Preference, passwordID string) string {
+	return preference.CredentialHelper + "\x00" + preference.StorageURL + "\x00" + passwordID
+}
+
+// runCredentialHelper runs the helper with the given action and returns what the helper printed as key/value pairs.
+func runCredentialHelper(preference Preference, action string, passwordType string, passwordID string,
+	secret string) (map[string]string, error) {
+
+	var cmd *exec.Cmd
+	if runtime.GOOS == "windows" {
+		cmd = exec.Command("cmd", "/C", preference.CredentialHelper+" "+action)
+	} else {
+		cmd = exec.Command("sh", "-c", preference.CredentialHelper+" "+action)
+	}
+
+	var input bytes.Buffer
+	fmt.Fprintf(&input, "storage=%s\n", preference.Name)
+	fmt.Fprintf(&input, "url=%s\n", preference.StorageURL)
+	fmt.Fprintf(&input, "id=%s\n", preference.SnapshotID)
+	fmt.Fprintf(&input, "key=%s\n", passwordType)
+	fmt.Fprintf(&input, "name=%s\n", passwordID)
+	if action == "store" {
+		fmt.Fprintf(&input, "secret=%s\n", secret)
+	}
+	fmt.Fprintf(&input, "\n")
+
+	var output bytes.Buffer
+	cmd.Stdin = &input
+	cmd.Stdout = &output
+	cmd.Stderr = os.Stderr
+
+	err := cmd.Run()
+	if err != nil {
+		return nil, err
+	}
+
+	result := make(map[string]string)
+	scanner := bufio.NewScanner(&output)
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), "\r")
+		if line == "" {
+			break
+		}
+		index := strings.Index(line, "=")
+		if index <= 0 {
+			return nil, fmt.Errorf("invalid output line from the credential helper")
+		}
+		result[line[:index]] = line[index+1:]
+	}
+
+	return result, nil
+}
+
+// getPasswordFromHelper asks the credential helper of the preference for the secret.  An empty string is returned if
+// no helper is configured or the helper doesn't have the secret.
+func getPasswordFromHelper(preference Preference, passwordType string, passwordID string) string {
+
+	if preference.CredentialHelper == "" {
+		return ""
+	}
+
+	credentialHelperLock.Lock()
+	defer credentialHelperLock.Unlock()
+
+	cacheKey := getCredentialHelperCacheKey(preference, passwordID)
+	if password, found := credentialHelperCache[cacheKey]; found {
+		return password
+	}
+
+	LOG_DEBUG("PASSWORD_HELPER", "Reading %s from the credential helper", passwordID)
+	result, err := runCredentialHelper(preference, "get", passwordType, passwordID, "")
+	if err != nil {
+		LOG_WARN("PASSWORD_HELPER", "The credential helper failed to get %s: %v", passwordID, err)
+		return ""
+	}
+
+	password := result["secret"]
+	if password != "" {
+		credentialHelperCache[cacheKey] = password
+	}
+	return password
+}
+
+// savePasswordToHelper passes the secret to the credential helper.  Helpers that don't store secrets can simply
+// ignore the 'store' action.
+func savePasswordToHelper(preference Preference, passwordType string, passwordID string, password string) {
+
+	credentialHelperLock.Lock()
+	defer credentialHelperLock.Unlock()
+
+	cacheKey := getCredentialHelperCacheKey(preference, passwordID)
+	if cached, found := credentialHelperCache[cacheKey]; found && cached == password {
+		return
+	}
+
+	_, err := runCredentialHelper(preference, "store", passwordType, passwordID, password)
+	if err != nil {
+		LOG_WARN("PASSWORD_HELPER", "The credential helper failed to store %s: %v", passwordID, err)
+		return
+	}
+	credentialHelperCache[cacheKey] = password
+}
+
+// erasePasswordFromHelper asks the credential helper to forget the secret, which happens when the user is asked to
+// enter a new one.
+func erasePasswordFromHelper(preference Preference, passwordType string, passwordID string) {
+
+	credentialHelperLock.Lock()
+	defer credentialHelperLock.Unlock()
+
+	delete(credentialHelperCache, getCredentialHelperCacheKey(preference, passwordID))
+
+	_, err := runCredentialHelper(preference, "erase", passwordType, passwordID, "")
+	if err != nil {
+		LOG_WARN("PASSWORD_HELPER", "The credential helper failed to erase %s: %v", passwordID, err)
+	}
+}
@@ -0,0 +1,61 @@
+// Copyright (c) Acrosync LLC. All rights reserved.
+// Free for personal use and commercial trial
+// Commercial use requires per-user licenses available from https://duplicacy.com
+
+package duplicacy
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+)
+
+func TestCredentialHelper(t *testing.T) {
+
+	if runtime.GOOS == "windows" {
+		t.Skip("The test helper is a shell script")
+	}
+
+	testDir, err := ioutil.TempDir("", "duplicacy_test")
+	if err != nil {
+		t.Errorf("Failed to create a temporary directory: %v", err)
+		return
+	}
+	defer os.RemoveAll(testDir)
+
+	// The helper answers 'get' requests with the key name reversed and logs every action it is asked to perform
+	helper := filepath.Join(testDir, "helper")
+	script := "#!/bin/sh\n" +
+		"echo $1 >> " + filepath.Join(testDir, "log") + "\n" +
+		"[ \"$1\" = get ] || exit 0\n" +
+		"while read line; do case $line in key=*) key=${line#key=};; esac; done\n" +
+		"echo secret=$(echo $key | rev)\n"
+	err = ioutil.WriteFile(helper, []byte(script), 0700)
+	if err != nil {
+		t.Errorf("Failed to create the credential helper: %v", err)
+		return
+	}
+
+	preference := Preference{
+		Name:             "default",
+		StorageURL:       "sftp://example.com/storage",
+		CredentialHelper: helper,
+	}
+
+	for i := 0; i < 2; i++ {
+		password := getPasswordFromHelper(preference, "password", "password")
+		if password != "drowssap" {
+			t.Errorf("The credential helper returned '%s' instead of 'drowssap'", password)
+		}
+	}
+
+	savePasswordToHelper(preference, "password", "password", "drowssap")
+	savePasswordToHelper(preference, "password", "password", "new")
+
+	log, _ := ioutil.ReadFile(filepath.Join(testDir, "log"))
+	if string(log) != "get\nstore\n" {
+		t.Errorf("The credential helper was run as %q; secrets should be cached", log)
+	}
+}
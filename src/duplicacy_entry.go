@@ -40,6 +40,10 @@ type Entry struct {
 	UID int
 	GID int
 
+	// User and group names, so ownership can be mapped by name when restoring to a different host
+	UserName  string
+	GroupName string
+
 	StartChunk  int
 	StartOffset int
 	EndChunk    int
@@ -171,6 +175,18 @@ func (entry *Entry) UnmarshalJSON(description []byte) (err error) {
 		}
 	}
 
+	if value, ok = object["user"]; ok {
+		if entry.UserName, ok = value.(string); !ok {
+			return fmt.Errorf("User name is not a string for file '%s' in the snapshot", entry.Path)
+		}
+	}
+
+	if value, ok = object["group"]; ok {
+		if entry.GroupName, ok = value.(string); !ok {
+			return fmt.Errorf("Group name is not a string for file '%s' in the snapshot", entry.Path)
+		}
+	}
+
 	if value, ok = object["attributes"]; ok {
 		if attributes, ok := value.(map[string]interface{}); !ok {
 			return fmt.Errorf("Attributes are invalid for file '%s' in the snapshot", entry.Path)
@@ -242,6 +258,12 @@ func (entry *Entry) convertToObject(encodeName bool) map[string]interface{} {
 	if entry.UID != -1 && entry.GID != -1 {
 		object["uid"] = entry.UID
 		object["gid"] = entry.GID
+		if entry.UserName != "" {
+			object["user"] = entry.UserName
+		}
+		if entry.GroupName != "" {
+			object["group"] = entry.GroupName
+		}
 	}
 
 	if len(entry.Attributes) > 0 {
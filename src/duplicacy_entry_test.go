@@ -216,3 +216,52 @@ func TestEntryList(t *testing.T) {
 	}
 
 }
+
+func TestEntryOwner(t *testing.T) {
+
+	entry := CreateEntry("file", 100, 0, 0644)
+	entry.UID = 1000
+	entry.GID = 100
+	entry.UserName = "alice"
+	entry.GroupName = "users"
+
+	description, err := entry.MarshalJSON()
+	if err != nil {
+		t.Errorf("Failed to encode the entry: %v", err)
+		return
+	}
+
+	newEntry := &Entry{}
+	err = newEntry.UnmarshalJSON(description)
+	if err != nil {
+		t.Errorf("Failed to decode the entry: %v", err)
+		return
+	}
+
+	if newEntry.UID != 1000 || newEntry.GID != 100 || newEntry.UserName != "alice" || newEntry.GroupName != "users" {
+		t.Errorf("Owner was decoded as %d:%d (%s:%s)", newEntry.UID, newEntry.GID, newEntry.UserName, newEntry.GroupName)
+	}
+
+	mapping, err := CreateOwnerMapping(false, []string{"uid:1000=501", "gid:100=20"}, false)
+	if err != nil {
+		t.Errorf("Failed to create the owner mapping: %v", err)
+		return
+	}
+
+	uid, gid := mapping.MapOwner(newEntry)
+	if uid != 501 || gid != 20 {
+		t.Errorf("Owner was mapped to %d:%d instead of 501:20", uid, gid)
+	}
+
+	mapping.Squash = true
+	uid, gid = mapping.MapOwner(newEntry)
+	if uid != os.Getuid() || gid != os.Getgid() {
+		t.Errorf("Owner was squashed to %d:%d instead of %d:%d", uid, gid, os.Getuid(), os.Getgid())
+	}
+
+	for _, spec := range []string{"1000=501", "uid:1000", "user:1000=501", "uid:a=b"} {
+		if _, err := CreateOwnerMapping(false, []string{spec}, false); err == nil {
+			t.Errorf("Owner mapping %s should be rejected", spec)
+		}
+	}
+}
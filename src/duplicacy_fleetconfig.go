@@ -0,0 +1,418 @@
+// Copyright (c) Acrosync LLC. All rights reserved.
+// Free for personal use and commercial trial
+// Commercial use requires per-user licenses available from https://duplicacy.com
+
+package duplicacy
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// FleetConfig describes a set of repositories in one file, from which the preferences, filters and scripts of each
+// repository are generated by the apply command.  An example:
+//
+//     {
+//         "repositories": [
+//             {
+//                 "path": "/home/alice",
+//                 "id": "alice-desktop",
+//                 "filters": ["-.cache/", "+*"],
+//                 "scripts": {"pre-backup": "#!/bin/sh\necho starting\n"},
+//                 "storages": [
+//                     {
+//                         "name": "default",
+//                         "url": "sftp://backup@nas/duplicacy",
+//                         "encrypted": true,
+//                         "keys": {"password_file": "/run/secrets/duplicacy"},
+//                         "retention": ["0:360", "30:180", "7:30", "1:7"],
+//                         "copy_to": ["offsite"],
+//                         "bandwidth_schedule": ["mon-fri 08:00-18:00 2M"]
+//                     },
+//                     {
+//                         "name": "offsite",
+//                         "url": "b2://alice-backup",
+//                         "encrypted": true
+//                     }
+//                 ]
+//             }
+//         ]
+//     }
+//
+// The first storage of a repository becomes the default one.  Storages are merged into the existing preferences,
+// and filters and scripts not given in the file are left as they are.
+type FleetConfig struct {
+	Repositories []*FleetRepository `json:"repositories"`
+}
+
+// FleetRepository describes one repository and its storages.
+type FleetRepository struct {
+	Path          string            `json:"path"`
+	ID            string            `json:"id"`
+	PreferenceDir string            `json:"pref_dir,omitempty"`
+	Filters       []string          `json:"filters,omitempty"`
+	Scripts       map[string]string `json:"scripts,omitempty"`
+	Storages      []*FleetStorage   `json:"storages"`
+}
+
+// FleetStorage describes one storage of a repository.  The id defaults to the id of the repository.  The retention
+// policy and the copy targets are only used when 'prune -use-retention' and 'copy -all-targets' are run.
+type FleetStorage struct {
+	Name              string            `json:"name"`
+	ID                string            `json:"id,omitempty"`
+	URL               string            `json:"url"`
+	Encrypted         bool              `json:"encrypted,omitempty"`
+	BackupProhibited  bool              `json:"no_backup,omitempty"`
+	RestoreProhibited bool              `json:"no_restore,omitempty"`
+	DoNotSavePassword bool              `json:"no_save_password,omitempty"`
+	NobackupFile      string            `json:"nobackup_file,omitempty"`
+	CredentialHelper  string            `json:"credential_helper,omitempty"`
+	Keys              map[string]string `json:"keys,omitempty"`
+	Parameters        map[string]string `json:"parameters,omitempty"`
+	Retention         []string          `json:"retention,omitempty"`
+	CopyTo            []string          `json:"copy_to,omitempty"`
+	BandwidthSchedule []string          `json:"bandwidth_schedule,omitempty"`
+	Nice              int               `json:"nice,omitempty"`
+	IOPriority        string            `json:"io_priority,omitempty"`
+	ReadRateLimit     int               `json:"read_limit_rate,omitempty"`
+	MaximumLoad       float64           `json:"max_load,omitempty"`
+}
+
+var fleetIDRegex = regexp.MustCompile(`^[^\s/\\]+$`)
+var fleetURLRegex = regexp.MustCompile(`^[\w-]+://`)
+var fleetRetentionRegex = regexp.MustCompile(`^([0-9]+):([0-9]+)$`)
+var fleetScriptRegex = regexp.MustCompile(`^([\w-]+-)?(pre|post)-[a-z]+$`)
+
+// LoadFleetConfig reads the configuration file.  Unknown fields are rejected so that typos don't go unnoticed.
+func LoadFleetConfig(configFile string) (*FleetConfig, error) {
+	description, err := ioutil.ReadFile(configFile)
+	if err != nil {
+		return nil, err
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(description))
+	decoder.DisallowUnknownFields()
+
+	config := &FleetConfig{}
+	err = decoder.Decode(config)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %v", configFile, err)
+	}
+	return config, nil
+}
+
+// Validate checks the configuration and returns all problems found.
+func (config *FleetConfig) Validate() (problems []string) {
+
+	if len(config.Repositories) == 0 {
+		problems = append(problems, "no repositories are defined")
+	}
+
+	repositoryPaths := make(map[string]bool)
+	for i, repository := range config.Repositories {
+
+		where := fmt.Sprintf("repository %d", i+1)
+		if repository.Path != "" {
+			where = fmt.Sprintf("repository %s", repository.Path)
+		}
+
+		if repository.Path == "" {
+			problems = append(problems, where+": no path is specified")
+		} else if !filepath.IsAbs(repository.Path) {
+			problems = append(problems, where+": the path must be absolute")
+		} else if repositoryPaths[filepath.Clean(repository.Path)] {
+			problems = append(problems, where+": the repository is defined more than once")
+		}
+		repositoryPaths[filepath.Clean(repository.Path)] = true
+
+		if repository.PreferenceDir != "" && !filepath.IsAbs(repository.PreferenceDir) {
+			problems = append(problems, where+": the preference directory must be absolute")
+		}
+
+		if !fleetIDRegex.MatchString(repository.ID) {
+			problems = append(problems, fmt.Sprintf("%s: invalid snapshot id '%s'", where, repository.ID))
+		}
+
+		for _, pattern := range repository.Filters {
+			if strings.HasPrefix(pattern, "i:") || strings.HasPrefix(pattern, "e:") {
+				if valid, err := IsValidRegex(pattern[2:]); !valid || err != nil {
+					problems = append(problems, fmt.Sprintf("%s: invalid regular expression in filter '%s'", where, pattern))
+				}
+			}
+		}
+
+		for name := range repository.Scripts {
+			if !fleetScriptRegex.MatchString(name) {
+				problems = append(problems, fmt.Sprintf("%s: invalid script name '%s'", where, name))
+			}
+		}
+
+		if len(repository.Storages) == 0 {
+			problems = append(problems, where+": no storages are defined")
+		}
+
+		storageNames := make(map[string]bool)
+		for _, storage := range repository.Storages {
+			if storage.Name == "" {
+				problems = append(problems, where+": a storage has no name")
+			} else if strings.ToLower(storage.Name) == "ssh" {
+				problems = append(problems, fmt.Sprintf("%s: '%s' is an invalid storage name", where, storage.Name))
+			} else if storageNames[storage.Name] {
+				problems = append(problems, fmt.Sprintf("%s: there is more than one storage named '%s'", where, storage.Name))
+			}
+			storageNames[storage.Name] = true
+		}
+
+		for _, storage := range repository.Storages {
+			storageWhere := fmt.Sprintf("%s, storage %s", where, storage.Name)
+
+			if storage.URL == "" {
+				problems = append(problems, storageWhere+": no url is specified")
+			} else if !fleetURLRegex.MatchString(storage.URL) && !filepath.IsAbs(storage.URL) &&
+				!strings.HasPrefix(storage.URL, "{") {
+				problems = append(problems, fmt.Sprintf("%s: '%s' is neither a url nor an absolute path",
+					storageWhere, storage.URL))
+			}
+
+			if storage.ID != "" && !fleetIDRegex.MatchString(storage.ID) {
+				problems = append(problems, fmt.Sprintf("%s: invalid snapshot id '%s'", storageWhere, storage.ID))
+			}
+
+			for _, retention := range storage.Retention {
+				if !fleetRetentionRegex.MatchString(retention) {
+					problems = append(problems, fmt.Sprintf("%s: invalid retention policy '%s'", storageWhere, retention))
+				}
+			}
+
+			if _, err := ParseBandwidthSchedule(storage.BandwidthSchedule); err != nil {
+				problems = append(problems, fmt.Sprintf("%s: %v", storageWhere, err))
+			}
+
+			if storage.Nice < 0 || storage.Nice > 19 {
+				problems = append(problems, fmt.Sprintf("%s: invalid nice value %d", storageWhere, storage.Nice))
+			}
+
+			if storage.IOPriority != "" {
+				if _, _, err := ParseIOPriority(storage.IOPriority); err != nil {
+					problems = append(problems, fmt.Sprintf("%s: %v", storageWhere, err))
+				}
+			}
+
+			for _, target := range storage.CopyTo {
+				if target == storage.Name {
+					problems = append(problems, storageWhere+": can't copy to itself")
+				} else if !storageNames[target] {
+					problems = append(problems, fmt.Sprintf("%s: copy target '%s' is not defined", storageWhere, target))
+				}
+			}
+		}
+	}
+
+	return problems
+}
+
+// getPreferences returns the preferences to be saved for the repository.  Each storage is merged into the existing
+// preference with the same name, so fields not described by the configuration, such as the repository path or keys
+// added by the set command, are kept; existing storages not in the configuration are kept after those that are.
+func (repository *FleetRepository) getPreferences(existingPreferences []Preference) []Preference {
+
+	existing := make(map[string]Preference)
+	for _, preference := range existingPreferences {
+		existing[preference.Name] = preference
+	}
+
+	var preferences []Preference
+	for _, storage := range repository.Storages {
+		snapshotID := storage.ID
+		if snapshotID == "" {
+			snapshotID = repository.ID
+		}
+
+		preference := existing[storage.Name]
+		delete(existing, storage.Name)
+
+		preference.Name = storage.Name
+		preference.SnapshotID = snapshotID
+		preference.StorageURL = storage.URL
+		preference.Encrypted = storage.Encrypted
+		preference.BackupProhibited = storage.BackupProhibited
+		preference.RestoreProhibited = storage.RestoreProhibited
+		preference.DoNotSavePassword = storage.DoNotSavePassword
+		preference.NobackupFile = storage.NobackupFile
+		preference.Keys = mergeFleetMap(preference.Keys, storage.Keys)
+		preference.Parameters = mergeFleetMap(preference.Parameters, storage.Parameters)
+		preference.CredentialHelper = storage.CredentialHelper
+		preference.Retention = storage.Retention
+		preference.CopyTo = storage.CopyTo
+		preference.BandwidthSchedule = storage.BandwidthSchedule
+		preference.Nice = storage.Nice
+		preference.IOPriority = storage.IOPriority
+		preference.ReadRateLimit = storage.ReadRateLimit
+		preference.MaximumLoad = storage.MaximumLoad
+
+		preferences = append(preferences, preference)
+	}
+
+	for _, preference := range existingPreferences {
+		if _, found := existing[preference.Name]; found {
+			preferences = append(preferences, preference)
+		}
+	}
+	return preferences
+}
+
+// mergeFleetMap returns the entries of 'existing' updated with those from the configuration.
+func mergeFleetMap(existing map[string]string, configured map[string]string) map[string]string {
+	if len(configured) == 0 {
+		return existing
+	}
+	merged := make(map[string]string)
+	for key, value := range existing {
+		merged[key] = value
+	}
+	for key, value := range configured {
+		merged[key] = value
+	}
+	return merged
+}
+
+// writeFileIfChanged writes the file only if its content differs, and returns whether it did (or would, in the dry
+// run mode).
+func writeFileIfChanged(file string, content []byte, mode os.FileMode, dryRun bool) (bool, error) {
+	existing, err := ioutil.ReadFile(file)
+	if err == nil && bytes.Equal(existing, content) {
+		return false, nil
+	}
+
+	if err == nil {
+		LOG_INFO("APPLY_UPDATE", "Updating %s", file)
+	} else {
+		LOG_INFO("APPLY_CREATE", "Creating %s", file)
+	}
+
+	if dryRun {
+		return true, nil
+	}
+	return true, ioutil.WriteFile(file, content, mode)
+}
+
+// apply creates or updates the files under the preference directory of the repository.
+func (repository *FleetRepository) apply(dryRun bool) (changes int, err error) {
+
+	if stat, err := os.Stat(repository.Path); err != nil || !stat.IsDir() {
+		return 0, fmt.Errorf("the repository directory does not exist")
+	}
+
+	preferenceDir := repository.PreferenceDir
+	if preferenceDir == "" {
+		preferenceDir = path.Join(repository.Path, DUPLICACY_DIRECTORY)
+	}
+
+	if !dryRun {
+		err = os.MkdirAll(preferenceDir, 0744)
+		if err != nil {
+			return changes, err
+		}
+	}
+
+	if repository.PreferenceDir != "" {
+		// Same as 'init -pref-dir': the .duplicacy file in the repository points to the preference directory
+		changed, err := writeFileIfChanged(path.Join(repository.Path, DUPLICACY_FILE), []byte(preferenceDir), 0644, dryRun)
+		if err != nil {
+			return changes, err
+		}
+		if changed {
+			changes++
+		}
+	}
+
+	var existingPreferences []Preference
+	description, err := ioutil.ReadFile(path.Join(preferenceDir, "preferences"))
+	if err == nil {
+		err = json.Unmarshal(description, &existingPreferences)
+		if err != nil {
+			return changes, fmt.Errorf("failed to parse the existing preferences: %v", err)
+		}
+	}
+
+	preferences := repository.getPreferences(existingPreferences)
+
+	// Compare the parsed preferences rather than the files so that differences in formatting don't count
+	if !reflect.DeepEqual(preferences, existingPreferences) {
+		description, err = json.MarshalIndent(preferences, "", "    ")
+		if err != nil {
+			return changes, err
+		}
+		changed, err := writeFileIfChanged(path.Join(preferenceDir, "preferences"), description, 0600, dryRun)
+		if err != nil {
+			return changes, err
+		}
+		if changed {
+			changes++
+		}
+	}
+
+	if repository.Filters != nil {
+		content := strings.Join(repository.Filters, "\n") + "\n"
+		changed, err := writeFileIfChanged(path.Join(preferenceDir, "filters"), []byte(content), 0644, dryRun)
+		if err != nil {
+			return changes, err
+		}
+		if changed {
+			changes++
+		}
+	}
+
+	var scriptNames []string
+	for name := range repository.Scripts {
+		scriptNames = append(scriptNames, name)
+	}
+	sort.Strings(scriptNames)
+
+	if len(scriptNames) > 0 && !dryRun {
+		err = os.MkdirAll(path.Join(preferenceDir, "scripts"), 0744)
+		if err != nil {
+			return changes, err
+		}
+	}
+
+	for _, name := range scriptNames {
+		changed, err := writeFileIfChanged(path.Join(preferenceDir, "scripts", name),
+			[]byte(repository.Scripts[name]), 0755, dryRun)
+		if err != nil {
+			return changes, err
+		}
+		if changed {
+			changes++
+		}
+	}
+
+	return changes, nil
+}
+
+// Apply creates or updates the preferences, filters and scripts of all repositories.  Running it again with the
+// same configuration changes nothing.  It returns the number of files created or updated.
+func (config *FleetConfig) Apply(dryRun bool) (changes int, err error) {
+
+	for _, repository := range config.Repositories {
+		n, err := repository.apply(dryRun)
+		changes += n
+		if err != nil {
+			return changes, fmt.Errorf("failed to apply the configuration to %s: %v", repository.Path, err)
+		}
+		if n == 0 {
+			LOG_INFO("APPLY_UNCHANGED", "Repository %s is up to date", repository.Path)
+		}
+	}
+
+	return changes, nil
+}
@@ -0,0 +1,147 @@
+// Copyright (c) Acrosync LLC. All rights reserved.
+// Free for personal use and commercial trial
+// Commercial use requires per-user licenses available from https://duplicacy.com
+
+package duplicacy
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+func TestFleetConfig(t *testing.T) {
+
+	setTestingT(t)
+
+	testDir, err := ioutil.TempDir("", "duplicacy_test")
+	if err != nil {
+		t.Errorf("Failed to create a temporary directory: %v", err)
+		return
+	}
+	defer os.RemoveAll(testDir)
+
+	repository1 := path.Join(testDir, "repository1")
+	repository2 := path.Join(testDir, "repository2")
+	preferenceDir2 := path.Join(testDir, "preferences2")
+	os.Mkdir(repository1, 0700)
+	os.Mkdir(repository2, 0700)
+
+	configFile := path.Join(testDir, "fleet.json")
+	content := `{
+    "repositories": [
+        {
+            "path": "` + repository1 + `",
+            "id": "host1",
+            "filters": ["-*.tmp", "e:^cache/"],
+            "scripts": {"pre-backup": "#!/bin/sh\necho pre\n"},
+            "storages": [
+                {"name": "default", "url": "/storage1", "retention": ["0:30", "1:7"], "copy_to": ["offsite"]},
+                {"name": "offsite", "url": "b2://bucket", "encrypted": true}
+            ]
+        },
+        {
+            "path": "` + repository2 + `",
+            "id": "host2",
+            "pref_dir": "` + preferenceDir2 + `",
+            "storages": [
+                {"name": "default", "url": "sftp://user@host/storage", "id": "host2-alt"}
+            ]
+        }
+    ]
+}`
+	ioutil.WriteFile(configFile, []byte(content), 0600)
+
+	config, err := LoadFleetConfig(configFile)
+	if err != nil {
+		t.Errorf("Failed to load the configuration: %v", err)
+		return
+	}
+
+	if problems := config.Validate(); len(problems) > 0 {
+		t.Errorf("The configuration should be valid: %s", strings.Join(problems, "; "))
+	}
+
+	changes, err := config.Apply(true)
+	if err != nil || changes != 5 {
+		t.Errorf("The dry run reported %d changes (%v) instead of 5", changes, err)
+	}
+	if _, err := os.Stat(path.Join(repository1, DUPLICACY_DIRECTORY)); err == nil {
+		t.Errorf("The dry run should not create any files")
+	}
+
+	changes, err = config.Apply(false)
+	if err != nil || changes != 5 {
+		t.Errorf("The first apply made %d changes (%v) instead of 5", changes, err)
+	}
+
+	changes, err = config.Apply(false)
+	if err != nil || changes != 0 {
+		t.Errorf("The second apply made %d changes (%v) instead of 0", changes, err)
+	}
+
+	if !LoadPreferences(repository1) || len(Preferences) != 2 {
+		t.Errorf("Failed to load the preferences of repository1")
+	} else if Preferences[0].Name != "default" || Preferences[0].SnapshotID != "host1" ||
+		len(Preferences[0].Retention) != 2 || len(Preferences[0].CopyTo) != 1 || !Preferences[1].Encrypted {
+		t.Errorf("Incorrect preferences for repository1: %v", Preferences)
+	}
+
+	if !LoadPreferences(repository2) || len(Preferences) != 1 || Preferences[0].SnapshotID != "host2-alt" {
+		t.Errorf("Failed to load the preferences of repository2 from the preference directory")
+	}
+
+	filters, _ := ioutil.ReadFile(path.Join(repository1, DUPLICACY_DIRECTORY, "filters"))
+	if string(filters) != "-*.tmp\ne:^cache/\n" {
+		t.Errorf("Incorrect filters file: %s", filters)
+	}
+
+	// Changing one storage should only update that preferences file
+	config.Repositories[0].Storages[1].URL = "b2://bucket2"
+	changes, err = config.Apply(false)
+	if err != nil || changes != 1 {
+		t.Errorf("The apply after the change made %d changes (%v) instead of 1", changes, err)
+	}
+
+	// Fields and storages not in the configuration are kept
+	if LoadPreferences(repository1) {
+		Preferences[0].RepositoryPath = "/elsewhere"
+		Preferences[0].Keys = map[string]string{"ssh_key_file": "/root/.ssh/id_rsa"}
+		Preferences = append(Preferences, Preference{Name: "local", SnapshotID: "host1", StorageURL: "/storage3"})
+		SavePreferences()
+	}
+	config.Repositories[0].Storages[0].Keys = map[string]string{"password_file": "/run/secrets/password"}
+	changes, err = config.Apply(false)
+	if err != nil || changes != 1 {
+		t.Errorf("The apply after the merge made %d changes (%v) instead of 1", changes, err)
+	}
+	if !LoadPreferences(repository1) || len(Preferences) != 3 {
+		t.Errorf("The storage not in the configuration was not kept: %v", Preferences)
+	} else if Preferences[0].RepositoryPath != "/elsewhere" || len(Preferences[0].Keys) != 2 ||
+		Preferences[1].StorageURL != "b2://bucket2" || Preferences[2].Name != "local" {
+		t.Errorf("The existing preferences were not merged: %v", Preferences)
+	}
+
+	invalid := &FleetConfig{
+		Repositories: []*FleetRepository{
+			{
+				Path:    "relative",
+				ID:      "bad id",
+				Filters: []string{"i:(["},
+				Scripts: map[string]string{"backup": ""},
+				Storages: []*FleetStorage{
+					{Name: "default", URL: "/storage", Retention: []string{"7"}, CopyTo: []string{"default", "none"},
+						BandwidthSchedule: []string{"08:00-18:00"}},
+					{Name: "default", URL: "storage"},
+				},
+			},
+		},
+	}
+
+	problems := invalid.Validate()
+	if len(problems) != 10 {
+		t.Errorf("Found %d problems instead of 10: %s", len(problems), strings.Join(problems, "; "))
+	}
+}
@@ -66,6 +66,9 @@ func (storage *GCDStorage) shouldRetry(threadIndex int, err error) (bool, error)
 		storage.attempts[threadIndex] = 0
 		return false, nil
 	} else if e, ok := err.(*googleapi.Error); ok {
+		if e.Code == 429 || e.Code == 503 || e.Code == 403 {
+			storage.RecordThrottling()
+		}
 		if 500 <= e.Code && e.Code < 600 {
 			// Retry for 5xx response codes.
 			message = fmt.Sprintf("HTTP status code %d", e.Code)
@@ -113,6 +113,9 @@ func (storage *GCSStorage) shouldRetry(backoff *int, err error) (bool, error) {
 	if err == nil {
 		return false, nil
 	} else if e, ok := err.(*googleapi.Error); ok {
+		if e.Code == 429 || e.Code == 503 || e.Code == 403 {
+			storage.RecordThrottling()
+		}
 		if 500 <= e.Code && e.Code < 600 {
 			// Retry for 5xx response codes.
 			message = fmt.Sprintf("HTTP status code %d", e.Code)
@@ -0,0 +1,77 @@
+// Copyright (c) Acrosync LLC. All rights reserved.
+// Free for personal use and commercial trial
+// Commercial use requires per-user licenses available from https://duplicacy.com
+
+package duplicacy
+
+import (
+	"sync/atomic"
+)
+
+// The maximum number of bytes chunk buffers are allowed to take up, with 0 meaning unlimited.  The budget is enforced
+// by limiting how many chunks the uploader and the downloader can hold at the same time; the chunk maker is held back
+// when the uploader can't take more chunks.
+var memoryBudget int64
+
+// Memory taken up by chunks obtained from Config.GetChunk and not yet returned by Config.PutChunk, and its peak value
+var chunkMemoryInUse int64
+var chunkMemoryPeak int64
+
+// SetMemoryBudget sets the maximum number of bytes chunk buffers can take up; 0 means unlimited.
+func SetMemoryBudget(budget int64) {
+	atomic.StoreInt64(&memoryBudget, budget)
+}
+
+// GetMemoryBudget returns the memory budget for chunk buffers; 0 means unlimited.
+func GetMemoryBudget() int64 {
+	return atomic.LoadInt64(&memoryBudget)
+}
+
+// GetPeakChunkMemory returns the largest amount of memory taken up by chunks in use so far.
+func GetPeakChunkMemory() int64 {
+	return atomic.LoadInt64(&chunkMemoryPeak)
+}
+
+// getChunkMemoryFootprint returns how much memory a chunk in use can take up: its buffer grows to the maximum chunk
+// size, and encryption or decryption needs another buffer of about the same size.
+func getChunkMemoryFootprint(config *Config) int64 {
+	return 2 * int64(config.MaximumChunkSize)
+}
+
+// getMaximumChunksInMemory returns how many chunks can be in use at the same time without exceeding the memory
+// budget, or 0 if there is no budget.  It is at least 2 so one chunk can be filled while another is transferred.
+func getMaximumChunksInMemory(config *Config) int {
+	budget := GetMemoryBudget()
+	footprint := getChunkMemoryFootprint(config)
+	if budget <= 0 || footprint <= 0 {
+		return 0
+	}
+	chunks := int(budget / footprint)
+	if chunks < 2 {
+		chunks = 2
+	}
+	return chunks
+}
+
+// logChunkMemoryStatistics reports the peak memory taken up by chunks, along with the budget if there is one.
+func logChunkMemoryStatistics(logID string) {
+	if budget := GetMemoryBudget(); budget > 0 {
+		LOG_INFO(logID, "Peak chunk memory: %s of the %s budget", PrettySize(GetPeakChunkMemory()), PrettySize(budget))
+	} else {
+		LOG_INFO(logID, "Peak chunk memory: %s", PrettySize(GetPeakChunkMemory()))
+	}
+}
+
+func reserveChunkMemory(config *Config) {
+	inUse := atomic.AddInt64(&chunkMemoryInUse, getChunkMemoryFootprint(config))
+	for {
+		peak := atomic.LoadInt64(&chunkMemoryPeak)
+		if inUse <= peak || atomic.CompareAndSwapInt64(&chunkMemoryPeak, peak, inUse) {
+			return
+		}
+	}
+}
+
+func releaseChunkMemory(config *Config) {
+	atomic.AddInt64(&chunkMemoryInUse, -getChunkMemoryFootprint(config))
+}
@@ -0,0 +1,120 @@
+// Copyright (c) Acrosync LLC. All rights reserved.
+// Free for personal use and commercial trial
+// Commercial use requires per-user licenses available from https://duplicacy.com
+
+package duplicacy
+
+import (
+	crypto_rand "crypto/rand"
+	"os"
+	"path"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// memoryTestStorage records how many uploads are in progress at the same time.
+type memoryTestStorage struct {
+	*FileStorage
+	lock             sync.Mutex
+	uploading        int
+	maximumUploading int
+}
+
+func (storage *memoryTestStorage) UploadFile(threadIndex int, filePath string, content []byte) (err error) {
+	storage.lock.Lock()
+	storage.uploading++
+	if storage.uploading > storage.maximumUploading {
+		storage.maximumUploading = storage.uploading
+	}
+	storage.lock.Unlock()
+
+	time.Sleep(20 * time.Millisecond)
+	err = storage.FileStorage.UploadFile(threadIndex, filePath, content)
+
+	storage.lock.Lock()
+	storage.uploading--
+	storage.lock.Unlock()
+	return err
+}
+
+func TestMemoryBudget(t *testing.T) {
+
+	setTestingT(t)
+
+	testDir := path.Join(os.TempDir(), "duplicacy_test", "memorybudget")
+	os.RemoveAll(testDir)
+	os.MkdirAll(testDir, 0700)
+	defer os.RemoveAll(testDir)
+
+	fileStorage, err := CreateFileStorage(testDir, false, 8)
+	if err != nil {
+		t.Errorf("Failed to create the storage: %v", err)
+		return
+	}
+	fileStorage.CreateDirectory(0, "chunks")
+	storage := &memoryTestStorage{FileStorage: fileStorage}
+
+	config := CreateConfig()
+	config.MaximumChunkSize = 64 * 1024
+	footprint := getChunkMemoryFootprint(config)
+
+	SetMemoryBudget(3 * footprint)
+	defer SetMemoryBudget(0)
+
+	baseline := atomic.LoadInt64(&chunkMemoryInUse)
+	atomic.StoreInt64(&chunkMemoryPeak, baseline)
+
+	uploader := CreateChunkUploader(config, storage, nil, 8,
+		func(chunk *Chunk, chunkIndex int, skipped bool, chunkSize int, uploadSize int) {
+			config.PutChunk(chunk)
+		})
+	uploader.Start()
+
+	var hashes []string
+	for i := 0; i < 20; i++ {
+		content := make([]byte, 1000)
+		crypto_rand.Read(content)
+		chunk := config.GetChunk()
+		chunk.Reset(true)
+		chunk.Write(content)
+		hashes = append(hashes, chunk.GetHash())
+		uploader.StartChunk(chunk, i)
+	}
+	uploader.Stop()
+
+	// One chunk is held by the caller and the rest of the budget goes to the uploader
+	if storage.maximumUploading != 2 {
+		t.Errorf("%d chunks were uploaded at the same time under a budget of 3 chunks", storage.maximumUploading)
+	}
+	if peak := GetPeakChunkMemory() - baseline; peak > 3*footprint {
+		t.Errorf("The peak memory %d exceeds the budget", peak)
+	}
+	if inUse := atomic.LoadInt64(&chunkMemoryInUse); inUse != baseline {
+		t.Errorf("%d bytes of chunk memory were not released", inUse-baseline)
+	}
+
+	downloader := CreateChunkDownloader(config, storage, nil, false, 8)
+	if downloader.maximumActiveChunks != 3 {
+		t.Errorf("The downloader can hold %d chunks under a budget of 3 chunks", downloader.maximumActiveChunks)
+	}
+	for _, hash := range hashes {
+		downloader.AddChunk(hash)
+	}
+	for i, hash := range hashes {
+		chunk := downloader.WaitForChunk(i)
+		if chunk.GetID() != config.GetChunkIDFromHash(hash) {
+			t.Errorf("Chunk %d was not downloaded correctly", i)
+		}
+		if downloader.numberOfActiveChunks > 3 {
+			t.Errorf("The downloader holds %d chunks", downloader.numberOfActiveChunks)
+		}
+	}
+	downloader.Stop()
+
+	SetMemoryBudget(0)
+	if uploader := CreateChunkUploader(config, storage, nil, 8, nil); uploader.memorySlots != nil {
+		t.Errorf("The uploader should not be limited without a budget")
+	}
+}
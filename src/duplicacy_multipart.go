@@ -0,0 +1,188 @@
+// Copyright (c) Acrosync LLC. All rights reserved.
+// Free for personal use and commercial trial
+// Commercial use requires per-user licenses available from https://duplicacy.com
+
+package duplicacy
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"sync"
+)
+
+const (
+	// S3 rejects parts smaller than 5MB except for the last one
+	MinimumPartSize      = 5 * 1024 * 1024
+	DefaultPartSize      = 16 * 1024 * 1024
+	DefaultPartThreads   = 4
+	MaximumNumberOfParts = 10000
+)
+
+// MultipartOptions controls how large files are transferred to and from S3 compatible and B2 storages.  Files
+// larger than the part size are uploaded with the multipart (or B2 large file) upload API and the parts after the
+// first one are downloaded with ranged GETs, with up to 'Threads' parts of the same file being transferred in
+// parallel.  A part size of 0 disables both.
+type MultipartOptions struct {
+	PartSize int
+	Threads  int
+}
+
+// filePart is the byte range [start, end) of a part.
+type filePart struct {
+	start int64
+	end   int64
+}
+
+// CreateMultipartOptions creates the options from the part size in megabytes and the number of parallel transfers.
+// A part size of 0 selects the default, while a negative one disables multipart transfers.
+func CreateMultipartOptions(partSizeInMB int, threads int) (MultipartOptions, error) {
+	options := MultipartOptions{
+		PartSize: partSizeInMB * 1024 * 1024,
+		Threads:  threads,
+	}
+
+	if partSizeInMB < 0 {
+		return MultipartOptions{}, nil
+	} else if partSizeInMB == 0 {
+		options.PartSize = DefaultPartSize
+	} else if options.PartSize < MinimumPartSize {
+		return options, fmt.Errorf("the part size must be at least %d MB", MinimumPartSize/1024/1024)
+	}
+
+	if threads == 0 {
+		options.Threads = DefaultPartThreads
+	} else if threads < 0 {
+		return options, fmt.Errorf("invalid number of part threads %d", threads)
+	}
+
+	return options, nil
+}
+
+// isMultipart returns true if a file of the given size should be transferred in parts.
+func (options MultipartOptions) isMultipart(size int64) bool {
+	return options.PartSize > 0 && size > int64(options.PartSize)
+}
+
+// getParts splits a file of the given size into parts for uploading.  The part size is raised if necessary to stay
+// within the maximum number of parts allowed by S3.
+func (options MultipartOptions) getParts(size int64) []filePart {
+	partSize := int64(options.PartSize)
+	for (size+partSize-1)/partSize > MaximumNumberOfParts {
+		partSize *= 2
+	}
+	return splitParts(0, size, partSize)
+}
+
+// splitParts splits the byte range [start, end) into parts of the given size.
+func splitParts(start int64, end int64, partSize int64) (parts []filePart) {
+	for ; start < end; start += partSize {
+		part := filePart{start: start, end: start + partSize}
+		if part.end > end {
+			part.end = end
+		}
+		parts = append(parts, part)
+	}
+	return parts
+}
+
+// transferParts calls 'transfer' on each part, running up to 'Threads' of them at the same time.  It returns the
+// first error encountered; the remaining parts are skipped once an error has occurred.
+func (options MultipartOptions) transferParts(numberOfParts int, transfer func(index int) error) error {
+
+	threads := options.Threads
+	if threads < 1 {
+		threads = 1
+	}
+
+	var firstError error
+	var errorLock sync.Mutex
+	var waitGroup sync.WaitGroup
+	indices := make(chan int, numberOfParts)
+	for i := 0; i < numberOfParts; i++ {
+		indices <- i
+	}
+	close(indices)
+
+	for i := 0; i < threads && i < numberOfParts; i++ {
+		waitGroup.Add(1)
+		go func() {
+			defer waitGroup.Done()
+			for index := range indices {
+				errorLock.Lock()
+				failed := firstError != nil
+				errorLock.Unlock()
+				if failed {
+					return
+				}
+
+				err := transfer(index)
+				if err != nil {
+					errorLock.Lock()
+					if firstError == nil {
+						firstError = err
+					}
+					errorLock.Unlock()
+				}
+			}
+		}()
+	}
+
+	waitGroup.Wait()
+	return firstError
+}
+
+// getPartRateLimit divides the rate limit of a file among the parts being transferred at the same time.
+func (options MultipartOptions) getPartRateLimit(rateLimit int) int {
+	if options.Threads > 1 {
+		return rateLimit / options.Threads
+	}
+	return rateLimit
+}
+
+// getRangeHeader returns the value of the Range header for downloading the part.
+func (part filePart) getRangeHeader() string {
+	return fmt.Sprintf("bytes=%d-%d", part.start, part.end-1)
+}
+
+// downloadInParts reads a file of the given size from the body of a plain GET.  Files no larger than the part size
+// are read entirely from the body; for larger files only the first part is read, and the remaining parts are
+// downloaded in parallel by 'download'.  A negative size means the size is unknown.
+func (options MultipartOptions) downloadInParts(body io.Reader, size int64, chunk *Chunk, rateLimit int,
+	download func(part filePart, writer io.Writer) error) error {
+
+	if !options.isMultipart(size) {
+		_, err := RateLimitedCopy(chunk, body, rateLimit)
+		return err
+	}
+
+	downloaded, err := RateLimitedCopy(chunk, io.LimitReader(body, int64(options.PartSize)), rateLimit)
+	if err != nil {
+		return err
+	}
+	return options.downloadRemainingParts(downloaded, size, chunk, download)
+}
+
+// downloadRemainingParts downloads the rest of a file whose first 'downloaded' bytes have already been written to
+// the chunk.  The parts are downloaded in parallel by 'download' and then written to the chunk in order.
+func (options MultipartOptions) downloadRemainingParts(downloaded int64, size int64, chunk *Chunk,
+	download func(part filePart, writer io.Writer) error) error {
+
+	parts := splitParts(downloaded, size, int64(options.PartSize))
+	buffers := make([]bytes.Buffer, len(parts))
+	err := options.transferParts(len(parts), func(index int) error {
+		return download(parts[index], &buffers[index])
+	})
+	if err != nil {
+		return err
+	}
+
+	for i := range buffers {
+		if int64(buffers[i].Len()) != parts[i].end-parts[i].start {
+			return fmt.Errorf("expected %d bytes at offset %d but received %d", parts[i].end-parts[i].start,
+				parts[i].start, buffers[i].Len())
+		}
+		chunk.Write(buffers[i].Bytes())
+	}
+	return nil
+}
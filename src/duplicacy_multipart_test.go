@@ -0,0 +1,80 @@
+// Copyright (c) Acrosync LLC. All rights reserved.
+// Free for personal use and commercial trial
+// Commercial use requires per-user licenses available from https://duplicacy.com
+
+package duplicacy
+
+import (
+	"bytes"
+	"crypto/rand"
+	"fmt"
+	"io"
+	"testing"
+)
+
+func TestMultipartOptions(t *testing.T) {
+
+	setTestingT(t)
+
+	options, err := CreateMultipartOptions(0, 0)
+	if err != nil || options.PartSize != DefaultPartSize || options.Threads != DefaultPartThreads {
+		t.Errorf("Incorrect default options: %+v %v", options, err)
+	}
+
+	if _, err = CreateMultipartOptions(1, 0); err == nil {
+		t.Errorf("A part size smaller than the minimum was accepted")
+	}
+
+	options, _ = CreateMultipartOptions(-1, 0)
+	if options.isMultipart(1024 * 1024 * 1024) {
+		t.Errorf("A negative part size should disable multipart transfers")
+	}
+
+	options, _ = CreateMultipartOptions(5, 3)
+	if options.isMultipart(int64(options.PartSize)) || !options.isMultipart(int64(options.PartSize)+1) {
+		t.Errorf("Only files larger than the part size should be transferred in parts")
+	}
+
+	parts := options.getParts(int64(options.PartSize)*2 + 100)
+	if len(parts) != 3 || parts[2].start != int64(options.PartSize)*2 || parts[2].end != int64(options.PartSize)*2+100 {
+		t.Errorf("Incorrect parts: %v", parts)
+	}
+
+	parts = options.getParts(int64(options.PartSize) * (MaximumNumberOfParts + 1))
+	if len(parts) > MaximumNumberOfParts {
+		t.Errorf("%d parts exceed the maximum", len(parts))
+	}
+
+	content := make([]byte, options.PartSize*3+1000)
+	rand.Read(content)
+
+	// Files no larger than one part are read from the plain GET only; larger ones only have their first part read
+	// from it, and the other parts are requested separately
+	for _, size := range []int{1000, options.PartSize, len(content)} {
+		requested := 0
+		chunk := CreateChunk(CreateConfig(), true)
+		chunk.Reset(false)
+		err = options.downloadInParts(bytes.NewReader(content[:size]), int64(size), chunk, 0,
+			func(part filePart, writer io.Writer) error {
+				requested++
+				_, err := writer.Write(content[part.start:part.end])
+				return err
+			})
+		if err != nil || !bytes.Equal(chunk.GetBytes(), content[:size]) {
+			t.Errorf("The file of %d bytes was not reassembled correctly: %v", size, err)
+		}
+		if (size <= options.PartSize) != (requested == 0) {
+			t.Errorf("%d parts were requested for a file of %d bytes", requested, size)
+		}
+	}
+
+	err = options.transferParts(10, func(index int) error {
+		if index == 4 {
+			return fmt.Errorf("part %d failed", index)
+		}
+		return nil
+	})
+	if err == nil {
+		t.Errorf("The error of a failed part was not returned")
+	}
+}
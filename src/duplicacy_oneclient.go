@@ -44,6 +44,9 @@ type OneDriveClient struct {
 
 	IsConnected bool
 	TestMode    bool
+
+	// Called when a request is rejected with 429 or 503
+	ThrottlingFunc func()
 }
 
 func NewOneDriveClient(tokenFile string) (*OneDriveClient, error) {
@@ -162,6 +165,9 @@ func (client *OneDriveClient) call(url string, method string, input interface{},
 			}
 			continue
 		} else if response.StatusCode > 401 && response.StatusCode != 404 {
+			if (response.StatusCode == 429 || response.StatusCode == 503) && client.ThrottlingFunc != nil {
+				client.ThrottlingFunc()
+			}
 			retryAfter := time.Duration(rand.Float32() * 1000.0 * float32(backoff))
 			LOG_INFO("ONEDRIVE_RETRY", "Response code: %d; retry after %d milliseconds", response.StatusCode, retryAfter)
 			time.Sleep(retryAfter * time.Millisecond)
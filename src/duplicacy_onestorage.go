@@ -48,6 +48,7 @@ func CreateOneDriveStorage(tokenFile string, storagePath string, threads int) (s
 		storageDir:     storagePath,
 		numberOfThread: threads,
 	}
+	client.ThrottlingFunc = storage.RecordThrottling
 
 	for _, path := range []string{"chunks", "fossils", "snapshots"} {
 		dir := storagePath + "/" + path
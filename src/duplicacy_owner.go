@@ -0,0 +1,186 @@
+// Copyright (c) Acrosync LLC. All rights reserved.
+// Free for personal use and commercial trial
+// Commercial use requires per-user licenses available from https://duplicacy.com
+
+package duplicacy
+
+import (
+	"fmt"
+	"os"
+	"os/user"
+	"regexp"
+	"strconv"
+	"sync"
+)
+
+// Looking up the user database can be slow so the results are cached, including failed lookups.
+var ownerCacheLock sync.Mutex
+var userNameCache = make(map[int]string)
+var groupNameCache = make(map[int]string)
+var userIDCache = make(map[string]int)
+var groupIDCache = make(map[string]int)
+
+// lookupUserName returns the name of the user with the given uid, or an empty string if there is no such user.
+func lookupUserName(uid int) string {
+	ownerCacheLock.Lock()
+	defer ownerCacheLock.Unlock()
+
+	if name, found := userNameCache[uid]; found {
+		return name
+	}
+
+	name := ""
+	if u, err := user.LookupId(strconv.Itoa(uid)); err == nil {
+		name = u.Username
+	}
+	userNameCache[uid] = name
+	return name
+}
+
+// lookupGroupName returns the name of the group with the given gid, or an empty string if there is no such group.
+func lookupGroupName(gid int) string {
+	ownerCacheLock.Lock()
+	defer ownerCacheLock.Unlock()
+
+	if name, found := groupNameCache[gid]; found {
+		return name
+	}
+
+	name := ""
+	if g, err := user.LookupGroupId(strconv.Itoa(gid)); err == nil {
+		name = g.Name
+	}
+	groupNameCache[gid] = name
+	return name
+}
+
+// lookupUserID returns the local uid of the named user, or -1 if there is no such user.
+func lookupUserID(name string) int {
+	ownerCacheLock.Lock()
+	defer ownerCacheLock.Unlock()
+
+	if uid, found := userIDCache[name]; found {
+		return uid
+	}
+
+	uid := -1
+	if u, err := user.Lookup(name); err == nil {
+		if id, err := strconv.Atoi(u.Uid); err == nil {
+			uid = id
+		}
+	}
+	userIDCache[name] = uid
+	return uid
+}
+
+// lookupGroupID returns the local gid of the named group, or -1 if there is no such group.
+func lookupGroupID(name string) int {
+	ownerCacheLock.Lock()
+	defer ownerCacheLock.Unlock()
+
+	if gid, found := groupIDCache[name]; found {
+		return gid
+	}
+
+	gid := -1
+	if g, err := user.LookupGroup(name); err == nil {
+		if id, err := strconv.Atoi(g.Gid); err == nil {
+			gid = id
+		}
+	}
+	groupIDCache[name] = gid
+	return gid
+}
+
+// OwnerMapping decides which uid and gid a restored file should be given when the user tables on the restoring host
+// differ from those on the host where the backup was made.
+type OwnerMapping struct {
+	// Map the user and group names saved in the snapshot to the local ids with the same names
+	ByName bool
+
+	// Explicit mapping from the saved uids/gids to local ones; these take precedence over name-based mapping
+	UIDs map[int]int
+	GIDs map[int]int
+
+	// Give every restored file to the current user
+	Squash bool
+}
+
+// Regex for matching 'uid:old=new' or 'gid:old=new'
+var ownerMappingRegex = regexp.MustCompile(`^(uid|gid):([0-9]+)=([0-9]+)$`)
+
+// CreateOwnerMapping creates an owner mapping.  Each of the 'mappings' is in the form of 'uid:old=new' or
+// 'gid:old=new'.
+func CreateOwnerMapping(byName bool, mappings []string, squash bool) (*OwnerMapping, error) {
+
+	mapping := &OwnerMapping{
+		ByName: byName,
+		UIDs:   make(map[int]int),
+		GIDs:   make(map[int]int),
+		Squash: squash,
+	}
+
+	for _, spec := range mappings {
+		matched := ownerMappingRegex.FindStringSubmatch(spec)
+		if matched == nil {
+			return nil, fmt.Errorf("Invalid owner mapping '%s'; use a mapping like 'uid:1000=501' or 'gid:100=20'", spec)
+		}
+
+		from, _ := strconv.Atoi(matched[2])
+		to, _ := strconv.Atoi(matched[3])
+		if matched[1] == "uid" {
+			mapping.UIDs[from] = to
+		} else {
+			mapping.GIDs[from] = to
+		}
+	}
+
+	return mapping, nil
+}
+
+// MapOwner returns the uid and gid that 'entry' should be restored with.
+func (mapping *OwnerMapping) MapOwner(entry *Entry) (uid int, gid int) {
+
+	if mapping.Squash {
+		return os.Getuid(), os.Getgid()
+	}
+
+	uid, gid = entry.UID, entry.GID
+
+	if newUID, found := mapping.UIDs[entry.UID]; found {
+		uid = newUID
+	} else if mapping.ByName && entry.UserName != "" {
+		if newUID := lookupUserID(entry.UserName); newUID != -1 {
+			uid = newUID
+		} else {
+			LOG_DEBUG("RESTORE_OWNER", "User %s not found for %s; keeping uid %d", entry.UserName, entry.Path, uid)
+		}
+	}
+
+	if newGID, found := mapping.GIDs[entry.GID]; found {
+		gid = newGID
+	} else if mapping.ByName && entry.GroupName != "" {
+		if newGID := lookupGroupID(entry.GroupName); newGID != -1 {
+			gid = newGID
+		} else {
+			LOG_DEBUG("RESTORE_OWNER", "Group %s not found for %s; keeping gid %d", entry.GroupName, entry.Path, gid)
+		}
+	}
+
+	return uid, gid
+}
+
+// Apply replaces the uid and gid of every entry with the mapped ones.  Entries without ownership information are
+// left alone.
+func (mapping *OwnerMapping) Apply(entries []*Entry) {
+	if mapping == nil {
+		return
+	}
+
+	for _, entry := range entries {
+		if entry.UID == -1 || entry.GID == -1 {
+			continue
+		}
+		entry.UID, entry.GID = mapping.MapOwner(entry)
+	}
+}
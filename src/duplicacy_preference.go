@@ -25,6 +25,15 @@ type Preference struct {
 	DoNotSavePassword bool              `json:"no_save_password"`
 	NobackupFile      string            `json:"nobackup_file"`
 	Keys              map[string]string `json:"keys"`
+	CredentialHelper  string            `json:"credential_helper,omitempty"`
+	Retention         []string          `json:"retention,omitempty"`
+	CopyTo            []string          `json:"copy_to,omitempty"`
+	Parameters        map[string]string `json:"parameters,omitempty"`
+	BandwidthSchedule []string          `json:"bandwidth_schedule,omitempty"`
+	Nice              int               `json:"nice,omitempty"`
+	IOPriority        string            `json:"io_priority,omitempty"`
+	ReadRateLimit     int               `json:"read_limit_rate,omitempty"`
+	MaximumLoad       float64           `json:"max_load,omitempty"`
 }
 
 var preferencePath string
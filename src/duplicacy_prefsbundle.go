@@ -0,0 +1,286 @@
+// Copyright (c) Acrosync LLC. All rights reserved.
+// Free for personal use and commercial trial
+// Commercial use requires per-user licenses available from https://duplicacy.com
+
+package duplicacy
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strings"
+)
+
+const PREFERENCE_BUNDLE_VERSION = 1
+
+// All secret types that storage backends may look up, used to find the secrets to be exported
+var storageSecretTypes = []string{
+	"password", "acd_token", "azure_key", "azure_sas_token", "azure_client_secret", "b2_id", "b2_key",
+	"dropbox_token", "gcd_token", "gcs_token", "hubic_token", "one_token", "s3_id", "s3_secret", "s3_sse_c_key",
+	"ssh_key_file", "ssh_password", "swift_key", "wasabi_key", "wasabi_secret", "webdav_password",
+}
+
+// PreferenceBundle holds everything under the preference directory needed to set up a repository on another
+// machine: the storage preferences, the filters file, the scripts and, optionally, the secrets saved in the
+// keychain/keyring or the secret store.  Secrets are encrypted with a passphrase that is not part of the bundle.
+// The keys in the preferences may hold secrets too, so they are only exported encrypted along with the secrets.
+type PreferenceBundle struct {
+	Version     int               `json:"version"`
+	Preferences []Preference      `json:"preferences"`
+	Filters     *string           `json:"filters,omitempty"`
+	Scripts     map[string]string `json:"scripts,omitempty"`
+	SecretSalt  []byte            `json:"secret_salt,omitempty"`
+	Secrets     []byte            `json:"secrets,omitempty"`
+}
+
+// preferenceBundleSecrets is what is encrypted into PreferenceBundle.Secrets.
+type preferenceBundleSecrets struct {
+	Secrets map[string]string            `json:"secrets"`
+	Keys    map[string]map[string]string `json:"keys,omitempty"` // the keys in the preferences of each storage
+}
+
+// getSavedSecret returns the secret saved by SavePassword, without asking the credential helper or the user.
+func getSavedSecret(passwordID string) string {
+	if SecretStoreExists() {
+		return secretStoreGet(passwordID)
+	}
+	return keyringGet(passwordID)
+}
+
+// ExportPreferences creates a bundle from the loaded preferences and the files under the preference directory.
+// Secrets are included only if 'passphrase' is not empty.
+func ExportPreferences(passphrase string) (*PreferenceBundle, error) {
+
+	bundle := &PreferenceBundle{
+		Version:     PREFERENCE_BUNDLE_VERSION,
+		Preferences: make([]Preference, len(Preferences)),
+	}
+
+	keys := make(map[string]map[string]string)
+	for i, preference := range Preferences {
+		if len(preference.Keys) > 0 {
+			keys[preference.Name] = preference.Keys
+			preference.Keys = nil
+		}
+		bundle.Preferences[i] = preference
+	}
+
+	preferenceDir := GetDuplicacyPreferencePath()
+
+	filters, err := ioutil.ReadFile(path.Join(preferenceDir, "filters"))
+	if err == nil {
+		content := string(filters)
+		bundle.Filters = &content
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	scriptDir := path.Join(preferenceDir, "scripts")
+	files, err := ioutil.ReadDir(scriptDir)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	for _, file := range files {
+		if !file.Mode().IsRegular() {
+			continue
+		}
+		content, err := ioutil.ReadFile(path.Join(scriptDir, file.Name()))
+		if err != nil {
+			return nil, err
+		}
+		if bundle.Scripts == nil {
+			bundle.Scripts = make(map[string]string)
+		}
+		bundle.Scripts[file.Name()] = string(content)
+	}
+
+	if passphrase == "" {
+		if len(keys) > 0 {
+			LOG_INFO("PREFERENCE_EXPORT", "The keys in the preferences of %d storages are only exported with the secrets",
+				len(keys))
+		}
+		return bundle, nil
+	}
+
+	secrets := make(map[string]string)
+	for _, preference := range Preferences {
+		for _, secretType := range storageSecretTypes {
+			passwordID := secretType
+			if preference.Name != "default" {
+				passwordID = preference.Name + "_" + secretType
+			}
+			if secret := getSavedSecret(passwordID); secret != "" {
+				LOG_DEBUG("PREFERENCE_EXPORT", "Exporting %s", passwordID)
+				secrets[passwordID] = secret
+			}
+		}
+	}
+	LOG_INFO("PREFERENCE_EXPORT", "%d secrets will be exported", len(secrets))
+
+	description, err := json.Marshal(&preferenceBundleSecrets{Secrets: secrets, Keys: keys})
+	if err != nil {
+		return nil, err
+	}
+
+	// The encryption of the secret store works just as well here
+	store := &SecretStore{Salt: make([]byte, 32)}
+	_, err = rand.Read(store.Salt)
+	if err != nil {
+		return nil, err
+	}
+	err = store.unlock(passphrase)
+	if err != nil {
+		return nil, err
+	}
+	bundle.Secrets, err = store.encrypt("secrets", string(description))
+	if err != nil {
+		return nil, err
+	}
+	bundle.SecretSalt = store.Salt
+
+	return bundle, nil
+}
+
+// LoadPreferenceBundle reads a bundle created by the export command.
+func LoadPreferenceBundle(bundleFile string) (*PreferenceBundle, error) {
+	description, err := ioutil.ReadFile(bundleFile)
+	if err != nil {
+		return nil, err
+	}
+
+	bundle := &PreferenceBundle{}
+	err = json.Unmarshal(description, bundle)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %v", bundleFile, err)
+	}
+
+	if bundle.Version > PREFERENCE_BUNDLE_VERSION {
+		return nil, fmt.Errorf("unsupported bundle version %d", bundle.Version)
+	}
+	return bundle, nil
+}
+
+// Save writes the bundle to a file that only the current user can read.
+func (bundle *PreferenceBundle) Save(bundleFile string) error {
+	description, err := json.MarshalIndent(bundle, "", "    ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(bundleFile, description, 0600)
+}
+
+// HasSecrets returns true if the bundle was exported with secrets.
+func (bundle *PreferenceBundle) HasSecrets() bool {
+	return len(bundle.Secrets) > 0
+}
+
+// RewriteStorageURLs replaces the prefix of storage urls according to the rewrite rules, each in the form of
+// 'old=new'.  Only the first matching rule is applied to each url.
+func (bundle *PreferenceBundle) RewriteStorageURLs(rewrites []string) error {
+
+	for _, rewrite := range rewrites {
+		if !strings.Contains(rewrite, "=") || strings.HasPrefix(rewrite, "=") {
+			return fmt.Errorf("invalid rewrite rule '%s'", rewrite)
+		}
+	}
+
+	for i := range bundle.Preferences {
+		preference := &bundle.Preferences[i]
+		for _, rewrite := range rewrites {
+			index := strings.Index(rewrite, "=")
+			prefix := rewrite[:index]
+			if strings.HasPrefix(preference.StorageURL, prefix) {
+				url := rewrite[index+1:] + preference.StorageURL[len(prefix):]
+				LOG_INFO("PREFERENCE_REWRITE", "Storage %s: %s => %s", preference.Name, preference.StorageURL, url)
+				preference.StorageURL = url
+				break
+			}
+		}
+	}
+	return nil
+}
+
+// Import writes the preferences, filters and scripts to the preference directory, and saves the secrets to the
+// secret store or the keychain/keyring.  'passphrase' is only needed if the bundle has secrets.
+func (bundle *PreferenceBundle) Import(passphrase string) error {
+
+	for name := range bundle.Scripts {
+		if strings.ContainsAny(name, `/\`) || name == "." || name == ".." {
+			return fmt.Errorf("invalid script name '%s'", name)
+		}
+	}
+
+	var secrets preferenceBundleSecrets
+	if bundle.HasSecrets() && passphrase != "" {
+		store := &SecretStore{Salt: bundle.SecretSalt}
+		err := store.unlock(passphrase)
+		if err != nil {
+			return err
+		}
+		description, err := store.decrypt("secrets", bundle.Secrets)
+		if err != nil {
+			return fmt.Errorf("the secrets can't be decrypted with the passphrase")
+		}
+		err = json.Unmarshal([]byte(description), &secrets)
+		if err != nil {
+			return err
+		}
+	}
+
+	preferenceDir := GetDuplicacyPreferencePath()
+
+	Preferences = bundle.Preferences
+	for i := range Preferences {
+		if keys, found := secrets.Keys[Preferences[i].Name]; found {
+			Preferences[i].Keys = keys
+		}
+	}
+	if !SavePreferences() {
+		return fmt.Errorf("failed to save the preferences")
+	}
+
+	if bundle.Filters != nil {
+		err := ioutil.WriteFile(path.Join(preferenceDir, "filters"), []byte(*bundle.Filters), 0644)
+		if err != nil {
+			return err
+		}
+	}
+
+	if len(bundle.Scripts) > 0 {
+		scriptDir := path.Join(preferenceDir, "scripts")
+		err := os.MkdirAll(scriptDir, 0744)
+		if err != nil {
+			return err
+		}
+		for name, content := range bundle.Scripts {
+			err = ioutil.WriteFile(path.Join(scriptDir, name), []byte(content), 0755)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	var names []string
+	for name := range secrets.Secrets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		LOG_DEBUG("PREFERENCE_IMPORT", "Importing %s", name)
+		if SecretStoreExists() {
+			secretStoreSet(name, secrets.Secrets[name])
+		} else {
+			keyringSet(name, secrets.Secrets[name])
+		}
+	}
+	if len(names) > 0 {
+		LOG_INFO("PREFERENCE_IMPORT", "%d secrets have been imported", len(names))
+	}
+
+	return nil
+}
@@ -0,0 +1,151 @@
+// Copyright (c) Acrosync LLC. All rights reserved.
+// Free for personal use and commercial trial
+// Commercial use requires per-user licenses available from https://duplicacy.com
+
+package duplicacy
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestPreferenceBundle(t *testing.T) {
+
+	setTestingT(t)
+
+	testDir, err := ioutil.TempDir("", "duplicacy_test")
+	if err != nil {
+		t.Errorf("Failed to create a temporary directory: %v", err)
+		return
+	}
+	defer os.RemoveAll(testDir)
+
+	sourceDir := filepath.Join(testDir, "source")
+	destinationDir := filepath.Join(testDir, "destination")
+	os.MkdirAll(filepath.Join(sourceDir, "scripts"), 0700)
+	os.Mkdir(destinationDir, 0700)
+
+	keyFile := filepath.Join(testDir, "key")
+	ioutil.WriteFile(keyFile, []byte("0123456789abcdef"), 0600)
+
+	// Secrets are saved to the secret store so the test doesn't touch the real keychain/keyring
+	SetDuplicacyPreferencePath(sourceDir)
+	openedSecretStore = nil
+	store, err := CreateSecretStore(SECRET_STORE_KEY_FILE, keyFile)
+	if err != nil {
+		t.Errorf("Failed to create the secret store: %v", err)
+		return
+	}
+	store.Set("password", "secret1")
+	store.Set("offsite_s3_secret", "secret2")
+	store.Set("unrelated", "secret3")
+
+	ioutil.WriteFile(filepath.Join(sourceDir, "filters"), []byte("-*.tmp\n"), 0644)
+	ioutil.WriteFile(filepath.Join(sourceDir, "scripts", "pre-backup"), []byte("#!/bin/sh\n"), 0755)
+
+	Preferences = []Preference{
+		{Name: "default", SnapshotID: "host1", StorageURL: "sftp://user@nas/duplicacy"},
+		{Name: "offsite", SnapshotID: "host1", StorageURL: "s3://us-east-1@amazon.com/bucket",
+			Keys: map[string]string{"s3_id": "secret4", "s3_secret": "secret5"}},
+	}
+
+	// Keys in the preferences are left out without the secrets
+	bundle, err := ExportPreferences("")
+	if err != nil {
+		t.Errorf("Failed to export the preferences: %v", err)
+		return
+	}
+	description, _ := json.Marshal(bundle)
+	for _, secret := range []string{"secret1", "secret2", "secret4", "secret5"} {
+		if strings.Contains(string(description), secret) {
+			t.Errorf("The secret %s is exported without -secrets", secret)
+		}
+	}
+	if len(Preferences[1].Keys) != 2 {
+		t.Errorf("The keys were removed from the loaded preferences")
+	}
+
+	bundleFile := filepath.Join(testDir, "bundle.json")
+	bundle, err = ExportPreferences("passphrase")
+	if err != nil {
+		t.Errorf("Failed to export the preferences: %v", err)
+		return
+	}
+	err = bundle.Save(bundleFile)
+	if err != nil {
+		t.Errorf("Failed to save the bundle: %v", err)
+		return
+	}
+
+	description, _ = ioutil.ReadFile(bundleFile)
+	for _, secret := range []string{"secret1", "secret2", "secret3", "secret4", "secret5"} {
+		if strings.Contains(string(description), secret) {
+			t.Errorf("The secret %s is stored in the bundle in plain text", secret)
+		}
+	}
+
+	bundle, err = LoadPreferenceBundle(bundleFile)
+	if err != nil {
+		t.Errorf("Failed to load the bundle: %v", err)
+		return
+	}
+
+	err = bundle.RewriteStorageURLs([]string{"sftp://user@nas/=sftp://user@nas2/", "sftp://=none"})
+	if err != nil {
+		t.Errorf("Failed to rewrite the storage urls: %v", err)
+	}
+	if bundle.Preferences[0].StorageURL != "sftp://user@nas2/duplicacy" {
+		t.Errorf("The storage url was rewritten to %s", bundle.Preferences[0].StorageURL)
+	}
+	if bundle.Preferences[1].StorageURL != "s3://us-east-1@amazon.com/bucket" {
+		t.Errorf("The storage url should not be rewritten: %s", bundle.Preferences[1].StorageURL)
+	}
+	if bundle.RewriteStorageURLs([]string{"no rule"}) == nil {
+		t.Errorf("An invalid rewrite rule was accepted")
+	}
+
+	SetDuplicacyPreferencePath(destinationDir)
+	openedSecretStore = nil
+	_, err = CreateSecretStore(SECRET_STORE_KEY_FILE, keyFile)
+	if err != nil {
+		t.Errorf("Failed to create the secret store: %v", err)
+		return
+	}
+
+	if bundle.Import("wrong") == nil {
+		t.Errorf("The secrets were decrypted with a wrong passphrase")
+	}
+
+	Preferences = nil
+	err = bundle.Import("passphrase")
+	if err != nil {
+		t.Errorf("Failed to import the bundle: %v", err)
+		return
+	}
+
+	description, _ = ioutil.ReadFile(filepath.Join(destinationDir, "preferences"))
+	if !strings.Contains(string(description), "sftp://user@nas2/duplicacy") {
+		t.Errorf("The preferences were not imported")
+	}
+	if len(Preferences) != 2 || Preferences[1].Keys["s3_secret"] != "secret5" {
+		t.Errorf("The keys in the preferences were not imported: %v", Preferences)
+	}
+
+	filters, _ := ioutil.ReadFile(filepath.Join(destinationDir, "filters"))
+	script, _ := ioutil.ReadFile(filepath.Join(destinationDir, "scripts", "pre-backup"))
+	if string(filters) != "-*.tmp\n" || string(script) != "#!/bin/sh\n" {
+		t.Errorf("The filters or scripts were not imported")
+	}
+
+	store, _ = OpenSecretStore()
+	if names := store.List(); len(names) != 2 || names[0] != "offsite_s3_secret" || names[1] != "password" {
+		t.Errorf("The imported secrets are %v", names)
+	}
+	if value, _ := store.Get("offsite_s3_secret"); value != "secret2" {
+		t.Errorf("The imported secret is '%s' instead of 'secret2'", value)
+	}
+}
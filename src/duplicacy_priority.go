@@ -0,0 +1,71 @@
+// Copyright (c) Acrosync LLC. All rights reserved.
+// Free for personal use and commercial trial
+// Commercial use requires per-user licenses available from https://duplicacy.com
+
+package duplicacy
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// I/O scheduling classes, using the values of the Linux ioprio_set system call
+const (
+	IOPriorityClassBestEffort = 2
+	IOPriorityClassIdle       = 3
+)
+
+// ParseIOPriority parses an I/O priority in the form of 'idle', 'best-effort', or 'best-effort:<level>' where the
+// level ranges from 0 (highest) to 7 (lowest) and defaults to 4.  Only classes that don't require special privileges
+// are accepted.
+func ParseIOPriority(value string) (class int, level int, err error) {
+	name := strings.ToLower(value)
+	levelString := ""
+	if index := strings.Index(name, ":"); index >= 0 {
+		name, levelString = name[:index], name[index+1:]
+	}
+
+	switch name {
+	case "idle":
+		if levelString != "" {
+			return 0, 0, fmt.Errorf("the idle I/O priority class doesn't take a level")
+		}
+		return IOPriorityClassIdle, 0, nil
+	case "best-effort", "be":
+		level = 4
+		if levelString != "" {
+			level, err = strconv.Atoi(levelString)
+			if err != nil || level < 0 || level > 7 {
+				return 0, 0, fmt.Errorf("invalid I/O priority level '%s'", levelString)
+			}
+		}
+		return IOPriorityClassBestEffort, level, nil
+	default:
+		return 0, 0, fmt.Errorf("invalid I/O priority '%s'; must be 'idle' or 'best-effort[:<level>]'", value)
+	}
+}
+
+// SetProcessPriority lowers the CPU priority of the process to the given nice value (0 to leave it unchanged) and
+// sets its I/O priority (empty to leave it unchanged).
+func SetProcessPriority(nice int, ioPriority string) error {
+	if nice < 0 || nice > 19 {
+		return fmt.Errorf("invalid nice value %d; must be between 0 and 19", nice)
+	}
+	if nice > 0 {
+		if err := setNice(nice); err != nil {
+			return fmt.Errorf("failed to set the nice value to %d: %v", nice, err)
+		}
+	}
+
+	if ioPriority != "" {
+		class, level, err := ParseIOPriority(ioPriority)
+		if err != nil {
+			return err
+		}
+		if err = setIOPriority(class, level); err != nil {
+			return fmt.Errorf("failed to set the I/O priority to %s: %v", ioPriority, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,68 @@
+// Copyright (c) Acrosync LLC. All rights reserved.
+// Free for personal use and commercial trial
+// Commercial use requires per-user licenses available from https://duplicacy.com
+
+package duplicacy
+
+import (
+	"fmt"
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+const (
+	ioprioWhoProcess = 1
+	ioprioClassShift = 13
+)
+
+// getThreadIDs returns the ids of all threads of the process.  On Linux both the nice value and the I/O priority
+// belong to individual threads, and only threads created afterwards inherit them.
+func getThreadIDs() []int {
+	var ids []int
+	if entries, err := ioutil.ReadDir("/proc/self/task"); err == nil {
+		for _, entry := range entries {
+			if id, err := strconv.Atoi(entry.Name()); err == nil {
+				ids = append(ids, id)
+			}
+		}
+	}
+	if len(ids) == 0 {
+		ids = append(ids, 0)
+	}
+	return ids
+}
+
+func setNice(nice int) error {
+	for _, id := range getThreadIDs() {
+		if err := syscall.Setpriority(syscall.PRIO_PROCESS, id, nice); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func setIOPriority(class int, level int) error {
+	priority := class<<ioprioClassShift | level
+	for _, id := range getThreadIDs() {
+		_, _, errno := syscall.Syscall(syscall.SYS_IOPRIO_SET, ioprioWhoProcess, uintptr(id), uintptr(priority))
+		if errno != 0 {
+			return errno
+		}
+	}
+	return nil
+}
+
+// GetSystemLoad returns the one-minute load average.
+func GetSystemLoad() (float64, error) {
+	content, err := ioutil.ReadFile("/proc/loadavg")
+	if err != nil {
+		return 0, err
+	}
+	fields := strings.Fields(string(content))
+	if len(fields) == 0 {
+		return 0, fmt.Errorf("/proc/loadavg is empty")
+	}
+	return strconv.ParseFloat(fields[0], 64)
+}
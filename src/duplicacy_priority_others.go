@@ -0,0 +1,26 @@
+// Copyright (c) Acrosync LLC. All rights reserved.
+// Free for personal use and commercial trial
+// Commercial use requires per-user licenses available from https://duplicacy.com
+
+// +build !windows
+// +build !linux
+
+package duplicacy
+
+import (
+	"fmt"
+	"syscall"
+)
+
+func setNice(nice int) error {
+	return syscall.Setpriority(syscall.PRIO_PROCESS, 0, nice)
+}
+
+func setIOPriority(class int, level int) error {
+	return fmt.Errorf("I/O priorities are not supported on this platform")
+}
+
+// GetSystemLoad returns the one-minute load average.
+func GetSystemLoad() (float64, error) {
+	return 0, fmt.Errorf("the system load is not available on this platform")
+}
@@ -0,0 +1,107 @@
+// Copyright (c) Acrosync LLC. All rights reserved.
+// Free for personal use and commercial trial
+// Commercial use requires per-user licenses available from https://duplicacy.com
+
+package duplicacy
+
+import (
+	"bytes"
+	crypto_rand "crypto/rand"
+	"io"
+	"runtime"
+	"testing"
+	"time"
+)
+
+func TestParseIOPriority(t *testing.T) {
+
+	setTestingT(t)
+
+	testCases := []struct {
+		value string
+		class int
+		level int
+	}{
+		{"idle", IOPriorityClassIdle, 0},
+		{"best-effort", IOPriorityClassBestEffort, 4},
+		{"BE:7", IOPriorityClassBestEffort, 7},
+		{"best-effort:0", IOPriorityClassBestEffort, 0},
+	}
+
+	for _, testCase := range testCases {
+		class, level, err := ParseIOPriority(testCase.value)
+		if err != nil {
+			t.Errorf("Failed to parse '%s': %v", testCase.value, err)
+		} else if class != testCase.class || level != testCase.level {
+			t.Errorf("'%s' was parsed as class %d level %d", testCase.value, class, level)
+		}
+	}
+
+	for _, value := range []string{"", "realtime", "idle:3", "best-effort:8", "be:x"} {
+		if _, _, err := ParseIOPriority(value); err == nil {
+			t.Errorf("'%s' should not be a valid I/O priority", value)
+		}
+	}
+
+	if err := SetProcessPriority(20, ""); err == nil {
+		t.Errorf("A nice value of 20 should not be accepted")
+	}
+
+	if runtime.GOOS == "linux" {
+		if load, err := GetSystemLoad(); err != nil || load < 0 {
+			t.Errorf("Failed to get the system load: %v", err)
+		}
+	}
+}
+
+func TestChunkMakerReadThrottling(t *testing.T) {
+
+	setTestingT(t)
+
+	config := CreateConfig()
+	config.AverageChunkSize = 64 * 1024
+	config.MaximumChunkSize = 256 * 1024
+	config.MinimumChunkSize = 16 * 1024
+	config.ChunkSeed = []byte("duplicacy")
+	config.HashKey = DEFAULT_KEY
+	config.IDKey = DEFAULT_KEY
+
+	content := make([]byte, 1024*1024)
+	crypto_rand.Read(content)
+
+	readContent := func(maker *ChunkMaker) (int, time.Duration) {
+		startTime := time.Now()
+		total := 0
+		maker.ForEachChunk(bytes.NewReader(content),
+			func(chunk *Chunk, final bool) {
+				total += chunk.GetLength()
+				config.PutChunk(chunk)
+			},
+			func(size int64, hash string) (io.Reader, bool) {
+				return nil, false
+			})
+		return total, time.Since(startTime)
+	}
+
+	// 1M at 2M/s should take about half a second after the initial burst of 2M is used up by the first read
+	maker := CreateChunkMaker(config, false)
+	maker.SetReadThrottling(2048, 0)
+	maker.readLimiter.Wait(2048 * 1024)
+	total, elapsed := readContent(maker)
+	if total != len(content) {
+		t.Errorf("%d bytes were chunked instead of %d", total, len(content))
+	}
+	if elapsed < 300*time.Millisecond || elapsed > 2*time.Second {
+		t.Errorf("Reading 1M at 2M/s took %s", elapsed)
+	}
+
+	// A load that can't be reached never pauses reading
+	if runtime.GOOS != "linux" {
+		return
+	}
+	maker = CreateChunkMaker(config, false)
+	maker.SetReadThrottling(0, 1000000)
+	if _, elapsed = readContent(maker); elapsed > time.Second {
+		t.Errorf("Reading without throttling took %s", elapsed)
+	}
+}
@@ -0,0 +1,52 @@
+// Copyright (c) Acrosync LLC. All rights reserved.
+// Free for personal use and commercial trial
+// Commercial use requires per-user licenses available from https://duplicacy.com
+
+package duplicacy
+
+import (
+	"fmt"
+	"syscall"
+)
+
+const (
+	IDLE_PRIORITY_CLASS           = 0x00000040
+	BELOW_NORMAL_PRIORITY_CLASS   = 0x00004000
+	PROCESS_MODE_BACKGROUND_BEGIN = 0x00100000
+)
+
+var procSetPriorityClass = dllkernel32.NewProc("SetPriorityClass")
+
+func setPriorityClass(class uintptr) error {
+	process, err := syscall.GetCurrentProcess()
+	if err != nil {
+		return err
+	}
+	r, _, err := procSetPriorityClass.Call(uintptr(process), class)
+	if r == 0 {
+		return err
+	}
+	return nil
+}
+
+// setNice maps nice values to priority classes: up to 9 is below normal and 10 or higher is idle.
+func setNice(nice int) error {
+	if nice >= 10 {
+		return setPriorityClass(IDLE_PRIORITY_CLASS)
+	}
+	return setPriorityClass(BELOW_NORMAL_PRIORITY_CLASS)
+}
+
+// setIOPriority puts the process in the background mode for the idle class, which lowers its I/O and memory
+// priorities.  The best-effort class is the default.
+func setIOPriority(class int, level int) error {
+	if class == IOPriorityClassIdle {
+		return setPriorityClass(PROCESS_MODE_BACKGROUND_BEGIN)
+	}
+	return nil
+}
+
+// GetSystemLoad returns the one-minute load average.
+func GetSystemLoad() (float64, error) {
+	return 0, fmt.Errorf("the system load is not available on this platform")
+}
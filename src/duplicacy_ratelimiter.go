@@ -0,0 +1,159 @@
+// Copyright (c) Acrosync LLC. All rights reserved.
+// Free for personal use and commercial trial
+// Commercial use requires per-user licenses available from https://duplicacy.com
+
+package duplicacy
+
+import (
+	"sync"
+	"time"
+)
+
+// RateLimiter is a token bucket shared by all threads transferring in the same direction, so that the rate limit
+// applies to the total transfer rate rather than to each individual transfer.  Tokens are bytes; they accumulate at
+// the configured rate up to the burst size while the limiter is idle.  A transfer larger than the tokens available
+// is still allowed to proceed, but the thread has to wait until the deficit has been paid off, which also holds back
+// any thread coming after it.
+type RateLimiter struct {
+	lock sync.Mutex
+
+	rate         float64 // Bytes per second; 0 means unlimited
+	burst        float64 // Maximum number of tokens that can be accumulated
+	defaultBurst bool    // If the burst size follows the rate
+	tokens       float64
+	lastTime     time.Time
+
+	startTime        time.Time
+	transferredBytes int64
+	throttledCount   int64         // Number of transfers that had to wait
+	waitTime         time.Duration // Total time spent waiting by all threads
+}
+
+// CreateRateLimiter creates a rate limiter with the rate in kilobytes/sec and the burst size in kilobytes.  If the
+// burst size is 0, the limiter allows one second worth of data to be sent at once.
+func CreateRateLimiter(rate int, burst int) *RateLimiter {
+	now := time.Now()
+	limiter := &RateLimiter{
+		defaultBurst: burst <= 0,
+		burst:        float64(burst) * 1024,
+		lastTime:     now,
+		startTime:    now,
+	}
+	limiter.setRate(rate)
+	limiter.tokens = limiter.burst
+	return limiter
+}
+
+// SetRate changes the rate limit (in kilobytes/sec), with 0 meaning unlimited.  Tokens accumulated so far are kept.
+func (limiter *RateLimiter) SetRate(rate int) {
+	if limiter == nil {
+		return
+	}
+	limiter.lock.Lock()
+	defer limiter.lock.Unlock()
+	limiter.refill(time.Now())
+	limiter.setRate(rate)
+}
+
+func (limiter *RateLimiter) setRate(rate int) {
+	limiter.rate = float64(rate) * 1024
+	if limiter.defaultBurst {
+		limiter.burst = limiter.rate
+	}
+	if limiter.tokens > limiter.burst {
+		limiter.tokens = limiter.burst
+	}
+}
+
+// GetRate returns the current rate limit in kilobytes/sec.
+func (limiter *RateLimiter) GetRate() int {
+	if limiter == nil {
+		return 0
+	}
+	limiter.lock.Lock()
+	defer limiter.lock.Unlock()
+	return int(limiter.rate / 1024)
+}
+
+func (limiter *RateLimiter) refill(now time.Time) {
+	if elapsed := now.Sub(limiter.lastTime); elapsed > 0 {
+		limiter.tokens += elapsed.Seconds() * limiter.rate
+		if limiter.tokens > limiter.burst {
+			limiter.tokens = limiter.burst
+		}
+	}
+	limiter.lastTime = now
+}
+
+// Wait takes 'size' bytes worth of tokens from the bucket, blocking until the bucket is no longer in deficit.  It
+// can be called before an upload, or after a download when the size isn't known in advance.  A nil limiter never
+// blocks.
+func (limiter *RateLimiter) Wait(size int) {
+	if limiter == nil {
+		return
+	}
+
+	limiter.lock.Lock()
+	limiter.transferredBytes += int64(size)
+	if limiter.rate == 0 {
+		limiter.lastTime = time.Now()
+		limiter.lock.Unlock()
+		return
+	}
+
+	limiter.refill(time.Now())
+	limiter.tokens -= float64(size)
+	var delay time.Duration
+	if limiter.tokens < 0 {
+		delay = time.Duration(-limiter.tokens / limiter.rate * float64(time.Second))
+		limiter.throttledCount++
+		limiter.waitTime += delay
+	}
+	limiter.lock.Unlock()
+
+	if delay > 0 {
+		time.Sleep(delay)
+	}
+}
+
+// RateLimiterStatistics describes the transfers that went through a rate limiter.
+type RateLimiterStatistics struct {
+	TransferredBytes int64
+	ElapsedTime      time.Duration
+	ThrottledCount   int64         // Number of transfers that had to wait
+	WaitTime         time.Duration // Total time spent waiting by all threads
+}
+
+// GetAverageRate returns the actual transfer rate in kilobytes/sec.
+func (statistics RateLimiterStatistics) GetAverageRate() int64 {
+	seconds := statistics.ElapsedTime.Seconds()
+	if seconds <= 0 {
+		return 0
+	}
+	return int64(float64(statistics.TransferredBytes) / 1024 / seconds)
+}
+
+// GetStatistics returns the statistics since the limiter was created.
+func (limiter *RateLimiter) GetStatistics() (statistics RateLimiterStatistics) {
+	if limiter == nil {
+		return statistics
+	}
+	limiter.lock.Lock()
+	defer limiter.lock.Unlock()
+	statistics.TransferredBytes = limiter.transferredBytes
+	statistics.ElapsedTime = time.Since(limiter.startTime)
+	statistics.ThrottledCount = limiter.throttledCount
+	statistics.WaitTime = limiter.waitTime
+	return statistics
+}
+
+// ReportStatistics logs the actual transfer rate and how often the rate limit kicked in.
+func (limiter *RateLimiter) ReportStatistics(direction string) {
+	if limiter == nil {
+		return
+	}
+	statistics := limiter.GetStatistics()
+	LOG_INFO("RATE_LIMIT", "%s %s at an average of %d kB/s; %d transfers waited %s in total for the rate limit",
+		direction, PrettySize(statistics.TransferredBytes), statistics.GetAverageRate(), statistics.ThrottledCount,
+		statistics.WaitTime.Round(time.Millisecond))
+}
@@ -0,0 +1,80 @@
+// Copyright (c) Acrosync LLC. All rights reserved.
+// Free for personal use and commercial trial
+// Commercial use requires per-user licenses available from https://duplicacy.com
+
+package duplicacy
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestRateLimiter(t *testing.T) {
+
+	setTestingT(t)
+
+	// 4 threads each sending 20 transfers of 32K at a combined rate of 4M/s should take about 0.6 seconds, after the
+	// initial burst of 64K
+	limiter := CreateRateLimiter(4096, 64)
+	startTime := time.Now()
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 20; j++ {
+				limiter.Wait(32 * 1024)
+			}
+		}()
+	}
+	wg.Wait()
+
+	elapsed := time.Since(startTime)
+	if elapsed < 500*time.Millisecond || elapsed > 2*time.Second {
+		t.Errorf("Sending 2.5M at 4M/s took %s", elapsed)
+	}
+
+	statistics := limiter.GetStatistics()
+	if statistics.TransferredBytes != 80*32*1024 {
+		t.Errorf("The limiter counted %d bytes", statistics.TransferredBytes)
+	}
+	if statistics.ThrottledCount < 70 || statistics.WaitTime < elapsed {
+		t.Errorf("Incorrect throttling statistics: %d transfers waited %s", statistics.ThrottledCount,
+			statistics.WaitTime)
+	}
+	if rate := statistics.GetAverageRate(); rate > 4096+1024 {
+		t.Errorf("The average rate %d kB/s is above the limit", rate)
+	}
+
+	// A transfer within the burst size after being idle doesn't have to wait
+	limiter = CreateRateLimiter(1024, 256)
+	startTime = time.Now()
+	limiter.Wait(256 * 1024)
+	if elapsed := time.Since(startTime); elapsed > 50*time.Millisecond {
+		t.Errorf("A transfer within the burst size took %s", elapsed)
+	}
+
+	// The next one must wait for the tokens to be refilled
+	startTime = time.Now()
+	limiter.Wait(128 * 1024)
+	if elapsed := time.Since(startTime); elapsed < 100*time.Millisecond {
+		t.Errorf("A transfer beyond the burst size took only %s", elapsed)
+	}
+
+	limiter.SetRate(0)
+	startTime = time.Now()
+	for i := 0; i < 100; i++ {
+		limiter.Wait(1024 * 1024)
+	}
+	if elapsed := time.Since(startTime); elapsed > 50*time.Millisecond {
+		t.Errorf("Transfers without a rate limit took %s", elapsed)
+	}
+
+	var unlimited *RateLimiter
+	unlimited.Wait(1024)
+	unlimited.SetRate(100)
+	if unlimited.GetStatistics().TransferredBytes != 0 {
+		t.Errorf("A nil limiter should do nothing")
+	}
+}
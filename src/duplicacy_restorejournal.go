@@ -0,0 +1,199 @@
+// Copyright (c) Acrosync LLC. All rights reserved.
+// Free for personal use and commercial trial
+// Commercial use requires per-user licenses available from https://duplicacy.com
+
+package duplicacy
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"path"
+)
+
+// restoreJournalHeader is the first line of the journal, identifying the restore it belongs to.
+type restoreJournalHeader struct {
+	ID       string `json:"id"`
+	Revision int    `json:"revision"`
+	Top      string `json:"top"`
+}
+
+// restoreJournalRecord is appended to the journal when a file has been restored ('Done' is true), or when more
+// chunks of a file being restored in place have been written.  The size and modification time of the file at that
+// point are recorded too, so a file changed after the record was written is not trusted by the next run.
+type restoreJournalRecord struct {
+	Path   string `json:"path"`
+	Done   bool   `json:"done,omitempty"`
+	Chunks int    `json:"chunks,omitempty"`
+	Offset int64  `json:"offset,omitempty"`
+	Size   int64  `json:"size"`
+	Time   int64  `json:"time"` // modification time in nanoseconds
+}
+
+// matches returns true if the file still has the size and modification time in the record.
+func (record *restoreJournalRecord) matches(stat os.FileInfo) bool {
+	return stat != nil && stat.Size() == record.Size && stat.ModTime().UnixNano() == record.Time
+}
+
+// RestoreJournal keeps track of the progress of a restore in a file under the preference directory, so an
+// interrupted restore can continue where it stopped.  Records are appended one json object per line and written
+// to the file immediately; a truncated last line left by a crash is simply ignored when loading.
+type RestoreJournal struct {
+	file    *os.File
+	encoder *json.Encoder
+
+	restoredFiles map[string]*restoreJournalRecord // files completely restored
+	partialFiles  map[string]*restoreJournalRecord // files partially written in place
+}
+
+func getRestoreJournalPath() string {
+	return path.Join(GetDuplicacyPreferencePath(), "restore_journal")
+}
+
+// CreateRestoreJournal starts a new journal for restoring 'top' to the given revision.  If 'resume' is true and the
+// existing journal was created for the same restore, its records are loaded and kept; otherwise it is discarded.
+func CreateRestoreJournal(snapshotID string, revision int, top string, resume bool) *RestoreJournal {
+
+	journal := &RestoreJournal{
+		restoredFiles: make(map[string]*restoreJournalRecord),
+		partialFiles:  make(map[string]*restoreJournalRecord),
+	}
+
+	header := restoreJournalHeader{
+		ID:       snapshotID,
+		Revision: revision,
+		Top:      top,
+	}
+
+	journalPath := getRestoreJournalPath()
+
+	resumed := false
+	if resume {
+		resumed = journal.load(journalPath, header)
+	}
+
+	var err error
+	if resumed {
+		journal.file, err = os.OpenFile(journalPath, os.O_WRONLY|os.O_APPEND, 0600)
+	} else {
+		journal.file, err = os.OpenFile(journalPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	}
+	if err != nil {
+		LOG_WARN("RESTORE_JOURNAL", "Failed to open the restore journal %s: %v", journalPath, err)
+		return nil
+	}
+
+	journal.encoder = json.NewEncoder(journal.file)
+	if !resumed {
+		journal.write(header)
+	}
+
+	return journal
+}
+
+// load reads the records from an existing journal.  It returns false if the journal doesn't exist or belongs to a
+// different restore.
+func (journal *RestoreJournal) load(journalPath string, header restoreJournalHeader) bool {
+
+	file, err := os.Open(journalPath)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			LOG_WARN("RESTORE_JOURNAL", "Failed to open the restore journal %s: %v", journalPath, err)
+		} else {
+			LOG_INFO("RESTORE_JOURNAL", "No previous restore to resume")
+		}
+		return false
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+
+	var existingHeader restoreJournalHeader
+	if !scanner.Scan() || json.Unmarshal(scanner.Bytes(), &existingHeader) != nil {
+		LOG_WARN("RESTORE_JOURNAL", "The restore journal %s is invalid; starting over", journalPath)
+		return false
+	}
+
+	if existingHeader != header {
+		LOG_INFO("RESTORE_JOURNAL", "The previous restore was for revision %d of %s to %s; starting over",
+			existingHeader.Revision, existingHeader.ID, existingHeader.Top)
+		return false
+	}
+
+	for scanner.Scan() {
+		record := &restoreJournalRecord{}
+		if json.Unmarshal(scanner.Bytes(), record) != nil {
+			continue
+		}
+		if record.Done {
+			journal.restoredFiles[record.Path] = record
+			delete(journal.partialFiles, record.Path)
+		} else {
+			journal.partialFiles[record.Path] = record
+		}
+	}
+
+	LOG_INFO("RESTORE_JOURNAL", "Resuming the previous restore: %d files restored, %d files partially restored",
+		len(journal.restoredFiles), len(journal.partialFiles))
+	return true
+}
+
+func (journal *RestoreJournal) write(record interface{}) {
+	err := journal.encoder.Encode(record)
+	if err != nil {
+		LOG_WARN("RESTORE_JOURNAL", "Failed to write to the restore journal: %v", err)
+	}
+}
+
+// IsFileRestored returns true if the file was completely restored by the previous run and hasn't been changed since,
+// according to 'stat' of the file on disk.
+func (journal *RestoreJournal) IsFileRestored(path string, stat os.FileInfo) bool {
+	if journal == nil {
+		return false
+	}
+	record, found := journal.restoredFiles[path]
+	return found && record.matches(stat)
+}
+
+// GetProgress returns the number of chunks of the file already written in place by the previous run, and the file
+// offset where the writing stopped.  Nothing is returned if the file has been changed since, according to 'stat'.
+func (journal *RestoreJournal) GetProgress(path string, stat os.FileInfo) (chunks int, offset int64) {
+	if journal == nil {
+		return 0, 0
+	}
+	if record, found := journal.partialFiles[path]; found && record.matches(stat) {
+		return record.Chunks, record.Offset
+	}
+	return 0, 0
+}
+
+// RecordProgress records that the first 'chunks' chunks of the file, up to 'offset', have been written in place,
+// leaving the file as described by 'stat'.
+func (journal *RestoreJournal) RecordProgress(path string, chunks int, offset int64, stat os.FileInfo) {
+	if journal == nil || stat == nil {
+		return
+	}
+	journal.write(&restoreJournalRecord{Path: path, Chunks: chunks, Offset: offset, Size: stat.Size(),
+		Time: stat.ModTime().UnixNano()})
+}
+
+// RecordFile records that the file has been completely restored, leaving it as described by 'stat'.
+func (journal *RestoreJournal) RecordFile(path string, stat os.FileInfo) {
+	if journal == nil || stat == nil {
+		return
+	}
+	journal.write(&restoreJournalRecord{Path: path, Done: true, Size: stat.Size(), Time: stat.ModTime().UnixNano()})
+}
+
+// Remove closes and deletes the journal once the restore has completed.
+func (journal *RestoreJournal) Remove() {
+	if journal == nil {
+		return
+	}
+	journal.file.Close()
+	err := os.Remove(journal.file.Name())
+	if err != nil {
+		LOG_WARN("RESTORE_JOURNAL", "Failed to remove the restore journal: %v", err)
+	}
+}
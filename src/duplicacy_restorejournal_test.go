@@ -0,0 +1,80 @@
+// Copyright (c) Acrosync LLC. All rights reserved.
+// Free for personal use and commercial trial
+// Commercial use requires per-user licenses available from https://duplicacy.com
+
+package duplicacy
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+func TestRestoreJournal(t *testing.T) {
+
+	setTestingT(t)
+
+	testDir, err := ioutil.TempDir("", "duplicacy_test")
+	if err != nil {
+		t.Errorf("Failed to create a temporary directory: %v", err)
+		return
+	}
+	defer os.RemoveAll(testDir)
+
+	SetDuplicacyPreferencePath(testDir)
+
+	stats := make(map[string]os.FileInfo)
+	for _, name := range []string{"file1", "file2", "file3"} {
+		filePath := path.Join(testDir, name)
+		ioutil.WriteFile(filePath, []byte(name), 0644)
+		stats[name], _ = os.Stat(filePath)
+	}
+
+	journal := CreateRestoreJournal("host1", 3, "/repository", false)
+	journal.RecordFile("file1", stats["file1"])
+	journal.RecordProgress("file2", 2, 1000, stats["file2"])
+	journal.RecordProgress("file2", 3, 1500, stats["file2"])
+	journal.RecordProgress("file3", 1, 100, stats["file3"])
+	journal.RecordFile("file3", stats["file3"])
+	journal.file.Close()
+
+	journal = CreateRestoreJournal("host1", 3, "/repository", true)
+	if !journal.IsFileRestored("file1", stats["file1"]) || !journal.IsFileRestored("file3", stats["file3"]) ||
+		journal.IsFileRestored("file2", stats["file2"]) {
+		t.Errorf("Restored files were not loaded correctly from the journal")
+	}
+	if chunks, offset := journal.GetProgress("file2", stats["file2"]); chunks != 3 || offset != 1500 {
+		t.Errorf("Progress of file2 is %d chunks at offset %d instead of 3 chunks at offset 1500", chunks, offset)
+	}
+	if chunks, _ := journal.GetProgress("file3", stats["file3"]); chunks != 0 {
+		t.Errorf("file3 should not be partially restored")
+	}
+
+	// Files changed after the records were written are not trusted
+	modifiedTime := stats["file1"].ModTime().Add(2 * time.Second)
+	os.Chtimes(path.Join(testDir, "file1"), modifiedTime, modifiedTime)
+	ioutil.WriteFile(path.Join(testDir, "file2"), []byte("changed"), 0644)
+	for _, name := range []string{"file1", "file2"} {
+		stats[name], _ = os.Stat(path.Join(testDir, name))
+	}
+	if journal.IsFileRestored("file1", stats["file1"]) || journal.IsFileRestored("file4", nil) {
+		t.Errorf("A changed or missing file should not be considered restored")
+	}
+	if chunks, _ := journal.GetProgress("file2", stats["file2"]); chunks != 0 {
+		t.Errorf("The progress of a changed file should not be used")
+	}
+	journal.file.Close()
+
+	// A journal for a different revision must not be resumed
+	journal = CreateRestoreJournal("host1", 4, "/repository", true)
+	if journal.IsFileRestored("file3", stats["file3"]) {
+		t.Errorf("The journal for a different revision should not be resumed")
+	}
+
+	journal.Remove()
+	if _, err := os.Stat(getRestoreJournalPath()); !os.IsNotExist(err) {
+		t.Errorf("The journal was not removed: %v", err)
+	}
+}
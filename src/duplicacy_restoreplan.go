@@ -0,0 +1,283 @@
+// Copyright (c) Acrosync LLC. All rights reserved.
+// Free for personal use and commercial trial
+// Commercial use requires per-user licenses available from https://duplicacy.com
+
+package duplicacy
+
+import (
+	"encoding/hex"
+	"io"
+	"os"
+)
+
+// Actions that a restore may take on a path
+const (
+	RESTORE_ACTION_CREATE    = "create"
+	RESTORE_ACTION_OVERWRITE = "overwrite"
+	RESTORE_ACTION_DELETE    = "delete"
+	RESTORE_ACTION_SKIP      = "skip"
+	RESTORE_ACTION_CONFLICT  = "conflict"
+)
+
+// RestorePlanEntry describes what a restore would do to a single path.
+type RestorePlanEntry struct {
+	Path   string `json:"path"`
+	Action string `json:"action"`
+	Size   int64  `json:"size"`
+	Reason string `json:"reason,omitempty"`
+}
+
+// RestorePlan is the outcome of a restore dry run.  Download estimates are based on unique chunks not already
+// present in local files at the same offsets; chunk sizes are before compression and encryption.  Local data that
+// has been moved to different offsets or paths isn't detected, so the reused chunks are a lower bound and the chunks
+// to download an upper bound.
+type RestorePlan struct {
+	Revision int                 `json:"revision"`
+	Entries  []*RestorePlanEntry `json:"entries"`
+
+	CreatedFiles     int `json:"created_files"`
+	OverwrittenFiles int `json:"overwritten_files"`
+	DeletedFiles     int `json:"deleted_files"`
+	SkippedFiles     int `json:"skipped_files"`
+	ConflictedFiles  int `json:"conflicted_files"`
+
+	ChunksToDownload int   `json:"chunks_to_download"`
+	BytesToDownload  int64 `json:"bytes_to_download"`
+	ReusedChunks     int   `json:"reused_chunks"`
+	ReusedBytes      int64 `json:"reused_bytes"`
+}
+
+func (plan *RestorePlan) addEntry(path string, action string, size int64, reason string) {
+	plan.Entries = append(plan.Entries, &RestorePlanEntry{
+		Path:   path,
+		Action: action,
+		Size:   size,
+		Reason: reason,
+	})
+
+	switch action {
+	case RESTORE_ACTION_CREATE:
+		plan.CreatedFiles++
+	case RESTORE_ACTION_OVERWRITE:
+		plan.OverwrittenFiles++
+	case RESTORE_ACTION_DELETE:
+		plan.DeletedFiles++
+	case RESTORE_ACTION_SKIP:
+		plan.SkippedFiles++
+	case RESTORE_ACTION_CONFLICT:
+		plan.ConflictedFiles++
+	}
+}
+
+// PlanRestore works out what Restore would do with the same arguments without modifying anything, neither locally
+// nor in the storage.  Restore always runs in place from the command line, so local files are examined for chunks
+// that can be reused at the same offsets.
+func (manager *BackupManager) PlanRestore(top string, revision int, quickMode bool, overwrite bool, deleteMode bool,
+	patterns []string) *RestorePlan {
+
+	LOG_DEBUG("RESTORE_PARAMETERS", "top: %s, revision: %d, quick: %t, delete: %t, dry run",
+		top, revision, quickMode, deleteMode)
+
+	remoteSnapshot := manager.SnapshotManager.DownloadSnapshot(manager.snapshotID, revision)
+	manager.SnapshotManager.DownloadSnapshotContents(remoteSnapshot, patterns, true)
+
+	// A directory that doesn't exist yet is treated as empty
+	localSnapshot := &Snapshot{}
+	_, err := os.Stat(top)
+	if err == nil {
+		localSnapshot, _, _, err = CreateSnapshotFromDirectory(manager.snapshotID, top, manager.nobackupFile)
+		if err != nil {
+			LOG_ERROR("SNAPSHOT_LIST", "Failed to list the repository: %v", err)
+			return nil
+		}
+	}
+
+	var remoteFiles []*Entry
+	for _, entry := range remoteSnapshot.Files {
+		if len(patterns) == 0 || MatchPath(entry.Path, patterns) {
+			remoteFiles = append(remoteFiles, entry)
+		}
+	}
+
+	plan := &RestorePlan{
+		Revision: revision,
+	}
+
+	// Chunks already counted, so a chunk shared by several files is only downloaded once
+	neededChunks := make(map[string]bool)
+
+	var extraFiles []*Entry
+
+	i := 0
+	for _, entry := range remoteFiles {
+
+		var local *Entry
+		for i < len(localSnapshot.Files) {
+			compare := entry.Compare(localSnapshot.Files[i])
+			if compare > 0 {
+				extraFiles = append(extraFiles, localSnapshot.Files[i])
+				i++
+				continue
+			}
+			if compare == 0 {
+				local = localSnapshot.Files[i]
+				i++
+			}
+			break
+		}
+
+		if local == nil {
+			if entry.IsFile() {
+				manager.planChunks(plan, remoteSnapshot, top, entry, nil, neededChunks)
+			}
+			plan.addEntry(entry.Path, RESTORE_ACTION_CREATE, entry.Size, "")
+			continue
+		}
+
+		if quickMode && local.IsSameAs(entry) {
+			plan.addEntry(entry.Path, RESTORE_ACTION_SKIP, entry.Size, "unchanged size and timestamp")
+			continue
+		}
+
+		if entry.IsLink() {
+			if local.IsLink() && local.Link == entry.Link {
+				plan.addEntry(entry.Path, RESTORE_ACTION_SKIP, entry.Size, "same link target")
+			} else {
+				plan.addEntry(entry.Path, RESTORE_ACTION_OVERWRITE, entry.Size, "different link target")
+			}
+			continue
+		}
+
+		if entry.IsDir() {
+			if !local.IsDir() {
+				plan.addEntry(entry.Path, RESTORE_ACTION_CONFLICT, entry.Size, "not a directory locally")
+			}
+			continue
+		}
+
+		if entry.Size == 0 {
+			if local.Size == 0 && local.Time == entry.Time {
+				plan.addEntry(entry.Path, RESTORE_ACTION_SKIP, 0, "unchanged empty file")
+			} else {
+				plan.addEntry(entry.Path, RESTORE_ACTION_OVERWRITE, 0, "")
+			}
+			continue
+		}
+
+		if !overwrite {
+			plan.addEntry(entry.Path, RESTORE_ACTION_CONFLICT, entry.Size, "file exists and -overwrite is not specified")
+			continue
+		}
+
+		if !manager.planChunks(plan, remoteSnapshot, top, entry, local, neededChunks) {
+			plan.addEntry(entry.Path, RESTORE_ACTION_SKIP, entry.Size, "unchanged content")
+			continue
+		}
+
+		plan.addEntry(entry.Path, RESTORE_ACTION_OVERWRITE, entry.Size, "")
+	}
+
+	for i < len(localSnapshot.Files) {
+		extraFiles = append(extraFiles, localSnapshot.Files[i])
+		i++
+	}
+
+	// Restore never deletes anything when patterns are given
+	if deleteMode && len(patterns) == 0 {
+		for _, local := range extraFiles {
+			plan.addEntry(local.Path, RESTORE_ACTION_DELETE, local.Size, "")
+		}
+	}
+
+	return plan
+}
+
+// planChunks adds the chunks needed to restore 'entry' to the plan.  If 'local' is not nil, the local file is read to
+// find chunks at the same offsets that can be reused.  It returns false if the local file is identical to 'entry'.
+func (manager *BackupManager) planChunks(plan *RestorePlan, snapshot *Snapshot, top string, entry *Entry, local *Entry,
+	neededChunks map[string]bool) bool {
+
+	reusable := make(map[int]bool)
+
+	if local != nil {
+		file, err := os.Open(joinPath(top, entry.Path))
+		if err != nil {
+			LOG_WARN("RESTORE_PLAN", "Can't open the existing file %s: %v", entry.Path, err)
+		} else {
+			defer file.Close()
+
+			fileHasher := manager.config.NewFileHasher()
+			buffer := make([]byte, 64*1024)
+
+			for i := entry.StartChunk; i <= entry.EndChunk; i++ {
+				start := 0
+				if i == entry.StartChunk {
+					start = entry.StartOffset
+				}
+				end := snapshot.ChunkLengths[i]
+				if i == entry.EndChunk {
+					end = entry.EndOffset
+				}
+
+				hasher := manager.config.NewKeyedHasher(manager.config.HashKey)
+				n, err := io.CopyBuffer(io.MultiWriter(hasher, fileHasher), io.LimitReader(file, int64(end-start)), buffer)
+				if err != nil {
+					LOG_WARN("RESTORE_PLAN", "Failed to read the existing file %s: %v", entry.Path, err)
+					break
+				}
+
+				// Only whole chunks found at the same offsets are reused by an in-place restore
+				if n == int64(end-start) && start == 0 && string(hasher.Sum(nil)) == snapshot.ChunkHashes[i] {
+					reusable[i] = true
+				}
+			}
+
+			// Any remaining bytes make the file different
+			io.CopyBuffer(fileHasher, file, buffer)
+			if hex.EncodeToString(fileHasher.Sum(nil)) == entry.Hash {
+				return false
+			}
+		}
+	}
+
+	for i := entry.StartChunk; i <= entry.EndChunk; i++ {
+		hash := snapshot.ChunkHashes[i]
+		if reusable[i] {
+			plan.ReusedChunks++
+			plan.ReusedBytes += int64(snapshot.ChunkLengths[i])
+			continue
+		}
+		if neededChunks[hash] {
+			continue
+		}
+		neededChunks[hash] = true
+		plan.ChunksToDownload++
+		plan.BytesToDownload += int64(snapshot.ChunkLengths[i])
+	}
+
+	return true
+}
+
+// Print shows the plan in a human readable form.  Skipped files are only listed at the trace level.
+func (plan *RestorePlan) Print() {
+
+	for _, entry := range plan.Entries {
+		level := INFO
+		if entry.Action == RESTORE_ACTION_SKIP {
+			level = TRACE
+		}
+		if entry.Reason != "" {
+			logf(level, "RESTORE_PLAN", "%-9s %s (%s)", entry.Action, entry.Path, entry.Reason)
+		} else {
+			logf(level, "RESTORE_PLAN", "%-9s %s", entry.Action, entry.Path)
+		}
+	}
+
+	LOG_INFO("RESTORE_PLAN", "Revision %d: %d to create, %d to overwrite, %d to delete, %d to skip, %d conflicts",
+		plan.Revision, plan.CreatedFiles, plan.OverwrittenFiles, plan.DeletedFiles, plan.SkippedFiles,
+		plan.ConflictedFiles)
+	LOG_INFO("RESTORE_PLAN", "Estimated download: at most %d chunks, %s bytes; reused from local files: at least "+
+		"%d chunks, %s bytes", plan.ChunksToDownload, PrettySize(plan.BytesToDownload), plan.ReusedChunks,
+		PrettySize(plan.ReusedBytes))
+	LOG_INFO("RESTORE_PLAN", "Only chunks found at the same offsets of the same files are counted as reused")
+}
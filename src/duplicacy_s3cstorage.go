@@ -5,6 +5,8 @@
 package duplicacy
 
 import (
+	"io"
+	"net/http"
 	"time"
 
 	"github.com/gilbertchen/goamz/aws"
@@ -17,6 +19,7 @@ type S3CStorage struct {
 
 	buckets    []*s3.Bucket
 	storageDir string
+	multipart  MultipartOptions
 }
 
 // CreateS3CStorage creates a amazon s3 storage object.
@@ -156,29 +159,95 @@ func (storage *S3CStorage) GetFileInfo(threadIndex int, filePath string) (exist
 	}
 }
 
+// SetMultipartOptions sets the part size and the number of parallel transfers for large files.
+func (storage *S3CStorage) SetMultipartOptions(options MultipartOptions) {
+	storage.multipart = options
+}
+
 // DownloadFile reads the file at 'filePath' into the chunk.
 func (storage *S3CStorage) DownloadFile(threadIndex int, filePath string, chunk *Chunk) (err error) {
 
-	readCloser, err := storage.buckets[threadIndex].GetReader(storage.storageDir + filePath)
+	bucket := storage.buckets[threadIndex]
+	response, err := storage.getPart(bucket, filePath, nil)
 	if err != nil {
 		return err
 	}
 
-	defer readCloser.Close()
+	defer response.Body.Close()
 
-	_, err = RateLimitedCopy(chunk, readCloser, storage.DownloadRateLimit/len(storage.buckets))
-	return err
+	rateLimit := storage.DownloadRateLimit / len(storage.buckets)
+	return storage.multipart.downloadInParts(response.Body, response.ContentLength, chunk, rateLimit, func(part filePart, writer io.Writer) error {
+		response, err := storage.getPart(bucket, filePath, &part)
+		if err != nil {
+			return err
+		}
+		defer response.Body.Close()
+		_, err = RateLimitedCopy(writer, response.Body, storage.multipart.getPartRateLimit(rateLimit))
+		return err
+	})
+}
 
+// getPart sends a GET request for the file, or for only a part of it if 'part' is not nil.
+func (storage *S3CStorage) getPart(bucket *s3.Bucket, filePath string, part *filePart) (*http.Response, error) {
+	headers := make(map[string][]string)
+	if part != nil {
+		headers["Range"] = []string{part.getRangeHeader()}
+	}
+	return bucket.GetResponseWithHeaders(storage.storageDir+filePath, headers)
 }
 
 // UploadFile writes 'content' to the file at 'filePath'.
 func (storage *S3CStorage) UploadFile(threadIndex int, filePath string, content []byte) (err error) {
 
+	if storage.multipart.isMultipart(int64(len(content))) {
+		return storage.uploadMultipart(threadIndex, filePath, content)
+	}
+
 	options := s3.Options{}
 	reader := CreateRateLimitedReader(content, storage.UploadRateLimit/len(storage.buckets))
 	return storage.buckets[threadIndex].PutReader(storage.storageDir+filePath, reader, int64(len(content)), "application/duplicacy", s3.Private, options)
 }
 
+// uploadMultipart uploads 'content' to the file at 'filePath' with the multipart upload API, sending several parts
+// in parallel.  The upload is aborted if any part fails.
+func (storage *S3CStorage) uploadMultipart(threadIndex int, filePath string, content []byte) (err error) {
+
+	multi, err := storage.buckets[threadIndex].InitMulti(storage.storageDir+filePath, "application/duplicacy",
+		s3.Private, s3.Options{})
+	if err != nil {
+		return err
+	}
+
+	parts := storage.multipart.getParts(int64(len(content)))
+	completedParts := make([]s3.Part, len(parts))
+	LOG_DEBUG("S3_MULTIPART", "Uploading %s in %d parts", filePath, len(parts))
+
+	err = storage.multipart.transferParts(len(parts), func(index int) error {
+		partContent := content[parts[index].start:parts[index].end]
+		reader := CreateRateLimitedReader(partContent,
+			storage.multipart.getPartRateLimit(storage.UploadRateLimit/len(storage.buckets)))
+		part, err := multi.PutPart(index+1, reader)
+		if err != nil {
+			return err
+		}
+		completedParts[index] = part
+		return nil
+	})
+
+	if err == nil {
+		err = multi.Complete(completedParts)
+	}
+
+	if err != nil {
+		abortError := multi.Abort()
+		if abortError != nil {
+			LOG_WARN("S3_MULTIPART", "Failed to abort the multipart upload of %s: %v", filePath, abortError)
+		}
+		return err
+	}
+	return nil
+}
+
 // If a local snapshot cache is needed for the storage to avoid downloading/uploading chunks too often when
 // managing snapshots.
 func (storage *S3CStorage) IsCacheNeeded() bool { return true }
@@ -10,8 +10,15 @@
 package duplicacy
 
 import (
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
 	"reflect"
 	"strings"
+	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/awserr"
@@ -27,6 +34,211 @@ type S3Storage struct {
 	bucket          string
 	storageDir      string
 	numberOfThreads int
+	options         S3Options
+	multipart       MultipartOptions
+}
+
+// S3Options are the optional settings for objects stored on S3.  Chunks and snapshots can be given different
+// storage classes; files other than chunks, such as 'config', use the snapshot storage class.  Server-side
+// encryption can be done with S3 managed keys ('AES256'), with KMS keys ('aws:kms', optionally with a key id), or
+// with a key provided by the customer (SSE-C), in which case the same key must be supplied for every download.
+// With Object Lock, every chunk and snapshot file is uploaded with a retention period during which it can't be
+// deleted.  The bucket should have a lifecycle rule that expires noncurrent versions, which removes deleted fossils.
+type S3Options struct {
+	ChunkStorageClass    string
+	SnapshotStorageClass string
+	ServerSideEncryption string
+	KMSKeyID             string
+	CustomerKey          []byte
+	ObjectLockMode       string
+	ObjectLockDays       int
+}
+
+// Storage classes whose objects can't be downloaded without being restored first
+var s3ArchiveStorageClasses = map[string]bool{
+	"GLACIER":      true,
+	"DEEP_ARCHIVE": true,
+}
+
+// CreateS3Options validates the settings and returns the options.  The customer key for SSE-C must be 256 bits
+// long, given as 64 hex digits or in base64.
+func CreateS3Options(chunkStorageClass string, snapshotStorageClass string, serverSideEncryption string,
+	kmsKeyID string, customerKey string) (options S3Options, err error) {
+
+	options.ChunkStorageClass = strings.ToUpper(chunkStorageClass)
+	options.SnapshotStorageClass = strings.ToUpper(snapshotStorageClass)
+
+	if s3ArchiveStorageClasses[options.SnapshotStorageClass] {
+		return options, fmt.Errorf("snapshots can't be stored in the %s storage class since they must be readable "+
+			"at any time", options.SnapshotStorageClass)
+	}
+	if s3ArchiveStorageClasses[options.ChunkStorageClass] {
+		LOG_WARN("S3_STORAGE_CLASS", "Chunks in the %s storage class must be restored on S3 before they can be "+
+			"downloaded; check, copy, and restore will fail until then", options.ChunkStorageClass)
+	}
+
+	switch strings.ToLower(serverSideEncryption) {
+	case "":
+	case "aes256", "sse-s3":
+		options.ServerSideEncryption = s3.ServerSideEncryptionAes256
+	case "aws:kms", "kms", "sse-kms":
+		options.ServerSideEncryption = s3.ServerSideEncryptionAwsKms
+	default:
+		return options, fmt.Errorf("unknown server-side encryption '%s'", serverSideEncryption)
+	}
+
+	if kmsKeyID != "" {
+		if options.ServerSideEncryption == "" {
+			options.ServerSideEncryption = s3.ServerSideEncryptionAwsKms
+		} else if options.ServerSideEncryption != s3.ServerSideEncryptionAwsKms {
+			return options, fmt.Errorf("a KMS key id can only be used with aws:kms encryption")
+		}
+		options.KMSKeyID = kmsKeyID
+	}
+
+	if customerKey != "" {
+		if options.ServerSideEncryption != "" {
+			return options, fmt.Errorf("SSE-C can't be combined with %s encryption", options.ServerSideEncryption)
+		}
+
+		if len(customerKey) == 64 {
+			options.CustomerKey, err = hex.DecodeString(customerKey)
+		} else {
+			options.CustomerKey, err = base64.StdEncoding.DecodeString(customerKey)
+		}
+		if err != nil || len(options.CustomerKey) != 32 {
+			return options, fmt.Errorf("the SSE-C key must be 256 bits long, in hex or base64")
+		}
+	}
+
+	return options, nil
+}
+
+// SetObjectLock sets the Object Lock retention mode ('governance' or 'compliance') and period for uploaded files.
+// The bucket must have been created with Object Lock enabled.
+func (options *S3Options) SetObjectLock(mode string, days int) error {
+	if mode == "" && days == 0 {
+		return nil
+	}
+
+	switch strings.ToUpper(mode) {
+	case "GOVERNANCE", "COMPLIANCE":
+		options.ObjectLockMode = strings.ToUpper(mode)
+	default:
+		return fmt.Errorf("unknown object lock mode '%s'", mode)
+	}
+
+	if days <= 0 {
+		return fmt.Errorf("the object lock retention period must be at least one day")
+	}
+	options.ObjectLockDays = days
+	return nil
+}
+
+// SetMultipartOptions sets the part size and the number of parallel transfers for large files.
+func (storage *S3Storage) SetMultipartOptions(options MultipartOptions) {
+	storage.multipart = options
+	if options.PartSize > 0 {
+		LOG_DEBUG("S3_MULTIPART", "Files larger than %d bytes will be transferred in parts using %d threads",
+			options.PartSize, options.Threads)
+	}
+}
+
+// SetOptions sets the storage classes and server-side encryption to be used by the storage.
+func (storage *S3Storage) SetOptions(options S3Options) {
+	storage.options = options
+	if options.ChunkStorageClass != "" || options.SnapshotStorageClass != "" {
+		LOG_DEBUG("S3_STORAGE_CLASS", "Storage class for chunks: %s, for snapshots: %s",
+			options.ChunkStorageClass, options.SnapshotStorageClass)
+	}
+	if options.ServerSideEncryption != "" {
+		LOG_DEBUG("S3_ENCRYPTION", "Server-side encryption: %s", options.ServerSideEncryption)
+	} else if len(options.CustomerKey) > 0 {
+		LOG_DEBUG("S3_ENCRYPTION", "Server-side encryption with customer-provided key")
+	}
+	if options.ObjectLockMode != "" {
+		LOG_INFO("S3_OBJECT_LOCK", "Files will be locked in %s mode for %d days", strings.ToLower(options.ObjectLockMode),
+			options.ObjectLockDays)
+	}
+}
+
+// setObjectLock adds the Object Lock headers to an upload or copy request.  The SDK version in use doesn't know
+// about Object Lock, so the headers are set directly.
+func (storage *S3Storage) setObjectLock(header http.Header) {
+	if storage.options.ObjectLockMode == "" {
+		return
+	}
+	lockedUntil := time.Now().UTC().Add(time.Duration(storage.options.ObjectLockDays) * 24 * time.Hour)
+	header.Set("X-Amz-Object-Lock-Mode", storage.options.ObjectLockMode)
+	header.Set("X-Amz-Object-Lock-Retain-Until-Date", lockedUntil.Format(time.RFC3339))
+}
+
+// getVersion returns the current version id of the file and the time until which it is locked.
+func (storage *S3Storage) getVersion(filePath string) (versionID *string, lockedUntil time.Time, err error) {
+	input := &s3.HeadObjectInput{
+		Bucket: aws.String(storage.bucket),
+		Key:    aws.String(storage.storageDir + filePath),
+	}
+	input.SSECustomerAlgorithm, input.SSECustomerKey = storage.getCustomerKey()
+
+	request, output := storage.client.HeadObjectRequest(input)
+	err = request.Send()
+	if err != nil {
+		return nil, lockedUntil, err
+	}
+
+	if value := request.HTTPResponse.Header.Get("X-Amz-Object-Lock-Retain-Until-Date"); value != "" {
+		lockedUntil, err = time.Parse(time.RFC3339, value)
+		if err != nil {
+			return nil, lockedUntil, fmt.Errorf("invalid retention date '%s' for %s", value, filePath)
+		}
+	}
+	return output.VersionId, lockedUntil, nil
+}
+
+// GetLockExpiry returns the time until which the file can't be deleted.  Files are only considered locked if Object
+// Lock is enabled for this storage.
+func (storage *S3Storage) GetLockExpiry(threadIndex int, filePath string) (lockedUntil time.Time, err error) {
+	if storage.options.ObjectLockMode == "" {
+		return lockedUntil, nil
+	}
+	_, lockedUntil, err = storage.getVersion(filePath)
+	if e, ok := err.(awserr.RequestFailure); ok && e.StatusCode() == 404 {
+		return lockedUntil, nil
+	}
+	return lockedUntil, err
+}
+
+// getStorageClass returns the storage class for the file, or nil to use the bucket default.
+func (storage *S3Storage) getStorageClass(filePath string) *string {
+	storageClass := storage.options.SnapshotStorageClass
+	if strings.HasPrefix(filePath, "chunks/") {
+		storageClass = storage.options.ChunkStorageClass
+	}
+	if storageClass == "" {
+		return nil
+	}
+	return aws.String(storageClass)
+}
+
+// getCustomerKey returns the algorithm and key for SSE-C requests, or nils if SSE-C is not enabled.  The SDK takes
+// care of encoding the key and computing its md5.
+func (storage *S3Storage) getCustomerKey() (algorithm *string, key *string) {
+	if len(storage.options.CustomerKey) == 0 {
+		return nil, nil
+	}
+	return aws.String("AES256"), aws.String(string(storage.options.CustomerKey))
+}
+
+// getServerSideEncryption returns the encryption method and KMS key id for uploads and copies.
+func (storage *S3Storage) getServerSideEncryption() (method *string, kmsKeyID *string) {
+	if storage.options.ServerSideEncryption != "" {
+		method = aws.String(storage.options.ServerSideEncryption)
+	}
+	if storage.options.KMSKeyID != "" {
+		kmsKeyID = aws.String(storage.options.KMSKeyID)
+	}
+	return method, kmsKeyID
 }
 
 // CreateS3Storage creates a amazon s3 storage object.
@@ -144,6 +356,25 @@ func (storage *S3Storage) DeleteFile(threadIndex int, filePath string) (err erro
 		Bucket: aws.String(storage.bucket),
 		Key:    aws.String(storage.storageDir + filePath),
 	}
+
+	if storage.options.ObjectLockMode != "" && !strings.HasSuffix(filePath, ".fsl") {
+		// Buckets with Object Lock are versioned, so a delete without a version id would only hide the file behind a
+		// delete marker.  The version itself must be deleted, which S3 refuses until its retention period ends.
+		// Fossils are never locked, so they are deleted with a single request; the versions hidden by their delete
+		// markers are left to a lifecycle rule that expires noncurrent versions.
+		versionID, lockedUntil, err := storage.getVersion(filePath)
+		if err != nil {
+			if e, ok := err.(awserr.RequestFailure); ok && e.StatusCode() == 404 {
+				return nil
+			}
+			return err
+		}
+		if lockedUntil.After(time.Now()) {
+			return FileLockedError{FilePath: filePath, LockedUntil: lockedUntil}
+		}
+		input.VersionId = versionID
+	}
+
 	_, err = storage.client.DeleteObject(input)
 	return err
 }
@@ -152,17 +383,52 @@ func (storage *S3Storage) DeleteFile(threadIndex int, filePath string) (err erro
 func (storage *S3Storage) MoveFile(threadIndex int, from string, to string) (err error) {
 
 	input := &s3.CopyObjectInput{
-		Bucket:     aws.String(storage.bucket),
-		CopySource: aws.String(storage.bucket + "/" + storage.storageDir + from),
-		Key:        aws.String(storage.storageDir + to),
+		Bucket:       aws.String(storage.bucket),
+		CopySource:   aws.String(storage.bucket + "/" + storage.storageDir + from),
+		Key:          aws.String(storage.storageDir + to),
+		StorageClass: storage.getStorageClass(to),
 	}
 
-	_, err = storage.client.CopyObject(input)
+	// The copy must be encrypted the same way; otherwise it would be stored with the bucket defaults
+	input.ServerSideEncryption, input.SSEKMSKeyId = storage.getServerSideEncryption()
+	input.SSECustomerAlgorithm, input.SSECustomerKey = storage.getCustomerKey()
+	input.CopySourceSSECustomerAlgorithm, input.CopySourceSSECustomerKey = storage.getCustomerKey()
+
+	request, output := storage.client.CopyObjectRequest(input)
+	if !strings.HasSuffix(to, ".fsl") {
+		// Fossils are not locked, or they couldn't be deleted when the fossil collection becomes deletable
+		storage.setObjectLock(request.HTTPRequest.Header)
+	}
+	err = request.Send()
 	if err != nil {
 		return err
 	}
 
-	return storage.DeleteFile(threadIndex, from)
+	if storage.options.ObjectLockMode == "" || strings.HasSuffix(from, ".fsl") {
+		return storage.DeleteFile(threadIndex, from)
+	}
+
+	// The copy reports the version of the source, so the version can be deleted without looking it up first.  Only
+	// if S3 refuses the deletion is the file checked for a lock, in which case the copy is removed again.
+	_, err = storage.client.DeleteObject(&s3.DeleteObjectInput{
+		Bucket:    aws.String(storage.bucket),
+		Key:       aws.String(storage.storageDir + from),
+		VersionId: output.CopySourceVersionId,
+	})
+	if e, ok := err.(awserr.RequestFailure); !ok || e.StatusCode() != 403 {
+		return err
+	}
+
+	lockedUntil, lockErr := storage.GetLockExpiry(threadIndex, from)
+	if lockErr != nil || !lockedUntil.After(time.Now()) {
+		return err
+	}
+	storage.client.DeleteObject(&s3.DeleteObjectInput{
+		Bucket:    aws.String(storage.bucket),
+		Key:       aws.String(storage.storageDir + to),
+		VersionId: output.VersionId,
+	})
+	return FileLockedError{FilePath: from, LockedUntil: lockedUntil}
 
 }
 
@@ -178,6 +444,7 @@ func (storage *S3Storage) GetFileInfo(threadIndex int, filePath string) (exist b
 		Bucket: aws.String(storage.bucket),
 		Key:    aws.String(storage.storageDir + filePath),
 	}
+	input.SSECustomerAlgorithm, input.SSECustomerKey = storage.getCustomerKey()
 
 	output, err := storage.client.HeadObject(input)
 	if err != nil {
@@ -198,38 +465,73 @@ func (storage *S3Storage) GetFileInfo(threadIndex int, filePath string) (exist b
 // DownloadFile reads the file at 'filePath' into the chunk.
 func (storage *S3Storage) DownloadFile(threadIndex int, filePath string, chunk *Chunk) (err error) {
 
-	input := &s3.GetObjectInput{
-		Bucket: aws.String(storage.bucket),
-		Key:    aws.String(storage.storageDir + filePath),
-	}
-
-	output, err := storage.client.GetObject(input)
+	output, err := storage.getObject(filePath, nil)
 	if err != nil {
 		return err
 	}
 
 	defer output.Body.Close()
 
-	_, err = RateLimitedCopy(chunk, output.Body, storage.DownloadRateLimit/len(storage.bucket))
-	return err
+	size := int64(-1)
+	if output.ContentLength != nil {
+		size = *output.ContentLength
+	}
 
+	rateLimit := storage.DownloadRateLimit / len(storage.bucket)
+	return storage.multipart.downloadInParts(output.Body, size, chunk, rateLimit, func(part filePart, writer io.Writer) error {
+		output, err := storage.getObject(filePath, &part)
+		if err != nil {
+			return err
+		}
+		defer output.Body.Close()
+		_, err = RateLimitedCopy(writer, output.Body, storage.multipart.getPartRateLimit(rateLimit))
+		return err
+	})
+}
+
+// getObject sends a GET request for the file, or for only a part of it if 'part' is not nil.
+func (storage *S3Storage) getObject(filePath string, part *filePart) (*s3.GetObjectOutput, error) {
+	input := &s3.GetObjectInput{
+		Bucket: aws.String(storage.bucket),
+		Key:    aws.String(storage.storageDir + filePath),
+	}
+	input.SSECustomerAlgorithm, input.SSECustomerKey = storage.getCustomerKey()
+	if part != nil {
+		input.Range = aws.String(part.getRangeHeader())
+	}
+	return storage.client.GetObject(input)
 }
 
 // UploadFile writes 'content' to the file at 'filePath'.
 func (storage *S3Storage) UploadFile(threadIndex int, filePath string, content []byte) (err error) {
 
+	if storage.multipart.isMultipart(int64(len(content))) {
+		return storage.uploadMultipart(filePath, content)
+	}
+
 	attempts := 0
 
 	for {
 		input := &s3.PutObjectInput{
-			Bucket:      aws.String(storage.bucket),
-			Key:         aws.String(storage.storageDir + filePath),
-			ACL:         aws.String(s3.ObjectCannedACLPrivate),
-			Body:        CreateRateLimitedReader(content, storage.UploadRateLimit/len(storage.bucket)),
-			ContentType: aws.String("application/duplicacy"),
+			Bucket:       aws.String(storage.bucket),
+			Key:          aws.String(storage.storageDir + filePath),
+			ACL:          aws.String(s3.ObjectCannedACLPrivate),
+			Body:         CreateRateLimitedReader(content, storage.UploadRateLimit/len(storage.bucket)),
+			ContentType:  aws.String("application/duplicacy"),
+			StorageClass: storage.getStorageClass(filePath),
+		}
+		input.ServerSideEncryption, input.SSEKMSKeyId = storage.getServerSideEncryption()
+		input.SSECustomerAlgorithm, input.SSECustomerKey = storage.getCustomerKey()
+
+		if storage.options.ObjectLockMode != "" {
+			// S3 requires Content-MD5 for uploads with Object Lock
+			sum := md5.Sum(content)
+			input.ContentMD5 = aws.String(base64.StdEncoding.EncodeToString(sum[:]))
 		}
 
-		_, err = storage.client.PutObject(input)
+		request, _ := storage.client.PutObjectRequest(input)
+		storage.setObjectLock(request.HTTPRequest.Header)
+		err = request.Send()
 		if err == nil || attempts >= 3 || !strings.Contains(err.Error(), "XAmzContentSHA256Mismatch") {
 			return err
 		}
@@ -241,6 +543,79 @@ func (storage *S3Storage) UploadFile(threadIndex int, filePath string, content [
 	return err
 }
 
+// uploadMultipart uploads 'content' to the file at 'filePath' with the multipart upload API, sending several parts
+// in parallel.  The upload is aborted if any part fails so that no incomplete parts are left to be billed for.
+func (storage *S3Storage) uploadMultipart(filePath string, content []byte) (err error) {
+
+	input := &s3.CreateMultipartUploadInput{
+		Bucket:       aws.String(storage.bucket),
+		Key:          aws.String(storage.storageDir + filePath),
+		ACL:          aws.String(s3.ObjectCannedACLPrivate),
+		ContentType:  aws.String("application/duplicacy"),
+		StorageClass: storage.getStorageClass(filePath),
+	}
+	input.ServerSideEncryption, input.SSEKMSKeyId = storage.getServerSideEncryption()
+	input.SSECustomerAlgorithm, input.SSECustomerKey = storage.getCustomerKey()
+
+	request, output := storage.client.CreateMultipartUploadRequest(input)
+	storage.setObjectLock(request.HTTPRequest.Header)
+	err = request.Send()
+	if err != nil {
+		return err
+	}
+	uploadID := output.UploadId
+
+	parts := storage.multipart.getParts(int64(len(content)))
+	completedParts := make([]*s3.CompletedPart, len(parts))
+	LOG_DEBUG("S3_MULTIPART", "Uploading %s in %d parts", filePath, len(parts))
+
+	err = storage.multipart.transferParts(len(parts), func(index int) error {
+		partContent := content[parts[index].start:parts[index].end]
+		partInput := &s3.UploadPartInput{
+			Bucket:     aws.String(storage.bucket),
+			Key:        aws.String(storage.storageDir + filePath),
+			UploadId:   uploadID,
+			PartNumber: aws.Int64(int64(index + 1)),
+			Body: CreateRateLimitedReader(partContent,
+				storage.multipart.getPartRateLimit(storage.UploadRateLimit/len(storage.bucket))),
+		}
+		partInput.SSECustomerAlgorithm, partInput.SSECustomerKey = storage.getCustomerKey()
+		if storage.options.ObjectLockMode != "" {
+			sum := md5.Sum(partContent)
+			partInput.ContentMD5 = aws.String(base64.StdEncoding.EncodeToString(sum[:]))
+		}
+
+		partOutput, err := storage.client.UploadPart(partInput)
+		if err != nil {
+			return err
+		}
+		completedParts[index] = &s3.CompletedPart{ETag: partOutput.ETag, PartNumber: partInput.PartNumber}
+		return nil
+	})
+
+	if err == nil {
+		_, err = storage.client.CompleteMultipartUpload(&s3.CompleteMultipartUploadInput{
+			Bucket:          aws.String(storage.bucket),
+			Key:             aws.String(storage.storageDir + filePath),
+			UploadId:        uploadID,
+			MultipartUpload: &s3.CompletedMultipartUpload{Parts: completedParts},
+		})
+	}
+
+	if err != nil {
+		_, abortError := storage.client.AbortMultipartUpload(&s3.AbortMultipartUploadInput{
+			Bucket:   aws.String(storage.bucket),
+			Key:      aws.String(storage.storageDir + filePath),
+			UploadId: uploadID,
+		})
+		if abortError != nil {
+			LOG_WARN("S3_MULTIPART", "Failed to abort the multipart upload of %s: %v", filePath, abortError)
+		}
+		return err
+	}
+	return nil
+}
+
 // If a local snapshot cache is needed for the storage to avoid downloading/uploading chunks too often when
 // managing snapshots.
 func (storage *S3Storage) IsCacheNeeded() bool { return true }
@@ -0,0 +1,83 @@
+// Copyright (c) Acrosync LLC. All rights reserved.
+// Free for personal use and commercial trial
+// Commercial use requires per-user licenses available from https://duplicacy.com
+
+package duplicacy
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestS3Options(t *testing.T) {
+
+	setTestingT(t)
+
+	options, err := CreateS3Options("standard_ia", "", "sse-kms", "arn:aws:kms:us-east-1:123456789012:key/abcd", "")
+	if err != nil {
+		t.Errorf("Failed to create the options: %v", err)
+	}
+	if options.ChunkStorageClass != "STANDARD_IA" || options.ServerSideEncryption != "aws:kms" {
+		t.Errorf("Incorrect options: %+v", options)
+	}
+
+	storage := &S3Storage{}
+	storage.SetOptions(options)
+	if class := storage.getStorageClass("chunks/12/3456"); class == nil || *class != "STANDARD_IA" {
+		t.Errorf("Chunks should be stored in STANDARD_IA")
+	}
+	if class := storage.getStorageClass("snapshots/host1/1"); class != nil {
+		t.Errorf("Snapshots should be stored in the default storage class")
+	}
+
+	// A KMS key id alone implies aws:kms
+	options, err = CreateS3Options("", "", "", "alias/duplicacy", "")
+	if err != nil || options.ServerSideEncryption != "aws:kms" {
+		t.Errorf("The KMS key id should enable aws:kms encryption: %+v %v", options, err)
+	}
+
+	options, err = CreateS3Options("", "", "", "", strings.Repeat("0f", 32))
+	if err != nil || len(options.CustomerKey) != 32 {
+		t.Errorf("Failed to parse the SSE-C key in hex: %v", err)
+	}
+
+	options, err = CreateS3Options("", "", "", "", "MDEyMzQ1Njc4OWFiY2RlZjAxMjM0NTY3ODlhYmNkZWY=")
+	if err != nil || len(options.CustomerKey) != 32 {
+		t.Errorf("Failed to parse the SSE-C key in base64: %v", err)
+	}
+
+	storage.SetOptions(options)
+	if algorithm, key := storage.getCustomerKey(); algorithm == nil || *algorithm != "AES256" || len(*key) != 32 {
+		t.Errorf("The SSE-C key is not passed to requests")
+	}
+
+	for _, invalid := range [][]string{
+		{"", "", "sse-x", "", ""},
+		{"", "", "aes256", "key", ""},
+		{"", "", "aes256", "", strings.Repeat("0f", 32)},
+		{"", "", "", "", "short"},
+		{"", "glacier", "", "", ""},
+	} {
+		_, err = CreateS3Options(invalid[0], invalid[1], invalid[2], invalid[3], invalid[4])
+		if err == nil {
+			t.Errorf("The options %v should be rejected", invalid)
+		}
+	}
+
+	err = options.SetObjectLock("governance", 30)
+	if err != nil || options.ObjectLockMode != "GOVERNANCE" || options.ObjectLockDays != 30 {
+		t.Errorf("Failed to set the object lock: %+v %v", options, err)
+	}
+
+	storage.SetOptions(options)
+	header := make(http.Header)
+	storage.setObjectLock(header)
+	if header.Get("X-Amz-Object-Lock-Mode") != "GOVERNANCE" || header.Get("X-Amz-Object-Lock-Retain-Until-Date") == "" {
+		t.Errorf("The object lock headers are not set: %v", header)
+	}
+
+	if options.SetObjectLock("legal", 30) == nil || options.SetObjectLock("compliance", 0) == nil {
+		t.Errorf("Invalid object lock options should be rejected")
+	}
+}
@@ -0,0 +1,360 @@
+// Copyright (c) Acrosync LLC. All rights reserved.
+// Free for personal use and commercial trial
+// Commercial use requires per-user licenses available from https://duplicacy.com
+
+package duplicacy
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/gilbertchen/gopass"
+)
+
+// Methods for unlocking the secret store
+const (
+	SECRET_STORE_PASSPHRASE = "passphrase"
+	SECRET_STORE_KEY_FILE   = "keyfile"
+	SECRET_STORE_MACHINE    = "machine"
+)
+
+// This is encrypted with the store key to detect a wrong passphrase or key file
+var secretStoreCheckValue = "duplicacy secret store"
+
+// SecretStore is an encrypted file under the preference directory that replaces the keychain/keyring on hosts
+// where there isn't one, such as Linux servers without a desktop session.  Each secret is encrypted by AES-GCM
+// with a key derived from a master passphrase, the content of a key file, or material bound to the machine, and
+// with its name as the additional data so encrypted values can't be swapped between names.
+type SecretStore struct {
+	Method  string            `json:"method"`
+	KeyFile string            `json:"key_file,omitempty"`
+	Salt    []byte            `json:"salt"`
+	Check   []byte            `json:"check"`
+	Secrets map[string][]byte `json:"secrets"`
+
+	path string
+	aead cipher.AEAD
+}
+
+// The unlocked secret store, so the passphrase is asked at most once per process
+var openedSecretStore *SecretStore
+
+// The error from the last failed attempt to unlock the secret store at this path, so the passphrase isn't asked and
+// the failure isn't reported again for every secret
+var secretStoreUnlockError error
+var secretStoreUnlockErrorPath string
+
+func getSecretStorePath() string {
+	return path.Join(GetDuplicacyPreferencePath(), "secrets")
+}
+
+// SecretStoreExists returns true if a secret store has been created for the repository.
+func SecretStoreExists() bool {
+	if preferencePath == "" {
+		return false
+	}
+	stat, err := os.Stat(getSecretStorePath())
+	return err == nil && !stat.IsDir()
+}
+
+// ReadPassword reads a secret from the keyboard without echoing it.
+func ReadPassword(prompt string) (string, error) {
+	fmt.Printf("%s", prompt)
+	password, err := gopass.GetPasswdMasked()
+	if err != nil {
+		return "", err
+	}
+	return string(password), nil
+}
+
+// getMachineKeyMaterial returns data that identifies this machine and the current user.  The machine id is readable
+// by every local user and the rest is easy to guess, so this only keeps secrets safe from copies of the store taken
+// to other machines; on this machine the secrets are protected by nothing more than the permissions of the store.
+func getMachineKeyMaterial() (string, error) {
+	for _, file := range []string{"/etc/machine-id", "/var/lib/dbus/machine-id"} {
+		machineID, err := ioutil.ReadFile(file)
+		if err == nil && len(strings.TrimSpace(string(machineID))) > 0 {
+			hostname, _ := os.Hostname()
+			return fmt.Sprintf("%s:%s:%d", strings.TrimSpace(string(machineID)), hostname, os.Getuid()), nil
+		}
+	}
+	return "", fmt.Errorf("no machine id is available on this host")
+}
+
+// getSecretStoreKeyMaterial returns the secret the store key is derived from.  The passphrase can be given by the
+// DUPLICACY_SECRETS_PASSPHRASE environment variable; otherwise it is read from the keyboard.
+func getSecretStoreKeyMaterial(method string, keyFile string, confirm bool) (string, error) {
+	switch method {
+	case SECRET_STORE_PASSPHRASE:
+		if passphrase, found := os.LookupEnv("DUPLICACY_SECRETS_PASSPHRASE"); found && passphrase != "" {
+			return passphrase, nil
+		}
+		if RunInBackground {
+			return "", fmt.Errorf("DUPLICACY_SECRETS_PASSPHRASE is not set")
+		}
+		passphrase, err := ReadPassword("Enter the passphrase of the secret store:")
+		if err != nil {
+			return "", err
+		}
+		if len(passphrase) == 0 {
+			return "", fmt.Errorf("the passphrase can't be empty")
+		}
+		if confirm {
+			again, err := ReadPassword("Re-enter the passphrase:")
+			if err != nil {
+				return "", err
+			}
+			if again != passphrase {
+				return "", fmt.Errorf("the passphrases entered do not match")
+			}
+		}
+		return passphrase, nil
+	case SECRET_STORE_KEY_FILE:
+		content, err := ioutil.ReadFile(keyFile)
+		if err != nil {
+			return "", err
+		}
+		if len(content) == 0 {
+			return "", fmt.Errorf("the key file %s is empty", keyFile)
+		}
+		return string(content), nil
+	case SECRET_STORE_MACHINE:
+		return getMachineKeyMaterial()
+	default:
+		return "", fmt.Errorf("unknown method '%s'", method)
+	}
+}
+
+func (store *SecretStore) unlock(material string) error {
+	key := GenerateKeyFromPassword(material, store.Salt, CONFIG_DEFAULT_ITERATIONS)
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return err
+	}
+	store.aead, err = cipher.NewGCM(block)
+	return err
+}
+
+func (store *SecretStore) encrypt(name string, plaintext string) ([]byte, error) {
+	nonce := make([]byte, store.aead.NonceSize())
+	_, err := rand.Read(nonce)
+	if err != nil {
+		return nil, err
+	}
+	return store.aead.Seal(nonce, nonce, []byte(plaintext), []byte(name)), nil
+}
+
+func (store *SecretStore) decrypt(name string, ciphertext []byte) (string, error) {
+	nonceSize := store.aead.NonceSize()
+	if len(ciphertext) < nonceSize {
+		return "", fmt.Errorf("the encrypted value is too short")
+	}
+	plaintext, err := store.aead.Open(nil, ciphertext[:nonceSize], ciphertext[nonceSize:], []byte(name))
+	if err != nil {
+		return "", err
+	}
+	return string(plaintext), nil
+}
+
+// CreateSecretStore creates a new empty secret store, replacing any existing one.
+func CreateSecretStore(method string, keyFile string) (*SecretStore, error) {
+
+	if method == SECRET_STORE_KEY_FILE && keyFile == "" {
+		return nil, fmt.Errorf("no key file is specified")
+	}
+
+	material, err := getSecretStoreKeyMaterial(method, keyFile, true)
+	if err != nil {
+		return nil, err
+	}
+
+	store := &SecretStore{
+		Method:  method,
+		KeyFile: keyFile,
+		Salt:    make([]byte, 32),
+		Secrets: make(map[string][]byte),
+		path:    getSecretStorePath(),
+	}
+
+	_, err = rand.Read(store.Salt)
+	if err != nil {
+		return nil, err
+	}
+
+	err = store.unlock(material)
+	if err != nil {
+		return nil, err
+	}
+
+	store.Check, err = store.encrypt(secretStoreCheckValue, secretStoreCheckValue)
+	if err != nil {
+		return nil, err
+	}
+
+	err = store.save()
+	if err != nil {
+		return nil, err
+	}
+
+	openedSecretStore = store
+	secretStoreUnlockError = nil
+	return store, nil
+}
+
+// OpenSecretStore loads and unlocks the secret store.  If the store couldn't be unlocked before, the same error is
+// returned without trying again.
+func OpenSecretStore() (*SecretStore, error) {
+
+	if openedSecretStore != nil && openedSecretStore.path == getSecretStorePath() {
+		return openedSecretStore, nil
+	}
+
+	if secretStoreUnlockError != nil && secretStoreUnlockErrorPath == getSecretStorePath() {
+		return nil, secretStoreUnlockError
+	}
+
+	store := &SecretStore{
+		path: getSecretStorePath(),
+	}
+
+	description, err := ioutil.ReadFile(store.path)
+	if err != nil {
+		return nil, err
+	}
+
+	err = json.Unmarshal(description, store)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %v", store.path, err)
+	}
+	if store.Secrets == nil {
+		store.Secrets = make(map[string][]byte)
+	}
+
+	material, err := getSecretStoreKeyMaterial(store.Method, store.KeyFile, false)
+	if err == nil {
+		err = store.unlock(material)
+	}
+	if err == nil {
+		check, checkErr := store.decrypt(secretStoreCheckValue, store.Check)
+		if checkErr != nil || check != secretStoreCheckValue {
+			err = fmt.Errorf("the secret store can't be unlocked with the %s", store.Method)
+		}
+	}
+	if err != nil {
+		secretStoreUnlockError = err
+		secretStoreUnlockErrorPath = store.path
+		return nil, err
+	}
+
+	openedSecretStore = store
+	return store, nil
+}
+
+func (store *SecretStore) save() error {
+	description, err := json.MarshalIndent(store, "", "    ")
+	if err != nil {
+		return err
+	}
+
+	// Write to a temporary file first so an interrupted write won't lose all the secrets
+	temporaryPath := store.path + ".tmp"
+	err = ioutil.WriteFile(temporaryPath, description, 0600)
+	if err != nil {
+		return err
+	}
+	return os.Rename(temporaryPath, store.path)
+}
+
+// Get returns the secret with the given name, or an empty string if there isn't one.
+func (store *SecretStore) Get(name string) (string, error) {
+	ciphertext, found := store.Secrets[name]
+	if !found {
+		return "", nil
+	}
+	return store.decrypt(name, ciphertext)
+}
+
+// Set stores the secret with the given name.
+func (store *SecretStore) Set(name string, value string) error {
+	ciphertext, err := store.encrypt(name, value)
+	if err != nil {
+		return err
+	}
+	store.Secrets[name] = ciphertext
+	return store.save()
+}
+
+// Remove deletes the secret with the given name.  It returns false if there is no such secret.
+func (store *SecretStore) Remove(name string) (bool, error) {
+	if _, found := store.Secrets[name]; !found {
+		return false, nil
+	}
+	delete(store.Secrets, name)
+	return true, store.save()
+}
+
+// List returns the names of all secrets in the store.
+func (store *SecretStore) List() []string {
+	var names []string
+	for name := range store.Secrets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// openSecretStoreForPassword opens the secret store for GetPassword and SavePassword.  A failure is only reported the
+// first time.
+func openSecretStoreForPassword() *SecretStore {
+	reported := secretStoreUnlockError != nil && secretStoreUnlockErrorPath == getSecretStorePath()
+	store, err := OpenSecretStore()
+	if err != nil && !reported {
+		LOG_WARN("SECRET_STORE", "Failed to open the secret store: %v", err)
+	}
+	return store
+}
+
+// secretStoreGet reads a secret for GetPassword.  Errors are logged rather than returned, so that the caller can
+// fall back to asking the user.
+func secretStoreGet(name string) string {
+	store := openSecretStoreForPassword()
+	if store == nil {
+		return ""
+	}
+
+	value, err := store.Get(name)
+	if err != nil {
+		LOG_WARN("SECRET_STORE", "Failed to decrypt %s from the secret store: %v", name, err)
+		return ""
+	}
+	if value != "" {
+		LOG_DEBUG("PASSWORD_SECRET_STORE", "Reading %s from the secret store", name)
+	}
+	return value
+}
+
+// secretStoreSet saves a secret for SavePassword.  An empty value removes the secret.
+func secretStoreSet(name string, value string) {
+	store := openSecretStoreForPassword()
+	if store == nil {
+		return
+	}
+
+	var err error
+	if value == "" {
+		_, err = store.Remove(name)
+	} else if current, _ := store.Get(name); current != value {
+		err = store.Set(name, value)
+	}
+	if err != nil {
+		LOG_WARN("SECRET_STORE", "Failed to save %s to the secret store: %v", name, err)
+	}
+}
@@ -0,0 +1,88 @@
+// Copyright (c) Acrosync LLC. All rights reserved.
+// Free for personal use and commercial trial
+// Commercial use requires per-user licenses available from https://duplicacy.com
+
+package duplicacy
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSecretStore(t *testing.T) {
+
+	testDir, err := ioutil.TempDir("", "duplicacy_test")
+	if err != nil {
+		t.Errorf("Failed to create a temporary directory: %v", err)
+		return
+	}
+	defer os.RemoveAll(testDir)
+
+	SetDuplicacyPreferencePath(testDir)
+	openedSecretStore = nil
+	secretStoreUnlockError = nil
+
+	keyFile := filepath.Join(testDir, "key")
+	ioutil.WriteFile(keyFile, []byte("0123456789abcdef"), 0600)
+
+	if SecretStoreExists() {
+		t.Errorf("The secret store should not exist yet")
+	}
+
+	store, err := CreateSecretStore(SECRET_STORE_KEY_FILE, keyFile)
+	if err != nil {
+		t.Errorf("Failed to create the secret store: %v", err)
+		return
+	}
+
+	store.Set("password", "secret1")
+	store.Set("s3_secret", "secret2")
+	store.Remove("s3_secret")
+
+	// Force the store to be read from the file again
+	openedSecretStore = nil
+	store, err = OpenSecretStore()
+	if err != nil {
+		t.Errorf("Failed to open the secret store: %v", err)
+		return
+	}
+
+	if value, _ := store.Get("password"); value != "secret1" {
+		t.Errorf("The stored password is '%s' instead of 'secret1'", value)
+	}
+	if names := store.List(); len(names) != 1 || names[0] != "password" {
+		t.Errorf("The secret store contains %v", names)
+	}
+
+	// An encrypted value moved to a different name must not be decrypted
+	store.Set("s3_id", "secret3")
+	store.Secrets["s3_id"], store.Secrets["password"] = store.Secrets["password"], store.Secrets["s3_id"]
+	if value, err := store.Get("password"); err == nil {
+		t.Errorf("The value of s3_id was decrypted as the password: '%s'", value)
+	}
+	store.Set("password", "secret1")
+
+	description, _ := ioutil.ReadFile(filepath.Join(testDir, "secrets"))
+	if len(description) == 0 {
+		t.Errorf("The secret store was not saved")
+	}
+
+	// A different key file must not unlock the store
+	openedSecretStore = nil
+	ioutil.WriteFile(keyFile, []byte("fedcba9876543210"), 0600)
+	if _, err = OpenSecretStore(); err == nil {
+		t.Errorf("The secret store was unlocked with a wrong key file")
+	}
+
+	// The failure is remembered so the key isn't asked for again
+	ioutil.WriteFile(keyFile, []byte("0123456789abcdef"), 0600)
+	if _, err = OpenSecretStore(); err == nil {
+		t.Errorf("The secret store was unlocked again after a failure")
+	}
+	secretStoreUnlockError = nil
+	if _, err = OpenSecretStore(); err != nil {
+		t.Errorf("Failed to open the secret store: %v", err)
+	}
+}
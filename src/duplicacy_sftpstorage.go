@@ -5,6 +5,7 @@
 package duplicacy
 
 import (
+	"bytes"
 	"fmt"
 	"io"
 	"math/rand"
@@ -12,22 +13,50 @@ import (
 	"os"
 	"path"
 	"runtime"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/pkg/sftp"
 	"golang.org/x/crypto/ssh"
 )
 
+const (
+	// The default maximum number of SSH connections opened by an SFTP storage
+	SFTPDefaultConnections = 8
+
+	// The number of times an operation is retried after the connection is lost
+	SFTPMaximumRetries = 3
+
+	// How long to wait for the response to a keepalive before the connection is considered lost
+	SFTPKeepAliveTimeout = 30 * time.Second
+)
+
 type SFTPStorage struct {
 	StorageBase
 
-	client          *sftp.Client
+	connections     []*sftpConnection // Thread i uses connection i % len(connections)
+	serverAddress   string
+	sftpConfig      *ssh.ClientConfig
+	dialer          SFTPDialer
+	stopKeepAlive   chan bool
 	minimumNesting  int // The minimum level of directories to dive into before searching for the chunk file.
 	storageDir      string
 	numberOfThreads int
 }
 
+// SFTPDialer opens an SSH connection to the server, for instance directly or through jump hosts.
+type SFTPDialer func(address string, config *ssh.ClientConfig) (*ssh.Client, error)
+
+// sftpConnection is an SSH connection with an SFTP session on top of it.  It is established on first use, and again
+// after it has been lost.
+type sftpConnection struct {
+	lock       sync.Mutex
+	connection *ssh.Client
+	client     *sftp.Client
+}
+
 func CreateSFTPStorageWithPassword(server string, port int, username string, storageDir string,
 	minimumNesting int, password string, threads int) (storage *SFTPStorage, err error) {
 
@@ -46,6 +75,19 @@ func CreateSFTPStorage(server string, port int, username string, storageDir stri
 	hostKeyCallback func(hostname string, remote net.Addr,
 		key ssh.PublicKey) error, threads int) (storage *SFTPStorage, err error) {
 
+	dialer := func(address string, config *ssh.ClientConfig) (*ssh.Client, error) {
+		return ssh.Dial("tcp", address, config)
+	}
+	return CreateSFTPStorageWithDialer(server, port, username, storageDir, minimumNesting, authMethods,
+		hostKeyCallback, threads, dialer)
+}
+
+// CreateSFTPStorageWithDialer is the same as CreateSFTPStorage except that connections are opened by 'dialer'.
+func CreateSFTPStorageWithDialer(server string, port int, username string, storageDir string, minimumNesting int,
+	authMethods []ssh.AuthMethod,
+	hostKeyCallback func(hostname string, remote net.Addr,
+		key ssh.PublicKey) error, threads int, dialer SFTPDialer) (storage *SFTPStorage, err error) {
+
 	sftpConfig := &ssh.ClientConfig{
 		User:            username,
 		Auth:            authMethods,
@@ -56,38 +98,37 @@ func CreateSFTPStorage(server string, port int, username string, storageDir stri
 		sftpConfig.Ciphers = []string{"aes128-ctr", "aes256-ctr"}
 	}
 
-	serverAddress := fmt.Sprintf("%s:%d", server, port)
-	connection, err := ssh.Dial("tcp", serverAddress, sftpConfig)
-	if err != nil {
-		return nil, err
+	for storageDir[len(storageDir)-1] == '/' {
+		storageDir = storageDir[:len(storageDir)-1]
 	}
 
-	client, err := sftp.NewClient(connection)
-	if err != nil {
-		connection.Close()
-		return nil, err
+	storage = &SFTPStorage{
+		serverAddress:   net.JoinHostPort(server, strconv.Itoa(port)),
+		sftpConfig:      sftpConfig,
+		dialer:          dialer,
+		storageDir:      storageDir,
+		minimumNesting:  minimumNesting,
+		numberOfThreads: threads,
 	}
+	storage.SetConnectionOptions(SFTPDefaultConnections, 0)
 
-	for storageDir[len(storageDir)-1] == '/' {
-		storageDir = storageDir[:len(storageDir)-1]
+	// Connect now so that authentication errors are reported right away
+	client, err := storage.connections[0].getClient(storage)
+	if err != nil {
+		return nil, err
 	}
 
 	fileInfo, err := client.Stat(storageDir)
 	if err != nil {
+		CloseSFTPStorage(storage)
 		return nil, fmt.Errorf("Can't access the storage path %s: %v", storageDir, err)
 	}
 
 	if !fileInfo.IsDir() {
+		CloseSFTPStorage(storage)
 		return nil, fmt.Errorf("The storage path %s is not a directory", storageDir)
 	}
 
-	storage = &SFTPStorage{
-		client:          client,
-		storageDir:      storageDir,
-		minimumNesting:  minimumNesting,
-		numberOfThreads: threads,
-	}
-
 	// Random number fo generating the temporary chunk file suffix.
 	rand.Seed(time.Now().UnixNano())
 
@@ -99,13 +140,202 @@ func CreateSFTPStorage(server string, port int, username string, storageDir stri
 }
 
 func CloseSFTPStorage(storage *SFTPStorage) {
-	storage.client.Close()
+	if storage.stopKeepAlive != nil {
+		close(storage.stopKeepAlive)
+		storage.stopKeepAlive = nil
+	}
+	for _, connection := range storage.connections {
+		connection.close()
+	}
+}
+
+// SetConnectionOptions sets the maximum number of SSH connections, one per thread up to this number, and the
+// interval between keepalive messages sent over each connection (0 to disable them).  A connection that fails to
+// respond to a keepalive is closed and will be reestablished when it is needed again.
+func (storage *SFTPStorage) SetConnectionOptions(maximumConnections int, keepAliveInterval time.Duration) {
+
+	numberOfConnections := storage.numberOfThreads
+	if maximumConnections > 0 && numberOfConnections > maximumConnections {
+		numberOfConnections = maximumConnections
+	}
+	if numberOfConnections < 1 {
+		numberOfConnections = 1
+	}
+
+	// Keep the connections that are already established
+	connections := make([]*sftpConnection, numberOfConnections)
+	for i := range connections {
+		if i < len(storage.connections) {
+			connections[i] = storage.connections[i]
+		} else {
+			connections[i] = &sftpConnection{}
+		}
+	}
+	for i := len(connections); i < len(storage.connections); i++ {
+		storage.connections[i].close()
+	}
+	storage.connections = connections
+
+	if storage.stopKeepAlive != nil {
+		close(storage.stopKeepAlive)
+		storage.stopKeepAlive = nil
+	}
+
+	if keepAliveInterval > 0 {
+		LOG_DEBUG("SFTP_KEEPALIVE", "Sending keepalives every %s over %d connections", keepAliveInterval,
+			numberOfConnections)
+		storage.stopKeepAlive = make(chan bool)
+		// The goroutine must not keep a reference to the storage, or the finalizer would never run
+		go sendSFTPKeepAlives(connections, keepAliveInterval, storage.stopKeepAlive)
+	}
+}
+
+// sendSFTPKeepAlives sends a keepalive message over each established connection at every interval.
+func sendSFTPKeepAlives(connections []*sftpConnection, interval time.Duration, stop chan bool) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			for _, connection := range connections {
+				connection.lock.Lock()
+				sshClient, client := connection.connection, connection.client
+				connection.lock.Unlock()
+				if sshClient == nil {
+					continue
+				}
+				err := sendSFTPKeepAlive(sshClient, SFTPKeepAliveTimeout)
+				if err != nil {
+					LOG_DEBUG("SFTP_KEEPALIVE", "The connection failed to respond to a keepalive: %v", err)
+					connection.reset(client)
+				}
+			}
+		}
+	}
+}
+
+// sendSFTPKeepAlive sends a keepalive message and waits for the response for at most 'timeout'.  A server that
+// stops responding would otherwise block the request forever; closing the connection unblocks it.
+func sendSFTPKeepAlive(sshClient *ssh.Client, timeout time.Duration) error {
+	result := make(chan error, 1)
+	go func() {
+		_, _, err := sshClient.SendRequest("keepalive@openssh.com", true, nil)
+		result <- err
+	}()
+
+	select {
+	case err := <-result:
+		return err
+	case <-time.After(timeout):
+		return fmt.Errorf("no response after %s", timeout)
+	}
+}
+
+// getClient returns the SFTP client of the connection, connecting to the server first if necessary.
+func (connection *sftpConnection) getClient(storage *SFTPStorage) (*sftp.Client, error) {
+	connection.lock.Lock()
+	defer connection.lock.Unlock()
+
+	if connection.client != nil {
+		return connection.client, nil
+	}
+
+	sshClient, err := storage.dialer(storage.serverAddress, storage.sftpConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	client, err := sftp.NewClient(sshClient)
+	if err != nil {
+		sshClient.Close()
+		return nil, err
+	}
+
+	connection.connection = sshClient
+	connection.client = client
+	return client, nil
+}
+
+// reset closes the connection if it is still using 'client', so the next operation will reconnect.  Other threads
+// sharing the connection may have already reconnected, in which case the new connection is kept.
+func (connection *sftpConnection) reset(client *sftp.Client) {
+	connection.lock.Lock()
+	defer connection.lock.Unlock()
+	if connection.client == client {
+		connection.closeLocked()
+	}
+}
+
+func (connection *sftpConnection) close() {
+	connection.lock.Lock()
+	defer connection.lock.Unlock()
+	connection.closeLocked()
+}
+
+func (connection *sftpConnection) closeLocked() {
+	if connection.client != nil {
+		connection.client.Close()
+		connection.client = nil
+	}
+	if connection.connection != nil {
+		connection.connection.Close()
+		connection.connection = nil
+	}
+}
+
+// isSFTPConnectionError returns true if the error indicates that the connection to the server has been lost.
+func isSFTPConnectionError(err error) bool {
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return true
+	}
+	if _, ok := err.(net.Error); ok {
+		return true
+	}
+	message := err.Error()
+	for _, pattern := range []string{"connection lost", "use of closed network connection", "broken pipe",
+		"connection reset"} {
+		if strings.Contains(message, pattern) {
+			return true
+		}
+	}
+	return false
+}
+
+// run calls 'operation' with the SFTP client of the connection assigned to the thread.  If the connection turns
+// out to be lost, it reconnects and calls 'operation' again.
+func (storage *SFTPStorage) run(threadIndex int, operation func(client *sftp.Client) error) (err error) {
+
+	connection := storage.connections[threadIndex%len(storage.connections)]
+
+	for attempt := 0; ; attempt++ {
+		var client *sftp.Client
+		client, err = connection.getClient(storage)
+		if err == nil {
+			err = operation(client)
+			if err == nil || !isSFTPConnectionError(err) {
+				return err
+			}
+			connection.reset(client)
+		}
+
+		if attempt >= SFTPMaximumRetries {
+			return err
+		}
+		LOG_INFO("SFTP_RECONNECT", "Lost the connection to %s: %v; reconnecting", storage.serverAddress, err)
+		time.Sleep(time.Duration(attempt+1) * time.Second)
+	}
 }
 
 // ListFiles return the list of files and subdirectories under 'file' (non-recursively)
 func (storage *SFTPStorage) ListFiles(threadIndex int, dirPath string) (files []string, sizes []int64, err error) {
 
-	entries, err := storage.client.ReadDir(path.Join(storage.storageDir, dirPath))
+	var entries []os.FileInfo
+	err = storage.run(threadIndex, func(client *sftp.Client) (err error) {
+		entries, err = client.ReadDir(path.Join(storage.storageDir, dirPath))
+		return err
+	})
 	if err != nil {
 		return nil, nil, err
 	}
@@ -126,44 +356,62 @@ func (storage *SFTPStorage) ListFiles(threadIndex int, dirPath string) (files []
 // DeleteFile deletes the file or directory at 'filePath'.
 func (storage *SFTPStorage) DeleteFile(threadIndex int, filePath string) (err error) {
 	fullPath := path.Join(storage.storageDir, filePath)
-	fileInfo, err := storage.client.Stat(fullPath)
-	if err != nil {
-		if os.IsNotExist(err) {
-			LOG_TRACE("SFTP_STORAGE", "File %s has disappeared before deletion", filePath)
+	return storage.run(threadIndex, func(client *sftp.Client) error {
+		fileInfo, err := client.Stat(fullPath)
+		if err != nil {
+			if os.IsNotExist(err) {
+				LOG_TRACE("SFTP_STORAGE", "File %s has disappeared before deletion", filePath)
+				return nil
+			}
+			return err
+		}
+		if fileInfo == nil {
 			return nil
 		}
-		return err
-	}
-	if fileInfo == nil {
-		return nil
-	}
-	return storage.client.Remove(path.Join(storage.storageDir, filePath))
+		return client.Remove(fullPath)
+	})
 }
 
 // MoveFile renames the file.
 func (storage *SFTPStorage) MoveFile(threadIndex int, from string, to string) (err error) {
+	fromPath := path.Join(storage.storageDir, from)
 	toPath := path.Join(storage.storageDir, to)
-	fileInfo, err := storage.client.Stat(toPath)
-	if fileInfo != nil {
-		return fmt.Errorf("The destination file %s already exists", toPath)
-	}
-	return storage.client.Rename(path.Join(storage.storageDir, from),
-		path.Join(storage.storageDir, to))
+	attempted := false
+	return storage.run(threadIndex, func(client *sftp.Client) error {
+		fileInfo, _ := client.Stat(toPath)
+		if fileInfo != nil {
+			// If the connection was lost after the server renamed the file, the retry finds the file already moved
+			if attempted {
+				if _, err := client.Stat(fromPath); os.IsNotExist(err) {
+					return nil
+				}
+			}
+			return fmt.Errorf("The destination file %s already exists", toPath)
+		}
+		attempted = true
+		return client.Rename(fromPath, toPath)
+	})
 }
 
 // CreateDirectory creates a new directory.
 func (storage *SFTPStorage) CreateDirectory(threadIndex int, dirPath string) (err error) {
 	fullPath := path.Join(storage.storageDir, dirPath)
-	fileInfo, err := storage.client.Stat(fullPath)
-	if fileInfo != nil && fileInfo.IsDir() {
-		return nil
-	}
-	return storage.client.Mkdir(path.Join(storage.storageDir, dirPath))
+	return storage.run(threadIndex, func(client *sftp.Client) error {
+		fileInfo, _ := client.Stat(fullPath)
+		if fileInfo != nil && fileInfo.IsDir() {
+			return nil
+		}
+		return client.Mkdir(fullPath)
+	})
 }
 
 // GetFileInfo returns the information about the file or directory at 'filePath'.
 func (storage *SFTPStorage) GetFileInfo(threadIndex int, filePath string) (exist bool, isDir bool, size int64, err error) {
-	fileInfo, err := storage.client.Stat(path.Join(storage.storageDir, filePath))
+	var fileInfo os.FileInfo
+	err = storage.run(threadIndex, func(client *sftp.Client) (err error) {
+		fileInfo, err = client.Stat(path.Join(storage.storageDir, filePath))
+		return err
+	})
 	if err != nil {
 		if os.IsNotExist(err) {
 			return false, false, 0, nil
@@ -181,42 +429,71 @@ func (storage *SFTPStorage) GetFileInfo(threadIndex int, filePath string) (exist
 
 // DownloadFile reads the file at 'filePath' into the chunk.
 func (storage *SFTPStorage) DownloadFile(threadIndex int, filePath string, chunk *Chunk) (err error) {
-	file, err := storage.client.Open(path.Join(storage.storageDir, filePath))
 
-	if err != nil {
-		return err
-	}
+	// Download into a buffer first so that a retry after a lost connection doesn't leave partial content in the chunk
+	var buffer bytes.Buffer
+	err = storage.run(threadIndex, func(client *sftp.Client) error {
+		buffer.Reset()
+		file, err := client.Open(path.Join(storage.storageDir, filePath))
+		if err != nil {
+			return err
+		}
 
-	defer file.Close()
-	if _, err = RateLimitedCopy(chunk, file, storage.DownloadRateLimit/storage.numberOfThreads); err != nil {
+		defer file.Close()
+		_, err = RateLimitedCopy(&buffer, file, storage.DownloadRateLimit/storage.numberOfThreads)
+		return err
+	})
+	if err != nil {
 		return err
 	}
 
+	chunk.Write(buffer.Bytes())
 	return nil
 }
 
 // UploadFile writes 'content' to the file at 'filePath'.
 func (storage *SFTPStorage) UploadFile(threadIndex int, filePath string, content []byte) (err error) {
 
+	letters := "abcdefghijklmnopqrstuvwxyz"
+	suffix := make([]byte, 8)
+	for i := range suffix {
+		suffix[i] = letters[rand.Intn(len(letters))]
+	}
+
+	temporaryFile := path.Join(storage.storageDir, filePath) + "." + string(suffix) + ".tmp"
+
+	retried := false
+	return storage.run(threadIndex, func(client *sftp.Client) error {
+		if retried {
+			// Remove what the failed attempt may have left behind
+			client.Remove(temporaryFile)
+		}
+		retried = true
+		return storage.uploadFile(client, filePath, temporaryFile, content)
+	})
+}
+
+func (storage *SFTPStorage) uploadFile(client *sftp.Client, filePath string, temporaryFile string, content []byte) (err error) {
+
 	fullPath := path.Join(storage.storageDir, filePath)
 
 	dirs := strings.Split(filePath, "/")
 	if len(dirs) > 1 {
 		fullDir := path.Dir(fullPath)
-		_, err := storage.client.Stat(fullDir)
+		_, err := client.Stat(fullDir)
 		if err != nil {
 			// The error may be caused by a non-existent fullDir, or a broken connection.  In either case,
 			// we just assume it is the former because there isn't a way to tell which is the case.
 			for i, _ := range dirs[1 : len(dirs)-1] {
 				subDir := path.Join(storage.storageDir, path.Join(dirs[0:i+2]...))
 				// We don't check the error; just keep going blindly but always store the last err
-				err = storage.client.Mkdir(subDir)
+				err = client.Mkdir(subDir)
 			}
 
 			// If there is an error creating the dirs, we check fullDir one more time, because another thread
 			// may happen to create the same fullDir ahead of this thread
 			if err != nil {
-				_, err := storage.client.Stat(fullDir)
+				_, err := client.Stat(fullDir)
 				if err != nil {
 					return err
 				}
@@ -224,15 +501,7 @@ func (storage *SFTPStorage) UploadFile(threadIndex int, filePath string, content
 		}
 	}
 
-	letters := "abcdefghijklmnopqrstuvwxyz"
-	suffix := make([]byte, 8)
-	for i := range suffix {
-		suffix[i] = letters[rand.Intn(len(letters))]
-	}
-
-	temporaryFile := fullPath + "." + string(suffix) + ".tmp"
-
-	file, err := storage.client.OpenFile(temporaryFile, os.O_WRONLY|os.O_CREATE|os.O_TRUNC)
+	file, err := client.OpenFile(temporaryFile, os.O_WRONLY|os.O_CREATE|os.O_TRUNC)
 	if err != nil {
 		return err
 	}
@@ -245,12 +514,14 @@ func (storage *SFTPStorage) UploadFile(threadIndex int, filePath string, content
 	}
 	file.Close()
 
-	err = storage.client.Rename(temporaryFile, fullPath)
+	err = client.Rename(temporaryFile, fullPath)
 	if err != nil {
 
-		if _, err = storage.client.Stat(fullPath); err == nil {
-			storage.client.Remove(temporaryFile)
+		if _, err = client.Stat(fullPath); err == nil {
+			client.Remove(temporaryFile)
 			return nil
+		} else if isSFTPConnectionError(err) {
+			return err
 		} else {
 			return fmt.Errorf("Uploaded file but failed to store it at %s: %v", fullPath, err)
 		}
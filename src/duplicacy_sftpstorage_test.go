@@ -0,0 +1,283 @@
+// Copyright (c) Acrosync LLC. All rights reserved.
+// Free for personal use and commercial trial
+// Commercial use requires per-user licenses available from https://duplicacy.com
+
+package duplicacy
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+)
+
+func TestSFTPConnectionPool(t *testing.T) {
+
+	setTestingT(t)
+
+	storage := &SFTPStorage{numberOfThreads: 4}
+	storage.SetConnectionOptions(SFTPDefaultConnections, 0)
+	if len(storage.connections) != 4 {
+		t.Errorf("%d connections for 4 threads", len(storage.connections))
+	}
+
+	first := storage.connections[0]
+	storage.SetConnectionOptions(2, 0)
+	if len(storage.connections) != 2 || storage.connections[0] != first {
+		t.Errorf("The pool was not resized correctly")
+	}
+
+	storage.numberOfThreads = 0
+	storage.SetConnectionOptions(0, 0)
+	if len(storage.connections) != 1 {
+		t.Errorf("There should be at least one connection")
+	}
+
+	for _, err := range []error{io.EOF, &net.OpError{Op: "read", Err: fmt.Errorf("timeout")},
+		fmt.Errorf("connection lost")} {
+		if !isSFTPConnectionError(err) {
+			t.Errorf("'%v' should be treated as a lost connection", err)
+		}
+	}
+
+	if isSFTPConnectionError(os.ErrNotExist) || isSFTPConnectionError(fmt.Errorf("permission denied")) {
+		t.Errorf("Other errors should not be treated as lost connections")
+	}
+}
+
+// sftpTestChannel is the server end of an SFTP session.  When 'drop' returns true, the connection is closed instead
+// of sending the response, as if it had been lost after the server carried out the request.
+type sftpTestChannel struct {
+	ssh.Channel
+	connection net.Conn
+	drop       func() bool
+}
+
+func (channel *sftpTestChannel) Write(data []byte) (int, error) {
+	if channel.drop() {
+		channel.connection.Close()
+		return 0, io.EOF
+	}
+	return channel.Channel.Write(data)
+}
+
+// startSFTPServerForTest runs an SFTP server on a local port until the returned listener is closed.
+func startSFTPServerForTest(t *testing.T, drop func() bool) net.Listener {
+
+	privateKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("Failed to generate the host key: %v", err)
+	}
+	hostKey, err := ssh.NewSignerFromKey(privateKey)
+	if err != nil {
+		t.Fatalf("Failed to create the host key signer: %v", err)
+	}
+	config := &ssh.ServerConfig{NoClientAuth: true}
+	config.AddHostKey(hostKey)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen on a local port: %v", err)
+	}
+
+	serve := func(connection net.Conn) {
+		defer connection.Close()
+		_, channels, requests, err := ssh.NewServerConn(connection, config)
+		if err != nil {
+			return
+		}
+		go ssh.DiscardRequests(requests)
+
+		for newChannel := range channels {
+			if newChannel.ChannelType() != "session" {
+				newChannel.Reject(ssh.UnknownChannelType, "unknown channel type")
+				continue
+			}
+			channel, requests, err := newChannel.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				for request := range requests {
+					isSFTP := request.Type == "subsystem" && len(request.Payload) > 4 &&
+						string(request.Payload[4:]) == "sftp"
+					request.Reply(isSFTP, nil)
+					if isSFTP {
+						server, err := sftp.NewServer(&sftpTestChannel{channel, connection, drop})
+						if err == nil {
+							server.Serve()
+						}
+						channel.Close()
+					}
+				}
+			}()
+		}
+	}
+
+	go func() {
+		for {
+			connection, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go serve(connection)
+		}
+	}()
+
+	return listener
+}
+
+func TestSFTPReconnect(t *testing.T) {
+
+	setTestingT(t)
+
+	testDir, err := ioutil.TempDir("", "duplicacy_sftp_test")
+	if err != nil {
+		t.Fatalf("Failed to create the test directory: %v", err)
+	}
+	defer os.RemoveAll(testDir)
+
+	fromPath := path.Join(testDir, "chunk")
+	toPath := path.Join(testDir, "chunk.fsl")
+
+	// Drop the connection once, right after the server has renamed the file or created the temporary file of an
+	// upload, before the client learns about it
+	const (
+		dropAfterRename = 1
+		dropAfterCreate = 2
+	)
+	var dropMode int32
+	drop := func() bool {
+		switch atomic.LoadInt32(&dropMode) {
+		case dropAfterRename:
+			if _, err := os.Stat(toPath); err != nil {
+				return false
+			}
+		case dropAfterCreate:
+			if matches, _ := filepath.Glob(path.Join(testDir, "chunks", "ab", "cdef.*.tmp")); len(matches) == 0 {
+				return false
+			}
+		default:
+			return false
+		}
+		return atomic.SwapInt32(&dropMode, 0) != 0
+	}
+
+	listener := startSFTPServerForTest(t, drop)
+	defer listener.Close()
+
+	var dials, failedDials int32
+	dialer := func(address string, config *ssh.ClientConfig) (*ssh.Client, error) {
+		atomic.AddInt32(&dials, 1)
+		if atomic.LoadInt32(&failedDials) > 0 {
+			atomic.AddInt32(&failedDials, -1)
+			return nil, &net.OpError{Op: "dial", Err: fmt.Errorf("connection refused")}
+		}
+		return ssh.Dial("tcp", address, config)
+	}
+
+	hostKeyCallback := func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		return nil
+	}
+
+	port := listener.Addr().(*net.TCPAddr).Port
+	storage, err := CreateSFTPStorageWithDialer("127.0.0.1", port, "test", testDir, 0, nil, hostKeyCallback, 1, dialer)
+	if err != nil {
+		t.Fatalf("Failed to create the SFTP storage: %v", err)
+	}
+	defer CloseSFTPStorage(storage)
+
+	// An operation that loses the connection is retried once over a new connection
+	atomic.StoreInt32(&dials, 0)
+	calls := 0
+	err = storage.run(0, func(client *sftp.Client) error {
+		calls++
+		if calls == 1 {
+			return io.EOF
+		}
+		return nil
+	})
+	if err != nil || calls != 2 || atomic.LoadInt32(&dials) != 1 {
+		t.Errorf("Lost connection: err %v, %d calls, %d reconnects; expected 2 calls and 1 reconnect",
+			err, calls, dials)
+	}
+
+	// A dialer that fails once is called again before the operation is run
+	storage.connections[0].close()
+	atomic.StoreInt32(&dials, 0)
+	atomic.StoreInt32(&failedDials, 1)
+	calls = 0
+	err = storage.run(0, func(client *sftp.Client) error {
+		calls++
+		return nil
+	})
+	if err != nil || calls != 1 || atomic.LoadInt32(&dials) != 2 {
+		t.Errorf("Failed dial: err %v, %d calls, %d dials; expected 1 call and 2 dials", err, calls, dials)
+	}
+
+	// Other errors are returned without reconnecting
+	atomic.StoreInt32(&dials, 0)
+	calls = 0
+	err = storage.run(0, func(client *sftp.Client) error {
+		calls++
+		return os.ErrPermission
+	})
+	if err != os.ErrPermission || calls != 1 || atomic.LoadInt32(&dials) != 0 {
+		t.Errorf("Permission error: err %v, %d calls, %d dials; expected 1 call and no dials", err, calls, dials)
+	}
+
+	// A rename that completed before the connection was lost is not reported as a failure when retried
+	err = ioutil.WriteFile(fromPath, []byte("chunk"), 0644)
+	if err != nil {
+		t.Fatalf("Failed to create the test file: %v", err)
+	}
+	atomic.StoreInt32(&dials, 0)
+	atomic.StoreInt32(&dropMode, dropAfterRename)
+	err = storage.MoveFile(0, "chunk", "chunk.fsl")
+	if err != nil {
+		t.Errorf("The retried move failed: %v", err)
+	}
+	if atomic.LoadInt32(&dropMode) != 0 || atomic.LoadInt32(&dials) != 1 {
+		t.Errorf("The connection was not lost and reestablished during the move")
+	}
+	if _, err := os.Stat(fromPath); !os.IsNotExist(err) {
+		t.Errorf("%s still exists after the move", fromPath)
+	}
+
+	// A move onto an existing file still fails
+	err = ioutil.WriteFile(fromPath, []byte("chunk"), 0644)
+	if err != nil {
+		t.Fatalf("Failed to create the test file: %v", err)
+	}
+	if err = storage.MoveFile(0, "chunk", "chunk.fsl"); err == nil {
+		t.Errorf("Moving onto an existing file should fail")
+	}
+
+	// An upload retried after the connection was lost doesn't leave the temporary file behind
+	atomic.StoreInt32(&dials, 0)
+	atomic.StoreInt32(&dropMode, dropAfterCreate)
+	err = storage.UploadFile(0, "chunks/ab/cdef", []byte("chunk"))
+	if err != nil {
+		t.Errorf("The retried upload failed: %v", err)
+	}
+	if atomic.LoadInt32(&dropMode) != 0 || atomic.LoadInt32(&dials) != 1 {
+		t.Errorf("The connection was not lost and reestablished during the upload")
+	}
+	content, err := ioutil.ReadFile(path.Join(testDir, "chunks", "ab", "cdef"))
+	if err != nil || string(content) != "chunk" {
+		t.Errorf("The uploaded file is missing or incorrect: %v", err)
+	}
+	if matches, _ := filepath.Glob(path.Join(testDir, "chunks", "ab", "*.tmp")); len(matches) != 0 {
+		t.Errorf("Temporary files left behind: %v", matches)
+	}
+}
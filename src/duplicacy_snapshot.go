@@ -26,6 +26,7 @@ type Snapshot struct {
 	EndTime       int64  // at what time the snapshot was done
 	FileSize      int64  // total file size
 	NumberOfFiles int64  // number of files
+	Version       int    // the format of the file list; 0 is the same as SNAPSHOT_VERSION_FILE_LIST
 
 	// A sequence of chunks whose aggregated content is the json representation of 'Files'.
 	FileSequence []string
@@ -36,6 +37,13 @@ type Snapshot struct {
 	// A sequence of chunks whose aggregated content is the json representation of 'ChunkLengths'.
 	LengthSequence []string
 
+	// Version 2 snapshots have none of the three sequences above.  Instead, this is a sequence of chunks whose
+	// aggregated content is the path index of the directory tree.
+	IndexSequence []string
+
+	// Chunks of the directory nodes that have been loaded or uploaded; this is not saved in the snapshot file.
+	TreeSequence []string
+
 	Files []*Entry // list of files and subdirectories
 
 	ChunkHashes  []string // a sequence of chunks representing the file content
@@ -44,8 +52,18 @@ type Snapshot struct {
 	Flag bool // used to mark certain snapshots for deletion or copy
 
 	discardAttributes bool
+
+	treeLoaded bool // if 'TreeSequence' and 'ChunkHashes' cover every directory of a version 2 snapshot
 }
 
+const (
+	// The file list is stored as one list of files, along with the hashes and lengths of all chunks
+	SNAPSHOT_VERSION_FILE_LIST = 1
+
+	// The file list is stored as a directory tree with a path index, so only the needed directories can be loaded
+	SNAPSHOT_VERSION_TREE = 2
+)
+
 // CreateEmptySnapshot creates an empty snapshot.
 func CreateEmptySnapshot(id string) (snapshto *Snapshot) {
 	return &Snapshot{
@@ -254,7 +272,9 @@ func CreateSnapshotFromDescription(description []byte) (snapshot *Snapshot, err
 		return nil, err
 	}
 
-	snapshot = &Snapshot{}
+	snapshot = &Snapshot{
+		Version: SNAPSHOT_VERSION_FILE_LIST,
+	}
 
 	if value, ok := root["id"]; !ok {
 		return nil, fmt.Errorf("No id is specified in the snapshot")
@@ -308,7 +328,22 @@ func CreateSnapshotFromDescription(description []byte) (snapshot *Snapshot, err
 		}
 	}
 
-	for _, sequenceType := range []string{"files", "chunks", "lengths"} {
+	if value, ok := root["version"]; ok {
+		if _, ok = value.(float64); !ok {
+			return nil, fmt.Errorf("Invalid version is specified in the snapshot")
+		}
+		snapshot.Version = int(value.(float64))
+		if snapshot.Version > SNAPSHOT_VERSION_TREE {
+			return nil, fmt.Errorf("Unsupported snapshot version %d", snapshot.Version)
+		}
+	}
+
+	sequenceTypes := []string{"files", "chunks", "lengths"}
+	if snapshot.Version >= SNAPSHOT_VERSION_TREE {
+		sequenceTypes = []string{"index"}
+	}
+
+	for _, sequenceType := range sequenceTypes {
 		if value, ok := root[sequenceType]; !ok {
 			return nil, fmt.Errorf("No %s are specified in the snapshot", sequenceType)
 		} else if _, ok = value.([]interface{}); !ok {
@@ -383,9 +418,15 @@ func (snapshot *Snapshot) MarshalJSON() ([]byte, error) {
 		object["file_size"] = snapshot.FileSize
 		object["number_of_files"] = snapshot.NumberOfFiles
 	}
-	object["files"] = encodeSequence(snapshot.FileSequence)
-	object["chunks"] = encodeSequence(snapshot.ChunkSequence)
-	object["lengths"] = encodeSequence(snapshot.LengthSequence)
+
+	if snapshot.Version >= SNAPSHOT_VERSION_TREE {
+		object["version"] = snapshot.Version
+		object["index"] = encodeSequence(snapshot.IndexSequence)
+	} else {
+		object["files"] = encodeSequence(snapshot.FileSequence)
+		object["chunks"] = encodeSequence(snapshot.ChunkSequence)
+		object["lengths"] = encodeSequence(snapshot.LengthSequence)
+	}
 
 	return json.Marshal(object)
 }
@@ -408,6 +449,8 @@ func (snapshot *Snapshot) SetSequence(sequenceType string, sequence []string) {
 		snapshot.FileSequence = sequence
 	} else if sequenceType == "chunks" {
 		snapshot.ChunkSequence = sequence
+	} else if sequenceType == "index" {
+		snapshot.IndexSequence = sequence
 	} else {
 		snapshot.LengthSequence = sequence
 	}
@@ -165,6 +165,52 @@ func (collection *FossilCollection) IsEmpty() bool {
 	return len(collection.Fossils) == 0 && len(collection.Temporaries) == 0
 }
 
+// Files that couldn't be deleted or fossilized because they were locked by the storage are recorded in this file in
+// the snapshot cache, together with the times their locks expire, so that a later prune can take care of them.
+const lockedFilesPath = "fossils/locked"
+
+// loadLockedFiles returns the locked files recorded by previous prunes.
+func (manager *SnapshotManager) loadLockedFiles() map[string]int64 {
+	lockedFiles := make(map[string]int64)
+
+	exist, _, _, err := manager.snapshotCache.GetFileInfo(0, lockedFilesPath)
+	if err != nil || !exist {
+		return lockedFiles
+	}
+
+	manager.fileChunk.Reset(false)
+	err = manager.snapshotCache.DownloadFile(0, lockedFilesPath, manager.fileChunk)
+	if err == nil {
+		err = json.Unmarshal(manager.fileChunk.GetBytes(), &lockedFiles)
+	}
+	if err != nil {
+		LOG_WARN("FOSSIL_LOCKED", "Failed to load the list of locked files: %v", err)
+	}
+	return lockedFiles
+}
+
+// saveLockedFiles saves the list of locked files, or removes it if there are none left.
+func (manager *SnapshotManager) saveLockedFiles(lockedFiles map[string]int64) {
+	if len(lockedFiles) == 0 {
+		exist, _, _, _ := manager.snapshotCache.GetFileInfo(0, lockedFilesPath)
+		if exist {
+			manager.snapshotCache.DeleteFile(0, lockedFilesPath)
+		}
+		return
+	}
+
+	description, err := json.Marshal(lockedFiles)
+	if err == nil {
+		err = manager.snapshotCache.UploadFile(0, lockedFilesPath, description)
+	}
+	if err != nil {
+		LOG_WARN("FOSSIL_LOCKED", "Failed to save the list of locked files: %v", err)
+		return
+	}
+	LOG_INFO("FOSSIL_LOCKED", "%d locked files will be deleted by a later prune once their locks expire",
+		len(lockedFiles))
+}
+
 // SnapshotManager is mainly responsible for downloading, and deleting snapshots.
 type SnapshotManager struct {
 
@@ -273,6 +319,11 @@ func (manager *SnapshotManager) DownloadSequence(sequence []string) (content []b
 
 func (manager *SnapshotManager) DownloadSnapshotFileSequence(snapshot *Snapshot, patterns []string, attributesNeeded bool) bool {
 
+	// The file list of a version 2 snapshot can be loaded only for the directories the patterns may match
+	if snapshot.Version >= SNAPSHOT_VERSION_TREE {
+		return manager.DownloadSnapshotTree(snapshot, patterns, attributesNeeded)
+	}
+
 	manager.CreateChunkDownloader()
 
 	reader := sequenceReader{
@@ -352,9 +403,16 @@ func (manager *SnapshotManager) DownloadSnapshotSequence(snapshot *Snapshot, seq
 // for the actual content of the snapshot to be usable.
 func (manager *SnapshotManager) DownloadSnapshotContents(snapshot *Snapshot, patterns []string, attributesNeeded bool) bool {
 
-	manager.DownloadSnapshotFileSequence(snapshot, patterns, attributesNeeded)
-	manager.DownloadSnapshotSequence(snapshot, "chunks")
-	manager.DownloadSnapshotSequence(snapshot, "lengths")
+	// Chunk hashes and lengths of a version 2 snapshot are stored in the directories along with the files
+	if snapshot.Version >= SNAPSHOT_VERSION_TREE {
+		if !manager.DownloadSnapshotTree(snapshot, patterns, attributesNeeded) {
+			return false
+		}
+	} else {
+		manager.DownloadSnapshotFileSequence(snapshot, patterns, attributesNeeded)
+		manager.DownloadSnapshotSequence(snapshot, "chunks")
+		manager.DownloadSnapshotSequence(snapshot, "lengths")
+	}
 
 	err := manager.CheckSnapshot(snapshot)
 	if err != nil {
@@ -433,8 +491,14 @@ func (manager *SnapshotManager) CleanSnapshotCache(latestSnapshot *Snapshot, all
 			continue
 		}
 
+		// The path index of a version 2 snapshot takes the place of the chunk sequence
+		sequence := cachedSnapshot.ChunkSequence
+		if cachedSnapshot.Version >= SNAPSHOT_VERSION_TREE {
+			sequence = cachedSnapshot.IndexSequence
+		}
+
 		isComplete := true
-		for _, chunkHash := range cachedSnapshot.ChunkSequence {
+		for _, chunkHash := range sequence {
 			chunkID := manager.config.GetChunkIDFromHash(chunkHash)
 
 			if _, exist, _, _ := manager.snapshotCache.FindChunk(0, chunkID, false); !exist {
@@ -451,7 +515,17 @@ func (manager *SnapshotManager) CleanSnapshotCache(latestSnapshot *Snapshot, all
 			continue
 		}
 
-		for _, chunkHash := range cachedSnapshot.ChunkSequence {
+		// The nodes of the directories are needed as well to find the chunks of the files
+		if cachedSnapshot.Version >= SNAPSHOT_VERSION_TREE {
+			nodeSequence, err := manager.getSnapshotTreeNodeSequences(cachedSnapshot)
+			if err != nil {
+				LOG_WARN("SNAPSHOT_CACHE", "Failed to load the path index of the cached snapshot file %s: %v",
+					snapshotFile, err)
+			}
+			sequence = append(sequence, nodeSequence...)
+		}
+
+		for _, chunkHash := range sequence {
 			chunkID := manager.config.GetChunkIDFromHash(chunkHash)
 			LOG_DEBUG("SNAPSHOT_CLEAN", "Snapshot %s revision %d needs chunk %s", cachedSnapshot.ID, cachedSnapshot.Revision, chunkID)
 			chunks[chunkID] = true
@@ -532,6 +606,33 @@ func (manager *SnapshotManager) ListSnapshotRevisions(snapshotID string) (revisi
 	return revisions, nil
 }
 
+// FindRevisionAtTime returns the latest revision of the snapshot created at or before 'atTime' (in Unix seconds).
+// It returns 0 if there is no such revision.
+func (manager *SnapshotManager) FindRevisionAtTime(snapshotID string, atTime int64) (revision int, err error) {
+
+	revisions, err := manager.ListSnapshotRevisions(snapshotID)
+	if err != nil {
+		return 0, err
+	}
+
+	// Revisions are sorted in increasing order and so are their start times, so a binary search only needs to
+	// download a few snapshots to find the first revision created after 'atTime'
+	index := sort.Search(len(revisions), func(i int) bool {
+		snapshot := manager.DownloadSnapshot(snapshotID, revisions[i])
+		if snapshot == nil {
+			return true
+		}
+		LOG_DEBUG("SNAPSHOT_AT", "Snapshot %s revision %d was created at %s", snapshotID, revisions[i],
+			time.Unix(snapshot.StartTime, 0).Format("2006-01-02 15:04:05"))
+		return snapshot.StartTime > atTime
+	})
+
+	if index == 0 {
+		return 0, nil
+	}
+	return revisions[index-1], nil
+}
+
 // DownloadLatestSnapshot downloads the snapshot with the largest revision number.
 func (manager *SnapshotManager) downloadLatestSnapshot(snapshotID string) (remote *Snapshot) {
 
@@ -604,6 +705,13 @@ func (manager *SnapshotManager) ListAllFiles(storage Storage, top string) (allFi
 // keepChunkHashes is true, snapshot.ChunkHashes will be populated.
 func (manager *SnapshotManager) GetSnapshotChunks(snapshot *Snapshot, keepChunkHashes bool) (chunks []string) {
 
+	if snapshot.Version >= SNAPSHOT_VERSION_TREE {
+		for _, chunkHash := range manager.getSnapshotTreeChunkHashes(snapshot, keepChunkHashes) {
+			chunks = append(chunks, manager.config.GetChunkIDFromHash(chunkHash))
+		}
+		return chunks
+	}
+
 	for _, chunkHash := range snapshot.FileSequence {
 		chunks = append(chunks, manager.config.GetChunkIDFromHash(chunkHash))
 	}
@@ -717,7 +825,8 @@ func (manager *SnapshotManager) ListSnapshots(snapshotID string, revisionsToList
 					}
 				}
 
-				metaChunks := len(snapshot.FileSequence) + len(snapshot.ChunkSequence) + len(snapshot.LengthSequence)
+				metaChunks := len(snapshot.FileSequence) + len(snapshot.ChunkSequence) + len(snapshot.LengthSequence) +
+					len(snapshot.IndexSequence) + len(snapshot.TreeSequence)
 				LOG_INFO("SNAPSHOT_STATS", "Files: %d, total size: %d, file chunks: %d, metadata chunks: %d",
 					totalFiles, totalFileSize, lastChunk+1, metaChunks)
 			}
@@ -1048,6 +1157,11 @@ func (manager *SnapshotManager) PrintSnapshot(snapshot *Snapshot) bool {
 	object["file_sequence"] = manager.ConvertSequence(snapshot.FileSequence)
 	object["chunk_sequence"] = manager.ConvertSequence(snapshot.ChunkSequence)
 	object["length_sequence"] = manager.ConvertSequence(snapshot.LengthSequence)
+	if snapshot.Version >= SNAPSHOT_VERSION_TREE {
+		object["version"] = snapshot.Version
+		object["index_sequence"] = manager.ConvertSequence(snapshot.IndexSequence)
+		object["tree_sequence"] = manager.ConvertSequence(snapshot.TreeSequence)
+	}
 
 	object["chunks"] = manager.ConvertSequence(snapshot.ChunkHashes)
 	object["lengths"] = snapshot.ChunkLengths
@@ -1277,9 +1391,11 @@ func (manager *SnapshotManager) Diff(top string, snapshotID string, revisions []
 
 	if len(filePath) > 0 {
 
-		manager.DownloadSnapshotContents(leftSnapshot, nil, false)
+		// Only the directory containing the file is needed from a version 2 snapshot
+		patterns := []string{"+" + filePath}
+		manager.DownloadSnapshotContents(leftSnapshot, patterns, false)
 		if rightSnapshot != nil && rightSnapshot.Revision != 0 {
-			manager.DownloadSnapshotContents(rightSnapshot, nil, false)
+			manager.DownloadSnapshotContents(rightSnapshot, patterns, false)
 		}
 
 		var leftFile []byte
@@ -1461,7 +1577,7 @@ func (manager *SnapshotManager) ShowHistory(top string, snapshotID string, revis
 	sort.Ints(revisions)
 	for _, revision := range revisions {
 		snapshot := manager.DownloadSnapshot(snapshotID, revision)
-		manager.DownloadSnapshotFileSequence(snapshot, nil, false)
+		manager.DownloadSnapshotFileSequence(snapshot, []string{"+" + filePath}, false)
 		file := manager.FindFile(snapshot, filePath, true)
 
 		if file != nil {
@@ -1708,6 +1824,24 @@ func (manager *SnapshotManager) PruneSnapshots(selfID string, snapshotID string,
 
 	referencedFossils := make(map[string]bool)
 
+	// Files left behind by previous prunes because they were locked by the storage.  Those still locked are kept in
+	// the list, along with any files found locked during this prune.
+	lockedFiles := manager.loadLockedFiles()
+	defer func() {
+		if dryRun {
+			return
+		}
+		manager.chunkOperator.Stop()
+		if len(manager.chunkOperator.locked) > 0 {
+			LOG_INFO("FOSSIL_LOCKED", "%d files are locked by the storage and their deletion has been deferred",
+				len(manager.chunkOperator.locked))
+		}
+		for file, lockedUntil := range manager.chunkOperator.locked {
+			lockedFiles[file] = lockedUntil
+		}
+		manager.saveLockedFiles(lockedFiles)
+	}()
+
 	// Find fossil collections previously created, and delete fossils and temporary files in them if they are
 	// deletable.
 	for _, collectionName := range collections {
@@ -1814,6 +1948,66 @@ func (manager *SnapshotManager) PruneSnapshots(selfID string, snapshotID string,
 		}
 	}
 
+	// Take care of the locked files whose locks have expired.  Fossils can be deleted right away as they were
+	// part of a deletable collection.  Chunks must be fossilized first unless they have been referenced again.
+	var expiredChunks []string
+	if !collectOnly {
+		now := time.Now().Unix()
+		for file, lockedUntil := range lockedFiles {
+			if lockedUntil > now {
+				continue
+			}
+
+			chunk := strings.TrimPrefix(file, chunkDir)
+			chunk = strings.Replace(chunk, "/", "", -1)
+			chunk = strings.Replace(chunk, ".fsl", "", -1)
+
+			if strings.HasSuffix(file, ".fsl") {
+				if dryRun {
+					LOG_INFO("FOSSIL_DELETE", "The chunk %s would be permanently removed", chunk)
+					continue
+				}
+				manager.chunkOperator.Delete(chunk, file)
+				fmt.Fprintf(logFile, "Deleted fossil %s (no longer locked)\n", chunk)
+				delete(lockedFiles, file)
+			} else if !deleteOnly {
+				expiredChunks = append(expiredChunks, file)
+			}
+		}
+	}
+
+	if len(expiredChunks) > 0 {
+		referencedChunks := make(map[string]bool)
+		for _, snapshots := range allSnapshots {
+			for _, snapshot := range snapshots {
+				for _, chunk := range manager.GetSnapshotChunks(snapshot, false) {
+					referencedChunks[chunk] = true
+				}
+			}
+		}
+
+		for _, file := range expiredChunks {
+			chunk := strings.Replace(strings.TrimPrefix(file, chunkDir), "/", "", -1)
+			if dryRun {
+				if !referencedChunks[chunk] {
+					LOG_INFO("CHUNK_FOSSILIZE", "The chunk %s would be marked as a fossil", chunk)
+				}
+				continue
+			}
+
+			delete(lockedFiles, file)
+			if referencedChunks[chunk] {
+				LOG_DEBUG("CHUNK_LOCKED", "The chunk %s is referenced again and will be kept", chunk)
+			} else if exclusive {
+				manager.chunkOperator.Delete(chunk, file)
+				fmt.Fprintf(logFile, "Deleted chunk %s (no longer locked)\n", chunk)
+			} else {
+				manager.chunkOperator.Fossilize(chunk, file)
+				fmt.Fprintf(logFile, "Marked fossil %s (no longer locked)\n", chunk)
+			}
+		}
+	}
+
 	if deleteOnly {
 		return true
 	}
@@ -1912,17 +2106,43 @@ func (manager *SnapshotManager) PruneSnapshots(selfID string, snapshotID string,
 		}
 	}
 
+	// Snapshot files still locked by the storage can't be deleted, so their chunks must be kept too
+	if lockingStorage, ok := manager.storage.(LockingStorage); ok && toBeDeleted > 0 {
+		for _, snapshots := range allSnapshots {
+			for _, snapshot := range snapshots {
+				if !snapshot.Flag {
+					continue
+				}
+				snapshotPath := fmt.Sprintf("snapshots/%s/%d", snapshot.ID, snapshot.Revision)
+				lockedUntil, err := lockingStorage.GetLockExpiry(0, snapshotPath)
+				if err != nil {
+					LOG_ERROR("SNAPSHOT_LOCKED", "Failed to check the lock of the snapshot %s at revision %d: %v",
+						snapshot.ID, snapshot.Revision, err)
+					return false
+				}
+				if lockedUntil.After(time.Now()) {
+					LOG_INFO("SNAPSHOT_LOCKED", "The snapshot %s at revision %d is locked until %s and will be kept",
+						snapshot.ID, snapshot.Revision, lockedUntil.Local().Format("2006-01-02 15:04:05"))
+					snapshot.Flag = false
+					toBeDeleted--
+				}
+			}
+		}
+	}
+
 	if toBeDeleted == 0 && !exhaustive {
 		LOG_INFO("SNAPSHOT_NONE", "No snapshot to delete")
-		return false
+		if len(expiredChunks) == 0 {
+			return false
+		}
 	}
 
 	collection := CreateFossilCollection(allSnapshots)
 
-	var success bool
+	success := true
 	if exhaustive {
 		success = manager.pruneSnapshotsExhaustive(referencedFossils, allSnapshots, collection, logFile, dryRun, exclusive)
-	} else {
+	} else if toBeDeleted > 0 {
 		success = manager.pruneSnapshotsNonExhaustive(allSnapshots, collection, logFile, dryRun, exclusive)
 	}
 	if !success {
@@ -2333,6 +2553,8 @@ func (manager *SnapshotManager) DownloadFile(path string, derivationKey string)
 		LOG_ERROR("DOWNLOAD_FILE", "Failed to download the file %s: %v", path, err)
 		return nil
 	}
+	downloadLimiter, _ := manager.storage.GetRateLimiters()
+	downloadLimiter.Wait(len(manager.fileChunk.GetBytes()))
 
 	if len(derivationKey) > 64 {
 		derivationKey = derivationKey[len(derivationKey) - 64:]
@@ -2378,6 +2600,8 @@ func (manager *SnapshotManager) UploadFile(path string, derivationKey string, co
 		return false
 	}
 
+	_, uploadLimiter := manager.storage.GetRateLimiters()
+	uploadLimiter.Wait(len(manager.fileChunk.GetBytes()))
 	err = manager.storage.UploadFile(0, path, manager.fileChunk.GetBytes())
 	if err != nil {
 		LOG_ERROR("UPLOAD_File", "Failed to upload the file %s: %v", path, err)
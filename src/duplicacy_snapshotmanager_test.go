@@ -582,3 +582,125 @@ func TestPruneMultipleThread(t *testing.T) {
 	snapshotManager.PruneSnapshots("repository1", "repository1", []int{}, []string{}, []string{}, false, true, []string{}, false, false, false, numberOfThreads)
 	checkTestSnapshots(snapshotManager, 1, 0)
 }
+
+// lockingTestStorage is a file storage in which files can be locked against deletion, like S3 with Object Lock.
+type lockingTestStorage struct {
+	*FileStorage
+	locks map[string]time.Time
+}
+
+func (storage *lockingTestStorage) GetLockExpiry(threadIndex int, filePath string) (time.Time, error) {
+	return storage.locks[filePath], nil
+}
+
+func (storage *lockingTestStorage) checkLock(filePath string) error {
+	if lockedUntil := storage.locks[filePath]; lockedUntil.After(time.Now()) {
+		return FileLockedError{FilePath: filePath, LockedUntil: lockedUntil}
+	}
+	return nil
+}
+
+func (storage *lockingTestStorage) DeleteFile(threadIndex int, filePath string) error {
+	if err := storage.checkLock(filePath); err != nil {
+		return err
+	}
+	return storage.FileStorage.DeleteFile(threadIndex, filePath)
+}
+
+func (storage *lockingTestStorage) MoveFile(threadIndex int, from string, to string) error {
+	if err := storage.checkLock(from); err != nil {
+		return err
+	}
+	return storage.FileStorage.MoveFile(threadIndex, from, to)
+}
+
+func TestPruneWithLockedFiles(t *testing.T) {
+
+	setTestingT(t)
+
+	testDir := path.Join(os.TempDir(), "duplicacy_test", "snapshot_test")
+
+	snapshotManager := createTestSnapshotManager(testDir)
+	storage := &lockingTestStorage{
+		FileStorage: snapshotManager.storage.(*FileStorage),
+		locks:       make(map[string]time.Time),
+	}
+	snapshotManager.storage = storage
+
+	chunkSize := 1024
+	chunkHash1 := uploadRandomChunk(snapshotManager, chunkSize)
+	chunkHash2 := uploadRandomChunk(snapshotManager, chunkSize)
+	chunkHash3 := uploadRandomChunk(snapshotManager, chunkSize)
+	chunkHash4 := uploadRandomChunk(snapshotManager, chunkSize)
+
+	now := time.Now().Unix()
+	day := int64(24 * 3600)
+	t.Logf("Creating 3 snapshots")
+	createTestSnapshot(snapshotManager, "vm1@host1", 1, now-3*day-3600, now-3*day-60, []string{chunkHash1, chunkHash2}, "tag")
+	createTestSnapshot(snapshotManager, "vm1@host1", 2, now-2*day-3600, now-2*day-60, []string{chunkHash2, chunkHash3}, "tag")
+	createTestSnapshot(snapshotManager, "vm1@host1", 3, now-1*day-3600, now-1*day-60, []string{chunkHash3, chunkHash4}, "tag")
+	checkTestSnapshots(snapshotManager, 3, 0)
+
+	chunkPath1, _, _, _ := storage.FindChunk(0, snapshotManager.config.GetChunkIDFromHash(chunkHash1), false)
+	storage.locks[chunkPath1] = time.Now().Add(time.Hour)
+	storage.locks["snapshots/vm1@host1/2"] = time.Now().Add(time.Hour)
+
+	t.Logf("Removing snapshot vm1@host1 revisions 1 and 2 -- revision 2 and one chunk are locked")
+	snapshotManager.PruneSnapshots("vm1@host1", "vm1@host1", []int{1, 2}, []string{}, []string{}, false, false, []string{}, false, false, false, 1)
+	checkTestSnapshots(snapshotManager, 2, 2)
+
+	if lockedFiles := snapshotManager.loadLockedFiles(); len(lockedFiles) != 1 || lockedFiles[chunkPath1] == 0 {
+		t.Errorf("The locked chunk was not recorded: %v", lockedFiles)
+	}
+
+	t.Logf("Creating 1 snapshot after the lock expires")
+	storage.locks[chunkPath1] = time.Now().Add(-time.Hour)
+	createTestSnapshot(snapshotManager, "vm1@host1", 4, now+1*day-3600, now+1*day, []string{chunkHash4}, "tag")
+
+	t.Logf("Prune without removing any snapshots -- the unlocked chunk will be fossilized")
+	snapshotManager.PruneSnapshots("vm1@host1", "vm1@host1", []int{}, []string{}, []string{}, false, false, []string{}, false, false, false, 1)
+	checkTestSnapshots(snapshotManager, 3, 1)
+
+	if exist, _, _, _ := snapshotManager.snapshotCache.GetFileInfo(0, lockedFilesPath); exist {
+		t.Errorf("The list of locked files was not removed")
+	}
+
+	t.Logf("Creating 1 snapshot")
+	createTestSnapshot(snapshotManager, "vm1@host1", 5, now+2*day-3600, now+2*day, []string{chunkHash4}, "tag")
+
+	t.Logf("Prune without removing any snapshots -- the fossil will be deleted")
+	snapshotManager.PruneSnapshots("vm1@host1", "vm1@host1", []int{}, []string{}, []string{}, false, false, []string{}, false, false, false, 1)
+	checkTestSnapshots(snapshotManager, 4, 0)
+}
+
+func TestFindRevisionAtTime(t *testing.T) {
+
+	setTestingT(t)
+
+	testDir := path.Join(os.TempDir(), "duplicacy_test", "snapshot_test")
+
+	snapshotManager := createTestSnapshotManager(testDir)
+
+	chunkHash := uploadRandomChunk(snapshotManager, 1024)
+	for i := 1; i <= 10; i++ {
+		createTestSnapshot(snapshotManager, "vm1@host1", i, int64(i)*1000, int64(i)*1000+60, []string{chunkHash}, "tag")
+	}
+
+	testCases := map[int64]int{
+		999:   0,
+		1000:  1,
+		1060:  1,
+		5500:  5,
+		10000: 10,
+		99999: 10,
+	}
+
+	for atTime, expected := range testCases {
+		revision, err := snapshotManager.FindRevisionAtTime("vm1@host1", atTime)
+		if err != nil {
+			t.Errorf("Failed to find the revision at %d: %v", atTime, err)
+		} else if revision != expected {
+			t.Errorf("Revision %d was found at %d; expecting %d", revision, atTime, expected)
+		}
+	}
+}
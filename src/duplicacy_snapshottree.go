@@ -0,0 +1,407 @@
+// Copyright (c) Acrosync LLC. All rights reserved.
+// Free for personal use and commercial trial
+// Commercial use requires per-user licenses available from https://duplicacy.com
+
+package duplicacy
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+// In a version 2 snapshot the file list is stored as a tree of directories.  Each directory is a node saved as its own
+// sequence of chunks, containing the entries directly under the directory and the chunks holding the content of its
+// files.  File entries refer to chunks by their indices in the node rather than in the whole snapshot, so a node
+// doesn't change unless the directory does, and unchanged directories are deduplicated between revisions.  The path
+// index lists every directory along with the chunks of its node, in the order in which the directory appears in the
+// flat file list, so that the nodes needed for a path can be found without loading any other node.
+
+// snapshotTreeNode is the json representation of a directory in a version 2 snapshot.
+type snapshotTreeNode struct {
+	Chunks  []string `json:"chunks"` // chunk hashes in hex
+	Lengths []int    `json:"lengths"`
+	Files   []*Entry `json:"files"`
+}
+
+// snapshotIndexEntry is an item in the path index of a version 2 snapshot.
+type snapshotIndexEntry struct {
+	Name     string   `json:"name"`     // the directory path in base64, with the root being empty
+	Sequence []string `json:"sequence"` // chunk hashes in hex of the node of the directory
+}
+
+// getParentDirectory returns the directory containing 'filePath', with a trailing '/' unless it is the root.
+func getParentDirectory(filePath string) string {
+	filePath = strings.TrimSuffix(filePath, "/")
+	if i := strings.LastIndex(filePath, "/"); i >= 0 {
+		return filePath[:i+1]
+	}
+	return ""
+}
+
+// groupSnapshotEntries returns all directories, starting with the root, in the order in which they appear in 'files',
+// and the entries directly under each of them.
+func groupSnapshotEntries(files []*Entry) (directories []string, children map[string][]*Entry) {
+	directories = []string{""}
+	children = make(map[string][]*Entry)
+	for _, entry := range files {
+		parent := getParentDirectory(entry.Path)
+		children[parent] = append(children[parent], entry)
+		if entry.IsDir() {
+			directories = append(directories, entry.Path)
+		}
+	}
+	return directories, children
+}
+
+// createSnapshotTreeNode creates the node for a directory containing 'entries', whose content indices point into
+// 'chunkHashes' and 'chunkLengths'.  Only the chunks used by the files are included in the node.  If 'top' is not
+// empty, attributes are read from the files under 'top' as they have been discarded to save memory.
+func createSnapshotTreeNode(entries []*Entry, chunkHashes []string, chunkLengths []int, top string) *snapshotTreeNode {
+
+	usedChunks := make(map[int]bool)
+	for _, entry := range entries {
+		if entry.IsFile() && entry.Size > 0 {
+			for i := entry.StartChunk; i <= entry.EndChunk; i++ {
+				usedChunks[i] = true
+			}
+		}
+	}
+
+	var chunkIndices []int
+	for i := range usedChunks {
+		chunkIndices = append(chunkIndices, i)
+	}
+	sort.Ints(chunkIndices)
+
+	node := &snapshotTreeNode{
+		Chunks:  make([]string, len(chunkIndices)),
+		Lengths: make([]int, len(chunkIndices)),
+		Files:   make([]*Entry, len(entries)),
+	}
+
+	localIndices := make(map[int]int)
+	for i, chunkIndex := range chunkIndices {
+		node.Chunks[i] = hex.EncodeToString([]byte(chunkHashes[chunkIndex]))
+		node.Lengths[i] = chunkLengths[chunkIndex]
+		localIndices[chunkIndex] = i
+	}
+
+	for i, entry := range entries {
+		newEntry := *entry
+		if newEntry.IsFile() && newEntry.Size > 0 {
+			newEntry.StartChunk = localIndices[entry.StartChunk]
+			newEntry.EndChunk = localIndices[entry.EndChunk]
+		}
+		if top != "" {
+			newEntry.ReadAttributes(top)
+		}
+		node.Files[i] = &newEntry
+	}
+
+	return node
+}
+
+// getSnapshotTreeFilter returns a function telling if the node of a directory must be loaded to find all entries
+// matching 'patterns', or nil if every node is needed.  Only include patterns narrow down the directories, since any
+// path may be matched by an exclude pattern or a regular expression.  A pattern without a prefix is taken as a path.
+func getSnapshotTreeFilter(patterns []string) func(directory string) bool {
+
+	if len(patterns) == 0 {
+		return nil
+	}
+
+	var prefixes []string
+	for _, pattern := range patterns {
+		if len(pattern) == 0 {
+			continue
+		}
+		if pattern[0] == '-' || strings.HasPrefix(pattern, "i:") || strings.HasPrefix(pattern, "e:") {
+			return nil
+		}
+		if pattern[0] == '+' {
+			pattern = pattern[1:]
+		}
+		if i := strings.IndexAny(pattern, "*?"); i >= 0 {
+			pattern = pattern[:i]
+		}
+		prefixes = append(prefixes, pattern)
+	}
+
+	return func(directory string) bool {
+		for _, prefix := range prefixes {
+			// Either the whole directory matches, or the pattern may match an entry directly under the directory
+			if strings.HasPrefix(directory, prefix) {
+				return true
+			}
+			if strings.HasPrefix(prefix, directory) &&
+				!strings.Contains(strings.TrimSuffix(prefix[len(directory):], "/"), "/") {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// assembleSnapshotTree rebuilds 'Files', 'ChunkHashes', and 'ChunkLengths' of the snapshot from the nodes of the
+// directories for which 'includeDirectory' returns true, or all nodes if it is nil.  The entries appear in the same
+// order as in a version 1 snapshot, and their content indices are adjusted to point into the combined chunk lists.
+// The entry of a directory is stored in the node of its parent, so the nodes of the directories above an included
+// directory are loaded too, but only the entries of the directories leading to included directories are taken
+// from them.
+func assembleSnapshotTree(snapshot *Snapshot, index []*snapshotIndexEntry, includeDirectory func(directory string) bool,
+	loadNode func(sequence []string) (*snapshotTreeNode, error)) error {
+
+	var files []*Entry
+	var chunkHashes []string
+	var chunkLengths []int
+	var treeSequence []string
+
+	directories := make([]string, len(index))
+	for i, item := range index {
+		directory, err := base64.StdEncoding.DecodeString(item.Name)
+		if err != nil {
+			return fmt.Errorf("Invalid directory name '%s' in the path index", item.Name)
+		}
+		directories[i] = string(directory)
+	}
+
+	included := make(map[string]bool)
+	ancestors := make(map[string]bool)
+	for _, directory := range directories {
+		if includeDirectory != nil && !includeDirectory(directory) {
+			continue
+		}
+		included[directory] = true
+		for parent := directory; parent != ""; {
+			parent = getParentDirectory(parent)
+			if ancestors[parent] {
+				break
+			}
+			ancestors[parent] = true
+		}
+	}
+
+	// Entries of subdirectories are found in the node of the parent but are placed where the subdirectory begins
+	directoryEntries := make(map[string]*Entry)
+
+	for i, item := range index {
+		directory := directories[i]
+
+		if entry, found := directoryEntries[directory]; found {
+			files = append(files, entry)
+			delete(directoryEntries, directory)
+		}
+
+		if !included[directory] && !ancestors[directory] {
+			continue
+		}
+
+		sequence, err := decodeSequence(item.Sequence)
+		if err != nil {
+			return err
+		}
+
+		node, err := loadNode(sequence)
+		if err != nil {
+			return fmt.Errorf("Failed to load the directory '%s': %v", directory, err)
+		}
+		treeSequence = append(treeSequence, sequence...)
+
+		if !included[directory] {
+			for _, entry := range node.Files {
+				if entry.IsDir() && (included[entry.Path] || ancestors[entry.Path]) {
+					directoryEntries[entry.Path] = entry
+				}
+			}
+			continue
+		}
+
+		if len(node.Chunks) != len(node.Lengths) {
+			return fmt.Errorf("The directory '%s' has %d chunk hashes but %d chunk lengths", directory,
+				len(node.Chunks), len(node.Lengths))
+		}
+
+		base := len(chunkHashes)
+		nodeChunks, err := decodeSequence(node.Chunks)
+		if err != nil {
+			return err
+		}
+		chunkHashes = append(chunkHashes, nodeChunks...)
+		chunkLengths = append(chunkLengths, node.Lengths...)
+
+		for _, entry := range node.Files {
+			if entry.IsDir() {
+				directoryEntries[entry.Path] = entry
+				continue
+			}
+			if entry.IsFile() && entry.Size > 0 {
+				if entry.StartChunk < 0 || entry.EndChunk >= len(node.Chunks) {
+					return fmt.Errorf("The file %s refers to chunks %d to %d while the directory has %d chunks",
+						entry.Path, entry.StartChunk, entry.EndChunk, len(node.Chunks))
+				}
+				entry.StartChunk += base
+				entry.EndChunk += base
+			}
+			files = append(files, entry)
+		}
+	}
+
+	snapshot.Files = files
+	snapshot.ChunkHashes = chunkHashes
+	snapshot.ChunkLengths = chunkLengths
+	snapshot.TreeSequence = treeSequence
+	snapshot.treeLoaded = includeDirectory == nil
+	return nil
+}
+
+// decodeSequence turns a sequence of hex hashes into a sequence of binary hashes.
+func decodeSequence(sequenceInHex []string) ([]string, error) {
+	sequence := make([]string, len(sequenceInHex))
+	for i, hashInHex := range sequenceInHex {
+		hash, err := hex.DecodeString(hashInHex)
+		if err != nil {
+			return nil, fmt.Errorf("Hash %s is not a valid hex string in the snapshot", hashInHex)
+		}
+		sequence[i] = string(hash)
+	}
+	return sequence, nil
+}
+
+// downloadSnapshotIndex loads the path index of a version 2 snapshot.
+func (manager *SnapshotManager) downloadSnapshotIndex(snapshot *Snapshot) (index []*snapshotIndexEntry, err error) {
+	err = json.Unmarshal(manager.DownloadSequence(snapshot.IndexSequence), &index)
+	return index, err
+}
+
+// getSnapshotTreeNodeSequences returns the chunk hashes of the nodes of all directories listed in the path index of
+// a version 2 snapshot.
+func (manager *SnapshotManager) getSnapshotTreeNodeSequences(snapshot *Snapshot) (sequence []string, err error) {
+	index, err := manager.downloadSnapshotIndex(snapshot)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, item := range index {
+		nodeSequence, err := decodeSequence(item.Sequence)
+		if err != nil {
+			return nil, err
+		}
+		sequence = append(sequence, nodeSequence...)
+	}
+	return sequence, nil
+}
+
+// DownloadSnapshotTree loads the file list of a version 2 snapshot, along with the chunks of the files.  Only
+// directories that may contain files matching 'patterns' are loaded.
+func (manager *SnapshotManager) DownloadSnapshotTree(snapshot *Snapshot, patterns []string, attributesNeeded bool) bool {
+
+	index, err := manager.downloadSnapshotIndex(snapshot)
+	if err != nil {
+		LOG_ERROR("SNAPSHOT_PARSE", "Failed to load the path index of the snapshot %s at revision %d: %v",
+			snapshot.ID, snapshot.Revision, err)
+		return false
+	}
+
+	includeDirectory := getSnapshotTreeFilter(patterns)
+	loadedDirectories := 0
+	loadNode := func(sequence []string) (*snapshotTreeNode, error) {
+		loadedDirectories++
+		node := &snapshotTreeNode{}
+		err := json.Unmarshal(manager.DownloadSequence(sequence), node)
+		return node, err
+	}
+
+	err = assembleSnapshotTree(snapshot, index, includeDirectory, loadNode)
+	if err != nil {
+		LOG_ERROR("SNAPSHOT_PARSE", "Failed to load files specified in the snapshot %s at revision %d: %v",
+			snapshot.ID, snapshot.Revision, err)
+		return false
+	}
+
+	if includeDirectory != nil {
+		LOG_DEBUG("SNAPSHOT_TREE", "Loaded %d of %d directories in the snapshot %s at revision %d",
+			loadedDirectories, len(index), snapshot.ID, snapshot.Revision)
+	}
+
+	for _, entry := range snapshot.Files {
+		// If we don't need the attributes or the file isn't included we clear the attributes to save memory
+		if !attributesNeeded || (len(patterns) != 0 && !MatchPath(entry.Path, patterns)) {
+			entry.Attributes = nil
+		}
+	}
+	return true
+}
+
+// getSnapshotTreeChunkHashes returns the hashes of all chunks referenced by a version 2 snapshot, including those of
+// the path index and the directories, loading the whole tree if needed.  Unless 'keepChunkHashes' is true, a tree
+// loaded here doesn't stay in memory.
+func (manager *SnapshotManager) getSnapshotTreeChunkHashes(snapshot *Snapshot, keepChunkHashes bool) (chunkHashes []string) {
+
+	if !snapshot.treeLoaded {
+		files, hashes, lengths, treeSequence := snapshot.Files, snapshot.ChunkHashes, snapshot.ChunkLengths,
+			snapshot.TreeSequence
+		if !manager.DownloadSnapshotTree(snapshot, nil, false) {
+			return nil
+		}
+
+		if !keepChunkHashes {
+			defer func() {
+				snapshot.Files, snapshot.ChunkHashes, snapshot.ChunkLengths, snapshot.TreeSequence = files, hashes,
+					lengths, treeSequence
+				snapshot.treeLoaded = false
+			}()
+		}
+	}
+
+	chunkHashes = append(chunkHashes, snapshot.IndexSequence...)
+	chunkHashes = append(chunkHashes, snapshot.TreeSequence...)
+	chunkHashes = append(chunkHashes, snapshot.ChunkHashes...)
+	return chunkHashes
+}
+
+// uploadSnapshotTree turns the file list of the snapshot into directory nodes and the path index, and uploads them
+// using 'uploadSequence'.
+func (manager *BackupManager) uploadSnapshotTree(snapshot *Snapshot, top string,
+	uploadSequence func(reader io.Reader) []string) error {
+
+	// Attributes have been discarded to save memory, so they must be read again from the files
+	attributeTop := ""
+	if snapshot.discardAttributes {
+		attributeTop = top
+	}
+
+	directories, children := groupSnapshotEntries(snapshot.Files)
+
+	var index []*snapshotIndexEntry
+	var treeSequence []string
+	for _, directory := range directories {
+		node := createSnapshotTreeNode(children[directory], snapshot.ChunkHashes, snapshot.ChunkLengths, attributeTop)
+		description, err := json.Marshal(node)
+		if err != nil {
+			return fmt.Errorf("Failed to encode the directory '%s': %v", directory, err)
+		}
+
+		sequence := uploadSequence(bytes.NewReader(description))
+		treeSequence = append(treeSequence, sequence...)
+		index = append(index, &snapshotIndexEntry{
+			Name:     base64.StdEncoding.EncodeToString([]byte(directory)),
+			Sequence: encodeSequence(sequence),
+		})
+	}
+
+	description, err := json.Marshal(index)
+	if err != nil {
+		return fmt.Errorf("Failed to encode the path index: %v", err)
+	}
+
+	snapshot.SetSequence("index", uploadSequence(bytes.NewReader(description)))
+	snapshot.TreeSequence = treeSequence
+	snapshot.treeLoaded = true
+	return nil
+}
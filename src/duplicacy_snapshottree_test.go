@@ -0,0 +1,231 @@
+// Copyright (c) Acrosync LLC. All rights reserved.
+// Free for personal use and commercial trial
+// Commercial use requires per-user licenses available from https://duplicacy.com
+
+package duplicacy
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+)
+
+// All chunks in the tree tests are 100 bytes long
+func createTreeTestFile(path string, startChunk int, startOffset int, endChunk int, endOffset int) *Entry {
+	entry := CreateEntry(path, int64((endChunk-startChunk)*100+endOffset-startOffset), 0, 0644)
+	entry.StartChunk, entry.StartOffset, entry.EndChunk, entry.EndOffset = startChunk, startOffset, endChunk, endOffset
+	return entry
+}
+
+func createTreeTestSnapshot(numberOfChunks int, files []*Entry) *Snapshot {
+	snapshot := &Snapshot{
+		ID:       "host1",
+		Revision: 1,
+		Version:  SNAPSHOT_VERSION_TREE,
+		Files:    files,
+	}
+	for i := 0; i < numberOfChunks; i++ {
+		snapshot.ChunkHashes = append(snapshot.ChunkHashes, fmt.Sprintf("%032d", i))
+		snapshot.ChunkLengths = append(snapshot.ChunkLengths, 100)
+	}
+	return snapshot
+}
+
+// getTreeTestContent describes each file in the snapshot by its path and the chunks it is made of.
+func getTreeTestContent(snapshot *Snapshot) (content []string) {
+	for _, entry := range snapshot.Files {
+		description := entry.Path
+		if entry.IsFile() && entry.Size > 0 {
+			description += fmt.Sprintf(":%d", entry.StartOffset)
+			for i := entry.StartChunk; i <= entry.EndChunk; i++ {
+				description += ":" + snapshot.ChunkHashes[i]
+			}
+			description += fmt.Sprintf(":%d", entry.EndOffset)
+		}
+		content = append(content, description)
+	}
+	return content
+}
+
+func TestSnapshotTree(t *testing.T) {
+
+	setTestingT(t)
+
+	testDir := path.Join(os.TempDir(), "duplicacy_test", "snapshottree")
+	snapshotManager := createTestSnapshotManager(testDir)
+	defer os.RemoveAll(testDir)
+
+	directoryMode := uint32(os.ModeDir | 0755)
+	snapshot := createTreeTestSnapshot(9, []*Entry{
+		createTreeTestFile("a.txt", 0, 0, 0, 50),
+		CreateEntry("d1/", 0, 0, directoryMode),
+		createTreeTestFile("d1/f1", 0, 50, 2, 30),
+		createTreeTestFile("d1/f2", 2, 30, 3, 100),
+		CreateEntry("d1/sub/", 0, 0, directoryMode),
+		createTreeTestFile("d1/sub/g", 4, 0, 5, 20),
+		CreateEntry("d2/", 0, 0, directoryMode),
+		CreateEntry("d2/empty", 0, 0, 0644),
+		createTreeTestFile("d2/h", 5, 20, 8, 100),
+	})
+
+	if err := snapshotManager.CheckSnapshot(snapshot); err != nil {
+		t.Errorf("The test snapshot is invalid: %v", err)
+		return
+	}
+	expectedContent := getTreeTestContent(snapshot)
+
+	// Each directory and the index fit into one chunk
+	err := (&BackupManager{}).uploadSnapshotTree(snapshot, "", func(reader io.Reader) []string {
+		content, _ := ioutil.ReadAll(reader)
+		return []string{uploadTestChunk(snapshotManager, content)}
+	})
+	if err != nil {
+		t.Errorf("Failed to upload the snapshot tree: %v", err)
+		return
+	}
+	if len(snapshot.TreeSequence) != 4 || len(snapshot.IndexSequence) != 1 {
+		t.Errorf("%d directory chunks and %d index chunks were uploaded", len(snapshot.TreeSequence),
+			len(snapshot.IndexSequence))
+	}
+
+	description, _ := snapshot.MarshalJSON()
+	loaded, err := CreateSnapshotFromDescription(description)
+	if err != nil {
+		t.Errorf("Failed to parse the snapshot: %v", err)
+		return
+	}
+	if loaded.Version != SNAPSHOT_VERSION_TREE || len(loaded.IndexSequence) != 1 || len(loaded.FileSequence) != 0 {
+		t.Errorf("The snapshot was not parsed as version 2: %s", description)
+	}
+
+	chunks := snapshotManager.GetSnapshotChunks(loaded, false)
+	if len(chunks) != 1+4+11 {
+		t.Errorf("The snapshot references %d chunks", len(chunks))
+	}
+	if loaded.Files != nil || loaded.treeLoaded {
+		t.Errorf("Listing chunks should not keep the tree in memory")
+	}
+
+	if !snapshotManager.DownloadSnapshotContents(loaded, nil, false) {
+		return
+	}
+	content := getTreeTestContent(loaded)
+	if fmt.Sprintf("%v", content) != fmt.Sprintf("%v", expectedContent) {
+		t.Errorf("The loaded files are\n%v\ninstead of\n%v", content, expectedContent)
+	}
+
+	// Only the directory containing the file is loaded, along with the directories above it for their entries
+	partial := &Snapshot{ID: "host1", Revision: 1, Version: SNAPSHOT_VERSION_TREE, IndexSequence: loaded.IndexSequence}
+	if !snapshotManager.DownloadSnapshotContents(partial, []string{"d1/sub/g"}, false) {
+		return
+	}
+	content = getTreeTestContent(partial)
+	expectedPartial := []string{expectedContent[1], expectedContent[4], expectedContent[5]}
+	if fmt.Sprintf("%v", content) != fmt.Sprintf("%v", expectedPartial) || len(partial.TreeSequence) != 3 {
+		t.Errorf("Loading d1/sub/g returned %v from %d directories", content, len(partial.TreeSequence))
+	}
+
+	// The root isn't included, but the entry of d1/ stored in it must still be present
+	partial = &Snapshot{ID: "host1", Revision: 1, Version: SNAPSHOT_VERSION_TREE, IndexSequence: loaded.IndexSequence}
+	if !snapshotManager.DownloadSnapshotContents(partial, []string{"+d1/sub/*"}, false) {
+		return
+	}
+	content = getTreeTestContent(partial)
+	if fmt.Sprintf("%v", content) != fmt.Sprintf("%v", expectedContent[1:6]) {
+		t.Errorf("Loading d1/sub/* returned %v", content)
+	}
+
+	partial = &Snapshot{ID: "host1", Revision: 1, Version: SNAPSHOT_VERSION_TREE, IndexSequence: loaded.IndexSequence}
+	if !snapshotManager.DownloadSnapshotContents(partial, []string{"+d1/*"}, false) {
+		return
+	}
+	content = getTreeTestContent(partial)
+	if fmt.Sprintf("%v", content) != fmt.Sprintf("%v", expectedContent[:7]) {
+		t.Errorf("Loading d1/* returned %v", content)
+	}
+
+	// Cleaning the snapshot cache keeps the nodes of the directories along with the path index
+	cache := snapshotManager.snapshotCache
+	cache.UploadFile(0, "snapshots/host1/1", description)
+	treeChunks := append(append([]string{}, loaded.IndexSequence...), loaded.TreeSequence...)
+	for _, chunkHash := range treeChunks {
+		chunkID := snapshotManager.config.GetChunkIDFromHash(chunkHash)
+		chunkPath, _, _, _ := snapshotManager.storage.FindChunk(0, chunkID, false)
+		chunkContent, _ := ioutil.ReadFile(path.Join(testDir, chunkPath))
+		cachePath, _, _, _ := cache.FindChunk(0, chunkID, false)
+		cache.UploadFile(0, cachePath, chunkContent)
+	}
+	strayID := snapshotManager.config.GetChunkIDFromHash(fmt.Sprintf("%032d", 99))
+	strayPath, _, _, _ := cache.FindChunk(0, strayID, false)
+	cache.UploadFile(0, strayPath, []byte("stray"))
+
+	snapshotManager.CleanSnapshotCache(nil, map[string][]*Snapshot{"host1": {loaded}})
+	for _, chunkHash := range treeChunks {
+		chunkID := snapshotManager.config.GetChunkIDFromHash(chunkHash)
+		if _, exist, _, _ := cache.FindChunk(0, chunkID, false); !exist {
+			t.Errorf("The chunk %s of the snapshot tree was removed from the cache", chunkID)
+		}
+	}
+	if _, exist, _, _ := cache.FindChunk(0, strayID, false); exist {
+		t.Errorf("The chunk %s not used by any snapshot was kept in the cache", strayID)
+	}
+
+	// A directory is stored the same way when chunks of other directories change
+	changed := createTreeTestSnapshot(10, []*Entry{
+		createTreeTestFile("a.txt", 0, 0, 1, 50),
+		CreateEntry("d1/", 0, 0, directoryMode),
+		createTreeTestFile("d1/f1", 1, 50, 3, 30),
+		createTreeTestFile("d1/f2", 3, 30, 4, 100),
+	})
+	for i := 1; i < 5; i++ {
+		changed.ChunkHashes[i] = snapshot.ChunkHashes[i-1]
+	}
+	_, children := groupSnapshotEntries(snapshot.Files)
+	_, changedChildren := groupSnapshotEntries(changed.Files)
+	original, _ := json.Marshal(createSnapshotTreeNode(children["d1/"], snapshot.ChunkHashes, snapshot.ChunkLengths, ""))
+	modified, _ := json.Marshal(createSnapshotTreeNode(changedChildren["d1/"], changed.ChunkHashes, changed.ChunkLengths, ""))
+	if string(original) != string(modified) {
+		t.Errorf("An unchanged directory is stored differently:\n%s\n%s", original, modified)
+	}
+}
+
+func TestSnapshotTreeFilter(t *testing.T) {
+
+	setTestingT(t)
+
+	testCases := []struct {
+		patterns   []string
+		directory  string
+		shouldLoad bool
+	}{
+		{[]string{"+a/b/c.txt"}, "a/b/", true},
+		{[]string{"+a/b/c.txt"}, "a/", false},
+		{[]string{"+a/b/c.txt"}, "", false},
+		{[]string{"+a/b/"}, "a/", true},
+		{[]string{"+a/b/"}, "a/b/d/", true},
+		{[]string{"+a/b/"}, "a/c/", false},
+		{[]string{"+a/b*"}, "a/", true},
+		{[]string{"+a/b*"}, "a/bc/d/", true},
+		{[]string{"+*.txt"}, "x/y/", true},
+		{[]string{"a/b/c.txt"}, "a/b/", true},
+		{[]string{"+a/b/c.txt", "+d/"}, "d/e/", true},
+	}
+
+	for _, testCase := range testCases {
+		filter := getSnapshotTreeFilter(testCase.patterns)
+		if filter == nil || filter(testCase.directory) != testCase.shouldLoad {
+			t.Errorf("Directory '%s' with patterns %v should be loaded: %t", testCase.directory, testCase.patterns,
+				testCase.shouldLoad)
+		}
+	}
+
+	for _, patterns := range [][]string{nil, {"-a/"}, {"+a/", "e:b"}, {"i:a"}} {
+		if getSnapshotTreeFilter(patterns) != nil {
+			t.Errorf("All directories should be loaded with patterns %v", patterns)
+		}
+	}
+}
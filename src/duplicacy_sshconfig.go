@@ -0,0 +1,546 @@
+// Copyright (c) Acrosync LLC. All rights reserved.
+// Free for personal use and commercial trial
+// Commercial use requires per-user licenses available from https://duplicacy.com
+
+package duplicacy
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/user"
+	"path"
+	"strconv"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// SSHHostConfig holds the settings from an OpenSSH client configuration file (~/.ssh/config) that apply to a host.
+// Only the settings relevant to SFTP storages are read.
+type SSHHostConfig struct {
+	HostName            string
+	Port                int
+	User                string
+	IdentityFiles       []string
+	CertificateFiles    []string
+	ProxyJump           string
+	UserKnownHostsFiles []string
+}
+
+// getHomeDirectory returns the home directory of the current user.
+func getHomeDirectory() string {
+	if currentUser, err := user.Current(); err == nil && currentUser.HomeDir != "" {
+		return currentUser.HomeDir
+	}
+	if home := os.Getenv("HOME"); home != "" {
+		return home
+	}
+	return os.Getenv("USERPROFILE")
+}
+
+// expandSSHPath expands '~' and the tokens %d (home directory), %h (remote host), %r (remote user) and %% in a
+// file name from the ssh configuration.
+func expandSSHPath(file string, host string, remoteUser string) string {
+	home := getHomeDirectory()
+	if file == "~" || strings.HasPrefix(file, "~/") {
+		file = home + file[1:]
+	}
+	replacer := strings.NewReplacer("%d", home, "%h", host, "%r", remoteUser, "%%", "%")
+	return replacer.Replace(file)
+}
+
+// matchSSHPattern matches the name against a pattern that may contain the wildcards '*' and '?'.
+func matchSSHPattern(pattern string, name string) bool {
+	for len(pattern) > 0 {
+		switch pattern[0] {
+		case '*':
+			for i := len(name); i >= 0; i-- {
+				if matchSSHPattern(pattern[1:], name[i:]) {
+					return true
+				}
+			}
+			return false
+		case '?':
+			if len(name) == 0 {
+				return false
+			}
+		default:
+			if len(name) == 0 || pattern[0] != name[0] {
+				return false
+			}
+		}
+		pattern = pattern[1:]
+		name = name[1:]
+	}
+	return len(name) == 0
+}
+
+// matchSSHPatternList returns true if the name matches any of the patterns and none of the negated ones.
+func matchSSHPatternList(patterns []string, name string) bool {
+	name = strings.ToLower(name)
+	matched := false
+	for _, pattern := range patterns {
+		pattern = strings.ToLower(pattern)
+		if strings.HasPrefix(pattern, "!") {
+			if matchSSHPattern(pattern[1:], name) {
+				return false
+			}
+		} else if matchSSHPattern(pattern, name) {
+			matched = true
+		}
+	}
+	return matched
+}
+
+// LoadSSHHostConfig reads the settings for 'host' from the configuration file.  As with OpenSSH, the first value
+// found for a setting wins, except for identity and certificate files which accumulate.  A missing file is not an
+// error.
+func LoadSSHHostConfig(configFile string, host string) (*SSHHostConfig, error) {
+
+	config := &SSHHostConfig{}
+
+	content, err := ioutil.ReadFile(configFile)
+	if err != nil {
+		if os.IsNotExist(err) {
+			config.HostName = host
+			return config, nil
+		}
+		return nil, err
+	}
+
+	// Settings before the first 'Host' line apply to all hosts
+	matching := true
+	seen := make(map[string]bool)
+
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+
+		index := strings.IndexAny(line, " \t=")
+		if index < 0 {
+			return nil, fmt.Errorf("%s, line %d: missing value", configFile, lineNumber)
+		}
+		keyword := strings.ToLower(line[:index])
+		value := strings.TrimSpace(strings.TrimLeft(strings.TrimSpace(line[index:]), "="))
+		value = strings.Trim(value, "\"")
+
+		switch keyword {
+		case "host":
+			matching = matchSSHPatternList(strings.Fields(value), host)
+			continue
+		case "match":
+			// Match blocks can depend on things we can't evaluate, so only 'Match all' is honoured
+			matching = strings.ToLower(value) == "all"
+			continue
+		}
+
+		if !matching {
+			continue
+		}
+
+		switch keyword {
+		case "identityfile":
+			config.IdentityFiles = append(config.IdentityFiles, value)
+			continue
+		case "certificatefile":
+			config.CertificateFiles = append(config.CertificateFiles, value)
+			continue
+		}
+
+		if seen[keyword] {
+			continue
+		}
+		seen[keyword] = true
+
+		switch keyword {
+		case "hostname":
+			config.HostName = strings.Replace(value, "%h", host, -1)
+		case "port":
+			config.Port, err = strconv.Atoi(value)
+			if err != nil {
+				return nil, fmt.Errorf("%s, line %d: invalid port '%s'", configFile, lineNumber, value)
+			}
+		case "user":
+			config.User = value
+		case "proxyjump":
+			config.ProxyJump = value
+		case "userknownhostsfile":
+			config.UserKnownHostsFiles = strings.Fields(value)
+		}
+	}
+
+	if config.HostName == "" {
+		config.HostName = host
+	}
+
+	for i, file := range config.IdentityFiles {
+		config.IdentityFiles[i] = expandSSHPath(file, config.HostName, config.User)
+	}
+	for i, file := range config.CertificateFiles {
+		config.CertificateFiles[i] = expandSSHPath(file, config.HostName, config.User)
+	}
+	for i, file := range config.UserKnownHostsFiles {
+		config.UserKnownHostsFiles[i] = expandSSHPath(file, config.HostName, config.User)
+	}
+
+	return config, scanner.Err()
+}
+
+// GetKnownHostsFiles returns the known_hosts files consulted for this host, in the same order as OpenSSH.
+func (config *SSHHostConfig) GetKnownHostsFiles() []string {
+	files := config.UserKnownHostsFiles
+	if len(files) == 0 {
+		sshDirectory := path.Join(getHomeDirectory(), ".ssh")
+		files = []string{path.Join(sshDirectory, "known_hosts"), path.Join(sshDirectory, "known_hosts2")}
+	}
+	return append(files, "/etc/ssh/ssh_known_hosts", "/etc/ssh/ssh_known_hosts2")
+}
+
+// LoadIdentities reads the private keys from the identity files, or from the default ones if none is configured.
+// A certificate found in '<identity>-cert.pub' or given by a CertificateFile setting is attached to its key, so
+// that the key can be used for certificate authentication.  Files that can't be loaded, for instance because they
+// are protected by a passphrase, are skipped.
+func (config *SSHHostConfig) LoadIdentities() (signers []ssh.Signer) {
+	identityFiles := config.IdentityFiles
+	if len(identityFiles) == 0 {
+		sshDirectory := path.Join(getHomeDirectory(), ".ssh")
+		for _, name := range []string{"id_rsa", "id_ecdsa", "id_ed25519"} {
+			identityFiles = append(identityFiles, path.Join(sshDirectory, name))
+		}
+	}
+
+	certificateFiles := config.CertificateFiles
+	for _, identityFile := range identityFiles {
+		certificateFiles = append(certificateFiles, identityFile+"-cert.pub")
+	}
+	certificates := loadSSHCertificates(certificateFiles)
+
+	for _, identityFile := range identityFiles {
+		content, err := ioutil.ReadFile(identityFile)
+		if err != nil {
+			continue
+		}
+		signer, err := ssh.ParsePrivateKey(content)
+		if err != nil {
+			LOG_DEBUG("SSH_IDENTITY", "Can't load the private key file %s: %v", identityFile, err)
+			continue
+		}
+
+		LOG_DEBUG("SSH_IDENTITY", "Loaded the private key file %s", identityFile)
+		signers = append(signers, getCertificateSigners(signer, certificates)...)
+		signers = append(signers, signer)
+	}
+	return signers
+}
+
+// loadSSHCertificates reads the OpenSSH certificates from the files that exist.
+func loadSSHCertificates(files []string) (certificates []*ssh.Certificate) {
+	for _, file := range files {
+		content, err := ioutil.ReadFile(file)
+		if err != nil {
+			continue
+		}
+		key, _, _, _, err := ssh.ParseAuthorizedKey(content)
+		if certificate, ok := key.(*ssh.Certificate); ok && err == nil {
+			certificates = append(certificates, certificate)
+		} else {
+			LOG_DEBUG("SSH_CERTIFICATE", "%s is not a valid certificate", file)
+		}
+	}
+	return certificates
+}
+
+// getCertificateSigners returns a signer for each certificate issued for the private key.
+func getCertificateSigners(signer ssh.Signer, certificates []*ssh.Certificate) (signers []ssh.Signer) {
+	for _, certificate := range certificates {
+		if !bytes.Equal(certificate.Key.Marshal(), signer.PublicKey().Marshal()) {
+			continue
+		}
+		certSigner, err := ssh.NewCertSigner(certificate, signer)
+		if err != nil {
+			LOG_DEBUG("SSH_CERTIFICATE", "Can't use the certificate %s: %v", ssh.FingerprintSHA256(certificate), err)
+			continue
+		}
+		signers = append(signers, certSigner)
+	}
+	return signers
+}
+
+// ParseSSHProxyJump parses the jump hosts in the form of '[user@]host[:port][,...]', and resolves each one with the
+// configuration file.
+func ParseSSHProxyJump(proxyJump string, configFile string) (jumpHosts []*SSHHostConfig, err error) {
+	if proxyJump == "" || strings.ToLower(proxyJump) == "none" {
+		return nil, nil
+	}
+
+	for _, jump := range strings.Split(proxyJump, ",") {
+		jump = strings.TrimPrefix(strings.TrimSpace(jump), "ssh://")
+		jumpUser := ""
+		if index := strings.LastIndex(jump, "@"); index >= 0 {
+			jumpUser = jump[:index]
+			jump = jump[index+1:]
+		}
+
+		port := 0
+		host := jump
+		if index := strings.LastIndex(jump, ":"); index >= 0 && !strings.HasSuffix(jump, "]") {
+			port, err = strconv.Atoi(jump[index+1:])
+			if err != nil {
+				return nil, fmt.Errorf("invalid jump host '%s'", jump)
+			}
+			host = jump[:index]
+		}
+		host = strings.Trim(host, "[]")
+
+		jumpHost, err := LoadSSHHostConfig(configFile, host)
+		if err != nil {
+			return nil, err
+		}
+		if jumpUser != "" {
+			jumpHost.User = jumpUser
+		}
+		if port != 0 {
+			jumpHost.Port = port
+		}
+		if jumpHost.Port == 0 {
+			jumpHost.Port = 22
+		}
+		jumpHosts = append(jumpHosts, jumpHost)
+	}
+	return jumpHosts, nil
+}
+
+// CreateSSHJumpDialer returns a dialer that reaches the server through the jump hosts, each one connected to through
+// the previous one.  Jump hosts are authenticated with their own identities followed by 'authMethods'.
+func CreateSSHJumpDialer(jumpHosts []*SSHHostConfig, defaultUser string, authMethods []ssh.AuthMethod,
+	hostKeyCallback ssh.HostKeyCallback) SFTPDialer {
+
+	return func(address string, config *ssh.ClientConfig) (*ssh.Client, error) {
+
+		var clients []*ssh.Client
+		closeAll := func() {
+			for i := len(clients) - 1; i >= 0; i-- {
+				clients[i].Close()
+			}
+		}
+
+		for _, jumpHost := range jumpHosts {
+			jumpUser := jumpHost.User
+			if jumpUser == "" {
+				jumpUser = defaultUser
+			}
+			jumpConfig := &ssh.ClientConfig{
+				User:            jumpUser,
+				HostKeyCallback: hostKeyCallback,
+			}
+			if signers := jumpHost.LoadIdentities(); len(signers) > 0 {
+				jumpConfig.Auth = append(jumpConfig.Auth, ssh.PublicKeys(signers...))
+			}
+			jumpConfig.Auth = append(jumpConfig.Auth, authMethods...)
+
+			jumpAddress := net.JoinHostPort(jumpHost.HostName, strconv.Itoa(jumpHost.Port))
+			LOG_DEBUG("SSH_JUMP", "Connecting to the jump host %s", jumpAddress)
+
+			var client *ssh.Client
+			var err error
+			if len(clients) == 0 {
+				client, err = ssh.Dial("tcp", jumpAddress, jumpConfig)
+			} else {
+				client, err = dialSSHThrough(clients[len(clients)-1], jumpAddress, jumpConfig)
+			}
+			if err != nil {
+				closeAll()
+				return nil, fmt.Errorf("failed to connect to the jump host %s: %v", jumpAddress, err)
+			}
+			clients = append(clients, client)
+		}
+
+		client, err := dialSSHThrough(clients[len(clients)-1], address, config)
+		if err != nil {
+			closeAll()
+			return nil, err
+		}
+
+		// Close the jump host connections along with the connection to the server
+		go func() {
+			client.Wait()
+			closeAll()
+		}()
+		return client, nil
+	}
+}
+
+// dialSSHThrough opens an SSH connection to 'address' tunneled through an existing connection.
+func dialSSHThrough(via *ssh.Client, address string, config *ssh.ClientConfig) (*ssh.Client, error) {
+	connection, err := via.Dial("tcp", address)
+	if err != nil {
+		return nil, err
+	}
+	clientConnection, channels, requests, err := ssh.NewClientConn(connection, address, config)
+	if err != nil {
+		connection.Close()
+		return nil, err
+	}
+	return ssh.NewClient(clientConnection, channels, requests), nil
+}
+
+// getKnownHostsNames returns the names under which a host may be listed in known_hosts: the host name, and the IP
+// address it resolved to, each in the form of '[host]:port' if the port isn't 22.
+func getKnownHostsNames(hostname string, remote net.Addr) (names []string) {
+	for _, address := range []string{hostname, remote.String()} {
+		host, port, err := net.SplitHostPort(address)
+		if err != nil {
+			host, port = address, "22"
+		}
+		name := host
+		if port != "22" {
+			name = "[" + host + "]:" + port
+		}
+		if len(names) == 0 || names[0] != name {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// matchKnownHostsEntry returns true if the hosts field of a known_hosts line matches any of the names.  Hashed
+// entries ('|1|salt|hash') are compared by hashing the names with the salt.
+func matchKnownHostsEntry(hosts string, names []string) bool {
+	matched := false
+	for _, pattern := range strings.Split(hosts, ",") {
+		negated := strings.HasPrefix(pattern, "!")
+		pattern = strings.TrimPrefix(pattern, "!")
+
+		for _, name := range names {
+			var found bool
+			if strings.HasPrefix(pattern, "|1|") {
+				fields := strings.Split(pattern[3:], "|")
+				if len(fields) != 2 {
+					continue
+				}
+				salt, err1 := base64.StdEncoding.DecodeString(fields[0])
+				hash, err2 := base64.StdEncoding.DecodeString(fields[1])
+				if err1 != nil || err2 != nil {
+					continue
+				}
+				mac := hmac.New(sha1.New, salt)
+				mac.Write([]byte(name))
+				found = hmac.Equal(mac.Sum(nil), hash)
+			} else {
+				found = matchSSHPattern(strings.ToLower(pattern), strings.ToLower(name))
+			}
+
+			if found && negated {
+				return false
+			} else if found {
+				matched = true
+			}
+		}
+	}
+	return matched
+}
+
+// CheckKnownHosts verifies the host key against the known_hosts files.  It returns true if the key is known, false
+// with no error if the host isn't listed at all, and an error if the host is listed with a different key or the
+// key has been revoked.  Host certificates signed by a '@cert-authority' key are accepted.
+func CheckKnownHosts(files []string, hostname string, remote net.Addr, key ssh.PublicKey) (bool, error) {
+
+	names := getKnownHostsNames(hostname, remote)
+	keyBytes := key.Marshal()
+	certificate, isCertificate := key.(*ssh.Certificate)
+
+	var authorities []ssh.PublicKey
+	var otherKeys []string
+
+	for _, file := range files {
+		content, err := ioutil.ReadFile(file)
+		if err != nil {
+			continue
+		}
+
+		for _, line := range strings.Split(string(content), "\n") {
+			line = strings.TrimSpace(line)
+			if line == "" || line[0] == '#' {
+				continue
+			}
+
+			marker := ""
+			if line[0] == '@' {
+				index := strings.IndexAny(line, " \t")
+				if index < 0 {
+					continue
+				}
+				marker = line[:index]
+				line = strings.TrimSpace(line[index:])
+			}
+
+			index := strings.IndexAny(line, " \t")
+			if index < 0 {
+				continue
+			}
+			hosts := line[:index]
+			entryKey, _, _, _, err := ssh.ParseAuthorizedKey([]byte(strings.TrimSpace(line[index:])))
+			if err != nil {
+				continue
+			}
+
+			if marker == "@revoked" {
+				if bytes.Equal(entryKey.Marshal(), keyBytes) ||
+					(isCertificate && bytes.Equal(entryKey.Marshal(), certificate.SignatureKey.Marshal())) {
+					return false, fmt.Errorf("the host key for %s has been revoked (file %s)", names[0], file)
+				}
+				continue
+			}
+
+			if !matchKnownHostsEntry(hosts, names) {
+				continue
+			}
+
+			if marker == "@cert-authority" {
+				authorities = append(authorities, entryKey)
+			} else if bytes.Equal(entryKey.Marshal(), keyBytes) {
+				return true, nil
+			} else if entryKey.Type() == key.Type() {
+				otherKeys = append(otherKeys, fmt.Sprintf("%s (file %s)", ssh.FingerprintSHA256(entryKey), file))
+			}
+		}
+	}
+
+	if isCertificate && len(authorities) > 0 {
+		checker := &ssh.CertChecker{
+			IsHostAuthority: func(authority ssh.PublicKey, address string) bool {
+				for _, trusted := range authorities {
+					if bytes.Equal(trusted.Marshal(), authority.Marshal()) {
+						return true
+					}
+				}
+				return false
+			},
+		}
+		err := checker.CheckHostKey(hostname, remote, key)
+		if err != nil {
+			return false, fmt.Errorf("the host certificate for %s is not valid: %v", names[0], err)
+		}
+		return true, nil
+	}
+
+	if len(otherKeys) > 0 {
+		for _, otherKey := range otherKeys {
+			LOG_WARN("HOSTKEY_OLD", "The known key for '%s' is %s", names[0], otherKey)
+		}
+		LOG_WARN("HOSTKEY_NEW", "The new key is %s", ssh.FingerprintSHA256(key))
+		return false, fmt.Errorf("The host key for '%s' has changed", names[0])
+	}
+
+	return false, nil
+}
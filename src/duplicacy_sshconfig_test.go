@@ -0,0 +1,149 @@
+// Copyright (c) Acrosync LLC. All rights reserved.
+// Free for personal use and commercial trial
+// Commercial use requires per-user licenses available from https://duplicacy.com
+
+package duplicacy
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base64"
+	"io/ioutil"
+	"net"
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+)
+
+func TestSSHConfig(t *testing.T) {
+
+	setTestingT(t)
+
+	testDir := path.Join(os.TempDir(), "duplicacy_test", "sshconfig")
+	os.RemoveAll(testDir)
+	os.MkdirAll(testDir, 0700)
+	defer os.RemoveAll(testDir)
+
+	configFile := path.Join(testDir, "config")
+	content := `
+# Comments and blank lines are ignored
+User defaultuser
+
+Host backup *.example.com !secret.example.com
+    HostName %h.internal
+    Port=2222
+    IdentityFile /keys/first
+    ProxyJump admin@bastion:2200,gateway
+
+Host backup
+    Port 22
+    IdentityFile "/keys/second"
+
+Host *
+    User otheruser
+    UserKnownHostsFile /hosts/one /hosts/two
+`
+	ioutil.WriteFile(configFile, []byte(content), 0600)
+
+	config, err := LoadSSHHostConfig(configFile, "backup")
+	if err != nil {
+		t.Errorf("Failed to load the ssh config: %v", err)
+		return
+	}
+	if config.HostName != "backup.internal" || config.Port != 2222 || config.User != "defaultuser" {
+		t.Errorf("Incorrect settings: %+v", config)
+	}
+	if strings.Join(config.IdentityFiles, ",") != "/keys/first,/keys/second" {
+		t.Errorf("Incorrect identity files: %v", config.IdentityFiles)
+	}
+	if files := config.GetKnownHostsFiles(); len(files) != 4 || files[1] != "/hosts/two" {
+		t.Errorf("Incorrect known hosts files: %v", files)
+	}
+
+	config, _ = LoadSSHHostConfig(configFile, "secret.example.com")
+	if config.HostName != "secret.example.com" || config.Port != 0 || config.ProxyJump != "" {
+		t.Errorf("A negated host pattern was matched: %+v", config)
+	}
+
+	config, _ = LoadSSHHostConfig(path.Join(testDir, "missing"), "backup")
+	if config == nil || config.HostName != "backup" {
+		t.Errorf("A missing config file should not be an error")
+	}
+
+	jumpHosts, err := ParseSSHProxyJump("admin@bastion:2200,gateway", configFile)
+	if err != nil || len(jumpHosts) != 2 {
+		t.Errorf("Failed to parse the jump hosts: %v", err)
+		return
+	}
+	if jumpHosts[0].User != "admin" || jumpHosts[0].Port != 2200 || jumpHosts[1].Port != 22 {
+		t.Errorf("Incorrect jump hosts: %+v %+v", jumpHosts[0], jumpHosts[1])
+	}
+}
+
+func TestSSHKnownHosts(t *testing.T) {
+
+	setTestingT(t)
+
+	testDir := path.Join(os.TempDir(), "duplicacy_test", "knownhosts")
+	os.RemoveAll(testDir)
+	os.MkdirAll(testDir, 0700)
+	defer os.RemoveAll(testDir)
+
+	newKey := func() ssh.PublicKey {
+		privateKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		publicKey, _ := ssh.NewPublicKey(&privateKey.PublicKey)
+		return publicKey
+	}
+	authorizedKey := func(key ssh.PublicKey) string {
+		return strings.TrimSpace(string(ssh.MarshalAuthorizedKey(key)))
+	}
+
+	hostKey := newKey()
+	otherKey := newKey()
+	revokedKey := newKey()
+
+	salt := []byte("0123456789abcdefghij")
+	mac := hmac.New(sha1.New, salt)
+	mac.Write([]byte("[sftp.example.com]:2222"))
+	hashedHost := "|1|" + base64.StdEncoding.EncodeToString(salt) + "|" + base64.StdEncoding.EncodeToString(mac.Sum(nil))
+
+	knownHostsFile := path.Join(testDir, "known_hosts")
+	content := hashedHost + " " + authorizedKey(hostKey) + "\n" +
+		"changed.example.com,10.0.0.2 " + authorizedKey(otherKey) + "\n" +
+		"@revoked * " + authorizedKey(revokedKey) + "\n"
+	ioutil.WriteFile(knownHostsFile, []byte(content), 0600)
+	files := []string{knownHostsFile, path.Join(testDir, "missing")}
+
+	remote := &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 2222}
+	known, err := CheckKnownHosts(files, "sftp.example.com:2222", remote, hostKey)
+	if !known || err != nil {
+		t.Errorf("The hashed host entry was not matched: %v", err)
+	}
+
+	known, err = CheckKnownHosts(files, "unknown.example.com:22", &net.TCPAddr{IP: net.ParseIP("10.0.0.3"), Port: 22},
+		hostKey)
+	if known || err != nil {
+		t.Errorf("An unknown host should not be matched: %v", err)
+	}
+
+	known, err = CheckKnownHosts(files, "unknown.example.com:22", remote, revokedKey)
+	if known || err == nil {
+		t.Errorf("A revoked key was accepted")
+	}
+
+	if !matchKnownHostsEntry("*.example.com,!bad.example.com", []string{"good.example.com"}) ||
+		matchKnownHostsEntry("*.example.com,!bad.example.com", []string{"bad.example.com"}) {
+		t.Errorf("Host patterns were not matched correctly")
+	}
+
+	if names := getKnownHostsNames("sftp.example.com:22", remote); len(names) != 2 ||
+		names[0] != "sftp.example.com" || names[1] != "[10.0.0.1]:2222" {
+		t.Errorf("Incorrect host names: %v", names)
+	}
+}
@@ -15,6 +15,8 @@ import (
 	"runtime"
 	"strconv"
 	"strings"
+	"sync/atomic"
+	"time"
 
 	"golang.org/x/crypto/ssh"
 	"golang.org/x/crypto/ssh/agent"
@@ -69,6 +71,33 @@ type Storage interface {
 
 	// Set the maximum transfer speeds.
 	SetRateLimits(downloadRateLimit int, uploadRateLimit int)
+
+	// Set the rate limiters shared by all threads transferring chunks and snapshot files.
+	SetRateLimiters(downloadLimiter *RateLimiter, uploadLimiter *RateLimiter)
+
+	// GetRateLimiters returns the shared rate limiters, which may be nil.
+	GetRateLimiters() (downloadLimiter *RateLimiter, uploadLimiter *RateLimiter)
+
+	// GetThrottlingCount returns the number of requests the storage has rejected for being sent too fast.
+	GetThrottlingCount() int
+}
+
+// LockingStorage is implemented by storages that can lock files against deletion for a period of time, such as S3
+// with Object Lock.
+type LockingStorage interface {
+	// GetLockExpiry returns the time until which the file at 'filePath' can't be deleted, or the zero time if the
+	// file isn't locked.
+	GetLockExpiry(threadIndex int, filePath string) (lockedUntil time.Time, err error)
+}
+
+// FileLockedError is returned by DeleteFile and MoveFile if the file is locked by the storage.
+type FileLockedError struct {
+	FilePath    string
+	LockedUntil time.Time
+}
+
+func (err FileLockedError) Error() string {
+	return fmt.Sprintf("%s is locked until %s", err.FilePath, err.LockedUntil.Local().Format("2006-01-02 15:04:05"))
 }
 
 // StorageBase is the base struct from which all storages are derived from
@@ -76,6 +105,11 @@ type StorageBase struct {
 	DownloadRateLimit int // Maximum download rate (bytes/seconds)
 	UploadRateLimit   int // Maximum upload reate (bytes/seconds)
 
+	downloadLimiter *RateLimiter // Limits the total download rate of all threads
+	uploadLimiter   *RateLimiter // Limits the total upload rate of all threads
+
+	throttlingCount int32 // Number of requests rejected with 429 or 503; accessed atomically
+
 	DerivedStorage Storage // Used as the pointer to the derived storage class
 
 	readLevels []int // At which nesting level to find the chunk with the given id
@@ -88,6 +122,27 @@ func (storage *StorageBase) SetRateLimits(downloadRateLimit int, uploadRateLimit
 	storage.UploadRateLimit = uploadRateLimit
 }
 
+// SetRateLimiters sets the rate limiters shared by all transfer threads
+func (storage *StorageBase) SetRateLimiters(downloadLimiter *RateLimiter, uploadLimiter *RateLimiter) {
+	storage.downloadLimiter = downloadLimiter
+	storage.uploadLimiter = uploadLimiter
+}
+
+// GetRateLimiters returns the rate limiters shared by all transfer threads
+func (storage *StorageBase) GetRateLimiters() (downloadLimiter *RateLimiter, uploadLimiter *RateLimiter) {
+	return storage.downloadLimiter, storage.uploadLimiter
+}
+
+// RecordThrottling is called by derived storages when a request is rejected because of too many requests
+func (storage *StorageBase) RecordThrottling() {
+	atomic.AddInt32(&storage.throttlingCount, 1)
+}
+
+// GetThrottlingCount returns the number of requests rejected because of too many requests
+func (storage *StorageBase) GetThrottlingCount() int {
+	return int(atomic.LoadInt32(&storage.throttlingCount))
+}
+
 // SetDefaultNestingLevels sets the default read and write levels.  This is usually called by
 // derived storages to set the levels with old values so that storages initialied by ealier versions
 // will continue to work.
@@ -213,7 +268,14 @@ func checkHostKey(hostname string, remote net.Addr, key ssh.PublicKey) error {
 // CreateStorage creates a storage object based on the provide storage URL.
 func CreateStorage(preference Preference, resetPassword bool, threads int) (storage Storage) {
 
-	storageURL := preference.StorageURL
+	storageURL, err := preference.GetStorageURL()
+	if err != nil {
+		LOG_ERROR("STORAGE_CREATE", "Failed to resolve the storage url %s: %v", preference.StorageURL, err)
+		return nil
+	}
+	if storageURL != preference.StorageURL {
+		LOG_INFO("STORAGE_PARAMETER", "Storage url resolved to %s", storageURL)
+	}
 
 	isFileStorage := false
 	isCacheNeeded := false
@@ -289,13 +351,51 @@ func CreateStorage(preference Preference, resetPassword bool, threads int) (stor
 			username = username[:len(username)-1]
 		}
 
+		// Settings from the OpenSSH configuration file apply unless overridden by the storage url.  The
+		// 'ssh_config' parameter specifies a different file, or 'none' to ignore it.
+		sshConfigFile := preference.GetStorageParameter("ssh_config")
+		if sshConfigFile == "" {
+			sshConfigFile = path.Join(getHomeDirectory(), ".ssh", "config")
+		} else if sshConfigFile == "none" {
+			sshConfigFile = ""
+		} else {
+			sshConfigFile = expandSSHPath(sshConfigFile, server, username)
+		}
+
+		hostConfig := &SSHHostConfig{HostName: server}
+		if sshConfigFile != "" {
+			hostConfig, err = LoadSSHHostConfig(sshConfigFile, server)
+			if err != nil {
+				LOG_ERROR("STORAGE_CREATE", "Failed to read the SSH configuration file %s: %v", sshConfigFile, err)
+				return nil
+			}
+			if hostConfig.HostName != server {
+				LOG_DEBUG("SSH_CONFIG", "Host %s resolved to %s", server, hostConfig.HostName)
+			}
+			server = hostConfig.HostName
+			if hostConfig.Port != 0 && !strings.Contains(matched[3], ":") {
+				port = hostConfig.Port
+			}
+			if username == "" {
+				username = hostConfig.User
+			}
+		}
+
+		var identities []ssh.Signer
+		if sshConfigFile != "" {
+			identities = hostConfig.LoadIdentities()
+		}
+
 		// If ssh_key_file is set, skip password-based login
 		keyFile := GetPasswordFromPreference(preference, "ssh_key_file")
 
+		// The password and the keys are remembered, as the storage may open more connections or reconnect later
 		password := ""
 		passwordCallback := func() (string, error) {
 			LOG_DEBUG("SSH_PASSWORD", "Attempting password login")
-			password = GetPassword(preference, "ssh_password", "Enter SSH password:", false, resetPassword)
+			if password == "" {
+				password = GetPassword(preference, "ssh_password", "Enter SSH password:", false, resetPassword)
+			}
 			return password, nil
 		}
 
@@ -303,7 +403,9 @@ func CreateStorage(preference Preference, resetPassword bool, threads int) (stor
 			err error) {
 			if len(questions) == 1 {
 				LOG_DEBUG("SSH_INTERACTIVE", "Attempting keyboard interactive login")
-				password = GetPassword(preference, "ssh_password", "Enter SSH password:", false, resetPassword)
+				if password == "" {
+					password = GetPassword(preference, "ssh_password", "Enter SSH password:", false, resetPassword)
+				}
 				answers = []string{password}
 				return answers, nil
 			} else {
@@ -311,10 +413,15 @@ func CreateStorage(preference Preference, resetPassword bool, threads int) (stor
 			}
 		}
 
+		var publicKeySigners []ssh.Signer
 		publicKeysCallback := func() ([]ssh.Signer, error) {
 			LOG_DEBUG("SSH_PUBLICKEY", "Attempting public key authentication")
 
-			signers := []ssh.Signer{}
+			if len(publicKeySigners) > 0 {
+				return publicKeySigners, nil
+			}
+
+			signers := append([]ssh.Signer{}, identities...)
 
 			agentSock := os.Getenv("SSH_AUTH_SOCK")
 			if agentSock != "" {
@@ -323,23 +430,29 @@ func CreateStorage(preference Preference, resetPassword bool, threads int) (stor
 				if err == nil {
 					LOG_DEBUG("SSH_AGENT", "Attempting public key authentication via agent")
 					sshAgent := agent.NewClient(connection)
-					signers, err = sshAgent.Signers()
+					agentSigners, err := sshAgent.Signers()
 					if err != nil {
 						LOG_DEBUG("SSH_AGENT", "Can't log in using public key authentication via agent: %v", err)
-					} else if len(signers) == 0 {
+					} else if len(agentSigners) == 0 {
 						LOG_DEBUG("SSH_AGENT", "SSH agent doesn't return any signer")
 					}
+					signers = append(signers, agentSigners...)
 				}
 			}
 
-			keyFile = GetPassword(preference, "ssh_key_file", "Enter the path of the private key file:",
-				true, resetPassword)
+			// Don't ask for a private key file if the identities from the SSH configuration can be used instead
+			if len(identities) == 0 || keyFile != "" {
+				keyFile = GetPassword(preference, "ssh_key_file", "Enter the path of the private key file:",
+					true, resetPassword)
+			}
 
 			var key ssh.Signer
 			var err error
 
 			if keyFile == "" {
-				LOG_INFO("SSH_PUBLICKEY", "No private key file is provided")
+				if len(identities) == 0 {
+					LOG_INFO("SSH_PUBLICKEY", "No private key file is provided")
+				}
 			} else {
 				var content []byte
 				content, err = ioutil.ReadFile(keyFile)
@@ -354,10 +467,14 @@ func CreateStorage(preference Preference, resetPassword bool, threads int) (stor
 			}
 
 			if key != nil {
+				// A certificate next to the private key file is offered before the key itself
+				certificates := loadSSHCertificates(append(hostConfig.CertificateFiles, keyFile+"-cert.pub"))
+				signers = append(signers, getCertificateSigners(key, certificates)...)
 				signers = append(signers, key)
 			}
 
 			if len(signers) > 0 {
+				publicKeySigners = signers
 				return signers, nil
 			} else {
 				return nil, err
@@ -373,7 +490,7 @@ func CreateStorage(preference Preference, resetPassword bool, threads int) (stor
 		keyFileAuthMethods := []ssh.AuthMethod{
 			ssh.PublicKeysCallback(publicKeysCallback),
 		}
-		if keyFile != "" {
+		if keyFile != "" || len(identities) > 0 {
 			authMethods = append(keyFileAuthMethods, passwordAuthMethods...)
 		} else {
 			authMethods = append(passwordAuthMethods, keyFileAuthMethods...)
@@ -393,21 +510,50 @@ func CreateStorage(preference Preference, resetPassword bool, threads int) (stor
 				authMethods = append(authMethods, ssh.PasswordCallback(passwordCallback))
 				authMethods = append(authMethods, ssh.KeyboardInteractive(keyboardInteractive))
 			}
-			if keyringGet(keyFileKey) != "" || os.Getenv("SSH_AUTH_SOCK") != "" {
+			if keyringGet(keyFileKey) != "" || os.Getenv("SSH_AUTH_SOCK") != "" || len(identities) > 0 {
 				authMethods = append(authMethods, ssh.PublicKeysCallback(publicKeysCallback))
 			}
 		}
 
+		// Hosts listed in the OpenSSH known_hosts files are verified against them; others are remembered in the
+		// known_hosts file under the preference directory
 		hostKeyChecker := func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+			if sshConfigFile != "" {
+				known, err := CheckKnownHosts(hostConfig.GetKnownHostsFiles(), hostname, remote, key)
+				if err != nil || known {
+					return err
+				}
+			}
 			return checkHostKey(hostname, remote, key)
 		}
 
-		sftpStorage, err := CreateSFTPStorage(server, port, username, storageDir, 2, authMethods, hostKeyChecker, threads)
+		dialer := func(address string, config *ssh.ClientConfig) (*ssh.Client, error) {
+			return ssh.Dial("tcp", address, config)
+		}
+		if hostConfig.ProxyJump != "" {
+			jumpHosts, err := ParseSSHProxyJump(hostConfig.ProxyJump, sshConfigFile)
+			if err != nil {
+				LOG_ERROR("STORAGE_CREATE", "Invalid ProxyJump setting for %s: %v", server, err)
+				return nil
+			}
+			if len(jumpHosts) > 0 {
+				dialer = CreateSSHJumpDialer(jumpHosts, username, authMethods, hostKeyChecker)
+			}
+		}
+
+		minimumNesting := preference.GetStorageIntParameter("nesting", 2)
+		sftpStorage, err := CreateSFTPStorageWithDialer(server, port, username, storageDir, minimumNesting,
+			authMethods, hostKeyChecker, threads, dialer)
 		if err != nil {
 			LOG_ERROR("STORAGE_CREATE", "Failed to load the SFTP storage at %s: %v", storageURL, err)
 			return nil
 		}
 
+		// Each thread gets its own connection, up to 'sftp_connections' connections, and 'sftp_keepalive' is the
+		// number of seconds between keepalive messages
+		sftpStorage.SetConnectionOptions(preference.GetStorageIntParameter("sftp_connections", SFTPDefaultConnections),
+			time.Duration(preference.GetStorageIntParameter("sftp_keepalive", 0))*time.Second)
+
 		if keyFile != "" {
 			SavePassword(preference, "ssh_key_file", keyFile)
 		} else if password != "" {
@@ -440,22 +586,55 @@ func CreateStorage(preference Preference, resetPassword bool, threads int) (stor
 		accessKey := GetPassword(preference, "s3_id", "Enter S3 Access Key ID:", true, resetPassword)
 		secretKey := GetPassword(preference, "s3_secret", "Enter S3 Secret Access Key:", true, resetPassword)
 
-		var err error
+		// If 's3_part_size' is set (in megabytes, or 0 for the default of 16), larger files are uploaded and
+		// downloaded in parts, 's3_part_threads' parts at a time; multipart transfers are disabled otherwise
+		multipartOptions, err := CreateMultipartOptions(preference.GetStorageIntParameter("s3_part_size", -1),
+			preference.GetStorageIntParameter("s3_part_threads", 0))
+		if err != nil {
+			LOG_ERROR("STORAGE_CREATE", "Invalid multipart options for the storage at %s: %v", storageURL, err)
+			return nil
+		}
 
 		if matched[1] == "s3c" {
-			storage, err = CreateS3CStorage(region, endpoint, bucket, storageDir, accessKey, secretKey, threads)
+			s3cStorage, err := CreateS3CStorage(region, endpoint, bucket, storageDir, accessKey, secretKey, threads)
 			if err != nil {
 				LOG_ERROR("STORAGE_CREATE", "Failed to load the S3C storage at %s: %v", storageURL, err)
 				return nil
 			}
+			s3cStorage.SetMultipartOptions(multipartOptions)
+			storage = s3cStorage
+			if preference.GetStorageParameter("s3_storage_class") != "" ||
+				preference.GetStorageParameter("s3_sse") != "" ||
+				preference.GetStorageParameter("s3_object_lock_mode") != "" {
+				LOG_WARN("STORAGE_CREATE",
+					"Storage classes, server-side encryption and object lock are not supported by s3c storages")
+			}
 		} else {
+			options, err := CreateS3Options(preference.GetStorageParameter("s3_storage_class"),
+				preference.GetStorageParameter("s3_snapshot_storage_class"),
+				preference.GetStorageParameter("s3_sse"), preference.GetStorageParameter("s3_sse_kms_key_id"),
+				GetPasswordFromPreference(preference, "s3_sse_c_key"))
+			if err != nil {
+				LOG_ERROR("STORAGE_CREATE", "Invalid options for the S3 storage at %s: %v", storageURL, err)
+				return nil
+			}
+			err = options.SetObjectLock(preference.GetStorageParameter("s3_object_lock_mode"),
+				preference.GetStorageIntParameter("s3_object_lock_days", 0))
+			if err != nil {
+				LOG_ERROR("STORAGE_CREATE", "Invalid object lock options for the S3 storage at %s: %v", storageURL, err)
+				return nil
+			}
+
 			isMinioCompatible := (matched[1] == "minio" || matched[1] == "minios")
 			isSSLSupported := (matched[1] == "s3" || matched[1] == "minios")
-			storage, err = CreateS3Storage(region, endpoint, bucket, storageDir, accessKey, secretKey, threads, isSSLSupported, isMinioCompatible)
+			s3Storage, err := CreateS3Storage(region, endpoint, bucket, storageDir, accessKey, secretKey, threads, isSSLSupported, isMinioCompatible)
 			if err != nil {
 				LOG_ERROR("STORAGE_CREATE", "Failed to load the S3 storage at %s: %v", storageURL, err)
 				return nil
 			}
+			s3Storage.SetOptions(options)
+			s3Storage.SetMultipartOptions(multipartOptions)
+			storage = s3Storage
 		}
 		SavePassword(preference, "s3_id", accessKey)
 		SavePassword(preference, "s3_secret", secretKey)
@@ -500,7 +679,8 @@ func CreateStorage(preference Preference, resetPassword bool, threads int) (stor
 	} else if matched[1] == "dropbox" {
 		storageDir := matched[3] + matched[5]
 		token := GetPassword(preference, "dropbox_token", "Enter Dropbox access token:", true, resetPassword)
-		dropboxStorage, err := CreateDropboxStorage(token, storageDir, 1, threads)
+		minimumNesting := preference.GetStorageIntParameter("nesting", 1)
+		dropboxStorage, err := CreateDropboxStorage(token, storageDir, minimumNesting, threads)
 		if err != nil {
 			LOG_ERROR("STORAGE_CREATE", "Failed to load the dropbox storage: %v", err)
 			return nil
@@ -509,15 +689,26 @@ func CreateStorage(preference Preference, resetPassword bool, threads int) (stor
 		return dropboxStorage
 	} else if matched[1] == "b2" {
 		bucket := matched[3]
+		storageDir := matched[5]
 
 		accountID := GetPassword(preference, "b2_id", "Enter Backblaze Account ID:", true, resetPassword)
 		applicationKey := GetPassword(preference, "b2_key", "Enter Backblaze Application Key:", true, resetPassword)
 
-		b2Storage, err := CreateB2Storage(accountID, applicationKey, bucket, threads)
+		// Files larger than 'b2_part_size' megabytes (16 by default, or -1 to disable) are uploaded with the large
+		// file API, 'b2_part_threads' parts at a time
+		multipartOptions, err := CreateMultipartOptions(preference.GetStorageIntParameter("b2_part_size", 0),
+			preference.GetStorageIntParameter("b2_part_threads", 0))
+		if err != nil {
+			LOG_ERROR("STORAGE_CREATE", "Invalid multipart options for the B2 storage: %v", err)
+			return nil
+		}
+
+		b2Storage, err := CreateB2Storage(accountID, applicationKey, bucket, storageDir, threads)
 		if err != nil {
 			LOG_ERROR("STORAGE_CREATE", "Failed to load the Backblaze B2 storage at %s: %v", storageURL, err)
 			return nil
 		}
+		b2Storage.SetMultipartOptions(multipartOptions)
 		SavePassword(preference, "b2_id", accountID)
 		SavePassword(preference, "b2_key", applicationKey)
 		return b2Storage
@@ -530,15 +721,46 @@ func CreateStorage(preference Preference, resetPassword bool, threads int) (stor
 			return nil
 		}
 
-		prompt := fmt.Sprintf("Enter the Access Key for the Azure storage account %s:", account)
-		accessKey := GetPassword(preference, "azure_key", prompt, true, resetPassword)
+		// The 'azure_auth' parameter selects how requests are authorized: with the account key (the default), with
+		// a SAS token, or as a service principal
+		credentials := AzureCredentials{Endpoint: preference.GetStorageParameter("azure_endpoint")}
+		var secretKey, secret string
+		switch preference.GetStorageParameter("azure_auth") {
+		case "", "key":
+			prompt := fmt.Sprintf("Enter the Access Key for the Azure storage account %s:", account)
+			secretKey = "azure_key"
+			secret = GetPassword(preference, secretKey, prompt, true, resetPassword)
+			credentials.AccountKey = secret
+		case "sas":
+			prompt := fmt.Sprintf("Enter the SAS token for the Azure container %s:", container)
+			secretKey = "azure_sas_token"
+			secret = GetPassword(preference, secretKey, prompt, true, resetPassword)
+			credentials.SASToken = secret
+		case "service_principal":
+			credentials.TenantID = preference.GetStorageParameter("azure_tenant_id")
+			credentials.ClientID = preference.GetStorageParameter("azure_client_id")
+			credentials.AuthorityHost = preference.GetStorageParameter("azure_authority_host")
+			if credentials.TenantID == "" || credentials.ClientID == "" {
+				LOG_ERROR("STORAGE_CREATE", "The parameters azure_tenant_id and azure_client_id must be set "+
+					"for service principal authentication")
+				return nil
+			}
+			prompt := fmt.Sprintf("Enter the client secret for the service principal %s:", credentials.ClientID)
+			secretKey = "azure_client_secret"
+			secret = GetPassword(preference, secretKey, prompt, true, resetPassword)
+			credentials.ClientSecret = secret
+		default:
+			LOG_ERROR("STORAGE_CREATE", "Unknown Azure authentication method '%s'",
+				preference.GetStorageParameter("azure_auth"))
+			return nil
+		}
 
-		azureStorage, err := CreateAzureStorage(account, accessKey, container, threads)
+		azureStorage, err := CreateAzureStorageWithCredentials(account, credentials, container, threads)
 		if err != nil {
 			LOG_ERROR("STORAGE_CREATE", "Failed to load the Azure storage at %s: %v", storageURL, err)
 			return nil
 		}
-		SavePassword(preference, "azure_key", accessKey)
+		SavePassword(preference, secretKey, secret)
 		return azureStorage
 	} else if matched[1] == "acd" {
 		storagePath := matched[3] + matched[4]
@@ -627,6 +849,16 @@ func CreateStorage(preference Preference, resetPassword bool, threads int) (stor
 			LOG_ERROR("STORAGE_CREATE", "Failed to load the WebDAV storage at %s: %v", storageURL, err)
 			return nil
 		}
+
+		// On Nextcloud servers, files larger than 'webdav_part_size' megabytes (16 by default, or -1 to disable)
+		// are uploaded in chunks, 'webdav_part_threads' chunks at a time
+		multipartOptions, err := CreateMultipartOptions(preference.GetStorageIntParameter("webdav_part_size", 0),
+			preference.GetStorageIntParameter("webdav_part_threads", 0))
+		if err != nil {
+			LOG_ERROR("STORAGE_CREATE", "Invalid multipart options for the WebDAV storage: %v", err)
+			return nil
+		}
+		webDAVStorage.SetMultipartOptions(multipartOptions)
 		SavePassword(preference, "webdav_password", password)
 		return webDAVStorage
 	} else {
@@ -37,6 +37,24 @@ func init() {
 	flag.Parse()
 }
 
+// setS3TestOptions applies the optional storage classes, server-side encryption and part size in the test config.
+func setS3TestOptions(storage *S3Storage, config map[string]string) error {
+	options, err := CreateS3Options(config["storage_class"], config["snapshot_storage_class"], config["sse"],
+		config["sse_kms_key_id"], config["sse_c_key"])
+	if err != nil {
+		return err
+	}
+	storage.SetOptions(options)
+
+	partSize, _ := strconv.Atoi(config["part_size"])
+	multipartOptions, err := CreateMultipartOptions(partSize, 0)
+	if err != nil {
+		return err
+	}
+	storage.SetMultipartOptions(multipartOptions)
+	return nil
+}
+
 func loadStorage(localStoragePath string, threads int) (Storage, error) {
 
 	if testStorageName == "" || testStorageName == "file" {
@@ -80,6 +98,9 @@ func loadStorage(localStoragePath string, threads int) (Storage, error) {
 		return storage, err
 	} else if testStorageName == "s3" {
 		storage, err := CreateS3Storage(config["region"], config["endpoint"], config["bucket"], config["directory"], config["access_key"], config["secret_key"], threads, true, false)
+		if err == nil {
+			err = setS3TestOptions(storage, config)
+		}
 		return storage, err
 		storage.SetDefaultNestingLevels([]int{2, 3}, 2)
 	} else if testStorageName == "wasabi" {
@@ -97,17 +118,23 @@ func loadStorage(localStoragePath string, threads int) (Storage, error) {
 	} else if testStorageName == "minio" {
 		storage, err := CreateS3Storage(config["region"], config["endpoint"], config["bucket"], config["directory"], config["access_key"], config["secret_key"], threads, false, true)
 		storage.SetDefaultNestingLevels([]int{2, 3}, 2)
+		if err == nil {
+			err = setS3TestOptions(storage, config)
+		}
 		return storage, err
 	} else if testStorageName == "minios" {
 		storage, err := CreateS3Storage(config["region"], config["endpoint"], config["bucket"], config["directory"], config["access_key"], config["secret_key"], threads, true, true)
 		storage.SetDefaultNestingLevels([]int{2, 3}, 2)
+		if err == nil {
+			err = setS3TestOptions(storage, config)
+		}
 		return storage, err
 	} else if testStorageName == "dropbox" {
 		storage, err := CreateDropboxStorage(config["token"], config["directory"], 1, threads)
 		storage.SetDefaultNestingLevels([]int{2, 3}, 2)
 		return storage, err
 	} else if testStorageName == "b2" {
-		storage, err := CreateB2Storage(config["account"], config["key"], config["bucket"], threads)
+		storage, err := CreateB2Storage(config["account"], config["key"], config["bucket"], config["directory"], threads)
 		storage.SetDefaultNestingLevels([]int{2, 3}, 2)
 		return storage, err
 	} else if testStorageName == "gcs-s3" {
@@ -123,7 +150,16 @@ func loadStorage(localStoragePath string, threads int) (Storage, error) {
 		storage.SetDefaultNestingLevels([]int{2, 3}, 2)
 		return storage, err
 	} else if testStorageName == "azure" {
-		storage, err := CreateAzureStorage(config["account"], config["key"], config["container"], threads)
+		credentials := AzureCredentials{
+			AccountKey:    config["key"],
+			SASToken:      config["sas_token"],
+			TenantID:      config["tenant_id"],
+			ClientID:      config["client_id"],
+			ClientSecret:  config["client_secret"],
+			AuthorityHost: config["authority_host"],
+			Endpoint:      config["endpoint"],
+		}
+		storage, err := CreateAzureStorageWithCredentials(config["account"], credentials, config["container"], threads)
 		storage.SetDefaultNestingLevels([]int{2, 3}, 2)
 		return storage, err
 	} else if testStorageName == "acd" {
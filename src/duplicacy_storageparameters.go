@@ -0,0 +1,130 @@
+// Copyright (c) Acrosync LLC. All rights reserved.
+// Free for personal use and commercial trial
+// Commercial use requires per-user licenses available from https://duplicacy.com
+
+package duplicacy
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// A storage can be defined by named parameters in addition to the storage url.  The url may then refer to a
+// parameter as '{name}', for example 's3://{region}@{endpoint}/{bucket}/{path}', and each parameter can be given,
+// from the highest precedence to the lowest:
+//
+//     1. by the global option '-param storage:name=value' for the named storage, or '-param name=value' for the
+//        storage the command works on (for the copy command that is the source storage)
+//     2. by the environment variable DUPLICACY_<NAME> for the default storage, or DUPLICACY_<STORAGE>_<NAME>
+//        for other storages, the same way passwords are looked up
+//     3. by the 'parameters' map in the preferences
+//
+// A few parameters have meanings of their own: 'url' replaces the entire storage url, 'threads' is the number of
+// threads used when the -threads option is not specified, and 'nesting' is the minimum directory level at which
+// SFTP and Dropbox storages start searching for chunks.
+
+var storageParameterRegex = regexp.MustCompile(`\{([\w-]+)\}`)
+
+// A parameter name given on the command line, optionally preceded by the storage name and a colon
+var storageParameterNameRegex = regexp.MustCompile(`^([^=]+:)?[\w-]+$`)
+
+// Parameters specified on the command line, indexed by 'storage:name' or just 'name' if no storage is given
+var storageParameterOverrides = make(map[string]string)
+
+// The storage that parameters given without a storage name apply to; if empty they apply to every storage
+var primaryStorageName string
+
+// SetStorageParameters sets the parameters given on the command line, each in the form of 'storage:name=value' or
+// 'name=value'.
+func SetStorageParameters(parameters []string) error {
+	for _, parameter := range parameters {
+		index := strings.Index(parameter, "=")
+		if index <= 0 || !storageParameterNameRegex.MatchString(parameter[:index]) {
+			return fmt.Errorf("invalid storage parameter '%s'", parameter)
+		}
+		storageParameterOverrides[parameter[:index]] = parameter[index+1:]
+	}
+	return nil
+}
+
+// SetPrimaryStorage restricts parameters given on the command line without a storage name to the named storage.
+// This is needed by commands that use more than one storage.
+func SetPrimaryStorage(storageName string) {
+	primaryStorageName = storageName
+}
+
+// lookupStorageParameter returns the value of the named parameter of the storage, and whether it is defined.
+func (preference Preference) lookupStorageParameter(name string) (string, bool) {
+
+	if value, found := storageParameterOverrides[preference.Name+":"+name]; found {
+		return value, true
+	}
+
+	if primaryStorageName == "" || primaryStorageName == preference.Name {
+		if value, found := storageParameterOverrides[name]; found {
+			return value, true
+		}
+	}
+
+	variable := name
+	if preference.Name != "default" {
+		variable = preference.Name + "_" + name
+	}
+	variable = strings.ToUpper("duplicacy_" + strings.Replace(variable, "-", "_", -1))
+	if value, found := os.LookupEnv(variable); found {
+		LOG_DEBUG("STORAGE_PARAMETER", "Reading the parameter %s from the environment variable %s", name, variable)
+		return value, true
+	}
+
+	value, found := preference.Parameters[name]
+	return value, found
+}
+
+// GetStorageParameter returns the value of the named parameter of the storage, or an empty string if the parameter
+// is not defined anywhere.
+func (preference Preference) GetStorageParameter(name string) string {
+	value, _ := preference.lookupStorageParameter(name)
+	return value
+}
+
+// GetStorageIntParameter returns the named parameter as an integer, or 'defaultValue' if the parameter is not
+// defined or not a valid integer.
+func (preference Preference) GetStorageIntParameter(name string, defaultValue int) int {
+	value := preference.GetStorageParameter(name)
+	if value == "" {
+		return defaultValue
+	}
+	number, err := strconv.Atoi(value)
+	if err != nil {
+		LOG_WARN("STORAGE_PARAMETER", "Invalid value '%s' for the parameter %s", value, name)
+		return defaultValue
+	}
+	return number
+}
+
+// GetStorageURL returns the storage url with all parameter references replaced by their values.
+func (preference Preference) GetStorageURL() (string, error) {
+
+	storageURL := preference.StorageURL
+	if value := preference.GetStorageParameter("url"); value != "" {
+		storageURL = value
+	}
+
+	var missing []string
+	storageURL = storageParameterRegex.ReplaceAllStringFunc(storageURL, func(reference string) string {
+		name := reference[1 : len(reference)-1]
+		value, found := preference.lookupStorageParameter(name)
+		if !found {
+			missing = append(missing, name)
+		}
+		return value
+	})
+
+	if len(missing) > 0 {
+		return "", fmt.Errorf("the storage parameter %s is not defined", strings.Join(missing, ", "))
+	}
+	return storageURL, nil
+}
@@ -0,0 +1,85 @@
+// Copyright (c) Acrosync LLC. All rights reserved.
+// Free for personal use and commercial trial
+// Commercial use requires per-user licenses available from https://duplicacy.com
+
+package duplicacy
+
+import (
+	"os"
+	"testing"
+)
+
+func TestStorageParameters(t *testing.T) {
+
+	setTestingT(t)
+
+	preference := Preference{
+		Name:       "offsite",
+		StorageURL: "s3://{region}@{endpoint}/{bucket}/{path}",
+		Parameters: map[string]string{
+			"region":   "us-east-1",
+			"endpoint": "amazon.com",
+			"bucket":   "backups",
+			"path":     "",
+			"threads":  "8",
+		},
+	}
+
+	storageURL, err := preference.GetStorageURL()
+	if err != nil || storageURL != "s3://us-east-1@amazon.com/backups/" {
+		t.Errorf("The storage url was resolved to %s (%v)", storageURL, err)
+	}
+
+	os.Setenv("DUPLICACY_OFFSITE_BUCKET", "test-backups")
+	defer os.Unsetenv("DUPLICACY_OFFSITE_BUCKET")
+
+	storageURL, _ = preference.GetStorageURL()
+	if storageURL != "s3://us-east-1@amazon.com/test-backups/" {
+		t.Errorf("The environment variable was not used: %s", storageURL)
+	}
+
+	err = SetStorageParameters([]string{"url=minio://{region}@localhost:9000/{bucket}", "threads=2"})
+	if err != nil {
+		t.Errorf("Failed to set the storage parameters: %v", err)
+	}
+	defer func() { storageParameterOverrides = make(map[string]string) }()
+
+	storageURL, _ = preference.GetStorageURL()
+	if storageURL != "minio://us-east-1@localhost:9000/test-backups" {
+		t.Errorf("The url parameter was not used: %s", storageURL)
+	}
+	if threads := preference.GetStorageIntParameter("threads", 1); threads != 2 {
+		t.Errorf("The threads parameter is %d instead of 2", threads)
+	}
+
+	preference.StorageURL = "sftp://{user}@{host}/path"
+	delete(storageParameterOverrides, "url")
+	if _, err = preference.GetStorageURL(); err == nil {
+		t.Errorf("Undefined parameters were not reported")
+	}
+
+	if SetStorageParameters([]string{"=value"}) == nil || SetStorageParameters([]string{"offsite:=value"}) == nil {
+		t.Errorf("An invalid parameter was accepted")
+	}
+
+	// Unscoped parameters only apply to the primary storage; scoped ones always apply to their own storage
+	SetPrimaryStorage("default")
+	defer SetPrimaryStorage("")
+
+	if threads := preference.GetStorageIntParameter("threads", 1); threads != 8 {
+		t.Errorf("The threads parameter for another storage is %d instead of 8", threads)
+	}
+
+	err = SetStorageParameters([]string{"offsite:threads=4", "other:threads=6"})
+	if err != nil {
+		t.Errorf("Failed to set the storage parameters: %v", err)
+	}
+	if threads := preference.GetStorageIntParameter("threads", 1); threads != 4 {
+		t.Errorf("The scoped threads parameter is %d instead of 4", threads)
+	}
+
+	SetPrimaryStorage("offsite")
+	if threads := preference.GetStorageIntParameter("threads", 1); threads != 4 {
+		t.Errorf("The scoped threads parameter for the primary storage is %d instead of 4", threads)
+	}
+}
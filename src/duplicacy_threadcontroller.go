@@ -0,0 +1,170 @@
+// Copyright (c) Acrosync LLC. All rights reserved.
+// Free for personal use and commercial trial
+// Commercial use requires per-user licenses available from https://duplicacy.com
+
+package duplicacy
+
+import (
+	"sync"
+	"time"
+)
+
+// ThreadController adapts the number of active transfer threads to what the storage can handle.  The uploader or
+// downloader starts the maximum number of threads, but only those with an index below the current count are allowed
+// to take tasks.  Transfers are measured over a period of time; the count is increased by one as long as doing so
+// improves the throughput, decreased by one if the latency per transfer goes up without any gain in throughput, and
+// halved if the storage starts throttling requests.
+type ThreadController struct {
+	lock          sync.Mutex
+	changeChannel chan bool // Closed and replaced whenever the number of threads changes
+
+	storage        Storage
+	operation      string // "upload" or "download"
+	minimumThreads int
+	maximumThreads int
+	threads        int
+
+	periodStart     time.Time
+	periodBytes     int64
+	periodTransfers int
+	periodLatency   time.Duration
+
+	lastThroughput      float64 // Bytes per second in the previous period
+	lastLatency         time.Duration
+	lastThrottlingCount int
+}
+
+// How long transfers are measured before the number of threads is adjusted
+var threadControllerInterval = 10 * time.Second
+
+const (
+	// The throughput must go up by this much for more threads to be considered better
+	threadControllerThroughputGain = 1.1
+
+	// The latency is considered to have gone up when it grows by this much
+	threadControllerLatencyGrowth = 1.25
+)
+
+// CreateThreadController creates a controller that keeps the number of threads between 'minimumThreads' and
+// 'maximumThreads', starting with the minimum.
+func CreateThreadController(storage Storage, operation string, minimumThreads int, maximumThreads int) *ThreadController {
+	if minimumThreads < 1 {
+		minimumThreads = 1
+	}
+	if maximumThreads < minimumThreads {
+		maximumThreads = minimumThreads
+	}
+
+	controller := &ThreadController{
+		changeChannel:       make(chan bool),
+		storage:             storage,
+		operation:           operation,
+		minimumThreads:      minimumThreads,
+		maximumThreads:      maximumThreads,
+		threads:             minimumThreads,
+		periodStart:         time.Now(),
+		lastThrottlingCount: storage.GetThrottlingCount(),
+	}
+
+	LOG_INFO("ADAPTIVE_THREADS", "Starting with %d %s threads, adjustable up to %d", controller.threads, operation,
+		maximumThreads)
+	return controller
+}
+
+// GetThreads returns the number of threads currently allowed to run.
+func (controller *ThreadController) GetThreads() int {
+	controller.lock.Lock()
+	defer controller.lock.Unlock()
+	return controller.threads
+}
+
+// WaitForTurn blocks until the thread with the given index is allowed to run.  It returns false if a value is
+// received from 'stopChannel' in the meantime, in which case the thread should exit.  A nil controller lets every
+// thread run.
+func (controller *ThreadController) WaitForTurn(threadIndex int, stopChannel chan bool) bool {
+	if controller == nil {
+		return true
+	}
+
+	for {
+		controller.lock.Lock()
+		active := threadIndex < controller.threads
+		changeChannel := controller.changeChannel
+		controller.lock.Unlock()
+
+		if active {
+			return true
+		}
+
+		select {
+		case <-changeChannel:
+		case <-stopChannel:
+			return false
+		}
+	}
+}
+
+// Record is called after each successful transfer of 'size' bytes that took 'latency' to complete.  The number of
+// threads is adjusted at the end of each measurement period.
+func (controller *ThreadController) Record(size int, latency time.Duration) {
+	if controller == nil {
+		return
+	}
+
+	controller.lock.Lock()
+	defer controller.lock.Unlock()
+
+	controller.periodBytes += int64(size)
+	controller.periodTransfers++
+	controller.periodLatency += latency
+
+	now := time.Now()
+	// Make sure every active thread has contributed to the measurement
+	if now.Sub(controller.periodStart) < threadControllerInterval || controller.periodTransfers < controller.threads {
+		return
+	}
+
+	throughput := float64(controller.periodBytes) / now.Sub(controller.periodStart).Seconds()
+	latency = controller.periodLatency / time.Duration(controller.periodTransfers)
+	throttlingCount := controller.storage.GetThrottlingCount()
+
+	threads := controller.threads
+	reason := ""
+	if throttlingCount > controller.lastThrottlingCount {
+		threads = controller.threads / 2
+		reason = "the storage is throttling requests"
+	} else if throughput > controller.lastThroughput*threadControllerThroughputGain {
+		threads = controller.threads + 1
+		reason = "the throughput has improved"
+	} else if controller.lastLatency > 0 &&
+		float64(latency) > float64(controller.lastLatency)*threadControllerLatencyGrowth {
+		threads = controller.threads - 1
+		reason = "the latency has increased"
+	}
+
+	if threads < controller.minimumThreads {
+		threads = controller.minimumThreads
+	} else if threads > controller.maximumThreads {
+		threads = controller.maximumThreads
+	}
+
+	LOG_DEBUG("ADAPTIVE_THREADS", "%d %s threads: %s/s, %.2f seconds per transfer, %d throttled requests",
+		controller.threads, controller.operation, PrettySize(int64(throughput)), latency.Seconds(),
+		throttlingCount-controller.lastThrottlingCount)
+
+	if threads != controller.threads {
+		LOG_INFO("ADAPTIVE_THREADS", "Using %d %s threads instead of %d because %s", threads, controller.operation,
+			controller.threads, reason)
+		controller.threads = threads
+		close(controller.changeChannel)
+		controller.changeChannel = make(chan bool)
+	}
+
+	controller.lastThroughput = throughput
+	controller.lastLatency = latency
+	controller.lastThrottlingCount = throttlingCount
+	controller.periodStart = now
+	controller.periodBytes = 0
+	controller.periodTransfers = 0
+	controller.periodLatency = 0
+}
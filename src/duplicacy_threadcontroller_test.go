@@ -0,0 +1,78 @@
+// Copyright (c) Acrosync LLC. All rights reserved.
+// Free for personal use and commercial trial
+// Commercial use requires per-user licenses available from https://duplicacy.com
+
+package duplicacy
+
+import (
+	"testing"
+	"time"
+)
+
+func TestThreadController(t *testing.T) {
+
+	setTestingT(t)
+
+	savedInterval := threadControllerInterval
+	threadControllerInterval = 0
+	defer func() { threadControllerInterval = savedInterval }()
+
+	storage := &FileStorage{}
+	controller := CreateThreadController(storage, "upload", 1, 4)
+
+	// Each period is made to last one second so the throughput is the number of bytes transferred
+	runPeriod := func(sizes []int, latency time.Duration) int {
+		for i, size := range sizes {
+			if i == len(sizes)-1 {
+				controller.periodStart = time.Now().Add(-time.Second)
+			}
+			controller.Record(size, latency)
+		}
+		return controller.GetThreads()
+	}
+
+	stopChannel := make(chan bool)
+	turnChannel := make(chan bool)
+	go func() {
+		turnChannel <- controller.WaitForTurn(1, stopChannel)
+	}()
+
+	if threads := runPeriod([]int{1000000}, 100*time.Millisecond); threads != 2 {
+		t.Errorf("The first period should add a thread, not %d", threads)
+	}
+
+	select {
+	case active := <-turnChannel:
+		if !active {
+			t.Errorf("The second thread was not allowed to run")
+		}
+	case <-time.After(time.Second):
+		t.Errorf("The second thread was not woken up")
+	}
+
+	if threads := runPeriod([]int{1000000, 1000000}, 100*time.Millisecond); threads != 3 {
+		t.Errorf("An improved throughput should add a thread, not %d", threads)
+	}
+
+	if threads := runPeriod([]int{700000, 700000, 700000}, 300*time.Millisecond); threads != 2 {
+		t.Errorf("A higher latency without a better throughput should remove a thread, not %d", threads)
+	}
+
+	storage.RecordThrottling()
+	if threads := runPeriod([]int{1000000, 1000000}, 100*time.Millisecond); threads != 1 {
+		t.Errorf("Throttling should halve the number of threads, not %d", threads)
+	}
+
+	go func() {
+		turnChannel <- controller.WaitForTurn(2, stopChannel)
+	}()
+	stopChannel <- true
+	if active := <-turnChannel; active {
+		t.Errorf("An inactive thread should exit when stopped")
+	}
+
+	var fixed *ThreadController
+	if !fixed.WaitForTurn(10, stopChannel) {
+		t.Errorf("A nil controller should let every thread run")
+	}
+}
@@ -9,6 +9,8 @@ import (
 	"crypto/sha256"
 	"fmt"
 	"io"
+	"io/ioutil"
+	"math"
 	"os"
 	"path"
 	"path/filepath"
@@ -163,38 +165,64 @@ func GenerateKeyFromPassword(password string, salt []byte, iterations int) []byt
 	return pbkdf2.Key([]byte(password), salt, iterations, 32, sha256.New)
 }
 
-// Get password from preference, env, but don't start any keyring request
+// readSecretFile returns the content of a file holding a secret, such as one mounted by a container runtime.  Trailing
+// line breaks are removed since most tools add one when writing the file.
+func readSecretFile(secretFile string) string {
+	content, err := ioutil.ReadFile(secretFile)
+	if err != nil {
+		LOG_ERROR("PASSWORD_FILE", "Failed to read the secret from %s: %v", secretFile, err)
+		return ""
+	}
+	return strings.TrimRight(string(content), "\r\n")
+}
+
+// Get password from preference, env, but don't start any keyring request.  Each secret can also be given as the path
+// of a file containing it, by the same env variable or key name with a '_file' suffix; the file is read every time
+// and its content is never saved anywhere.
 func GetPasswordFromPreference(preference Preference, passwordType string) string {
 	passwordID := passwordType
 	if preference.Name != "default" {
 		passwordID = preference.Name + "_" + passwordID
 	}
 
+	// Some keys, like ssh_key_file, are file paths themselves
+	fileAllowed := !strings.HasSuffix(passwordType, "_file")
+
 	{
 		name := strings.ToUpper("duplicacy_" + passwordID)
 		LOG_DEBUG("PASSWORD_ENV_VAR", "Reading the environment variable %s", name)
 		if password, found := os.LookupEnv(name); found && password != "" {
 			return password
 		}
+
+		if fileAllowed {
+			if secretFile, found := os.LookupEnv(name + "_FILE"); found && secretFile != "" {
+				LOG_DEBUG("PASSWORD_ENV_VAR", "Reading %s from the file specified by %s_FILE", passwordID, name)
+				return readSecretFile(secretFile)
+			}
+		}
 	}
 
 	// If the password is stored in the preference, there is no need to include the storage name
 	// (i.e., preference.Name) in the key, so the key name should really be passwordType rather
 	// than passwordID; we're using passwordID here only for backward compatibility
-	if len(preference.Keys) > 0 && len(preference.Keys[passwordID]) > 0 {
-		LOG_DEBUG("PASSWORD_PREFERENCE", "Reading %s from preferences", passwordID)
-		return preference.Keys[passwordID]
-	}
+	for _, key := range []string{passwordID, passwordType} {
+		if len(preference.Keys) > 0 && len(preference.Keys[key]) > 0 {
+			LOG_DEBUG("PASSWORD_PREFERENCE", "Reading %s from preferences", key)
+			return preference.Keys[key]
+		}
 
-	if len(preference.Keys) > 0 && len(preference.Keys[passwordType]) > 0 {
-		LOG_DEBUG("PASSWORD_PREFERENCE", "Reading %s from preferences", passwordType)
-		return preference.Keys[passwordType]
+		if fileAllowed && len(preference.Keys) > 0 && len(preference.Keys[key+"_file"]) > 0 {
+			LOG_DEBUG("PASSWORD_PREFERENCE", "Reading %s from the file specified by %s_file", key, key)
+			return readSecretFile(preference.Keys[key+"_file"])
+		}
 	}
 
 	return ""
 }
 
-// GetPassword attempts to get the password from KeyChain/KeyRing, environment variables, or keyboard input.
+// GetPassword attempts to get the password from environment variables, the preference, the credential helper,
+// KeyChain/KeyRing (or the secret store if one has been created), or keyboard input.
 func GetPassword(preference Preference, passwordType string, prompt string,
 	showPassword bool, resetPassword bool) string {
 	passwordID := passwordType
@@ -208,11 +236,27 @@ func GetPassword(preference Preference, passwordType string, prompt string,
 		passwordID = preference.Name + "_" + passwordID
 	}
 
+	if preference.CredentialHelper != "" {
+		if resetPassword && !RunInBackground {
+			erasePasswordFromHelper(preference, passwordType, passwordID)
+		} else if password := getPasswordFromHelper(preference, passwordType, passwordID); password != "" {
+			return password
+		}
+	}
+
 	if resetPassword && !RunInBackground {
-		keyringSet(passwordID, "")
+		if SecretStoreExists() {
+			secretStoreSet(passwordID, "")
+		} else {
+			keyringSet(passwordID, "")
+		}
 	} else {
-		password := keyringGet(passwordID)
-		if password != "" {
+		if SecretStoreExists() {
+			// The secret store is used in place of the keychain/keyring
+			if password := secretStoreGet(passwordID); password != "" {
+				return password
+			}
+		} else if password := keyringGet(passwordID); password != "" {
 			LOG_DEBUG("PASSWORD_KEYCHAIN", "Reading %s from keychain/keyring", passwordType)
 			return password
 		}
@@ -262,6 +306,18 @@ func SavePassword(preference Preference, passwordType string, password string) {
 	if preference.Name != "default" {
 		passwordID = preference.Name + "_" + passwordID
 	}
+
+	// With a credential helper configured, secrets are kept by the helper rather than the keyring
+	if preference.CredentialHelper != "" {
+		savePasswordToHelper(preference, passwordType, passwordID, password)
+		return
+	}
+
+	if SecretStoreExists() {
+		secretStoreSet(passwordID, password)
+		return
+	}
+
 	keyringSet(passwordID, password)
 }
 
@@ -448,24 +504,79 @@ func PrettyTime(seconds int64) string {
 	}
 }
 
+// AtoSize converts a size such as '4m' into bytes.  It returns 0 if the size is invalid or doesn't fit in an int,
+// which on 32-bit platforms is the case for sizes of 2g and above.
 func AtoSize(sizeString string) int {
+	size := AtoSize64(sizeString)
+	if size > int64(math.MaxInt32) && strconv.IntSize == 32 {
+		return 0
+	}
+	return int(size)
+}
+
+// AtoSize64 is the same as AtoSize but returns an int64, so sizes of several gigabytes can be given on all platforms.
+func AtoSize64(sizeString string) int64 {
 	sizeString = strings.ToLower(sizeString)
 
-	sizeRegex := regexp.MustCompile(`^([0-9]+)([mk])?$`)
+	sizeRegex := regexp.MustCompile(`^([0-9]+)([gmk])?$`)
 	matched := sizeRegex.FindStringSubmatch(sizeString)
 	if matched == nil {
 		return 0
 	}
 
-	size, _ := strconv.Atoi(matched[1])
+	size, err := strconv.ParseInt(matched[1], 10, 64)
+	if err != nil {
+		return 0
+	}
 
-	if matched[2] == "m" {
-		size *= 1024 * 1024
+	unit := int64(1)
+	if matched[2] == "g" {
+		unit = 1024 * 1024 * 1024
+	} else if matched[2] == "m" {
+		unit = 1024 * 1024
 	} else if matched[2] == "k" {
-		size *= 1024
+		unit = 1024
+	}
+
+	if size > math.MaxInt64/unit {
+		return 0
+	}
+	return size * unit
+}
+
+// ParseRevisionTime converts the time specification given by the -at option into Unix seconds.  It accepts
+// an absolute time such as '2006-01-02 15:04' (interpreted in the local time zone), or a relative time such as
+// '3d' meaning 3 days before 'now'.  Supported units for relative times are 'h' (hours), 'd' (days), and 'w' (weeks).
+func ParseRevisionTime(timeString string, now time.Time) (int64, error) {
+
+	timeString = strings.TrimSpace(timeString)
+
+	relativeRegex := regexp.MustCompile(`^([0-9]+)([hdw])$`)
+	matched := relativeRegex.FindStringSubmatch(strings.ToLower(timeString))
+	if matched != nil {
+		count, _ := strconv.Atoi(matched[1])
+		unit := time.Hour
+		if matched[2] == "d" {
+			unit = 24 * time.Hour
+		} else if matched[2] == "w" {
+			unit = 7 * 24 * time.Hour
+		}
+		return now.Add(-time.Duration(count) * unit).Unix(), nil
+	}
+
+	layouts := []string{"2006-01-02 15:04:05", "2006-01-02 15:04", "2006-01-02T15:04:05", "2006-01-02T15:04",
+		"2006-01-02"}
+	for _, layout := range layouts {
+		if t, err := time.ParseInLocation(layout, timeString, time.Local); err == nil {
+			return t.Unix(), nil
+		}
+	}
+
+	if t, err := time.Parse(time.RFC3339, timeString); err == nil {
+		return t.Unix(), nil
 	}
 
-	return size
+	return 0, fmt.Errorf("Invalid time '%s'; use a time like '2006-01-02 15:04' or an age like '3d'", timeString)
 }
 
 func MinInt(x, y int) int {
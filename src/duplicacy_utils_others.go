@@ -25,6 +25,8 @@ func GetOwner(entry *Entry, fileInfo *os.FileInfo) {
 	if ok && stat != nil {
 		entry.UID = int(stat.Uid)
 		entry.GID = int(stat.Gid)
+		entry.UserName = lookupUserName(entry.UID)
+		entry.GroupName = lookupGroupName(entry.GID)
 	} else {
 		entry.UID = -1
 		entry.GID = -1
@@ -8,6 +8,9 @@ import (
 	"bytes"
 	"io"
 	"io/ioutil"
+	"math"
+	"os"
+	"strconv"
 	"time"
 
 	crypto_rand "crypto/rand"
@@ -136,3 +139,99 @@ func TestRateLimit(t *testing.T) {
 	t.Logf("Elapsed time: %s, actual rate: %.3f kB/s, expected rate: %d kB/s", elapsed, actualRate, expectedRate)
 
 }
+
+func TestParseRevisionTime(t *testing.T) {
+
+	now := time.Date(2026, 9, 10, 12, 0, 0, 0, time.Local)
+
+	DATA := []struct {
+		value    string
+		expected time.Time
+	}{
+		{"2026-09-01 14:00", time.Date(2026, 9, 1, 14, 0, 0, 0, time.Local)},
+		{"2026-09-01 14:00:30", time.Date(2026, 9, 1, 14, 0, 30, 0, time.Local)},
+		{"2026-09-01", time.Date(2026, 9, 1, 0, 0, 0, 0, time.Local)},
+		{"3d", now.Add(-3 * 24 * time.Hour)},
+		{"12h", now.Add(-12 * time.Hour)},
+		{"2w", now.Add(-14 * 24 * time.Hour)},
+	}
+
+	for _, data := range DATA {
+		value, err := ParseRevisionTime(data.value, now)
+		if err != nil {
+			t.Errorf("Failed to parse %s: %v", data.value, err)
+		} else if value != data.expected.Unix() {
+			t.Errorf("%s was parsed as %d instead of %d", data.value, value, data.expected.Unix())
+		}
+	}
+
+	for _, value := range []string{"", "3x", "yesterday", "2026-13-01"} {
+		if _, err := ParseRevisionTime(value, now); err == nil {
+			t.Errorf("%s should be rejected", value)
+		}
+	}
+}
+
+func TestAtoSize(t *testing.T) {
+
+	DATA := []struct {
+		value    string
+		expected int64
+	}{
+		{"4k", 4 * 1024},
+		{"16M", 16 * 1024 * 1024},
+		{"2g", 2 * 1024 * 1024 * 1024},
+		{"4g", 4 * 1024 * 1024 * 1024},
+		{"12345", 12345},
+		{"4t", 0},
+		{"99999999999999999999g", 0},
+	}
+
+	for _, data := range DATA {
+		if size := AtoSize64(data.value); size != data.expected {
+			t.Errorf("%s was parsed as %d instead of %d", data.value, size, data.expected)
+		}
+
+		// Sizes that don't fit in an int must be rejected rather than wrap around
+		expected := data.expected
+		if strconv.IntSize == 32 && expected > math.MaxInt32 {
+			expected = 0
+		}
+		if size := AtoSize(data.value); int64(size) != expected {
+			t.Errorf("%s was parsed as %d instead of %d", data.value, size, expected)
+		}
+	}
+}
+
+func TestGetPasswordFromFile(t *testing.T) {
+
+	secretFile, err := ioutil.TempFile("", "duplicacy_test")
+	if err != nil {
+		t.Errorf("Failed to create a temporary file: %v", err)
+		return
+	}
+	defer os.Remove(secretFile.Name())
+	secretFile.WriteString("secret\n")
+	secretFile.Close()
+
+	preference := Preference{
+		Name: "offsite",
+		Keys: map[string]string{"s3_secret_file": secretFile.Name()},
+	}
+
+	if password := GetPasswordFromPreference(preference, "s3_secret"); password != "secret" {
+		t.Errorf("Read '%s' from the file specified by s3_secret_file", password)
+	}
+
+	os.Setenv("DUPLICACY_OFFSITE_PASSWORD_FILE", secretFile.Name())
+	defer os.Unsetenv("DUPLICACY_OFFSITE_PASSWORD_FILE")
+	if password := GetPasswordFromPreference(preference, "password"); password != "secret" {
+		t.Errorf("Read '%s' from the file specified by DUPLICACY_OFFSITE_PASSWORD_FILE", password)
+	}
+
+	// Keys ending with _file are file paths themselves and are never read through another file
+	preference.Keys["ssh_key_file_file"] = secretFile.Name()
+	if password := GetPasswordFromPreference(preference, "ssh_key_file"); password != "" {
+		t.Errorf("ssh_key_file was read as '%s'", password)
+	}
+}
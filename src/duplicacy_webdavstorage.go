@@ -10,20 +10,33 @@ package duplicacy
 
 import (
 	"bytes"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
 	"encoding/xml"
 	"errors"
 	"fmt"
+	"hash"
+	"hash/adler32"
 	"io"
 	"io/ioutil"
 	"math/rand"
 	"net/http"
+	"net/url"
 	//"net/http/httputil"
+	"regexp"
 	"strconv"
 	"sync"
+	"sync/atomic"
 	"time"
 	"strings"
 )
 
+// WebDAVInfiniteDepth is the depth of a PROPFIND request that lists a directory recursively.
+const WebDAVInfiniteDepth = -1
+
 type WebDAVStorage struct {
 	StorageBase
 
@@ -38,6 +51,10 @@ type WebDAVStorage struct {
 	threads            int
 	directoryCache     map[string]int // stores directories known to exist by this backend
 	directoryCacheLock sync.Mutex     // lock for accessing directoryCache
+
+	multipart       MultipartOptions // Controls chunked uploads of large files
+	uploadsDir      string           // The Nextcloud directory for chunked uploads; empty if not supported
+	noInfiniteDepth int32            // Set to 1 if the server refuses PROPFIND requests with 'Depth: infinity'
 }
 
 var (
@@ -46,8 +63,13 @@ var (
 	errWebDAVNotExist = errors.New("Path does not exist")
 	errWebDAVMaximumBackoff = errors.New("Maximum backoff reached")
 	errWebDAVMethodNotAllowed = errors.New("Method not allowed")
+	errWebDAVDepthNotAllowed = errors.New("Infinite depth not allowed")
 )
 
+// The Nextcloud WebDAV endpoint for files is remote.php/dav/files/<user>/, and chunked uploads are created under
+// remote.php/dav/uploads/<user>/
+var nextcloudFilesRegex = regexp.MustCompile(`^(.*remote\.php/dav/)files/([^/]+)/`)
+
 func CreateWebDAVStorage(host string, port int, username string, password string, storageDir string, useHTTP bool, threads int) (storage *WebDAVStorage, err error) {
 	if storageDir[len(storageDir)-1] != '/' {
 		storageDir += "/"
@@ -83,6 +105,11 @@ func CreateWebDAVStorage(host string, port int, username string, password string
 	}
 	storage.storageDir = storageDir
 
+	if matched := nextcloudFilesRegex.FindStringSubmatch(storageDir); matched != nil {
+		storage.uploadsDir = matched[1] + "uploads/" + matched[2] + "/"
+		LOG_DEBUG("WEBDAV_CHUNKED", "Large files will be uploaded in chunks to %s", storage.uploadsDir)
+	}
+
 	for _, dir := range []string{"snapshots", "chunks"} {
 		storage.CreateDirectory(0, dir)
 	}
@@ -92,6 +119,8 @@ func CreateWebDAVStorage(host string, port int, username string, password string
 	return storage, nil
 }
 
+// createConnectionString returns the url of 'uri', which is relative to the storage directory unless it starts
+// with '/'.
 func (storage *WebDAVStorage) createConnectionString(uri string) string {
 
 	url := storage.host
@@ -105,10 +134,23 @@ func (storage *WebDAVStorage) createConnectionString(uri string) string {
 	if storage.port > 0 {
 		url += fmt.Sprintf(":%d", storage.port)
 	}
+	if strings.HasPrefix(uri, "/") {
+		return url + uri
+	}
 	return url + "/" + storage.storageDir + uri
 }
 
-func (storage *WebDAVStorage) retry(backoff int) int {
+// retry waits before the next attempt, for as long as the server asks to in the Retry-After header of a 429 or 503
+// response, or otherwise for a random delay that doubles each time.
+func (storage *WebDAVStorage) retry(backoff int, response *http.Response) int {
+	if response != nil && (response.StatusCode == 429 || response.StatusCode == 503) {
+		storage.RecordThrottling()
+		if retryAfter, err := strconv.Atoi(response.Header.Get("Retry-After")); err == nil && retryAfter > 0 {
+			LOG_DEBUG("WEBDAV_RETRY", "Retrying after %d seconds as requested by the server", retryAfter)
+			time.Sleep(time.Duration(retryAfter) * time.Second)
+			return backoff
+		}
+	}
 	delay := rand.Intn(backoff*500) + backoff*500
 	time.Sleep(time.Duration(delay) * time.Millisecond)
 	backoff *= 2
@@ -116,6 +158,12 @@ func (storage *WebDAVStorage) retry(backoff int) int {
 }
 
 func (storage *WebDAVStorage) sendRequest(method string, uri string, depth int, data []byte) (io.ReadCloser, http.Header, error) {
+	return storage.sendRequestWithHeaders(method, uri, depth, data, nil)
+}
+
+// sendRequestWithHeaders is the same as sendRequest except that 'extraHeaders' are added to the request.
+func (storage *WebDAVStorage) sendRequestWithHeaders(method string, uri string, depth int, data []byte,
+	extraHeaders map[string]string) (io.ReadCloser, http.Header, error) {
 
 	backoff := 1
 	for i := 0; i < 8; i++ {
@@ -125,6 +173,9 @@ func (storage *WebDAVStorage) sendRequest(method string, uri string, depth int,
 		if method == "PROPFIND" {
 			headers["Content-Type"] = "application/xml"
 			headers["Depth"] = fmt.Sprintf("%d", depth)
+			if depth == WebDAVInfiniteDepth {
+				headers["Depth"] = "infinity"
+			}
 			dataReader = bytes.NewReader(data)
 		} else if method == "PUT" {
 			headers["Content-Type"] = "application/octet-stream"
@@ -150,6 +201,9 @@ func (storage *WebDAVStorage) sendRequest(method string, uri string, depth int,
 		for key, value := range headers {
 			request.Header.Set(key, value)
 		}
+		for key, value := range extraHeaders {
+			request.Header.Set(key, value)
+		}
 
 		//requestDump, err := httputil.DumpRequest(request, true)
 		//LOG_INFO("debug", "Request: %s", requestDump)
@@ -157,7 +211,7 @@ func (storage *WebDAVStorage) sendRequest(method string, uri string, depth int,
 		response, err := storage.client.Do(request)
 		if err != nil {
 			LOG_TRACE("WEBDAV_RETRY", "URL request '%s %s' returned an error (%v)", method, uri, err)
-			backoff = storage.retry(backoff)
+			backoff = storage.retry(backoff, nil)
 			continue
 		}
 
@@ -170,16 +224,17 @@ func (storage *WebDAVStorage) sendRequest(method string, uri string, depth int,
 		}
 
 		response.Body.Close()
-		if response.StatusCode == 404 {
-			// Retry if it is UPLOAD, otherwise return immediately
-			if method != "PUT" {
-				return nil, nil, errWebDAVNotExist
-			}
+		if response.StatusCode == 404 || (response.StatusCode == 409 && method == "PUT") {
+			// For an upload this means that the parent directory doesn't exist, which the caller can fix
+			return nil, nil, errWebDAVNotExist
 		} else if response.StatusCode == 405 {
 			return nil, nil, errWebDAVMethodNotAllowed
+		} else if depth == WebDAVInfiniteDepth && (response.StatusCode == 400 || response.StatusCode == 403 ||
+			response.StatusCode == 501) {
+			return nil, nil, errWebDAVDepthNotAllowed
 		}
 		LOG_INFO("WEBDAV_RETRY", "URL request '%s %s' returned status code %d", method, uri, response.StatusCode)
-		backoff = storage.retry(backoff)
+		backoff = storage.retry(backoff, response)
 	}
 	return nil, nil, errWebDAVMaximumBackoff
 }
@@ -252,6 +307,10 @@ func (storage *WebDAVStorage) getProperties(uri string, depth int, properties ..
 		}
 
 		responseKey := responseTag.Href
+		// Some servers return absolute urls, or escape the path
+		if parsed, err := url.Parse(responseKey); err == nil {
+			responseKey = parsed.Path
+		}
 		responses[responseKey] = properties
 
 	}
@@ -266,9 +325,27 @@ func (storage *WebDAVStorage) ListFiles(threadIndex int, dir string) (files []st
 	if dir[len(dir)-1] != '/' {
 		dir += "/"
 	}
-	properties, err := storage.getProperties(dir, 1, "getcontentlength", "resourcetype")
-	if err != nil {
-		return nil, nil, err
+
+	// The chunks directory is listed recursively with one request if the server allows it
+	var properties map[string]WebDAVProperties
+	recursive := false
+	if dir == "chunks/" && atomic.LoadInt32(&storage.noInfiniteDepth) == 0 {
+		properties, err = storage.getProperties(dir, WebDAVInfiniteDepth, "getcontentlength", "resourcetype")
+		if err == errWebDAVDepthNotAllowed {
+			LOG_DEBUG("WEBDAV_LIST", "The server doesn't allow listing directories recursively")
+			atomic.StoreInt32(&storage.noInfiniteDepth, 1)
+		} else if err != nil {
+			return nil, nil, err
+		} else {
+			recursive = true
+		}
+	}
+
+	if !recursive {
+		properties, err = storage.getProperties(dir, 1, "getcontentlength", "resourcetype")
+		if err != nil {
+			return nil, nil, err
+		}
 	}
 
 	prefixLength := len(storage.storageDir) + len(dir) + 1
@@ -297,7 +374,7 @@ func (storage *WebDAVStorage) ListFiles(threadIndex int, dir string) (files []st
 				files = append(files, file[prefixLength:])
 				sizes = append(sizes, int64(size))
 			}
-		} else {
+		} else if !recursive {
 			// This is a dir
 			file := file[prefixLength:]
 			if file[len(file)-1] != '/' {
@@ -408,31 +485,229 @@ func (storage *WebDAVStorage) CreateDirectory(threadIndex int, dir string) (err
 	return nil
 }
 
-// DownloadFile reads the file at 'filePath' into the chunk.
+// DownloadFile reads the file at 'filePath' into the chunk.  If the server provides a checksum of the file, the
+// content is verified against it.
 func (storage *WebDAVStorage) DownloadFile(threadIndex int, filePath string, chunk *Chunk) (err error) {
-	readCloser, _, err := storage.sendRequest("GET", filePath, 0, nil)
+	headers := map[string]string{
+		"Want-Digest":     "SHA-256, SHA;q=0.5, MD5;q=0.1",
+		"Accept-Encoding": "identity",
+	}
+	readCloser, header, err := storage.sendRequestWithHeaders("GET", filePath, 0, nil, headers)
 	if err != nil {
 		return err
 	}
 
-	_, err = RateLimitedCopy(chunk, readCloser, storage.DownloadRateLimit/storage.threads)
-	return err
+	defer readCloser.Close()
+
+	checksums := getWebDAVChecksums(header)
+	writers := []io.Writer{chunk}
+	for _, checksum := range checksums {
+		writers = append(writers, checksum.hasher)
+	}
+
+	_, err = RateLimitedCopy(io.MultiWriter(writers...), readCloser, storage.DownloadRateLimit/storage.threads)
+	if err != nil {
+		return err
+	}
+	return verifyWebDAVChecksums(checksums, filePath)
 }
 
-// UploadFile writes 'content' to the file at 'filePath'.
+// UploadFile writes 'content' to the file at 'filePath'.  The checksums of the content are sent along so that
+// servers supporting them can verify the upload, and if the server returns a checksum it is verified as well.
 func (storage *WebDAVStorage) UploadFile(threadIndex int, filePath string, content []byte) (err error) {
 
 	// If there is an error in creating the parent directory, proceed anyway
 	storage.createParentDirectory(threadIndex, filePath)
 
-	readCloser, _, err := storage.sendRequest("PUT", filePath, 0, content)
+	if storage.uploadsDir != "" && storage.multipart.isMultipart(int64(len(content))) {
+		return storage.uploadChunked(threadIndex, filePath, content)
+	}
+
+	headers := getWebDAVChecksumHeaders(content)
+	for i := 0; ; i++ {
+		readCloser, header, err := storage.sendRequestWithHeaders("PUT", filePath, 0, content, headers)
+		if err == errWebDAVNotExist && i < 2 {
+			// The parent directory may have been removed since it was cached
+			LOG_DEBUG("WEBDAV_UPLOAD", "The parent directory of %s doesn't exist; recreating it", filePath)
+			storage.forgetParentDirectory(filePath)
+			storage.createParentDirectory(threadIndex, filePath)
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		readCloser.Close()
+
+		checksums := getWebDAVChecksums(header)
+		for _, checksum := range checksums {
+			checksum.hasher.Write(content)
+		}
+		return verifyWebDAVChecksums(checksums, filePath)
+	}
+}
+
+// uploadChunked uploads a large file with the Nextcloud chunking protocol.  The file is split into parts that are
+// uploaded to a temporary directory, which the server then assembles into the file when '.file' is moved to the
+// destination.
+func (storage *WebDAVStorage) uploadChunked(threadIndex int, filePath string, content []byte) (err error) {
+
+	transferID := make([]byte, 8)
+	rand.Read(transferID)
+	uploadDir := "/" + storage.uploadsDir + "duplicacy-" + hex.EncodeToString(transferID)
+
+	// Nextcloud needs to know the destination and the total size when the upload starts
+	headers := map[string]string{
+		"Destination":     storage.createConnectionString(filePath),
+		"OC-Total-Length": strconv.Itoa(len(content)),
+	}
+
+	readCloser, _, err := storage.sendRequestWithHeaders("MKCOL", uploadDir, 0, []byte(""), headers)
 	if err != nil {
-		return err
+		return fmt.Errorf("failed to start the chunked upload: %v", err)
 	}
 	readCloser.Close()
+
+	parts := storage.multipart.getParts(int64(len(content)))
+	LOG_DEBUG("WEBDAV_CHUNKED", "Uploading %s in %d parts to %s", filePath, len(parts), uploadDir)
+
+	err = storage.multipart.transferParts(len(parts), func(index int) error {
+		part := content[parts[index].start:parts[index].end]
+		partHeaders := getWebDAVChecksumHeaders(part)
+		for key, value := range headers {
+			partHeaders[key] = value
+		}
+		partPath := fmt.Sprintf("%s/%05d", uploadDir, index+1)
+		readCloser, _, err := storage.sendRequestWithHeaders("PUT", partPath, 0, part, partHeaders)
+		if err != nil {
+			return err
+		}
+		readCloser.Close()
+		return nil
+	})
+
+	if err == nil {
+		moveHeaders := getWebDAVChecksumHeaders(content)
+		moveHeaders["OC-Total-Length"] = headers["OC-Total-Length"]
+		var header http.Header
+		readCloser, header, err = storage.sendRequestWithHeaders("MOVE", uploadDir+"/.file", 0,
+			[]byte("/"+storage.storageDir+filePath), moveHeaders)
+		if err == nil {
+			readCloser.Close()
+			checksums := getWebDAVChecksums(header)
+			for _, checksum := range checksums {
+				checksum.hasher.Write(content)
+			}
+			return verifyWebDAVChecksums(checksums, filePath)
+		}
+	}
+
+	// Remove the parts that have been uploaded
+	if readCloser, _, deleteErr := storage.sendRequest("DELETE", uploadDir, 0, []byte("")); deleteErr == nil {
+		readCloser.Close()
+	}
+	return err
+}
+
+// forgetParentDirectory removes the parent directory of 'filePath' from the cache of existing directories.
+func (storage *WebDAVStorage) forgetParentDirectory(filePath string) {
+	found := strings.LastIndex(filePath, "/")
+	if found == -1 {
+		return
+	}
+	storage.directoryCacheLock.Lock()
+	delete(storage.directoryCache, filePath[:found])
+	storage.directoryCacheLock.Unlock()
+}
+
+// SetMultipartOptions sets the part size and the number of parallel part uploads for chunked uploads, which are
+// only available on Nextcloud servers.
+func (storage *WebDAVStorage) SetMultipartOptions(options MultipartOptions) {
+	storage.multipart = options
+}
+
+// webDAVChecksum is a checksum returned by the server in the 'Digest' (RFC 3230) or 'OC-Checksum' (ownCloud and
+// Nextcloud) header, along with a hasher to compute the actual checksum of the content.
+type webDAVChecksum struct {
+	algorithm string
+	expected  []byte
+	hasher    hash.Hash
+}
+
+func newWebDAVHasher(algorithm string) hash.Hash {
+	switch strings.Replace(strings.ToLower(algorithm), "-", "", -1) {
+	case "sha256":
+		return sha256.New()
+	case "sha", "sha1":
+		return sha1.New()
+	case "md5":
+		return md5.New()
+	case "adler32":
+		return adler32.New()
+	}
 	return nil
 }
 
+// getWebDAVChecksums parses the checksums in the response headers.  Checksums using unsupported algorithms are
+// ignored.
+func getWebDAVChecksums(header http.Header) (checksums []*webDAVChecksum) {
+	if header == nil {
+		return nil
+	}
+
+	// Digest: SHA-256=<base64>, MD5=<base64>
+	for _, digest := range strings.Split(header.Get("Digest"), ",") {
+		index := strings.Index(digest, "=")
+		if index <= 0 {
+			continue
+		}
+		algorithm := strings.TrimSpace(digest[:index])
+		expected, err := base64.StdEncoding.DecodeString(strings.TrimSpace(digest[index+1:]))
+		hasher := newWebDAVHasher(algorithm)
+		if err == nil && hasher != nil {
+			checksums = append(checksums, &webDAVChecksum{algorithm: algorithm, expected: expected, hasher: hasher})
+		}
+	}
+
+	// OC-Checksum: SHA1:<hex> MD5:<hex> ADLER32:<hex>
+	for _, checksum := range strings.Fields(header.Get("OC-Checksum")) {
+		index := strings.Index(checksum, ":")
+		if index <= 0 {
+			continue
+		}
+		algorithm := checksum[:index]
+		expected, err := hex.DecodeString(checksum[index+1:])
+		hasher := newWebDAVHasher(algorithm)
+		if err == nil && hasher != nil {
+			checksums = append(checksums, &webDAVChecksum{algorithm: algorithm, expected: expected, hasher: hasher})
+		}
+	}
+	return checksums
+}
+
+// verifyWebDAVChecksums compares the checksums returned by the server with those computed from the content.
+func verifyWebDAVChecksums(checksums []*webDAVChecksum, filePath string) error {
+	for _, checksum := range checksums {
+		if actual := checksum.hasher.Sum(nil); !bytes.Equal(actual, checksum.expected) {
+			return fmt.Errorf("The %s checksum of %s is %x but the server reported %x", checksum.algorithm,
+				filePath, actual, checksum.expected)
+		}
+	}
+	if len(checksums) > 0 {
+		LOG_TRACE("WEBDAV_CHECKSUM", "Verified the %s checksum of %s", checksums[0].algorithm, filePath)
+	}
+	return nil
+}
+
+// getWebDAVChecksumHeaders returns the headers that allow the server to verify an upload.
+func getWebDAVChecksumHeaders(content []byte) map[string]string {
+	sha1Hash := sha1.Sum(content)
+	sha256Hash := sha256.Sum256(content)
+	return map[string]string{
+		"OC-Checksum": "SHA1:" + hex.EncodeToString(sha1Hash[:]),
+		"Digest":      "SHA-256=" + base64.StdEncoding.EncodeToString(sha256Hash[:]),
+	}
+}
+
 // If a local snapshot cache is needed for the storage to avoid downloading/uploading chunks too often when
 // managing snapshots.
 func (storage *WebDAVStorage) IsCacheNeeded() bool { return true }
@@ -0,0 +1,306 @@
+// Copyright (c) Acrosync LLC. All rights reserved.
+// Free for personal use and commercial trial
+// Commercial use requires per-user licenses available from https://duplicacy.com
+
+package duplicacy
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// webDAVTestServer is an in-memory WebDAV server that mimics Nextcloud: it verifies and returns checksums, and
+// supports chunked uploads under /remote.php/dav/uploads/.
+type webDAVTestServer struct {
+	server *httptest.Server
+	lock   sync.Mutex
+	files  map[string][]byte
+	dirs   map[string]bool
+
+	allowInfiniteDepth bool
+	corruptDownloads   bool
+	infiniteRequests   int
+	chunkedUploads     int
+}
+
+func newWebDAVTestServer(allowInfiniteDepth bool) *webDAVTestServer {
+	server := &webDAVTestServer{
+		files:              make(map[string][]byte),
+		dirs:               make(map[string]bool),
+		allowInfiniteDepth: allowInfiniteDepth,
+	}
+	for _, dir := range []string{"/remote.php", "/remote.php/dav", "/remote.php/dav/files", "/remote.php/dav/files/user",
+		"/remote.php/dav/files/user/backup", "/remote.php/dav/uploads", "/remote.php/dav/uploads/user"} {
+		server.dirs[dir] = true
+	}
+	server.server = httptest.NewTLSServer(http.HandlerFunc(server.handle))
+	return server
+}
+
+func (server *webDAVTestServer) propfindEntry(name string, isDir bool) string {
+	href := (&url.URL{Path: name}).EscapedPath()
+	if isDir {
+		return fmt.Sprintf("<d:response><d:href>%s/</d:href><d:propstat><d:prop><d:getcontentlength/>"+
+			"<d:resourcetype><d:collection/></d:resourcetype></d:prop></d:propstat></d:response>", href)
+	}
+	return fmt.Sprintf("<d:response><d:href>%s</d:href><d:propstat><d:prop><d:getcontentlength>%d</d:getcontentlength>"+
+		"<d:resourcetype/></d:prop></d:propstat></d:response>", href, len(server.files[name]))
+}
+
+func (server *webDAVTestServer) handle(writer http.ResponseWriter, request *http.Request) {
+	server.lock.Lock()
+	defer server.lock.Unlock()
+
+	if username, password, ok := request.BasicAuth(); !ok || username != "user" || password != "password" {
+		writer.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	body, _ := ioutil.ReadAll(request.Body)
+	name := strings.TrimSuffix(request.URL.Path, "/")
+
+	switch request.Method {
+	case "PROPFIND":
+		depth := request.Header.Get("Depth")
+		if depth == "infinity" {
+			server.infiniteRequests++
+			if !server.allowInfiniteDepth {
+				writer.WriteHeader(http.StatusForbidden)
+				return
+			}
+		}
+
+		var entries []string
+		if _, found := server.files[name]; found {
+			entries = append(entries, server.propfindEntry(name, false))
+		} else if server.dirs[name] {
+			entries = append(entries, server.propfindEntry(name, true))
+			if depth != "0" {
+				for _, children := range []map[string]bool{server.dirs, server.fileNames()} {
+					for child := range children {
+						if !strings.HasPrefix(child, name+"/") {
+							continue
+						}
+						if depth == "1" && strings.Contains(child[len(name)+1:], "/") {
+							continue
+						}
+						entries = append(entries, server.propfindEntry(child, server.dirs[child]))
+					}
+				}
+			}
+		} else {
+			writer.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		writer.WriteHeader(207)
+		fmt.Fprintf(writer, `<?xml version="1.0"?><d:multistatus xmlns:d="DAV:">%s</d:multistatus>`,
+			strings.Join(entries, ""))
+
+	case "MKCOL":
+		if server.dirs[name] {
+			writer.WriteHeader(http.StatusMethodNotAllowed)
+		} else if !server.dirs[path.Dir(name)] {
+			writer.WriteHeader(http.StatusConflict)
+		} else {
+			server.dirs[name] = true
+			writer.WriteHeader(http.StatusCreated)
+		}
+
+	case "PUT":
+		if !server.dirs[path.Dir(name)] {
+			writer.WriteHeader(http.StatusConflict)
+			return
+		}
+		hash := sha1.Sum(body)
+		if checksum := request.Header.Get("OC-Checksum"); checksum != "" && checksum != "SHA1:"+hex.EncodeToString(hash[:]) {
+			writer.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		server.files[name] = body
+		writer.Header().Set("OC-Checksum", "SHA1:"+hex.EncodeToString(hash[:]))
+		writer.WriteHeader(http.StatusCreated)
+
+	case "GET":
+		content, found := server.files[name]
+		if !found {
+			writer.WriteHeader(http.StatusNotFound)
+			return
+		}
+		hash := sha256.Sum256(content)
+		writer.Header().Set("Digest", "SHA-256="+base64.StdEncoding.EncodeToString(hash[:]))
+		if server.corruptDownloads {
+			content = append([]byte{content[0] + 1}, content[1:]...)
+		}
+		writer.Write(content)
+
+	case "MOVE":
+		destination, _ := url.Parse(request.Header.Get("Destination"))
+		if strings.HasSuffix(name, "/.file") {
+			// Assemble the parts of a chunked upload
+			uploadDir := path.Dir(name)
+			var parts []string
+			for file := range server.files {
+				if path.Dir(file) == uploadDir {
+					parts = append(parts, file)
+				}
+			}
+			sort.Strings(parts)
+			var content []byte
+			for _, part := range parts {
+				content = append(content, server.files[part]...)
+				delete(server.files, part)
+			}
+			delete(server.dirs, uploadDir)
+			if strconv.Itoa(len(content)) != request.Header.Get("OC-Total-Length") {
+				writer.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			server.files[destination.Path] = content
+			server.chunkedUploads++
+		} else {
+			content, found := server.files[name]
+			if !found {
+				writer.WriteHeader(http.StatusNotFound)
+				return
+			}
+			delete(server.files, name)
+			server.files[destination.Path] = content
+		}
+		writer.WriteHeader(http.StatusCreated)
+
+	case "DELETE":
+		server.remove(name)
+		writer.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func (server *webDAVTestServer) fileNames() map[string]bool {
+	names := make(map[string]bool)
+	for name := range server.files {
+		names[name] = true
+	}
+	return names
+}
+
+func (server *webDAVTestServer) remove(name string) {
+	for file := range server.files {
+		if file == name || strings.HasPrefix(file, name+"/") {
+			delete(server.files, file)
+		}
+	}
+	for dir := range server.dirs {
+		if dir == name || strings.HasPrefix(dir, name+"/") {
+			delete(server.dirs, dir)
+		}
+	}
+}
+
+func createWebDAVStorageForTest(t *testing.T, server *webDAVTestServer) *WebDAVStorage {
+	address, _ := url.Parse(server.server.URL)
+	port, _ := strconv.Atoi(address.Port())
+
+	// The storage uses the default client, which must trust the certificate of the test server
+	defaultClient := http.DefaultClient
+	http.DefaultClient = server.server.Client()
+	defer func() { http.DefaultClient = defaultClient }()
+
+	storage, err := CreateWebDAVStorage(address.Hostname(), port, "user", "password", "remote.php/dav/files/user/backup",
+		false, 2)
+	if err != nil {
+		t.Errorf("Failed to create the WebDAV storage: %v", err)
+		return nil
+	}
+	return storage
+}
+
+func TestWebDAVStorage(t *testing.T) {
+
+	setTestingT(t)
+
+	server := newWebDAVTestServer(true)
+	defer server.server.Close()
+
+	storage := createWebDAVStorageForTest(t, server)
+	if storage == nil {
+		return
+	}
+	if storage.uploadsDir != "remote.php/dav/uploads/user/" {
+		t.Errorf("The uploads directory is '%s'", storage.uploadsDir)
+	}
+
+	options, _ := CreateMultipartOptions(MinimumPartSize/1024/1024, 2)
+	storage.SetMultipartOptions(options)
+
+	small := []byte("small chunk")
+	large := make([]byte, MinimumPartSize*2+1000)
+	rand.Read(large)
+
+	if err := storage.UploadFile(0, "chunks/ab/cdef", small); err != nil {
+		t.Errorf("Failed to upload the small chunk: %v", err)
+	}
+	if err := storage.UploadFile(1, "chunks/large", large); err != nil {
+		t.Errorf("Failed to upload the large chunk: %v", err)
+	}
+
+	if server.chunkedUploads != 1 || !bytes.Equal(server.files["/remote.php/dav/files/user/backup/chunks/large"], large) {
+		t.Errorf("The large chunk was not uploaded in chunks")
+	}
+	for dir := range server.dirs {
+		if strings.HasPrefix(dir, "/remote.php/dav/uploads/user/") {
+			t.Errorf("The upload directory %s was not removed", dir)
+		}
+	}
+
+	files, sizes, err := storage.ListFiles(0, "chunks/")
+	sort.Strings(files)
+	if err != nil || strings.Join(files, ",") != "ab/cdef,large" || len(sizes) != 2 || server.infiniteRequests != 1 {
+		t.Errorf("Incorrect recursive listing: %v %v", files, err)
+	}
+
+	chunk := CreateChunk(CreateConfig(), true)
+	chunk.Reset(false)
+	if err = storage.DownloadFile(0, "chunks/large", chunk); err != nil || !bytes.Equal(chunk.GetBytes(), large) {
+		t.Errorf("The large chunk was not downloaded correctly: %v", err)
+	}
+
+	server.corruptDownloads = true
+	chunk.Reset(false)
+	if err = storage.DownloadFile(0, "chunks/ab/cdef", chunk); err == nil {
+		t.Errorf("A corrupted download was not detected")
+	}
+	server.corruptDownloads = false
+
+	// The parent directory is cached, so the storage must recover from its removal
+	server.remove("/remote.php/dav/files/user/backup/chunks/ab")
+	if err = storage.UploadFile(0, "chunks/ab/1234", small); err != nil {
+		t.Errorf("Failed to upload after the parent directory was removed: %v", err)
+	}
+
+	server.allowInfiniteDepth = false
+	storage = createWebDAVStorageForTest(t, server)
+	if storage == nil {
+		return
+	}
+
+	files, _, err = storage.ListFiles(0, "chunks/")
+	sort.Strings(files)
+	if err != nil || strings.Join(files, ",") != "ab/,large" || storage.noInfiniteDepth == 0 {
+		t.Errorf("Incorrect listing without infinite depth: %v %v", files, err)
+	}
+}